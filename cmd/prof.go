@@ -1,11 +1,49 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	_ "net/http/pprof"
+)
 
+import (
 	"github.com/spinlock/xserver/pkg/xserver"
+	"github.com/spinlock/xserver/pkg/xserver/args"
 )
 
 func main() {
-	xserver.Start()
+	cfg, err := args.Parse(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "parse argument(s) failed:\n        %s\n", err)
+		os.Exit(1)
+	}
+	srv, err := xserver.New(&xserver.Config{Config: *cfg})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create server failed:\n        %s\n", err)
+		os.Exit(1)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "start server failed:\n        %s\n", err)
+		os.Exit(1)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("[signal]: recv '%v', shutdown\n", <-sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(cfg.Drain+5))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "shutdown server failed:\n        %s\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/udpbench"
+)
+
+func main() {
+	opts := &udpbench.Options{Output: os.Stdout}
+	var sockets, batches string
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&sockets, "sockets", "1,4", "sockets per family of each run, separated by comma")
+	fs.StringVar(&batches, "batch", "1,8,32", "datagrams per system call of each run, separated by comma")
+	fs.IntVar(&opts.Clients, "clients", 64, "number of client sockets")
+	fs.IntVar(&opts.Workers, "workers", 32, "number of server workers")
+	fs.IntVar(&opts.Packets, "packets", 20000, "datagrams sent by each client")
+	fs.IntVar(&opts.Size, "size", 1200, "size of the datagrams")
+	fs.IntVar(&opts.Window, "window", 32, "datagrams in flight per client")
+	if err := fs.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(1)
+	}
+	var err error
+	if opts.Sockets, err = parseInts(sockets); err == nil {
+		opts.Batches, err = parseInts(batches)
+	}
+	if err == nil {
+		err = udpbench.Run(opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "run udpbench failed:\n        %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func parseInts(s string) ([]int, error) {
+	is := make([]int, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) == 0 {
+			continue
+		} else if i, err := strconv.Atoi(v); err != nil || i < 1 {
+			return nil, errors.New(fmt.Sprintf("bad value '%s'", v))
+		} else {
+			is = append(is, i)
+		}
+	}
+	return is, nil
+}
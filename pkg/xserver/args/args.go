@@ -5,161 +5,399 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
 )
 
-import (
-	"github.com/spinlock/xserver/pkg/xserver/utils"
-)
-
-var args struct {
+// Args are the values of a Config as the server uses them, with the
+// defaults filled in.
+type Args struct {
 	ncpu     int
 	parallel int
 	udp      struct {
-		listen []uint16
+		listen  []uint16
+		sockets int
+		batch   int
 	}
 	rpc struct {
-		listen uint16
-		remote struct {
-			ip   string
-			port uint16
-		}
+		listen  uint16
+		remotes []Remote
 	}
 	heartbeat int
+	dhrotate  int
+	drain     int
 	manage    int
 	retrans   []int
-	http      uint16
-	apps      []string
-	debug     bool
+	recvbuf   int
+	backlog   struct {
+		flow     int
+		session  int
+		overflow string
+		expiry   int
+	}
+	async struct {
+		groups   int
+		workers  int
+		queue    int
+		overflow string
+		wait     int
+	}
+	cluster struct {
+		node   uint8
+		listen uint16
+		nodes  []Remote
+	}
+	http  uint16
+	apps  []string
+	debug bool
+}
+
+type Config struct {
+	Ncpu           int
+	Parallel       int
+	Ports          []uint16
+	Sockets        int
+	Batch          int
+	Listen         uint16
+	Remote         string
+	Manage         int
+	Retrans        []int
+	RecvBuf        int
+	FlowBacklog    int
+	SessionBacklog int
+	Overflow       string
+	BacklogExpiry  int
+	AsyncGroups    int
+	AsyncWorkers   int
+	AsyncQueue     int
+	AsyncOverflow  string
+	AsyncWait      int
+	Node           int
+	NodeListen     uint16
+	Nodes          string
+	Http           uint16
+	Admin          string
+	Apps           []string
+	Auth           string
+	TLSCert        string
+	TLSKey         string
+	TLSCA          string
+	Secret         string
+	Heartbeat      int
+	DHRotate       int
+	Drain          int
+	Debug          bool
+}
+
+func Default() *Config {
+	c := &Config{}
+	c.Ncpu = 1
+	c.Parallel = 32
+	c.Ports = []uint16{1935}
+	c.Batch = 32
+	c.Manage = 500
+	c.Retrans = []int{500, 500, 1000, 1500, 1500, 2500, 3000, 4000, 5000, 7500, 10000, 15000}
+	c.RecvBuf = 1024
+	c.FlowBacklog = 4096
+	c.SessionBacklog = 16384
+	c.Overflow = "abandon"
+	c.BacklogExpiry = 5000
+	c.AsyncGroups = 32
+	c.AsyncWorkers = 4
+	c.AsyncQueue = 4096
+	c.AsyncOverflow = "block"
+	c.AsyncWait = 100
+	c.Heartbeat = 60
+	c.DHRotate = 0
+	c.Drain = 5
+	return c
 }
 
-func init() {
-	var ncpu, parallel, manage, heartbeat int
-	var rtmfp, listen, remote, http, apps, retrans string
+func Parse(name string, arguments []string) (*Config, error) {
+	var ncpu, parallel, sockets, batch, manage, recvbuf, flowbacklog, sessionbacklog, backlogexpiry, heartbeat, dhrotate, drain int
+	var asyncgroups, asyncworkers, asyncqueue, asyncwait int
+	var node int
+	var rtmfp, listen, remote, nodelisten, nodes, http, apps, auth, retrans, overflow, asyncoverflow string
+	var tlscert, tlskey, tlsca string
 	var debug bool
 
-	flag.IntVar(&ncpu, "ncpu", 1, "maximum number of CPUs, in [1, 1024]")
-	flag.IntVar(&parallel, "parallel", 32, "number of parallel worker-routins per connection, in [1, 1024]")
-	flag.StringVar(&rtmfp, "rtmfp", "1935", "rtmfp ports list, for example, '1935,1936,1937'")
-	flag.StringVar(&listen, "listen", "", "rpc listen port")
-	flag.StringVar(&remote, "remote", "", "rpc remote port")
-	flag.IntVar(&manage, "manage", 500, "session management interval, in [100, 10000] milliseconds")
-	flag.StringVar(&retrans, "retrans", "500,500,1000,1500,1500,2500,3000,4000,5000,7500,10000,15000", "retransmission intervals, in [100, 30000] milliseconds")
-	flag.StringVar(&http, "http", "", "default http port")
-	flag.StringVar(&apps, "apps", "", "application names, separated by comma")
-	flag.IntVar(&heartbeat, "heartbeat", 60, "keep alive message from server, in [1, 60] seconds")
-	flag.BoolVar(&debug, "debug", false, "send log to stdio")
-	flag.Usage = func() {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.IntVar(&ncpu, "ncpu", 1, "maximum number of CPUs, in [1, 1024]")
+	fs.IntVar(&parallel, "parallel", 32, "number of parallel worker-routins per connection, in [1, 1024]")
+	fs.StringVar(&rtmfp, "rtmfp", "1935", "rtmfp ports list, for example, '1935,1936,1937'")
+	fs.IntVar(&sockets, "sockets", 0, "sockets per rtmfp port and address family, sharing the port with SO_REUSEPORT, 0 means one per cpu, in [0, 256]")
+	fs.IntVar(&batch, "batch", 32, "datagrams read or written per system call, in [1, 1024]")
+	fs.StringVar(&listen, "listen", "", "rpc listen port")
+	fs.StringVar(&remote, "remote", "", "rpc remote addresses, for example, '10.0.0.1:8000,10.0.0.2:8000'")
+	fs.IntVar(&manage, "manage", 500, "delay before a closed flow is dropped from its session, in [100, 10000] milliseconds")
+	fs.StringVar(&retrans, "retrans", "500,500,1000,1500,1500,2500,3000,4000,5000,7500,10000,15000", "upper bounds of the successive retransmission timeouts, in [100, 30000] milliseconds")
+	fs.IntVar(&recvbuf, "recvbuf", 1024, "reassembly buffer of each incoming flow, in [64, 65536] kilobytes")
+	fs.IntVar(&flowbacklog, "flowbacklog", 4096, "data an outgoing flow may hold, queued or unacked, in [64, 1048576] kilobytes")
+	fs.IntVar(&sessionbacklog, "sessionbacklog", 16384, "data the outgoing flows of a session may hold, queued or unacked, in [64, 1048576] kilobytes")
+	fs.StringVar(&overflow, "overflow", "abandon", "past a backlog, once unreliable data is dropped, 'abandon' the reliable data older than -backlogexpiry or 'close' the player or session")
+	fs.IntVar(&backlogexpiry, "backlogexpiry", 5000, "age past which reliable data of a stream or group flow may be abandoned with -overflow=abandon, in [100, 600000] milliseconds")
+	fs.IntVar(&asyncgroups, "asyncgroups", 32, "async worker groups, the calls of a key run in order in the same one, in [1, 1024]")
+	fs.IntVar(&asyncworkers, "asyncworkers", 4, "workers per async group, each running the calls of one key at a time, in [1, 256]")
+	fs.IntVar(&asyncqueue, "asyncqueue", 4096, "calls queued per async group, in [16, 1048576]")
+	fs.StringVar(&asyncoverflow, "asyncoverflow", "block", "once an async group is full, 'reject' the call, 'drop' the oldest queued or 'block' the caller up to -asyncwait")
+	fs.IntVar(&asyncwait, "asyncwait", 100, "time a call waits for room with -asyncoverflow=block, in [1, 10000] milliseconds")
+	fs.IntVar(&node, "node", 0, "id of this node in a cluster, unique among -nodes, 0 means no cluster, in [0, 255]")
+	fs.StringVar(&nodelisten, "nodelisten", "", "cluster listen port, taking the links of the other nodes, with tls or XSERVER_RPC_SECRET set")
+	fs.StringVar(&nodes, "nodes", "", "cluster addresses of the other nodes, for example, '10.0.0.1:1936,10.0.0.2:1936'")
+	fs.StringVar(&http, "http", "", "default http port")
+	fs.StringVar(&apps, "apps", "", "application names, separated by comma")
+	fs.StringVar(&auth, "auth", "static", "client authorization, one of 'static', 'hmac' or 'rpc'")
+	fs.StringVar(&tlscert, "tlscert", "", "certificate file of the rpc link, enables tls on -listen and -remote")
+	fs.StringVar(&tlskey, "tlskey", "", "private key file of -tlscert")
+	fs.StringVar(&tlsca, "tlsca", "", "ca file checking the certificates of rpc peers")
+	fs.IntVar(&heartbeat, "heartbeat", 60, "keep alive message from server, in [1, 60] seconds")
+	fs.IntVar(&dhrotate, "dhrotate", 0, "lifetime of handshake diffie-hellman keys, 0 means a new key per handshake, in [0, 3600] seconds")
+	fs.IntVar(&drain, "drain", 5, "time to flush sessions on shutdown, in [0, 300] seconds")
+	fs.BoolVar(&debug, "debug", false, "send log to stdio")
+	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage:\n")
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 	}
-	flag.Parse()
-
-	defer func() {
-		if x := recover(); x != nil {
-			fmt.Fprintf(os.Stderr, "parse argument(s) failed:\n")
-			fmt.Fprintf(os.Stderr, "        %s\n", x)
-			os.Exit(1)
-		}
-	}()
-
-	args.debug = debug
-
-	if ncpu < 1 {
-		utils.Panic(fmt.Sprintf("invalid ncpu = %d", ncpu))
-	} else {
-		args.ncpu = ncpu
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
 	}
 
-	if parallel < 1 || parallel > 1024 {
-		utils.Panic(fmt.Sprintf("invalid parallel = %d", parallel))
-	} else {
-		args.parallel = parallel
-	}
+	c := &Config{}
+	c.Ncpu, c.Parallel = ncpu, parallel
+	c.Sockets, c.Batch = sockets, batch
+	c.Manage, c.RecvBuf, c.Heartbeat, c.DHRotate, c.Drain = manage, recvbuf, heartbeat, dhrotate, drain
+	c.FlowBacklog, c.SessionBacklog, c.Overflow = flowbacklog, sessionbacklog, trimSpace(overflow)
+	c.BacklogExpiry = backlogexpiry
+	c.AsyncGroups, c.AsyncWorkers, c.AsyncQueue = asyncgroups, asyncworkers, asyncqueue
+	c.AsyncOverflow, c.AsyncWait = trimSpace(asyncoverflow), asyncwait
+	c.Auth = trimSpace(auth)
+	c.TLSCert, c.TLSKey, c.TLSCA = trimSpace(tlscert), trimSpace(tlskey), trimSpace(tlsca)
+	c.Secret = os.Getenv("XSERVER_RPC_SECRET")
+	c.Admin = os.Getenv("XSERVER_ADMIN_TOKEN")
+	c.Debug = debug
 
 	if ports, err := parsePorts(rtmfp); err != nil {
-		utils.Panic(fmt.Sprintf("invalid rtmfp = '%s', error = '%v'", rtmfp, err))
-	} else if len(ports) == 0 {
-		utils.Panic(fmt.Sprintf("invalid rtmfp = '%s'", rtmfp))
+		return nil, errors.New(fmt.Sprintf("invalid rtmfp = '%s', error = '%v'", rtmfp, err))
 	} else {
-		args.udp.listen = ports
+		c.Ports = ports
 	}
 
 	if listen = trimSpace(listen); len(listen) == 0 {
-		args.rpc.listen = 0
+		c.Listen = 0
 	} else if port, err := parsePort(listen); err != nil {
-		utils.Panic(fmt.Sprintf("invalid listen = '%s', error = '%v'", listen, err))
+		return nil, errors.New(fmt.Sprintf("invalid listen = '%s', error = '%v'", listen, err))
 	} else {
-		args.rpc.listen = port
+		c.Listen = port
 	}
 
-	if remote = trimSpace(remote); len(remote) == 0 {
-		args.rpc.remote.port = 0
-	} else if ip, port, err := parseAddr(remote); err != nil {
-		utils.Panic(fmt.Sprintf("invalid remote = '%s', error = '%v'", remote, err))
+	c.Remote = trimSpace(remote)
+
+	c.Node = node
+	if nodelisten = trimSpace(nodelisten); len(nodelisten) == 0 {
+		c.NodeListen = 0
+	} else if port, err := parsePort(nodelisten); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid nodelisten = '%s', error = '%v'", nodelisten, err))
 	} else {
-		args.rpc.remote.ip, args.rpc.remote.port = ip, port
+		c.NodeListen = port
 	}
+	c.Nodes = trimSpace(nodes)
 
-	if manage < 100 || manage > 10000 {
-		utils.Panic(fmt.Sprintf("invalid manage = %d", manage))
+	if values, err := parseInts(retrans); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid retrans = '%s', error = '%v'", retrans, err))
 	} else {
-		args.manage = manage
+		c.Retrans = values
 	}
 
-	if heartbeat < 1 || heartbeat > 60 {
-		utils.Panic(fmt.Sprintf("invalid heartbeat = %d", heartbeat))
+	if http = trimSpace(http); len(http) == 0 {
+		c.Http = 0
+	} else if port, err := parsePort(http); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid http = '%s', error = '%v'", http, err))
 	} else {
-		args.heartbeat = heartbeat
+		c.Http = port
 	}
 
-	if values, err := parseInts(retrans); err != nil {
-		utils.Panic(fmt.Sprintf("invalid retrans = '%s', error = '%v'", retrans, err))
-	} else if len(values) == 0 {
-		utils.Panic(fmt.Sprintf("invalid retrans = '%s'", retrans))
-	} else {
-		for _, v := range values {
-			if v < 100 || v > 30000 {
-				utils.Panic(fmt.Sprintf("invalid retrans = '%s'", retrans))
-			}
+	c.Apps = []string{}
+	for _, s := range strings.Split(apps, ",") {
+		if app := trimSpace(s); len(app) != 0 {
+			c.Apps = append(c.Apps, app)
 		}
-		args.retrans = values
 	}
 
-	if http = trimSpace(http); len(http) == 0 {
-		args.http = 0
-	} else if port, err := parsePort(http); err != nil {
-		utils.Panic(fmt.Sprintf("invalid http = '%s', error = '%v'", http, err))
-	} else {
-		args.http = port
+	if err := c.Validate(); err != nil {
+		return nil, err
 	}
+	return c, nil
+}
 
-	if apps = trimSpace(apps); len(apps) == 0 {
-		args.apps = []string{}
-	} else {
-		set := make(map[string]string)
-		for _, s := range strings.Split(apps, ",") {
-			if app := trimSpace(s); len(app) != 0 {
-				set[app] = app
-			}
+func (c *Config) Validate() error {
+	if c.Ncpu < 1 {
+		return errors.New(fmt.Sprintf("invalid ncpu = %d", c.Ncpu))
+	}
+	if c.Parallel < 1 || c.Parallel > 1024 {
+		return errors.New(fmt.Sprintf("invalid parallel = %d", c.Parallel))
+	}
+	if len(c.Ports) == 0 {
+		return errors.New("invalid rtmfp, empty ports list")
+	}
+	if c.Sockets < 0 || c.Sockets > 256 {
+		return errors.New(fmt.Sprintf("invalid sockets = %d", c.Sockets))
+	}
+	if c.Batch < 1 || c.Batch > 1024 {
+		return errors.New(fmt.Sprintf("invalid batch = %d", c.Batch))
+	}
+	if _, err := parseRemotes(c.Remote); err != nil {
+		return errors.New(fmt.Sprintf("invalid remote = '%s', error = '%v'", c.Remote, err))
+	}
+	switch c.Auth {
+	case "", "static", "hmac":
+	case "rpc":
+		if len(c.Remote) == 0 {
+			return errors.New("invalid auth = 'rpc', no remote")
 		}
-		for app, _ := range set {
-			args.apps = append(args.apps, app)
+	default:
+		return errors.New(fmt.Sprintf("invalid auth = '%s'", c.Auth))
+	}
+	if len(c.TLSCert) != 0 || len(c.TLSKey) != 0 || len(c.TLSCA) != 0 {
+		if len(c.TLSCert) == 0 || len(c.TLSKey) == 0 || len(c.TLSCA) == 0 {
+			return errors.New("invalid tls, tlscert, tlskey and tlsca go together")
+		}
+	}
+	if c.Manage < 100 || c.Manage > 10000 {
+		return errors.New(fmt.Sprintf("invalid manage = %d", c.Manage))
+	}
+	if c.RecvBuf < 64 || c.RecvBuf > 65536 {
+		return errors.New(fmt.Sprintf("invalid recvbuf = %d", c.RecvBuf))
+	}
+	if c.FlowBacklog < 64 || c.FlowBacklog > 1048576 {
+		return errors.New(fmt.Sprintf("invalid flowbacklog = %d", c.FlowBacklog))
+	}
+	if c.SessionBacklog < 64 || c.SessionBacklog > 1048576 {
+		return errors.New(fmt.Sprintf("invalid sessionbacklog = %d", c.SessionBacklog))
+	}
+	switch c.Overflow {
+	case "", "abandon", "close":
+	default:
+		return errors.New(fmt.Sprintf("invalid overflow = '%s'", c.Overflow))
+	}
+	if c.BacklogExpiry < 100 || c.BacklogExpiry > 600000 {
+		return errors.New(fmt.Sprintf("invalid backlogexpiry = %d", c.BacklogExpiry))
+	}
+	if c.AsyncGroups < 1 || c.AsyncGroups > 1024 {
+		return errors.New(fmt.Sprintf("invalid asyncgroups = %d", c.AsyncGroups))
+	}
+	if c.AsyncWorkers < 1 || c.AsyncWorkers > 256 {
+		return errors.New(fmt.Sprintf("invalid asyncworkers = %d", c.AsyncWorkers))
+	}
+	if c.AsyncQueue < 16 || c.AsyncQueue > 1048576 {
+		return errors.New(fmt.Sprintf("invalid asyncqueue = %d", c.AsyncQueue))
+	}
+	switch c.AsyncOverflow {
+	case "", "reject", "drop", "block":
+	default:
+		return errors.New(fmt.Sprintf("invalid asyncoverflow = '%s'", c.AsyncOverflow))
+	}
+	if c.AsyncWait < 1 || c.AsyncWait > 10000 {
+		return errors.New(fmt.Sprintf("invalid asyncwait = %d", c.AsyncWait))
+	}
+	if c.Node < 0 || c.Node > 255 {
+		return errors.New(fmt.Sprintf("invalid node = %d", c.Node))
+	}
+	if _, err := parseRemotes(c.Nodes); err != nil {
+		return errors.New(fmt.Sprintf("invalid nodes = '%s', error = '%v'", c.Nodes, err))
+	}
+	if c.Node == 0 && (len(c.Nodes) != 0 || c.NodeListen != 0) {
+		return errors.New("invalid node = 0, with nodes or nodelisten")
+	}
+	if (len(c.Nodes) != 0 || c.NodeListen != 0) && len(c.TLSCert) == 0 && len(c.Secret) == 0 {
+		return errors.New("invalid nodes or nodelisten, the cluster links need tls or XSERVER_RPC_SECRET")
+	}
+	if c.Heartbeat < 1 || c.Heartbeat > 60 {
+		return errors.New(fmt.Sprintf("invalid heartbeat = %d", c.Heartbeat))
+	}
+	if c.DHRotate < 0 || c.DHRotate > 3600 {
+		return errors.New(fmt.Sprintf("invalid dhrotate = %d", c.DHRotate))
+	}
+	if c.Drain < 0 || c.Drain > 300 {
+		return errors.New(fmt.Sprintf("invalid drain = %d", c.Drain))
+	}
+	if len(c.Retrans) == 0 {
+		return errors.New("invalid retrans, empty intervals list")
+	}
+	for _, v := range c.Retrans {
+		if v < 100 || v > 30000 {
+			return errors.New(fmt.Sprintf("invalid retrans = %v", c.Retrans))
 		}
 	}
+	return nil
+}
+
+// New resolves c, which Validate has accepted.
+func New(c *Config) *Args {
+	args := &Args{}
+	args.ncpu = c.Ncpu
+	args.parallel = c.Parallel
+	args.udp.listen = append([]uint16{}, c.Ports...)
+	if args.udp.sockets = c.Sockets; c.Sockets == 0 {
+		if args.udp.sockets = c.Ncpu; c.Ncpu > 256 {
+			args.udp.sockets = 256
+		}
+	}
+	args.udp.batch = c.Batch
+	args.rpc.listen = c.Listen
+	if remotes, err := parseRemotes(c.Remote); err != nil {
+		args.rpc.remotes = nil
+	} else {
+		args.rpc.remotes = remotes
+	}
+	args.manage = c.Manage
+	args.heartbeat = c.Heartbeat
+	args.dhrotate = c.DHRotate
+	args.drain = c.Drain
+	args.retrans = append([]int{}, c.Retrans...)
+	args.recvbuf = c.RecvBuf
+	args.backlog.flow = c.FlowBacklog
+	args.backlog.session = c.SessionBacklog
+	if args.backlog.overflow = c.Overflow; len(c.Overflow) == 0 {
+		args.backlog.overflow = "abandon"
+	}
+	args.backlog.expiry = c.BacklogExpiry
+	args.async.groups = c.AsyncGroups
+	args.async.workers = c.AsyncWorkers
+	args.async.queue = c.AsyncQueue
+	if args.async.overflow = c.AsyncOverflow; len(c.AsyncOverflow) == 0 {
+		args.async.overflow = "block"
+	}
+	args.async.wait = c.AsyncWait
+	args.cluster.node = uint8(c.Node)
+	args.cluster.listen = c.NodeListen
+	if nodes, err := parseRemotes(c.Nodes); err != nil {
+		args.cluster.nodes = nil
+	} else {
+		args.cluster.nodes = nodes
+	}
+	args.http = c.Http
+	set := make(map[string]string)
+	for _, app := range c.Apps {
+		if app = trimSpace(app); len(app) != 0 {
+			set[app] = app
+		}
+	}
+	args.apps = make([]string, 0, len(set))
+	for app, _ := range set {
+		args.apps = append(args.apps, app)
+	}
+	args.debug = c.Debug
 
 	if loc, err := time.LoadLocation("Asia/Shanghai"); err != nil {
 		log.Printf("[location]: set location failed, error = '%v'\n", err)
 	} else {
 		log.Printf("[location]: set location = '%v'\n", loc)
 	}
-	log.Printf("[argument]: %+v", args)
-
-	runtime.GOMAXPROCS(args.ncpu)
+	log.Printf("[argument]: %+v", *args)
+	return args
 }
 
 func trimSpace(s string) string {
@@ -167,14 +405,31 @@ func trimSpace(s string) string {
 }
 
 func parseAddr(s string) (string, uint16, error) {
-	if idx := strings.Index(s, ":"); idx > 0 {
-		if port, err := parsePort(s[idx+1:]); err == nil {
-			return s[:idx], port, nil
+	if host, port, err := net.SplitHostPort(s); err == nil && len(host) != 0 {
+		if p, err := parsePort(port); err == nil {
+			return host, p, nil
 		}
 	}
 	return "", 0, errors.New("bad ip address")
 }
 
+// parseRemotes parses a comma separated list of addresses, dropping repeats.
+func parseRemotes(s string) ([]Remote, error) {
+	rs := make([]Remote, 0)
+	set := make(map[Remote]bool)
+	for _, x := range strings.Split(s, ",") {
+		if v := trimSpace(x); len(v) != 0 {
+			if ip, port, err := parseAddr(v); err != nil {
+				return nil, err
+			} else if r := (Remote{ip, port}); !set[r] {
+				set[r] = true
+				rs = append(rs, r)
+			}
+		}
+	}
+	return rs, nil
+}
+
 func parsePort(s string) (uint16, error) {
 	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
 		if p := uint16(v); int64(p) == v && p != 0 {
@@ -221,45 +476,131 @@ func parseInts(s string) ([]int, error) {
 	return is, nil
 }
 
-func Parallel() int {
-	return args.parallel
+// Ncpu is what GOMAXPROCS is set to; it is the only value a server changes
+// for the whole process.
+func (a *Args) Ncpu() int {
+	return a.ncpu
+}
+
+func (a *Args) Parallel() int {
+	return a.parallel
+}
+
+func (a *Args) Sockets() int {
+	return a.udp.sockets
+}
+
+func (a *Args) Batch() int {
+	return a.udp.batch
+}
+
+func (a *Args) Manage() int {
+	return a.manage
+}
+
+func (a *Args) Retrans() []int {
+	return a.retrans
+}
+
+func (a *Args) RecvBuf() int {
+	return a.recvbuf
+}
+
+func (a *Args) FlowBacklog() int {
+	return a.backlog.flow
+}
+
+func (a *Args) SessionBacklog() int {
+	return a.backlog.session
+}
+
+// BacklogExpiry is the age, in milliseconds, past which reliable data may be
+// abandoned.
+func (a *Args) BacklogExpiry() int {
+	return a.backlog.expiry
+}
+
+// CloseOnOverflow tells whether a flow past its backlog closes its player,
+// or its session, rather than abandoning its oldest reliable data.
+func (a *Args) CloseOnOverflow() bool {
+	return a.backlog.overflow == "close"
+}
+
+func (a *Args) AsyncGroups() int {
+	return a.async.groups
+}
+
+func (a *Args) AsyncWorkers() int {
+	return a.async.workers
+}
+
+func (a *Args) AsyncQueue() int {
+	return a.async.queue
+}
+
+// AsyncOverflow returns what a call to a full async group does: "reject",
+// "drop" or "block".
+func (a *Args) AsyncOverflow() string {
+	return a.async.overflow
+}
+
+func (a *Args) AsyncWait() int {
+	return a.async.wait
+}
+
+// Node returns the id of this node in its cluster, 0 out of a cluster.
+func (a *Args) Node() uint8 {
+	return a.cluster.node
+}
+
+func (a *Args) NodeListenPort() uint16 {
+	return a.cluster.listen
+}
+
+func (a *Args) NodeRemotes() []Remote {
+	return a.cluster.nodes
+}
+
+func (a *Args) HttpPort() uint16 {
+	return a.http
 }
 
-func Manage() int {
-	return args.manage
+func (a *Args) Heartbeat() int {
+	return a.heartbeat
 }
 
-func Retrans() []int {
-	return args.retrans
+func (a *Args) DHRotate() int {
+	return a.dhrotate
 }
 
-func HttpPort() uint16 {
-	return args.http
+func (a *Args) Drain() int {
+	return a.drain
 }
 
-func Heartbeat() int {
-	return args.heartbeat
+func (a *Args) UdpListenPorts() []uint16 {
+	return a.udp.listen
 }
 
-func UdpListenPorts() []uint16 {
-	return args.udp.listen
+func (a *Args) RpcListenPort() uint16 {
+	return a.rpc.listen
 }
 
-func RpcListenPort() uint16 {
-	return args.rpc.listen
+type Remote struct {
+	IP   string
+	Port uint16
 }
 
-func RpcRemote() (string, uint16) {
-	return args.rpc.remote.ip, args.rpc.remote.port
+func (a *Args) RpcRemotes() []Remote {
+	return a.rpc.remotes
 }
 
-func IsDebug() bool {
-	return args.debug
+func (a *Args) IsDebug() bool {
+	return a.debug
 }
 
-func IsAuthorizedApp(app string) bool {
-	for i := 0; i < len(args.apps); i++ {
-		if app == args.apps[i] {
+func (a *Args) IsAuthorizedApp(app string) bool {
+	for i := 0; i < len(a.apps); i++ {
+		if app == a.apps[i] {
 			return true
 		}
 	}
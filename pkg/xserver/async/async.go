@@ -3,61 +3,338 @@ package async
 import (
 	"container/list"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 import (
+	"github.com/spinlock/xserver/pkg/xserver/args"
 	"github.com/spinlock/xserver/pkg/xserver/counts"
 	"github.com/spinlock/xserver/pkg/xserver/utils"
 	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
-var groups [32]struct {
-	lock sync.Mutex
-	cond *sync.Cond
-	list *list.List
-}
-
-func init() {
-	for i := 0; i < len(groups); i++ {
-		g := &groups[i]
-		g.cond = sync.NewCond(&g.lock)
-		g.list = list.New()
-		main := func() {
-			defer func() {
-				if x := recover(); x != nil {
-					counts.Count("async.panic", 1)
-					xlog.ErrLog.Printf("[async]: panic = %v\n%s\n", x, utils.Trace())
-				}
+// Calls are run by -asyncgroups groups, the group of a call picked by its
+// gid. A group queues the calls of each gid apart, and its -asyncworkers
+// workers take the gids in turn, a gid to a worker at a time, so that the
+// calls of a gid run in the order they were made while a slow one holds up
+// no other gid.
+//
+// A group takes at most -asyncqueue calls by Offer, the media and broadcasts
+// fanned out to sessions; past that an offer is rejected, pushes the oldest
+// offer queued out, or waits up to -asyncwait for room and is rejected then,
+// as -asyncoverflow says. Calls by Call, the joins, exits, replies and
+// notifications that must not be lost, are queued whatever the depth.
+
+const (
+	overflowReject = iota
+	overflowDrop
+	overflowBlock
+)
+
+type task struct {
+	f  func()
+	at int64
+	q  *queue
+	e  *list.Element
+	o  *list.Element
+}
+
+// queue holds the calls of a gid. It is in the ready list of its group
+// while it has calls and no worker, and goes once a worker leaves it empty.
+type queue struct {
+	gid     uint64
+	tasks   list.List
+	e       *list.Element
+	running bool
+}
+
+type group struct {
+	pool    *Pool
+	keys    map[uint64]*queue
+	ready   list.List
+	order   list.List
+	depth   int
+	freed   chan struct{}
+	work    *sync.Cond
+	stopped bool
+	stats   struct {
+		calls    uint64
+		done     uint64
+		rejected uint64
+		dropped  uint64
+		wait     int64
+		run      int64
+	}
+	sync.Mutex
+}
+
+// Pool is the async groups of a server, idle until it starts.
+type Pool struct {
+	args     *args.Args
+	counts   *counts.Counts
+	logs     *xlog.Logs
+	groups   []*group
+	queue    int
+	overflow int
+	wait     time.Duration
+	quit     chan struct{}
+	workers  sync.WaitGroup
+	depth    *counts.Histogram
+	waited   *counts.Histogram
+	ran      *counts.Histogram
+	sync.RWMutex
+}
+
+func New(a *args.Args, c *counts.Counts, l *xlog.Logs) *Pool {
+	p := &Pool{args: a, counts: c, logs: l}
+	p.depth = c.NewHistogram("async.queue.depth", 0, 1, 2, 4, 8, 16, 64, 256, 1024, 4096)
+	p.waited = c.NewHistogram("async.wait.seconds", 0.0001, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1)
+	p.ran = c.NewHistogram("async.run.seconds", 0.0001, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1)
+	return p
+}
+
+func (p *Pool) Start() {
+	p.Lock()
+	defer p.Unlock()
+	switch p.args.AsyncOverflow() {
+	case "reject":
+		p.overflow = overflowReject
+	case "drop":
+		p.overflow = overflowDrop
+	default:
+		p.overflow = overflowBlock
+	}
+	p.queue = p.args.AsyncQueue()
+	p.wait = time.Millisecond * time.Duration(p.args.AsyncWait())
+	p.quit = make(chan struct{})
+	p.groups = make([]*group, p.args.AsyncGroups())
+	for i := 0; i < len(p.groups); i++ {
+		g := &group{pool: p}
+		g.keys = make(map[uint64]*queue)
+		g.work = sync.NewCond(&g.Mutex)
+		p.groups[i] = g
+		for j := 0; j < p.args.AsyncWorkers(); j++ {
+			p.workers.Add(1)
+			go func() {
+				defer p.workers.Done()
+				g.run()
 			}()
-			for {
-				var f func()
-				g.lock.Lock()
-				if e := g.list.Front(); e != nil {
-					f = g.list.Remove(e).(func())
-				} else {
-					g.cond.Wait()
-				}
-				g.lock.Unlock()
-				if f != nil {
-					f()
-				}
-			}
 		}
-		go func() {
-			for {
-				main()
-			}
-		}()
 	}
 }
 
-func Call(gid uint64, f func()) {
+// Stop stops the workers; the calls still queued are dropped, and those
+// waiting for room are rejected.
+func (p *Pool) Stop() {
+	p.Lock()
+	if p.quit != nil {
+		close(p.quit)
+		p.quit = nil
+	}
+	groups := p.groups
+	p.groups = nil
+	p.Unlock()
+	for _, g := range groups {
+		g.Lock()
+		g.stopped = true
+		g.work.Broadcast()
+		g.Unlock()
+	}
+	p.workers.Wait()
+}
+
+// run takes the gid first in line, runs its next call and puts it back at
+// the end of the line when more calls wait.
+func (g *group) run() {
+	g.Lock()
+	defer g.Unlock()
+	for {
+		for g.ready.Len() == 0 && !g.stopped {
+			g.work.Wait()
+		}
+		if g.stopped {
+			return
+		}
+		q := g.ready.Remove(g.ready.Front()).(*queue)
+		q.e, q.running = nil, true
+		t := g.take(q.tasks.Front())
+		g.Unlock()
+		g.exec(t)
+		g.Lock()
+		q.running = false
+		if q.tasks.Len() != 0 {
+			q.e = g.ready.PushBack(q)
+		} else {
+			delete(g.keys, q.gid)
+		}
+	}
+}
+
+// push queues t for gid, with the group locked; the offers go in the order
+// list too, the one the oldest is dropped from.
+func (g *group) push(gid uint64, t *task, bounded bool) {
+	q := g.keys[gid]
+	if q == nil {
+		q = &queue{gid: gid}
+		g.keys[gid] = q
+	}
+	t.q, t.e = q, q.tasks.PushBack(t)
+	if bounded {
+		t.o = g.order.PushBack(t)
+	}
+	if !q.running && q.e == nil {
+		q.e = g.ready.PushBack(q)
+		g.work.Signal()
+	}
+	g.depth++
+}
+
+// take unqueues the task of e, with the group locked, and wakes a caller
+// waiting for room.
+func (g *group) take(e *list.Element) *task {
+	t := e.Value.(*task)
+	q := t.q
+	q.tasks.Remove(t.e)
+	if t.o != nil {
+		g.order.Remove(t.o)
+	}
+	if q.tasks.Len() == 0 && !q.running {
+		g.ready.Remove(q.e)
+		delete(g.keys, q.gid)
+		q.e = nil
+	}
+	g.depth--
+	if g.freed != nil {
+		close(g.freed)
+		g.freed = nil
+	}
+	return t
+}
+
+func (g *group) exec(t *task) {
+	p := g.pool
+	start := time.Now().UnixNano()
+	defer func() {
+		if x := recover(); x != nil {
+			p.counts.Count("async.panic", 1)
+			p.logs.ErrLog.Printf("[async]: panic = %v\n%s\n", x, utils.Trace())
+		}
+		now := time.Now().UnixNano()
+		atomic.AddUint64(&g.stats.done, 1)
+		atomic.AddInt64(&g.stats.wait, start-t.at)
+		atomic.AddInt64(&g.stats.run, now-start)
+		p.waited.Observe(float64(start-t.at) / float64(time.Second))
+		p.ran.Observe(float64(now-start) / float64(time.Second))
+	}()
+	t.f()
+}
+
+// Call queues f in the group of gid whatever the depth of the group, for
+// the calls that must not be lost, and never waits. It returns false only
+// once the workers are stopped.
+func (p *Pool) Call(gid uint64, f func()) bool {
+	return p.call(gid, f, false, false)
+}
+
+// Offer queues f in the group of gid as -asyncoverflow says, and tells
+// whether it did. A caller holding a session lock passes false for wait,
+// and is rejected at once rather than made to wait for room.
+func (p *Pool) Offer(gid uint64, f func(), wait bool) bool {
+	return p.call(gid, f, true, wait)
+}
+
+func (p *Pool) call(gid uint64, f func(), bounded, wait bool) bool {
 	if f == nil {
-		return
+		return false
+	}
+	p.RLock()
+	groups, max, overflow, timeout, quit := p.groups, p.queue, p.overflow, p.wait, p.quit
+	p.RUnlock()
+	if len(groups) == 0 {
+		p.counts.Count("async.stopped", 1)
+		return false
+	}
+	g := groups[gid%uint64(len(groups))]
+	atomic.AddUint64(&g.stats.calls, 1)
+	t := &task{f: f, at: time.Now().UnixNano()}
+	g.Lock()
+	defer g.Unlock()
+	if bounded && g.depth >= max {
+		p.counts.Count("async.full", 1)
+	}
+	var timer *time.Timer
+	for bounded && g.depth >= max && !g.stopped {
+		switch {
+		case overflow == overflowDrop && g.order.Len() != 0:
+			g.take(g.order.Front())
+			atomic.AddUint64(&g.stats.dropped, 1)
+			p.counts.Count("async.dropped", 1)
+			continue
+		case overflow == overflowBlock && wait:
+			if timer == nil {
+				timer = time.NewTimer(timeout)
+				defer timer.Stop()
+			}
+			if g.freed == nil {
+				g.freed = make(chan struct{})
+			}
+			freed := g.freed
+			g.Unlock()
+			select {
+			case <-freed:
+				g.Lock()
+				continue
+			case <-timer.C:
+			case <-quit:
+			}
+			g.Lock()
+		}
+		atomic.AddUint64(&g.stats.rejected, 1)
+		p.counts.Count("async.rejected", 1)
+		return false
+	}
+	if g.stopped {
+		p.counts.Count("async.stopped", 1)
+		return false
+	}
+	p.depth.Observe(float64(g.depth))
+	g.push(gid, t, bounded)
+	return true
+}
+
+// Stats describes a group: the calls queued now, the calls made, run,
+// rejected and dropped so far, and the time they waited in the queue and
+// took to run, in total.
+type Stats struct {
+	Depth    int
+	Calls    uint64
+	Done     uint64
+	Rejected uint64
+	Dropped  uint64
+	Wait     time.Duration
+	Run      time.Duration
+}
+
+// Groups returns the stats of every group, in order.
+func (p *Pool) Groups() []Stats {
+	p.RLock()
+	groups := p.groups
+	p.RUnlock()
+	all := make([]Stats, len(groups))
+	for i, g := range groups {
+		g.Lock()
+		depth := g.depth
+		g.Unlock()
+		all[i] = Stats{
+			Depth:    depth,
+			Calls:    atomic.LoadUint64(&g.stats.calls),
+			Done:     atomic.LoadUint64(&g.stats.done),
+			Rejected: atomic.LoadUint64(&g.stats.rejected),
+			Dropped:  atomic.LoadUint64(&g.stats.dropped),
+			Wait:     time.Duration(atomic.LoadInt64(&g.stats.wait)),
+			Run:      time.Duration(atomic.LoadInt64(&g.stats.run)),
+		}
 	}
-	g := &groups[gid%uint64(len(groups))]
-	g.lock.Lock()
-	g.list.PushBack(f)
-	g.cond.Signal()
-	g.lock.Unlock()
+	return all
 }
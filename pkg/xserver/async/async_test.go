@@ -0,0 +1,127 @@
+package async
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/args"
+	"github.com/spinlock/xserver/pkg/xserver/xlog"
+)
+
+func start(t *testing.T, workers int, overflow string) *Pool {
+	c := args.Default()
+	c.AsyncGroups, c.AsyncWorkers, c.AsyncQueue = 1, workers, 16
+	c.AsyncOverflow, c.AsyncWait = overflow, 10
+	p := New(args.New(c), nil, xlog.New(false, nil))
+	p.Start()
+	t.Cleanup(p.Stop)
+	return p
+}
+
+// TestCallOrder has a gid blocked in a call while another gid of the same
+// group runs, and the calls of each gid run in the order they were made.
+func TestCallOrder(t *testing.T) {
+	p := start(t, 2, "block")
+	release := make(chan struct{})
+	var lock sync.Mutex
+	ran := make(map[uint64][]int)
+	done := make(chan struct{}, 16)
+	call := func(gid uint64, i int) {
+		if !p.Call(gid, func() {
+			if gid == 1 && i == 0 {
+				<-release
+			}
+			lock.Lock()
+			ran[gid] = append(ran[gid], i)
+			lock.Unlock()
+			done <- struct{}{}
+		}) {
+			t.Fatalf("call %d of gid %d rejected", i, gid)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		call(1, i)
+	}
+	for i := 0; i < 4; i++ {
+		call(2, i)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatal("gid 2 held up by gid 1")
+		}
+	}
+	close(release)
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, gid := range []uint64{1, 2} {
+		for i, v := range ran[gid] {
+			if v != i {
+				t.Fatalf("gid %d ran %v", gid, ran[gid])
+			}
+		}
+	}
+}
+
+func TestOfferOverflow(t *testing.T) {
+	for _, overflow := range []string{"reject", "block", "drop"} {
+		t.Run(overflow, func(t *testing.T) {
+			p := start(t, 1, overflow)
+			release := make(chan struct{})
+			defer close(release)
+			p.Call(0, func() {
+				<-release
+			})
+			time.Sleep(time.Millisecond * 10)
+			for i := 0; i < 16; i++ {
+				if !p.Offer(uint64(i+1), func() {}, true) {
+					t.Fatalf("offer %d rejected", i)
+				}
+			}
+			accepted := p.Offer(17, func() {}, true)
+			if drop := overflow == "drop"; accepted != drop {
+				t.Fatalf("offer past the queue accepted = %v", accepted)
+			}
+			if p.Offer(18, func() {}, false) != (overflow == "drop") {
+				t.Fatal("offer without wait")
+			}
+			// the calls that must not be lost go past the queue
+			for i := 0; i < 4; i++ {
+				if !p.Call(uint64(i+1), func() {}) {
+					t.Fatalf("call %d rejected", i)
+				}
+			}
+			if s := p.Groups()[0]; s.Depth != 20 {
+				t.Fatalf("depth = %d", s.Depth)
+			}
+		})
+	}
+}
+
+// TestOfferKeepsCalls fills a group with calls, which an offer must not
+// push out.
+func TestOfferKeepsCalls(t *testing.T) {
+	p := start(t, 1, "drop")
+	release := make(chan struct{})
+	defer close(release)
+	p.Call(0, func() {
+		<-release
+	})
+	time.Sleep(time.Millisecond * 10)
+	for i := 0; i < 16; i++ {
+		p.Call(uint64(i+1), func() {})
+	}
+	if p.Offer(17, func() {}, true) {
+		t.Fatal("offer accepted in a group full of calls")
+	}
+	if s := p.Groups()[0]; s.Depth != 16 || s.Dropped != 0 {
+		t.Fatalf("depth = %d, dropped = %d", s.Depth, s.Dropped)
+	}
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/amf"
+	"github.com/spinlock/xserver/pkg/xserver/rpc"
+)
+
+// Hello is what is known about a client when its handshake starts: the app
+// and query of the url it dialed and where it comes from.
+type Hello struct {
+	App   string
+	Query url.Values
+	Addr  *net.UDPAddr
+}
+
+// Connect is the 'connect' call of a session: the connect object as sent by
+// the player and the extra arguments following it, where tokens usually go.
+type Connect struct {
+	Xid    uint32
+	App    string
+	Query  url.Values
+	Addr   *net.UDPAddr
+	Object *amf.Object
+	Args   []interface{}
+}
+
+// Authorizer decides which clients may use the server. AuthorizeHello runs
+// inside the handshake and must answer at once; AuthorizeConnect may answer
+// later, from any goroutine, by calling reply exactly once with nil to accept
+// or with the reason of the rejection.
+type Authorizer interface {
+	AuthorizeHello(h *Hello) error
+	AuthorizeConnect(c *Connect, reply func(error))
+}
+
+// New builds the authorizer selected by the -auth argument: 'static' checks
+// the app list only, 'hmac' also wants a token signed with the secret in
+// $XSERVER_AUTH_SECRET and 'rpc' asks the backend of link about every
+// connect.
+func New(kind string, apps []string, link *rpc.Link) (Authorizer, error) {
+	switch kind {
+	case "", "static":
+		return NewStatic(apps), nil
+	case "hmac":
+		secret := os.Getenv("XSERVER_AUTH_SECRET")
+		if len(secret) == 0 {
+			return nil, errors.New("auth.hmac needs XSERVER_AUTH_SECRET")
+		}
+		return NewHMAC([]byte(secret), apps), nil
+	case "rpc":
+		return NewRPC(apps, time.Second*5, link), nil
+	}
+	return nil, errors.New(fmt.Sprintf("auth.unknown kind = '%s'", kind))
+}
+
+// AppName returns the first non empty segment of path, which is how both
+// the hello url and the connect object name the app.
+func AppName(path string) string {
+	for _, s := range strings.Split(path, "/") {
+		if len(s) != 0 {
+			return s
+		}
+	}
+	return ""
+}
+
+func NewConnect(xid uint32, addr *net.UDPAddr, obj *amf.Object, args []interface{}) *Connect {
+	c := &Connect{}
+	c.Xid = xid
+	c.Addr = addr
+	c.Object = obj
+	c.Args = args
+	if s, ok := obj.GetString("app"); ok {
+		c.App = AppName(s)
+	}
+	if s, ok := obj.GetString("tcUrl"); ok {
+		if u, err := url.Parse(s); err == nil {
+			c.Query = u.Query()
+			if len(c.App) == 0 {
+				c.App = AppName(u.Path)
+			}
+		}
+	}
+	if c.Query == nil {
+		c.Query = url.Values{}
+	}
+	return c
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HMAC accepts the apps of a list when the client also shows a token signed
+// for that app. A token is '<expires>.<signature>', expires being unix seconds
+// and signature the hex HMAC-SHA256 of '<app>.<expires>' under the secret.
+// It is looked for in the 'token' query of the url, then in the 'token' field
+// of the connect object, then in the first string argument after it.
+type HMAC struct {
+	*Static
+	secret []byte
+}
+
+func NewHMAC(secret []byte, apps []string) *HMAC {
+	return &HMAC{NewStatic(apps), append([]byte{}, secret...)}
+}
+
+func SignToken(secret []byte, app string, expires time.Time) string {
+	ts := strconv.FormatInt(expires.Unix(), 10)
+	return ts + "." + sign(secret, app, ts)
+}
+
+func sign(secret []byte, app string, ts string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(app + "." + ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *HMAC) verify(app string, token string) error {
+	idx := strings.IndexByte(token, '.')
+	if idx <= 0 {
+		return errors.New("malformed token")
+	}
+	ts, sig := token[:idx], token[idx+1:]
+	if expires, err := strconv.ParseInt(ts, 10, 64); err != nil {
+		return errors.New("malformed token")
+	} else if time.Now().Unix() > expires {
+		return errors.New("expired token")
+	}
+	if !hmac.Equal([]byte(sig), []byte(sign(a.secret, app, ts))) {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+// AuthorizeHello rejects a bad token early when the url carries one, but a
+// missing token is left for the connect.
+func (a *HMAC) AuthorizeHello(h *Hello) error {
+	if err := a.Static.AuthorizeHello(h); err != nil {
+		return err
+	}
+	if token := h.Query.Get("token"); len(token) != 0 {
+		return a.verify(h.App, token)
+	}
+	return nil
+}
+
+func (a *HMAC) AuthorizeConnect(c *Connect, reply func(error)) {
+	if err := a.authorize(c.App); err != nil {
+		reply(err)
+		return
+	}
+	token := c.Query.Get("token")
+	if len(token) == 0 {
+		token, _ = c.Object.GetString("token")
+	}
+	if len(token) == 0 {
+		for _, v := range c.Args {
+			if s, ok := v.(string); ok {
+				token = s
+				break
+			}
+		}
+	}
+	if len(token) == 0 {
+		reply(errors.New("missing token"))
+		return
+	}
+	reply(a.verify(c.App, token))
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"errors"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/amf/amf0"
+	"github.com/spinlock/xserver/pkg/xserver/rpc"
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+// RPC accepts the apps of a list at hello, then asks the backend about each
+// connect with an XRequest of code 'auth' whose data is the amf0 connect
+// object followed by the arguments. The backend answers with an amf0 boolean,
+// optionally followed by a string telling why the client is rejected.
+type RPC struct {
+	*Static
+	timeout time.Duration
+	link    *rpc.Link
+}
+
+func NewRPC(apps []string, timeout time.Duration, link *rpc.Link) *RPC {
+	return &RPC{NewStatic(apps), timeout, link}
+}
+
+func (a *RPC) AuthorizeConnect(c *Connect, reply func(error)) {
+	if err := a.authorize(c.App); err != nil {
+		reply(err)
+		return
+	}
+	w := amf0.NewWriter(xio.NewPacketWriter(nil))
+	if err := w.WriteObject(c.Object); err != nil {
+		reply(errors.New("auth.rpc.write object"))
+		return
+	}
+	for _, v := range c.Args {
+		if err := w.Write(v); err != nil {
+			reply(errors.New("auth.rpc.write argument"))
+			return
+		}
+	}
+	a.link.Ask(c.Xid, c.Addr, "auth", w.Bytes(), a.timeout, func(data []byte, ok bool) {
+		if !ok {
+			reply(errors.New("authorization unavailable"))
+			return
+		}
+		r := amf0.NewReader(xio.NewPacketReader(data))
+		if accept, err := r.ReadBoolean(); err != nil {
+			reply(errors.New("authorization malformed"))
+		} else if !accept {
+			if reason, err := r.ReadString(); err == nil && len(reason) != 0 {
+				reply(errors.New(reason))
+			} else {
+				reply(errors.New("rejected by backend"))
+			}
+		} else {
+			reply(nil)
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Static accepts the apps of a fixed list, as -apps always did.
+type Static struct {
+	apps map[string]bool
+}
+
+func NewStatic(apps []string) *Static {
+	a := &Static{}
+	a.apps = make(map[string]bool)
+	for _, app := range apps {
+		a.apps[app] = true
+	}
+	return a
+}
+
+func (a *Static) authorize(app string) error {
+	if len(app) == 0 || !a.apps[app] {
+		return errors.New(fmt.Sprintf("unauthorized app = %s", app))
+	}
+	return nil
+}
+
+func (a *Static) AuthorizeHello(h *Hello) error {
+	return a.authorize(h.App)
+}
+
+func (a *Static) AuthorizeConnect(c *Connect, reply func(error)) {
+	reply(a.authorize(c.App))
+}
@@ -0,0 +1,588 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/amf"
+	"github.com/spinlock/xserver/pkg/xserver/rtmfp"
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+const (
+	mainSignature   = "\x00\x54\x43\x04\x00"
+	streamSignature = "\x00\x54\x43\x04"
+)
+
+// Client is an RTMFP NetConnection to an xserver. It is meant for end-to-end
+// tests, load generators and health probes, so it implements just enough of
+// the protocol to talk to this server: reliable flows with acks and
+// retransmission, keepalives, and the amf calls the server understands.
+type Client struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+	xid     uint32
+	yid     uint32
+	pid     string
+	rtmfp.AESEngine
+	recvtime int64
+	stmptime uint16
+	lastfid  uint64
+	lastcb   float64
+	mainfw   *flowWriter
+	writers  map[uint64]*flowWriter
+	readers  map[uint64]*flowReader
+	waits    map[float64]chan *Message
+	msgs     chan *Message
+	rsplist  []*message
+	info     *amf.Object
+	credit   int
+	stats    Stats
+	closed   bool
+	quit     chan struct{}
+	done     sync.WaitGroup
+	sync.Mutex
+}
+
+// Dial performs the handshake with the server at addr and connects to the
+// application named by uri, for example 'rtmfp://127.0.0.1:1935/app'. The
+// timeout bounds the handshake and every call made on the returned Client.
+func Dial(addr string, uri string, timeout time.Duration) (*Client, error) {
+	c, connected, err := DialAsync(addr, uri, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := connected(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialAsync is Dial returning once the connect is sent, with what waits for
+// its answer and closes the Client if it fails. Calls made meanwhile follow
+// the connect, as those a player pipelines.
+func DialAsync(addr string, uri string, timeout time.Duration) (*Client, func() error, error) {
+	if u, err := url.ParseRequestURI(uri); err != nil {
+		return nil, nil, err
+	} else if len(u.Path) <= 1 {
+		return nil, nil, errors.New("client.dial.missing app")
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &Client{}
+	c.conn = conn
+	c.timeout = timeout
+	c.writers = make(map[uint64]*flowWriter)
+	c.readers = make(map[uint64]*flowReader)
+	c.waits = make(map[float64]chan *Message)
+	c.msgs = make(chan *Message, 1024)
+	c.credit = -1
+	c.quit = make(chan struct{})
+	if err := c.handshake(uri); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	c.done.Add(2)
+	go c.recv()
+	go c.manage()
+	result, err := c.connect(uri)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	connected := func() error {
+		m, err := result()
+		if err != nil {
+			c.Close()
+			return err
+		}
+		for _, v := range m.Args {
+			if o, ok := v.(*amf.Object); ok {
+				c.info = o
+				break
+			}
+		}
+		return nil
+	}
+	return c, connected, nil
+}
+
+// Lookup asks the server at addr where the peer pid, hex encoded as Pid
+// returns it, is reached, as a peer does before it handshakes with another
+// one, and returns its public address first. The server tells the peer too,
+// so that it can punch back.
+func Lookup(addr string, pid string, timeout time.Duration) ([]*net.UDPAddr, error) {
+	epd, err := hex.DecodeString(pid)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	h, err := newHandshake()
+	if err != nil {
+		return nil, err
+	}
+	if msg, err := h.newIntroduceMessage(string(epd)); err != nil {
+		return nil, err
+	} else if r, err := h.exchange(conn, msg, 0x71, time.Now().Add(timeout)); err != nil {
+		return nil, err
+	} else {
+		return h.parseIntroduceResponse(r)
+	}
+}
+
+func (c *Client) handshake(uri string) error {
+	deadline := time.Now().Add(c.timeout)
+	h, err := newHandshake()
+	if err != nil {
+		return err
+	}
+	if msg, err := h.newHelloMessage(uri); err != nil {
+		return err
+	} else if r, err := h.exchange(c.conn, msg, 0x70, deadline); err != nil {
+		return err
+	} else if err := h.parseHelloResponse(r); err != nil {
+		return err
+	}
+	if msg, err := h.newAssignMessage(); err != nil {
+		return err
+	} else if r, err := h.exchange(c.conn, msg, 0x78, deadline); err != nil {
+		return err
+	} else if xid, encrypt, decrypt, err := h.parseAssignResponse(r); err != nil {
+		return err
+	} else {
+		engine := rtmfp.NewAESEngine()
+		if err := engine.SetKey(encrypt, decrypt); err != nil {
+			return err
+		}
+		c.AESEngine = engine
+		c.xid, c.yid, c.pid = xid, h.yid, h.pid()
+	}
+	return nil
+}
+
+func (c *Client) connect(uri string) (func() (*Message, error), error) {
+	obj := amf.NewObject()
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		obj.SetString("app", u.Path[1:])
+	}
+	obj.SetString("tcUrl", uri)
+	obj.SetNumber("objectEncoding", 3)
+	c.Lock()
+	c.lastfid++
+	c.mainfw = newFlowWriter(c.lastfid, mainSignature, nil)
+	c.writers[c.mainfw.fid] = c.mainfw
+	c.Unlock()
+	return c.start(c.mainfw, "connect", obj)
+}
+
+// Xid is the session id assigned by the server.
+func (c *Client) Xid() uint32 {
+	return c.xid
+}
+
+// Pid is the hex encoded peer id, as used by 'relay' and NetGroup.
+func (c *Client) Pid() string {
+	return hex.EncodeToString([]byte(c.pid))
+}
+
+// LocalAddr returns the address of the udp socket, which is where the server
+// sees the client come from unless there is a nat in between.
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Info is the object returned by the server to 'connect'.
+func (c *Client) Info() *amf.Object {
+	return c.info
+}
+
+// Stats counts flow fragments and acks seen by the client since Dial.
+type Stats struct {
+	Sent       uint64
+	Retrans    uint64
+	Recv       uint64
+	Duplicates uint64
+	Acks       uint64
+	AckRanges  uint64
+	Exceptions uint64
+}
+
+func (c *Client) Stats() Stats {
+	c.Lock()
+	defer c.Unlock()
+	return c.stats
+}
+
+// SetCredit makes the acks of the client offer blocks of 1024 bytes of
+// buffer, rather than what its readers have room for; a negative value goes
+// back to the latter.
+func (c *Client) SetCredit(blocks int) {
+	c.Lock()
+	defer c.Unlock()
+	c.credit = blocks
+}
+
+// Messages delivers every message received on the NetConnection flow that is
+// not the answer to a pending Call. Messages are dropped if nobody reads.
+func (c *Client) Messages() <-chan *Message {
+	return c.msgs
+}
+
+// Call invokes a server method and waits for its '_result' or '_error'.
+func (c *Client) Call(name string, args ...interface{}) (*Message, error) {
+	return c.call(c.mainfw, name, args...)
+}
+
+// Send invokes a server method without waiting for an answer.
+func (c *Client) Send(name string, args ...interface{}) error {
+	return c.invoke(c.mainfw, name, 0, args...)
+}
+
+// Relay forwards args to the peer pid through the server, which delivers them
+// as 'onRelay'.
+func (c *Client) Relay(pid string, args ...interface{}) error {
+	return c.Send("relay", append([]interface{}{pid}, args...)...)
+}
+
+func (c *Client) CreateStream() (*Stream, error) {
+	m, err := c.Call("createStream")
+	if err != nil {
+		return nil, err
+	}
+	sid := float64(0)
+	if len(m.Args) != 0 {
+		sid, _ = m.Args[0].(float64)
+	}
+	if sid <= 0 {
+		return nil, errors.New("client.createStream.bad stream id")
+	}
+	s := &Stream{}
+	s.c = c
+	s.sid = uint32(sid)
+	s.msgs = make(chan *Message, 1024)
+	w := xio.NewPacketWriter(nil)
+	w.WriteBytes([]byte(streamSignature))
+	w.Write7BitValue32(s.sid)
+	c.Lock()
+	defer c.Unlock()
+	c.lastfid++
+	s.fw = newFlowWriter(c.lastfid, string(w.Bytes()), s)
+	c.writers[s.fw.fid] = s.fw
+	return s, nil
+}
+
+func (c *Client) call(fw *flowWriter, name string, args ...interface{}) (*Message, error) {
+	result, err := c.start(fw, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return result()
+}
+
+// start invokes a server method, and returns what waits for its answer.
+func (c *Client) start(fw *flowWriter, name string, args ...interface{}) (func() (*Message, error), error) {
+	c.Lock()
+	c.lastcb++
+	callback := c.lastcb
+	wait := make(chan *Message, 16)
+	c.waits[callback] = wait
+	c.Unlock()
+	done := func() {
+		c.Lock()
+		delete(c.waits, callback)
+		c.Unlock()
+	}
+	if err := c.invoke(fw, name, callback, args...); err != nil {
+		done()
+		return nil, err
+	}
+	return func() (*Message, error) {
+		defer done()
+		timeout := time.After(c.timeout)
+		for {
+			select {
+			case m := <-wait:
+				if !m.terminal() {
+					continue
+				}
+				return m, m.err()
+			case <-timeout:
+				return nil, errors.New(fmt.Sprintf("client.call.timeout, name = %s", name))
+			case <-c.quit:
+				return nil, errors.New("client.call.closed")
+			}
+		}
+	}, nil
+}
+
+func (c *Client) invoke(fw *flowWriter, name string, callback float64, args ...interface{}) error {
+	if data, err := newAmfMessage(name, callback, args...); err != nil {
+		return err
+	} else {
+		return c.write(fw, true, data)
+	}
+}
+
+func (c *Client) write(fw *flowWriter, reliable bool, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errors.New("client.closed")
+	}
+	defer c.flush()
+	fw.AddFragments(c, reliable, data)
+	return nil
+}
+
+// Closed returns a channel that is closed once the session is gone, either
+// by Close or because the server closed it.
+func (c *Client) Closed() <-chan struct{} {
+	return c.quit
+}
+
+func (c *Client) Close() error {
+	c.Lock()
+	if !c.closed {
+		c.send(newMessage(0x4c, nil))
+		c.flush()
+		c.shutdown()
+	}
+	c.Unlock()
+	c.done.Wait()
+	return nil
+}
+
+func (c *Client) shutdown() {
+	c.closed = true
+	close(c.quit)
+	c.conn.Close()
+}
+
+func (c *Client) send(msg *message) {
+	c.rsplist = append(c.rsplist, msg)
+}
+
+func (c *Client) flush() {
+	const limit = 1200
+	for len(c.rsplist) != 0 {
+		msgs, size := make([]rtmfp.ResponseMessage, 0, 8), 0
+		for len(c.rsplist) != 0 {
+			msg := c.rsplist[0]
+			if size += msg.Size(); size > limit && len(msgs) != 0 {
+				break
+			}
+			msgs = append(msgs, msg)
+			c.rsplist = c.rsplist[1:]
+		}
+		pkt := &packet{0x89, true, c.recvtime, c.stmptime, msgs}
+		if data, err := rtmfp.PacketToBytes(pkt); err != nil {
+			continue
+		} else if data, err = rtmfp.EncodePacket(c, c.xid, data); err != nil {
+			continue
+		} else {
+			c.conn.Write(data)
+		}
+	}
+	c.rsplist = nil
+}
+
+func (c *Client) recv() {
+	defer c.done.Done()
+	for {
+		buf := make([]byte, 2048)
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-c.quit:
+				return
+			default:
+			}
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			c.Lock()
+			if !c.closed {
+				c.shutdown()
+			}
+			c.Unlock()
+			return
+		}
+		c.handlePacket(buf[:n])
+	}
+}
+
+func (c *Client) manage() {
+	defer c.done.Done()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(time.Millisecond * 100):
+		}
+		c.Lock()
+		if !c.closed {
+			now := time.Now().UnixNano()
+			for _, fw := range c.writers {
+				fw.Manage(c, now)
+			}
+			c.flush()
+		}
+		c.Unlock()
+	}
+}
+
+func (c *Client) handlePacket(data []byte) {
+	if xid, err := rtmfp.PacketXid(data); err != nil || xid != c.yid {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return
+	}
+	defer c.flush()
+	if _, err := rtmfp.DecodePacket(c, data); err != nil {
+		return
+	}
+	c.recvtime = time.Now().UnixNano()
+	c.handle(xio.NewPacketReader(data[6:]))
+}
+
+func (c *Client) handle(r *xio.PacketReader) {
+	if marker, err := r.Read8(); err != nil {
+		return
+	} else {
+		if c.stmptime, err = r.Read16(); err != nil {
+			return
+		}
+		switch marker | 0xf0 {
+		default:
+			return
+		case 0xfe, 0xfd:
+			if _, err = r.Read16(); err != nil {
+				return
+			}
+		case 0xfa, 0xf9:
+		}
+	}
+	var lastreq *flowRequest
+	for r.Len() != 0 {
+		msg, err := rtmfp.ParseRequestMessage(r)
+		if err != nil {
+			break
+		}
+		if msg.Code != 0x11 && lastreq != nil {
+			c.handleFlowRequest(lastreq)
+			lastreq = nil
+		}
+		switch msg.Code {
+		case 0x01:
+			c.send(&message{0x41, append([]byte{}, msg.Bytes()...)})
+		case 0x0c, 0x4c:
+			if msg.Code == 0x0c {
+				c.send(newMessage(0x4c, nil))
+				c.flush()
+			}
+			c.shutdown()
+			return
+		case 0x51:
+			if fid, ack, err := parseFlowAck(msg.PacketReader); err == nil {
+				c.stats.Acks++
+				if len(ack.ranges) != 0 {
+					c.stats.AckRanges++
+				}
+				if fw := c.writers[fid]; fw != nil {
+					fw.CommitAck(ack)
+				}
+			}
+		case 0x5e:
+			if fid, err := msg.Read7BitValue64(); err == nil {
+				c.stats.Exceptions++
+				if fw := c.writers[fid]; fw != nil {
+					fw.frags.Init()
+				}
+			}
+		case 0x10:
+			if req, err := parseFlowRequest(msg.PacketReader); err == nil {
+				lastreq = req
+			}
+		case 0x11:
+			if lastreq != nil {
+				if err := lastreq.AddSlice(msg.PacketReader); err != nil {
+					lastreq = nil
+				}
+			}
+		}
+	}
+	if lastreq != nil {
+		c.handleFlowRequest(lastreq)
+	}
+}
+
+func (c *Client) handleFlowRequest(req *flowRequest) {
+	fr := c.readers[req.fid]
+	if fr == nil {
+		if len(req.signature) == 0 {
+			return
+		}
+		var stream *Stream
+		if fw := c.writers[req.writer]; fw != nil {
+			stream = fw.stream
+		}
+		fr = newFlowReader(req.fid, stream)
+		c.readers[req.fid] = fr
+	}
+	for _, f := range req.frags {
+		if f.stage <= fr.stage || fr.frags[f.stage] != nil {
+			c.stats.Duplicates++
+		}
+	}
+	c.stats.Recv += uint64(len(req.frags))
+	fr.AddFragments(req.stageack, req.frags, func(data []byte) {
+		if m, err := parseMessage(data); err == nil {
+			c.deliver(fr, m)
+		}
+	})
+	c.send(fr.newAckMessage(c.credit))
+}
+
+func (c *Client) deliver(fr *flowReader, m *Message) {
+	if m.Callback != 0 {
+		if wait := c.waits[m.Callback]; wait != nil {
+			select {
+			case wait <- m:
+			default:
+			}
+			return
+		}
+	}
+	msgs := c.msgs
+	if s := fr.stream; s != nil {
+		msgs = s.msgs
+	}
+	select {
+	case msgs <- m:
+	default:
+	}
+}
@@ -0,0 +1,362 @@
+package client
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+const (
+	flagsHeader     = 0x80
+	flagsWithAfter  = 0x10
+	flagsWithBefore = 0x20
+	flagsAbandoned  = 0x02
+	flagsEnd        = 0x01
+)
+
+const (
+	minRetrans = time.Millisecond * 300
+	maxRetrans = time.Second * 5
+)
+
+type fragment struct {
+	stage    uint64
+	flags    uint8
+	data     []byte
+	sendtime int64
+}
+
+type flowWriter struct {
+	fid       uint64
+	signature string
+	stage     uint64
+	frags     list.List
+	retrans   time.Duration
+	lasttime  int64
+	stream    *Stream
+}
+
+func newFlowWriter(fid uint64, signature string, stream *Stream) *flowWriter {
+	fw := &flowWriter{}
+	fw.fid = fid
+	fw.signature = signature
+	fw.stage = 0
+	fw.frags.Init()
+	fw.retrans = minRetrans
+	fw.lasttime = 0
+	fw.stream = stream
+	return fw
+}
+
+func (fw *flowWriter) stageack() uint64 {
+	if e := fw.frags.Front(); e != nil {
+		return e.Value.(*fragment).stage - 1
+	}
+	return fw.stage
+}
+
+func (fw *flowWriter) AddFragments(c *Client, reliable bool, data []byte) {
+	const step = 1024
+	stageack := fw.stageack()
+	now := time.Now().UnixNano()
+	cnt := (step - 1 + len(data)) / step
+	if cnt == 0 {
+		cnt = 1
+	}
+	for i, beg := 0, 0; i < cnt; i++ {
+		end := beg + step
+		if end > len(data) {
+			end = len(data)
+		}
+		flags := uint8(0)
+		if i != 0 {
+			flags |= flagsWithBefore
+		}
+		if i != cnt-1 {
+			flags |= flagsWithAfter
+		}
+		fw.stage++
+		f := &fragment{fw.stage, flags, data[beg:end], now}
+		c.stats.Sent++
+		if reliable {
+			fw.frags.PushBack(f)
+		}
+		c.send(fw.newFlowMessage(f, stageack))
+		beg = end
+	}
+	if fw.lasttime == 0 {
+		fw.lasttime = now
+	}
+}
+
+func (fw *flowWriter) CommitAck(ack *flowAck) {
+	progress := false
+	for e := fw.frags.Front(); e != nil; {
+		next := e.Next()
+		f := e.Value.(*fragment)
+		if f.stage <= ack.stage || ack.contains(f.stage) {
+			fw.frags.Remove(e)
+			progress = true
+		}
+		e = next
+	}
+	if progress {
+		fw.retrans, fw.lasttime = minRetrans, time.Now().UnixNano()
+	}
+}
+
+func (fw *flowWriter) Manage(c *Client, now int64) {
+	if fw.frags.Len() == 0 {
+		fw.lasttime = 0
+		return
+	}
+	if fw.lasttime+int64(fw.retrans) > now {
+		return
+	}
+	if fw.retrans *= 2; fw.retrans > maxRetrans {
+		fw.retrans = maxRetrans
+	}
+	fw.lasttime = now
+	stageack := fw.stageack()
+	for e := fw.frags.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*fragment)
+		f.sendtime = now
+		c.stats.Retrans++
+		c.send(fw.newFlowMessage(f, stageack))
+	}
+}
+
+func (fw *flowWriter) newFlowMessage(f *fragment, stageack uint64) *message {
+	w := xio.NewPacketWriter(nil)
+	flags := f.flags
+	if stageack == 0 {
+		flags |= flagsHeader
+	}
+	w.Write8(flags)
+	w.Write7BitValue64(fw.fid)
+	w.Write7BitValue64(f.stage)
+	w.Write7BitValue64(f.stage - stageack)
+	if stageack == 0 {
+		w.WriteString8(fw.signature)
+		w.Write8(0)
+	}
+	w.WriteBytes(f.data)
+	return newMessage(0x10, w)
+}
+
+type flowReader struct {
+	fid    uint64
+	stage  uint64
+	frags  map[uint64]*fragment
+	ready  []*fragment
+	stream *Stream
+	closed bool
+}
+
+func newFlowReader(fid uint64, stream *Stream) *flowReader {
+	fr := &flowReader{}
+	fr.fid = fid
+	fr.stage = 0
+	fr.frags = make(map[uint64]*fragment)
+	fr.stream = stream
+	return fr
+}
+
+func (fr *flowReader) AddFragments(stageack uint64, frags []*fragment, deliver func([]byte)) {
+	if fr.stage < stageack {
+		for stage := range fr.frags {
+			if stage <= stageack {
+				delete(fr.frags, stage)
+			}
+		}
+		fr.stage, fr.ready = stageack, nil
+	}
+	for _, f := range frags {
+		if f.stage > fr.stage {
+			fr.frags[f.stage] = f
+		}
+	}
+	for {
+		f := fr.frags[fr.stage+1]
+		if f == nil {
+			return
+		}
+		delete(fr.frags, f.stage)
+		fr.stage = f.stage
+		if (f.flags & flagsAbandoned) != 0 {
+			fr.ready = nil
+		} else {
+			if (f.flags & flagsWithBefore) == 0 {
+				fr.ready = []*fragment{f}
+			} else if len(fr.ready) != 0 {
+				fr.ready = append(fr.ready, f)
+			}
+			if (f.flags&flagsWithAfter) == 0 && len(fr.ready) != 0 {
+				var data []byte
+				for _, x := range fr.ready {
+					data = append(data, x.data...)
+				}
+				fr.ready = nil
+				if len(data) != 0 {
+					deliver(data)
+				}
+			}
+		}
+		if (f.flags & flagsEnd) != 0 {
+			fr.closed = true
+		}
+	}
+}
+
+func (fr *flowReader) newAckMessage(credit int) *message {
+	ack := &flowAck{stage: fr.stage}
+	stages := make([]uint64, 0, len(fr.frags))
+	for stage := range fr.frags {
+		stages = append(stages, stage)
+	}
+	sort.Slice(stages, func(i, j int) bool {
+		return stages[i] < stages[j]
+	})
+	for _, stage := range stages {
+		if n := len(ack.ranges); n != 0 && ack.ranges[n-1].end+1 == stage {
+			ack.ranges[n-1].end = stage
+		} else {
+			ack.ranges = append(ack.ranges, flowAckRange{stage, stage})
+		}
+	}
+	cnt := uint64(0x7f)
+	if size := len(fr.frags); size != 0 {
+		cnt = 0x3f00 - uint64(size)
+	}
+	if credit >= 0 {
+		cnt = uint64(credit)
+	}
+	w := xio.NewPacketWriter(nil)
+	w.Write7BitValue64(fr.fid)
+	w.Write7BitValue64(cnt)
+	w.Write7BitValue64(ack.stage)
+	last := ack.stage
+	for _, r := range ack.ranges {
+		w.Write7BitValue64(r.beg - last - 2)
+		w.Write7BitValue64(r.end - r.beg)
+		last = r.end
+	}
+	return newMessage(0x51, w)
+}
+
+type flowAck struct {
+	stage  uint64
+	ranges []flowAckRange
+}
+
+type flowAckRange struct {
+	beg, end uint64
+}
+
+func (ack *flowAck) contains(stage uint64) bool {
+	for _, r := range ack.ranges {
+		if r.beg <= stage && stage <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFlowAck(r *xio.PacketReader) (uint64, *flowAck, error) {
+	fid, err := r.Read7BitValue64()
+	if err != nil {
+		return 0, nil, errors.New("flowack.read fid")
+	}
+	if _, err := r.Read7BitValue64(); err != nil {
+		return 0, nil, errors.New("flowack.read cnt")
+	}
+	ack := &flowAck{}
+	if ack.stage, err = r.Read7BitValue64(); err != nil {
+		return 0, nil, errors.New("flowack.read stage")
+	}
+	stage := ack.stage
+	for r.Len() != 0 {
+		var beg, end uint64
+		if beg, err = r.Read7BitValue64(); err != nil {
+			return 0, nil, errors.New("flowack.read range")
+		}
+		if end, err = r.Read7BitValue64(); err != nil {
+			return 0, nil, errors.New("flowack.read range")
+		}
+		beg = beg + stage + 2
+		end = end + beg
+		ack.ranges = append(ack.ranges, flowAckRange{beg, end})
+		stage = end
+	}
+	return fid, ack, nil
+}
+
+type flowRequest struct {
+	fid       uint64
+	signature string
+	writer    uint64
+	stageack  uint64
+	frags     []*fragment
+}
+
+func parseFlowRequest(r *xio.PacketReader) (*flowRequest, error) {
+	var err error
+	flags := uint8(0)
+	if flags, err = r.Read8(); err != nil {
+		return nil, errors.New("flow.read flags")
+	}
+	req := &flowRequest{}
+	if req.fid, err = r.Read7BitValue64(); err != nil {
+		return nil, errors.New("flow.read fid")
+	}
+	stage, delta := uint64(0), uint64(0)
+	if stage, err = r.Read7BitValue64(); err != nil {
+		return nil, errors.New("flow.read stage")
+	}
+	if delta, err = r.Read7BitValue64(); err != nil {
+		return nil, errors.New("flow.read delta")
+	}
+	if (flags & flagsHeader) != 0 {
+		// the signature is the first option, the server leaves it out once
+		// the flow has been acknowledged and sends only the terminator
+		for first := true; ; first = false {
+			if size, err := r.Read8(); err != nil {
+				return nil, errors.New("flow.read header content size")
+			} else if size == 0 {
+				break
+			} else if n := int(size); n > r.Len() {
+				return nil, errors.New("flow.too big header content size")
+			} else {
+				opt := make([]byte, n)
+				if err := r.ReadBytes(opt); err != nil {
+					return nil, errors.New("flow.read header content")
+				}
+				if first {
+					req.signature = string(opt)
+				} else if opt[0] == 0x0a {
+					if fid, err := xio.NewPacketReader(opt[1:]).Read7BitValue64(); err == nil {
+						req.writer = fid
+					}
+				}
+			}
+		}
+	}
+	req.stageack = stage - delta
+	req.frags = append(req.frags, &fragment{stage, flags &^ flagsHeader, r.Bytes(), 0})
+	return req, nil
+}
+
+func (req *flowRequest) AddSlice(r *xio.PacketReader) error {
+	if flags, err := r.Read8(); err != nil {
+		return errors.New("flow.read flags")
+	} else {
+		stage := req.frags[len(req.frags)-1].stage + 1
+		req.frags = append(req.frags, &fragment{stage, flags, r.Bytes(), 0})
+		return nil
+	}
+}
@@ -0,0 +1,291 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/rtmfp"
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+var (
+	cryptkey = []byte("Adobe Systems 02")
+)
+
+type handshake struct {
+	rtmfp.AESEngine
+	tag       []byte
+	cookie    []byte
+	dh        rtmfp.DHEngine
+	keys      []byte
+	initiator []byte
+	yid       uint32
+}
+
+func newHandshake() (*handshake, error) {
+	h := &handshake{}
+	h.AESEngine = rtmfp.NewAESEngine()
+	if err := h.SetKey(cryptkey, cryptkey); err != nil {
+		return nil, err
+	}
+	h.tag = make([]byte, 16)
+	if _, err := rand.Read(h.tag); err != nil {
+		return nil, err
+	}
+	if e, err := rtmfp.NewDHEngine(); err != nil {
+		return nil, err
+	} else {
+		h.dh = e
+	}
+	w := xio.NewPacketWriter(nil)
+	pubkey := h.dh.GetPublicKey()
+	w.Write7BitValue64(uint64(len(pubkey) + 2))
+	w.WriteBytes([]byte{0x1d, 0x02})
+	w.WriteBytes(pubkey)
+	h.keys = w.Bytes()
+
+	nonce := make([]byte, 64)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	w = xio.NewPacketWriter(nil)
+	w.WriteBytes([]byte{0x02, 0x1d, 0x02, 0x41, 0x0e})
+	w.WriteBytes(nonce)
+	w.WriteBytes([]byte{0x03, 0x1a, 0x02, 0x0a, 0x02, 0x1e, 0x02})
+	h.initiator = w.Bytes()
+
+	for rnd := xio.NewRandomReader(time.Now().UnixNano()); h.yid == 0; {
+		h.yid = rnd.Read32()
+	}
+	return h, nil
+}
+
+func (h *handshake) pid() string {
+	sum := sha256.Sum256(h.keys)
+	return string(sum[:])
+}
+
+func (h *handshake) newHelloMessage(url string) (*message, error) {
+	if len(url) == 0 || len(url) > 0xfd {
+		return nil, errors.New("hello.bad url")
+	}
+	w := xio.NewPacketWriter(nil)
+	if err := w.Write8(0); err != nil {
+		return nil, err
+	}
+	if err := w.Write8(uint8(len(url) + 1)); err != nil {
+		return nil, err
+	}
+	if err := w.Write8(0x0a); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBytes([]byte(url)); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBytes(h.tag); err != nil {
+		return nil, err
+	}
+	return newMessage(0x30, w), nil
+}
+
+// newIntroduceMessage asks for the addresses of the peer pid, as a peer
+// does before it handshakes with another one.
+func (h *handshake) newIntroduceMessage(pid string) (*message, error) {
+	if len(pid) != 0x20 {
+		return nil, errors.New("introduce.bad pid")
+	}
+	w := xio.NewPacketWriter(nil)
+	if err := w.Write8(0); err != nil {
+		return nil, err
+	}
+	if err := w.Write8(uint8(len(pid) + 1)); err != nil {
+		return nil, err
+	}
+	if err := w.Write8(0x0f); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBytes([]byte(pid)); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBytes(h.tag); err != nil {
+		return nil, err
+	}
+	return newMessage(0x30, w), nil
+}
+
+func (h *handshake) parseIntroduceResponse(r *xio.PacketReader) ([]*net.UDPAddr, error) {
+	if size, err := r.Read8(); err != nil {
+		return nil, errors.New("introduce.read tag.len")
+	} else {
+		tag := make([]byte, int(size))
+		if err := r.ReadBytes(tag); err != nil {
+			return nil, errors.New("introduce.read tag")
+		} else if !bytes.Equal(tag, h.tag) {
+			return nil, errors.New("introduce.unmatched tag")
+		}
+	}
+	var addrs []*net.UDPAddr
+	for r.Len() != 0 {
+		flag, err := r.Read8()
+		if err != nil {
+			return nil, errors.New("introduce.read addr.flag")
+		}
+		ip := make([]byte, net.IPv4len)
+		if flag&0x80 != 0 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if err := r.ReadBytes(ip); err != nil {
+			return nil, errors.New("introduce.read addr.ip")
+		}
+		port, err := r.Read16()
+		if err != nil {
+			return nil, errors.New("introduce.read addr.port")
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: net.IP(ip), Port: int(port)})
+	}
+	return addrs, nil
+}
+
+func (h *handshake) newAssignMessage() (*message, error) {
+	w := xio.NewPacketWriter(nil)
+	if err := w.Write32(h.yid); err != nil {
+		return nil, err
+	}
+	if err := w.Write7BitValue64(uint64(len(h.cookie))); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBytes(h.cookie); err != nil {
+		return nil, err
+	}
+	if err := w.Write7BitValue64(uint64(len(h.keys))); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBytes(h.keys); err != nil {
+		return nil, err
+	}
+	if err := w.Write7BitValue64(uint64(len(h.initiator))); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBytes(h.initiator); err != nil {
+		return nil, err
+	}
+	if err := w.Write8(0x58); err != nil {
+		return nil, err
+	}
+	return newMessage(0x38, w), nil
+}
+
+func (h *handshake) parseHelloResponse(r *xio.PacketReader) error {
+	if size, err := r.Read8(); err != nil {
+		return errors.New("hello.read tag.len")
+	} else {
+		tag := make([]byte, int(size))
+		if err := r.ReadBytes(tag); err != nil {
+			return errors.New("hello.read tag")
+		} else if !bytes.Equal(tag, h.tag) {
+			return errors.New("hello.unmatched tag")
+		}
+	}
+	if cookie, err := r.ReadString8(); err != nil {
+		return errors.New("hello.read cookie")
+	} else {
+		h.cookie = []byte(cookie)
+	}
+	return nil
+}
+
+func (h *handshake) parseAssignResponse(r *xio.PacketReader) (uint32, []byte, []byte, error) {
+	xid, err := r.Read32()
+	if err != nil {
+		return 0, nil, nil, errors.New("assign.read xid")
+	}
+	size := uint64(0)
+	if size, err = r.Read7BitValue64(); err != nil {
+		return 0, nil, nil, errors.New("assign.read responder.len")
+	} else if size > uint64(r.Len()) {
+		return 0, nil, nil, errors.New("assign.bad responder.len")
+	}
+	responder := make([]byte, int(size))
+	if err := r.ReadBytes(responder); err != nil {
+		return 0, nil, nil, errors.New("assign.read responder")
+	}
+	encrypt, decrypt, err := rtmfp.ComputeInitiatorKeys(h.dh, responder, h.initiator)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return xid, encrypt, decrypt, nil
+}
+
+func (h *handshake) exchange(conn *net.UDPConn, msg *message, code uint8, deadline time.Time) (*xio.PacketReader, error) {
+	pkt := &packet{0x0b, false, 0, 0, []rtmfp.ResponseMessage{msg}}
+	data, err := rtmfp.PacketToBytes(pkt)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = rtmfp.EncodePacket(h, 0, data); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2048)
+	for {
+		now := time.Now()
+		if !now.Before(deadline) {
+			return nil, errors.New(fmt.Sprintf("handshake.timeout, code = 0x%02x", code))
+		}
+		if _, err := conn.Write(data); err != nil {
+			return nil, err
+		}
+		retry := now.Add(time.Millisecond * 500)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+		conn.SetReadDeadline(retry)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if r, err := h.decode(buf[:n], code); err == nil {
+				conn.SetReadDeadline(time.Time{})
+				return r, nil
+			}
+		}
+	}
+}
+
+func (h *handshake) decode(data []byte, code uint8) (*xio.PacketReader, error) {
+	data = append([]byte{}, data...)
+	if xid, err := rtmfp.PacketXid(data); err != nil {
+		return nil, err
+	} else if xid != 0 && xid != h.yid {
+		return nil, errors.New("handshake.unmatched xid")
+	}
+	if _, err := rtmfp.DecodePacket(h, data); err != nil {
+		return nil, err
+	}
+	r := xio.NewPacketReader(data[6:])
+	if marker, err := r.Read8(); err != nil {
+		return nil, errors.New("packet.read marker")
+	} else if marker != 0x0b {
+		return nil, errors.New(fmt.Sprintf("packet.unknown marker = 0x%02x", marker))
+	}
+	if _, err := r.Read16(); err != nil {
+		return nil, errors.New("packet.read time")
+	}
+	if msg, err := rtmfp.ParseRequestMessage(r); err != nil {
+		return nil, err
+	} else if msg.Code != code {
+		return nil, errors.New(fmt.Sprintf("message.unexpected code = 0x%02x", msg.Code))
+	} else {
+		return msg.PacketReader, nil
+	}
+}
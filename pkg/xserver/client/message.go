@@ -0,0 +1,153 @@
+package client
+
+import (
+	"errors"
+	"strings"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/amf"
+	"github.com/spinlock/xserver/pkg/xserver/amf/amf0"
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+// Message is one message delivered by the server on a flow. Amf messages
+// (code 0x14, 0x11 and 0x0f) carry Name, Callback and the decoded Args; media
+// messages (0x08 and 0x09) carry Time and the raw body in Data; everything
+// else only has the raw body in Data.
+type Message struct {
+	Code     uint8
+	Name     string
+	Callback float64
+	Args     []interface{}
+	Time     uint32
+	Data     []byte
+}
+
+// Status returns the code of the first amf object argument, which is where
+// the server puts 'NetConnection.Connect.Success', 'NetStream.Play.Start' and
+// friends.
+func (m *Message) Status() (string, bool) {
+	for _, v := range m.Args {
+		if obj, ok := v.(*amf.Object); ok {
+			return obj.GetString("code")
+		}
+	}
+	return "", false
+}
+
+func (m *Message) terminal() bool {
+	switch m.Name {
+	case "_result", "_error":
+		return true
+	case "onStatus":
+		code, _ := m.Status()
+		return code != "NetStream.Play.Reset"
+	}
+	return false
+}
+
+func (m *Message) err() error {
+	if m.Name == "_error" {
+		if code, ok := m.Status(); ok {
+			return errors.New(code)
+		}
+		return errors.New("client.call failed")
+	}
+	if code, ok := m.Status(); ok {
+		for _, s := range []string{".Failed", ".BadName", ".Rejected"} {
+			if strings.HasSuffix(code, s) {
+				return errors.New(code)
+			}
+		}
+	}
+	return nil
+}
+
+func parseMessage(data []byte) (*Message, error) {
+	r := xio.NewPacketReader(data)
+	m := &Message{}
+	code, err := r.Read8()
+	if err != nil {
+		return nil, errors.New("message.read code")
+	}
+	m.Code = code
+	switch code {
+	default:
+		m.Data = r.Bytes()
+		return m, nil
+	case 0x08, 0x09:
+		if m.Time, err = r.Read32(); err != nil {
+			return nil, errors.New("message.read time")
+		}
+		m.Data = r.Bytes()
+		return m, nil
+	case 0x14:
+		if err := r.Skip(4); err != nil {
+			return nil, errors.New("message.skip useless")
+		}
+	case 0x11, 0x0f:
+		if err := r.Skip(5); err != nil {
+			return nil, errors.New("message.skip useless")
+		}
+	}
+	ar := amf0.NewReader(r)
+	if m.Name, err = ar.ReadString(); err != nil {
+		return nil, errors.New("message.amf.read name")
+	}
+	if code != 0x0f {
+		if m.Callback, err = ar.ReadNumber(); err != nil {
+			return nil, errors.New("message.amf.read callback")
+		}
+		if ar.Len() != 0 && ar.TestNull() {
+			if err := ar.ReadNull(); err != nil {
+				return nil, errors.New("message.amf.read null")
+			}
+		}
+	}
+	for ar.Len() != 0 {
+		if v, err := ar.Read(); err != nil {
+			m.Data = ar.Bytes()
+			break
+		} else {
+			m.Args = append(m.Args, v)
+		}
+	}
+	return m, nil
+}
+
+func newAmfMessage(name string, callback float64, args ...interface{}) ([]byte, error) {
+	w := amf0.NewWriter(xio.NewPacketWriter(nil))
+	if err := w.Write8(0x14); err != nil {
+		return nil, errors.New("message.amf.write code")
+	}
+	if err := w.Write32(0); err != nil {
+		return nil, errors.New("message.amf.write useless")
+	}
+	if err := w.WriteString(name); err != nil {
+		return nil, errors.New("message.amf.write name")
+	}
+	if err := w.WriteNumber(callback); err != nil {
+		return nil, errors.New("message.amf.write callback")
+	}
+	if err := w.WriteNull(); err != nil {
+		return nil, errors.New("message.amf.write null")
+	}
+	for _, v := range args {
+		if i, ok := v.(int); ok {
+			v = float64(i)
+		}
+		if err := w.Write(v); err != nil {
+			return nil, errors.New("message.amf.write argument")
+		}
+	}
+	return w.Bytes(), nil
+}
+
+func newMediaMessage(code uint8, time uint32, body []byte) []byte {
+	w := xio.NewPacketWriter(nil)
+	w.Write8(code)
+	w.Write32(time)
+	w.WriteBytes(body)
+	return w.Bytes()
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/rtmfp"
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+type packet struct {
+	marker   uint8
+	echotime bool
+	recvtime int64
+	stmptime uint16
+	msgs     []rtmfp.ResponseMessage
+}
+
+func (pkt *packet) Marker() uint8 {
+	return pkt.marker
+}
+
+func (pkt *packet) EchoTime() (bool, int64, uint16) {
+	return pkt.echotime, pkt.recvtime, pkt.stmptime
+}
+
+func (pkt *packet) Messages() []rtmfp.ResponseMessage {
+	return pkt.msgs
+}
+
+type message struct {
+	code uint8
+	data []byte
+}
+
+func (msg *message) Code() uint8 {
+	return msg.code
+}
+
+func (msg *message) WriteTo(w *xio.PacketWriter) error {
+	return w.WriteBytes(msg.data)
+}
+
+func (msg *message) Size() int {
+	return 3 + len(msg.data)
+}
+
+func newMessage(code uint8, w *xio.PacketWriter) *message {
+	if w == nil {
+		return &message{code, nil}
+	}
+	return &message{code, w.Bytes()}
+}
@@ -0,0 +1,50 @@
+package client
+
+// Stream is a NetStream created on the Client's NetConnection.
+type Stream struct {
+	c    *Client
+	sid  uint32
+	fw   *flowWriter
+	msgs chan *Message
+}
+
+func (s *Stream) Sid() uint32 {
+	return s.sid
+}
+
+// Messages delivers media, data and status messages received on this stream.
+// Messages are dropped if nobody reads.
+func (s *Stream) Messages() <-chan *Message {
+	return s.msgs
+}
+
+// Play subscribes to the named publication and waits for 'NetStream.Play.Start'.
+func (s *Stream) Play(name string) error {
+	_, err := s.c.call(s.fw, "play", name)
+	return err
+}
+
+// Publish starts the named publication and waits for 'NetStream.Publish.Start'.
+func (s *Stream) Publish(name string) error {
+	_, err := s.c.call(s.fw, "publish", name)
+	return err
+}
+
+// Send invokes name on every subscriber of the publication.
+func (s *Stream) Send(name string, args ...interface{}) error {
+	return s.c.invoke(s.fw, name, 0, args...)
+}
+
+// SendAudio and SendVideo publish one media message, body being the flv tag
+// payload.
+func (s *Stream) SendAudio(time uint32, body []byte) error {
+	return s.c.write(s.fw, true, newMediaMessage(0x08, time, body))
+}
+
+func (s *Stream) SendVideo(time uint32, body []byte) error {
+	return s.c.write(s.fw, true, newMediaMessage(0x09, time, body))
+}
+
+func (s *Stream) Close() error {
+	return s.c.invoke(s.fw, "closeStream", 0)
+}
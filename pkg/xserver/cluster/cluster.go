@@ -0,0 +1,668 @@
+// Package cluster lets a few xservers behind one address act as one. Every
+// node dials each of the others and tells them, over that link, which
+// sessions it holds; a node acting for one of its sessions sends what is
+// meant for a session of another node over the link to that node.
+//
+// The link a node dials carries its own messages only: it starts with a
+// hello, answered with the hello of the other side so that the dialer
+// learns whom it reached, then lists the sessions of the node, and goes on
+// with joins, exits, pings and the messages forwarded. The hello binds the
+// link to the node it names: a message on it naming any other is dropped.
+// A reconnect starts over with a hello and the full list, and so does a
+// link which had no room for a join or an exit; a node silent for
+// nodeTimeout loses its sessions in the directory of the others.
+//
+// Streams are listed the same way, by the node holding their master, and
+// pulled by the nodes playing them: see stream.go.
+package cluster
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/args"
+	"github.com/spinlock/xserver/pkg/xserver/counts"
+	"github.com/spinlock/xserver/pkg/xserver/tcp"
+	"github.com/spinlock/xserver/pkg/xserver/xlog"
+)
+
+const (
+	pingInterval = time.Second
+	nodeTimeout  = time.Second * 5
+)
+
+// Entry is a session held by a node.
+type Entry struct {
+	Node  uint8
+	Xid   uint32
+	Pid   string
+	Addrs []*net.UDPAddr
+}
+
+// Handler takes what the other nodes send to the sessions of this one.
+// It is called from the routines reading the links and should not block.
+//
+// Publish and Unpublish follow the master of a stream coming and going on
+// another node, Stream the data pulled from it, Resync that some of that
+// data was lost on the way, and Codecs returns the codec headers a puller
+// gets first, or again after a loss.
+type Handler interface {
+	Relay(pid string, data []byte)
+	Broadcast(xids []uint32, data []byte, reliable bool)
+	Introduce(pid string, tag []byte, raddr *net.UDPAddr)
+	Publish(name string)
+	Unpublish(name string)
+	Stream(name string, data []byte, reliable bool)
+	Resync(name string)
+	Codecs(name string) [][]byte
+}
+
+type link struct {
+	*tcp.Client
+	cluster *Cluster
+	addr    string
+	id      uint8
+	hello   bool
+}
+
+// subscriber is a node pulling a stream of this one. It renewed last at
+// lasttime, pending holds the reliable data its link had no room for yet,
+// and resync tells that some data was lost, so the codec headers go first.
+type subscriber struct {
+	lasttime int64
+	pending  [][]byte
+	resync   bool
+}
+
+type remote struct {
+	lasttime int64
+	xids     map[uint32]*Entry
+	streams  map[string]bool
+}
+
+// Cluster is the node a server makes of itself, or none while its id is 0.
+type Cluster struct {
+	id      uint8
+	handler Handler
+	srv     *tcp.Server
+	peers   map[*tcp.Peer]uint8
+	links   []*link
+	byid    map[uint8]*link
+	local   map[uint32]*Entry
+	nodes   map[uint8]*remote
+	byxid   map[uint32]*Entry
+	bypid   map[string]*Entry
+	streams struct {
+		local   map[string]bool
+		origins map[string]uint8
+		pulls   map[string]uint8
+		subs    map[string]map[uint8]*subscriber
+	}
+	counts *counts.Counts
+	logs   *xlog.Logs
+	quit   chan struct{}
+	done   sync.WaitGroup
+	sync.Mutex
+}
+
+func New(cnts *counts.Counts, logs *xlog.Logs) *Cluster {
+	c := &Cluster{}
+	c.counts, c.logs = cnts, logs
+	return c
+}
+
+// Start joins the cluster as node id, listening for the links of the other
+// nodes on port and dialing them at remotes, all of them secured by sec.
+// Node 0 stays out of any.
+func (c *Cluster) Start(id uint8, port uint16, remotes []args.Remote, sec *tcp.Security, handler Handler) error {
+	if id == 0 {
+		return nil
+	}
+	if sec == nil && (port != 0 || len(remotes) != 0) {
+		return errors.New("cluster.links need tls or a secret")
+	}
+	var srv *tcp.Server
+	if port != 0 {
+		var err error
+		if srv, err = tcp.ListenSecure(port, sec, c.counts, c.logs.TcpLog); err != nil {
+			return err
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.id, c.handler, c.srv = id, handler, srv
+	c.peers = make(map[*tcp.Peer]uint8)
+	c.byid = make(map[uint8]*link)
+	c.local = make(map[uint32]*Entry)
+	c.nodes = make(map[uint8]*remote)
+	c.byxid = make(map[uint32]*Entry)
+	c.bypid = make(map[string]*Entry)
+	c.streams.local = make(map[string]bool)
+	c.streams.origins = make(map[string]uint8)
+	c.streams.pulls = make(map[string]uint8)
+	c.streams.subs = make(map[string]map[uint8]*subscriber)
+	c.quit = make(chan struct{})
+	c.links = nil
+	for _, r := range remotes {
+		l := &link{cluster: c, addr: net.JoinHostPort(r.IP, strconv.Itoa(int(r.Port)))}
+		l.Client = tcp.DialHooks(r.IP, r.Port, sec, &tcp.Hooks{
+			Connect:    l.connect,
+			Disconnect: l.disconnect,
+		}, c.counts, c.logs.TcpLog)
+		c.links = append(c.links, l)
+		c.done.Add(1)
+		go l.serve()
+	}
+	if srv != nil {
+		c.done.Add(1)
+		go c.serve(srv)
+	}
+	c.done.Add(1)
+	go c.ping(c.quit)
+	log.Printf("[cluster]: node %d, listen port %d, nodes = %d\n", id, port, len(remotes))
+	return nil
+}
+
+func (c *Cluster) Stop() {
+	c.Lock()
+	if c.id == 0 {
+		c.Unlock()
+		return
+	}
+	srv, links := c.srv, c.links
+	close(c.quit)
+	c.id, c.handler, c.srv, c.links = 0, nil, nil, nil
+	c.peers, c.byid, c.local, c.nodes = nil, nil, nil, nil
+	c.byxid, c.bypid = nil, nil
+	c.streams.local, c.streams.origins = nil, nil
+	c.streams.pulls, c.streams.subs = nil, nil
+	c.Unlock()
+	if srv != nil {
+		srv.Close()
+	}
+	for _, l := range links {
+		l.Close()
+	}
+	c.done.Wait()
+}
+
+func (c *Cluster) Enabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.id != 0
+}
+
+// Node returns the id of this node, 0 out of a cluster.
+func (c *Cluster) Node() uint8 {
+	c.Lock()
+	defer c.Unlock()
+	return c.id
+}
+
+// connect returns the hello, the sessions and the streams of this node,
+// sent first on a new link.
+func (l *link) connect() [][]byte {
+	l.cluster.Lock()
+	defer l.cluster.Unlock()
+	if l.cluster.id == 0 {
+		return nil
+	}
+	l.hello = false
+	msgs := make([]*Message, 0, 1+len(l.cluster.local))
+	msgs = append(msgs, &Message{Code: CodeHello})
+	for _, e := range l.cluster.local {
+		msgs = append(msgs, &Message{Code: CodeJoin, Xid: e.Xid, Pid: e.Pid, Addrs: e.Addrs})
+	}
+	for name := range l.cluster.streams.local {
+		msgs = append(msgs, &Message{Code: CodePublish, Name: name})
+	}
+	bss := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		m.Node = l.cluster.id
+		if bs, err := Encode(m); err == nil {
+			bss = append(bss, bs)
+		}
+	}
+	l.cluster.counts.Count("cluster.link.up", 1)
+	return bss
+}
+
+func (l *link) disconnect() {
+	l.cluster.Lock()
+	if l.cluster.byid != nil && l.cluster.byid[l.id] == l {
+		delete(l.cluster.byid, l.id)
+	}
+	l.cluster.Unlock()
+	l.cluster.counts.Count("cluster.link.down", 1)
+	log.Printf("[cluster]: link to node %d [%s] is down\n", l.id, l.addr)
+}
+
+// serve reads the hellos the other side answers on the link.
+func (l *link) serve() {
+	defer l.cluster.done.Done()
+	for {
+		bs := l.Recv()
+		if len(bs) == 0 {
+			if l.Closed() {
+				return
+			}
+			continue
+		}
+		m, err := Decode(bs)
+		if err != nil {
+			l.cluster.counts.Count("cluster.decode.error", 1)
+			l.cluster.logs.ErrLog.Printf("[cluster]: decode error = '%v'\n", err)
+			continue
+		}
+		if m.Code != CodeHello || !l.cluster.valid(m.Node) {
+			continue
+		}
+		l.cluster.Lock()
+		if l.hello && l.id != m.Node {
+			l.cluster.Unlock()
+			l.cluster.counts.Count("cluster.node.mismatch", 1)
+			l.cluster.logs.ErrLog.Printf("[cluster]: hello from node %d on the link to node %d\n", m.Node, l.id)
+			continue
+		}
+		if l.cluster.byid != nil {
+			l.id, l.hello = m.Node, true
+			l.cluster.byid[m.Node] = l
+		}
+		l.cluster.Unlock()
+		l.cluster.counts.Count("cluster.node.up", 1)
+		log.Printf("[cluster]: link to node %d [%s] is up\n", m.Node, l.addr)
+	}
+}
+
+// valid tells whether a node may send to this one: not itself, which
+// would be a node listed in its own -nodes, nor the id of no node.
+func (c *Cluster) valid(id uint8) bool {
+	c.Lock()
+	defer c.Unlock()
+	return id != 0 && id != c.id
+}
+
+// serve reads the links of the other nodes.
+func (c *Cluster) serve(srv *tcp.Server) {
+	defer c.done.Done()
+	for {
+		p := srv.Recv()
+		if p == nil || len(p.Data) == 0 {
+			if srv.Closed() {
+				return
+			}
+			continue
+		}
+		m, err := Decode(p.Data)
+		if err != nil {
+			c.counts.Count("cluster.decode.error", 1)
+			c.logs.ErrLog.Printf("[cluster]: decode error = '%v'\n", err)
+			continue
+		}
+		if !c.valid(m.Node) {
+			c.counts.Count("cluster.node.invalid", 1)
+			c.logs.ErrLog.Printf("[cluster]: message from invalid node %d\n", m.Node)
+			continue
+		}
+		if !c.bind(p.From(), m.Node, m.Code == CodeHello) {
+			continue
+		}
+		if m.Code == CodeHello {
+			c.hello(m.Node)
+			if bs, err := Encode(&Message{Code: CodeHello, Node: c.Node()}); err == nil {
+				p.Reply(bs)
+			}
+			continue
+		}
+		if !c.seen(m.Node) {
+			c.counts.Count("cluster.node.unknown", 1)
+			continue
+		}
+		c.handle(m)
+	}
+}
+
+// bind ties from to the node of its first hello, and tells whether a
+// message naming id may be taken from it: not before a hello, nor naming
+// another node than the hello did.
+func (c *Cluster) bind(from *tcp.Peer, id uint8, hello bool) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.peers == nil {
+		return false
+	}
+	bound, ok := c.peers[from]
+	switch {
+	case ok && bound != id:
+		c.counts.Count("cluster.node.mismatch", 1)
+		c.logs.ErrLog.Printf("[cluster]: message from node %d on the link of node %d\n", id, bound)
+		return false
+	case !ok && !hello:
+		c.counts.Count("cluster.node.unknown", 1)
+		return false
+	case !ok:
+		c.peers[from] = id
+	}
+	return true
+}
+
+// hello forgets the sessions and the streams of id, as it is about to list
+// them again, and its pulls, as it pulls again within a ping.
+func (c *Cluster) hello(id uint8) {
+	c.Lock()
+	defer c.Unlock()
+	if c.nodes == nil {
+		return
+	}
+	if r := c.nodes[id]; r != nil {
+		c.drop(id, r)
+	}
+	c.unsubscribeAll(id)
+	c.nodes[id] = &remote{time.Now().UnixNano(), make(map[uint32]*Entry), make(map[string]bool)}
+	c.logs.SssLog.Printf("[cluster] hello node %d\n", id)
+}
+
+// seen notes that id is alive, unless it has not said hello yet.
+func (c *Cluster) seen(id uint8) bool {
+	c.Lock()
+	defer c.Unlock()
+	if r := c.nodes[id]; r != nil {
+		r.lasttime = time.Now().UnixNano()
+		return true
+	}
+	return false
+}
+
+func (c *Cluster) handle(m *Message) {
+	c.counts.Count("cluster.recv", 1)
+	switch m.Code {
+	case CodePing:
+	case CodeJoin:
+		c.Lock()
+		if r := c.nodes[m.Node]; r != nil {
+			if e := c.byxid[m.Xid]; e != nil {
+				c.forget(e)
+			}
+			e := &Entry{m.Node, m.Xid, m.Pid, m.Addrs}
+			r.xids[e.Xid] = e
+			c.byxid[e.Xid] = e
+			c.bypid[e.Pid] = e
+		}
+		c.Unlock()
+	case CodeExit:
+		c.Lock()
+		if e := c.byxid[m.Xid]; e != nil && e.Node == m.Node {
+			c.forget(e)
+		}
+		c.Unlock()
+	case CodeRelay:
+		if h := c.getHandler(); h != nil {
+			h.Relay(m.Pid, m.Data)
+		}
+	case CodeBroadcast:
+		if h := c.getHandler(); h != nil {
+			h.Broadcast(m.Xids, m.Data, m.Reliable)
+		}
+	case CodeIntroduce:
+		if h := c.getHandler(); h != nil && len(m.Addrs) != 0 {
+			h.Introduce(m.Pid, m.Tag, m.Addrs[0])
+		}
+	case CodePublish, CodeUnpublish, CodeSubscribe, CodeUnsubscribe, CodeStream, CodeResync:
+		c.handleStream(m)
+	default:
+		c.counts.Count("cluster.code.unknown", 1)
+	}
+}
+
+func (c *Cluster) getHandler() Handler {
+	c.Lock()
+	defer c.Unlock()
+	return c.handler
+}
+
+// forget removes e from the directory; the caller holds the lock.
+func (c *Cluster) forget(e *Entry) {
+	if r := c.nodes[e.Node]; r != nil {
+		delete(r.xids, e.Xid)
+	}
+	if c.byxid[e.Xid] == e {
+		delete(c.byxid, e.Xid)
+	}
+	if c.bypid[e.Pid] == e {
+		delete(c.bypid, e.Pid)
+	}
+}
+
+// drop forgets the sessions and the streams of r, and returns the streams
+// whose master was on r.
+func (c *Cluster) drop(id uint8, r *remote) []string {
+	for _, e := range r.xids {
+		c.forget(e)
+	}
+	names := make([]string, 0, len(r.streams))
+	for name := range r.streams {
+		if c.unorigin(id, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ping tells the other nodes this one is alive, and drops those which
+// have been silent too long.
+func (c *Cluster) ping(quit <-chan struct{}) {
+	defer c.done.Done()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(pingInterval):
+		}
+		c.sendAll(&Message{Code: CodePing})
+		c.resubscribe()
+		c.repush()
+		expired := time.Now().UnixNano() - int64(nodeTimeout)
+		var gone []string
+		c.Lock()
+		for id, r := range c.nodes {
+			if r.lasttime < expired {
+				gone = append(gone, c.drop(id, r)...)
+				c.unsubscribeAll(id)
+				c.unpullAll(id)
+				delete(c.nodes, id)
+				c.counts.Count("cluster.node.timeout", 1)
+				c.logs.SssLog.Printf("[cluster] timeout node %d\n", id)
+			}
+		}
+		c.expire(expired)
+		for from := range c.peers {
+			if from.Closed() {
+				delete(c.peers, from)
+			}
+		}
+		h := c.handler
+		c.Unlock()
+		if h != nil {
+			for _, name := range gone {
+				h.Unpublish(name)
+			}
+		}
+	}
+}
+
+// send queues m on the link to id, and tells whether it could.
+func (c *Cluster) send(id uint8, m *Message) bool {
+	c.Lock()
+	l := c.byid[id]
+	m.Node = c.id
+	c.Unlock()
+	if l == nil {
+		c.counts.Count("cluster.send.nolink", 1)
+		return false
+	}
+	return c.offer(l, m)
+}
+
+func (c *Cluster) sendAll(m *Message) {
+	c.Lock()
+	links := c.links
+	m.Node = c.id
+	c.Unlock()
+	for _, l := range links {
+		c.offer(l, m)
+	}
+}
+
+// offer never blocks: a link too slow to keep up loses messages. One which
+// loses a message of the directory is reset, and starts over with it all.
+func (c *Cluster) offer(l *link, m *Message) bool {
+	bs := c.encode(m)
+	if bs == nil {
+		return false
+	}
+	if !l.Offer(bs) {
+		c.counts.Count("cluster.send.full", 1)
+		switch m.Code {
+		case CodeJoin, CodeExit, CodePublish, CodeUnpublish:
+			c.counts.Count("cluster.link.reset", 1)
+			l.Reset()
+		}
+		return false
+	}
+	c.counts.Count("cluster.send", 1)
+	return true
+}
+
+func (c *Cluster) encode(m *Message) []byte {
+	bs, err := Encode(m)
+	if err != nil {
+		c.counts.Count("cluster.encode.error", 1)
+		c.logs.ErrLog.Printf("[cluster]: encode error = '%v'\n", err)
+		return nil
+	}
+	return bs
+}
+
+// Join tells the other nodes that this one holds the session xid, or that
+// its addresses have changed.
+func (c *Cluster) Join(xid uint32, pid string, addrs []*net.UDPAddr) {
+	c.Lock()
+	if c.id == 0 {
+		c.Unlock()
+		return
+	}
+	c.local[xid] = &Entry{c.id, xid, pid, addrs}
+	c.Unlock()
+	c.counts.Count("cluster.join", 1)
+	c.sendAll(&Message{Code: CodeJoin, Xid: xid, Pid: pid, Addrs: addrs})
+}
+
+func (c *Cluster) Exit(xid uint32) {
+	c.Lock()
+	if c.id == 0 || c.local[xid] == nil {
+		c.Unlock()
+		return
+	}
+	delete(c.local, xid)
+	c.Unlock()
+	c.counts.Count("cluster.exit", 1)
+	c.sendAll(&Message{Code: CodeExit, Xid: xid})
+}
+
+// Find returns the session of pid held by another node.
+func (c *Cluster) Find(pid string) *Entry {
+	c.Lock()
+	defer c.Unlock()
+	if e := c.bypid[pid]; e != nil {
+		x := *e
+		return &x
+	}
+	return nil
+}
+
+// Relay sends data to the session of pid on the node holding it, and tells
+// whether there is one.
+func (c *Cluster) Relay(pid string, data []byte) bool {
+	e := c.Find(pid)
+	if e == nil {
+		return false
+	}
+	c.counts.Count("cluster.relay", 1)
+	return c.send(e.Node, &Message{Code: CodeRelay, Pid: pid, Data: data})
+}
+
+// Broadcast sends data to the sessions of xids held by other nodes, once
+// to each node, and returns how many were found.
+func (c *Cluster) Broadcast(xids []uint32, data []byte, reliable bool) int {
+	bynode := make(map[uint8][]uint32)
+	c.Lock()
+	for _, xid := range xids {
+		if e := c.byxid[xid]; e != nil {
+			bynode[e.Node] = append(bynode[e.Node], xid)
+		}
+	}
+	c.Unlock()
+	n := 0
+	for id, xids := range bynode {
+		c.counts.Count("cluster.broadcast", 1)
+		c.send(id, &Message{Code: CodeBroadcast, Xids: xids, Data: data, Reliable: reliable})
+		n += len(xids)
+	}
+	return n
+}
+
+// Introduce returns the addresses of the session of pid held by another
+// node, and has that node tell the session that raddr wants to reach it.
+func (c *Cluster) Introduce(pid string, tag []byte, raddr *net.UDPAddr) ([]*net.UDPAddr, bool) {
+	e := c.Find(pid)
+	if e == nil || len(e.Addrs) == 0 {
+		return nil, false
+	}
+	c.counts.Count("cluster.introduce", 1)
+	c.send(e.Node, &Message{Code: CodeIntroduce, Pid: pid, Tag: tag, Addrs: []*net.UDPAddr{raddr}})
+	return e.Addrs, true
+}
+
+// Summary describes the nodes heard from and the sessions they hold.
+func (c *Cluster) Summary() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+	nodes := make(map[string]interface{}, len(c.nodes))
+	for id, r := range c.nodes {
+		_, linked := c.byid[id]
+		nodes[strconv.Itoa(int(id))] = map[string]interface{}{
+			"sessions": len(r.xids),
+			"streams":  len(r.streams),
+			"lasttime": r.lasttime,
+			"linked":   linked,
+		}
+	}
+	pushes := 0
+	for _, subs := range c.streams.subs {
+		pushes += len(subs)
+	}
+	return map[string]interface{}{
+		"node":     c.id,
+		"sessions": len(c.local),
+		"nodes":    nodes,
+		"streams": map[string]interface{}{
+			"published": len(c.streams.local),
+			"pulls":     len(c.streams.pulls),
+			"pushes":    pushes,
+		},
+	}
+}
+
+// Nodes returns how many other nodes are alive, and how many sessions they
+// hold in all.
+func (c *Cluster) Nodes() (int, int) {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.nodes), len(c.byxid)
+}
@@ -0,0 +1,176 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+const (
+	CodeHello     = 'H'
+	CodePing      = 'P'
+	CodeJoin      = 'J'
+	CodeExit      = 'X'
+	CodeRelay     = 'R'
+	CodeBroadcast = 'B'
+	CodeIntroduce = 'I'
+
+	CodePublish     = 'U'
+	CodeUnpublish   = 'u'
+	CodeSubscribe   = 'S'
+	CodeUnsubscribe = 's'
+	CodeStream      = 'D'
+	CodeResync      = 'r'
+)
+
+// Message is what nodes send each other, from Node. Which fields matter
+// depends on the code:
+//
+//	hello      the link is from Node, what follows replaces its sessions
+//	ping       Node is alive
+//	join       Node holds the session Xid of Pid, reachable at Addrs
+//	exit       the session Xid is gone
+//	relay      Data to the session of Pid
+//	broadcast  Data to the sessions Xids, Reliable or not
+//	introduce  Addrs[0] wants to reach Pid, with the handshake Tag
+//
+//	publish      Node holds the master of the stream Name
+//	unpublish    the master of Name is gone
+//	subscribe    Node plays Name and pulls it, again every ping
+//	unsubscribe  Node no longer plays Name
+//	stream       Data of the stream Name, Reliable or not
+//	resync       data of Name was lost, its codec headers follow
+//
+// Every field is written, in order, whatever the code, so that a message
+// stays readable by a node which does not know its code; a field added
+// goes last, and is left empty when reading what an older node wrote.
+type Message struct {
+	Code     uint8
+	Node     uint8
+	Xid      uint32
+	Xids     []uint32
+	Pid      string
+	Addrs    []*net.UDPAddr
+	Tag      []byte
+	Reliable bool
+	Data     []byte
+	Name     string
+}
+
+func Encode(m *Message) ([]byte, error) {
+	w := xio.NewPacketWriter(nil)
+	if err := w.Write8(m.Code); err != nil {
+		return nil, err
+	}
+	if err := w.Write8(m.Node); err != nil {
+		return nil, err
+	}
+	if err := w.Write32(m.Xid); err != nil {
+		return nil, err
+	}
+	if err := w.Write32(uint32(len(m.Xids))); err != nil {
+		return nil, err
+	}
+	for _, xid := range m.Xids {
+		if err := w.Write32(xid); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.WriteString16(m.Pid); err != nil {
+		return nil, err
+	}
+	if err := w.Write8(uint8(len(m.Addrs))); err != nil {
+		return nil, err
+	}
+	for _, addr := range m.Addrs {
+		if err := w.WriteString8(addr.String()); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.WriteString8(string(m.Tag)); err != nil {
+		return nil, err
+	}
+	reliable := uint8(0)
+	if m.Reliable {
+		reliable = 1
+	}
+	if err := w.Write8(reliable); err != nil {
+		return nil, err
+	}
+	if err := w.WriteString32(string(m.Data)); err != nil {
+		return nil, err
+	}
+	if err := w.WriteString16(m.Name); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func Decode(bs []byte) (*Message, error) {
+	r := xio.NewPacketReader(bs)
+	m := &Message{}
+	var err error
+	if m.Code, err = r.Read8(); err != nil {
+		return nil, errors.New("cluster.read code")
+	}
+	if m.Node, err = r.Read8(); err != nil {
+		return nil, errors.New("cluster.read node")
+	}
+	if m.Xid, err = r.Read32(); err != nil {
+		return nil, errors.New("cluster.read xid")
+	}
+	if n, err := r.Read32(); err != nil || int(n) > r.Len()/4 {
+		return nil, errors.New("cluster.read xids.len")
+	} else if n != 0 {
+		m.Xids = make([]uint32, n)
+		for i := 0; i < len(m.Xids); i++ {
+			if m.Xids[i], err = r.Read32(); err != nil {
+				return nil, errors.New("cluster.read xids")
+			}
+		}
+	}
+	if m.Pid, err = r.ReadString16(); err != nil {
+		return nil, errors.New("cluster.read pid")
+	}
+	if n, err := r.Read8(); err != nil {
+		return nil, errors.New("cluster.read addrs.len")
+	} else {
+		for i := 0; i < int(n); i++ {
+			if s, err := r.ReadString8(); err != nil {
+				return nil, errors.New("cluster.read addrs")
+			} else if addr, err := net.ResolveUDPAddr("udp", s); err != nil {
+				return nil, errors.New(fmt.Sprintf("cluster.bad addr = '%s'", s))
+			} else {
+				m.Addrs = append(m.Addrs, addr)
+			}
+		}
+	}
+	if tag, err := r.ReadString8(); err != nil {
+		return nil, errors.New("cluster.read tag")
+	} else if len(tag) != 0 {
+		m.Tag = []byte(tag)
+	}
+	if reliable, err := r.Read8(); err != nil {
+		return nil, errors.New("cluster.read reliable")
+	} else {
+		m.Reliable = reliable != 0
+	}
+	if n, err := r.Read32(); err != nil || int(n) > r.Len() {
+		return nil, errors.New("cluster.read data.len")
+	} else if n != 0 {
+		m.Data = make([]byte, n)
+		if err := r.ReadBytes(m.Data); err != nil {
+			return nil, errors.New("cluster.read data")
+		}
+	}
+	if r.Len() != 0 {
+		if m.Name, err = r.ReadString16(); err != nil {
+			return nil, errors.New("cluster.read name")
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,332 @@
+package cluster
+
+import (
+	"time"
+)
+
+// A node publishing a stream, its origin, lists it to the other nodes as
+// it does its sessions. A node playing a stream published elsewhere, an
+// edge, subscribes to the origin and gets the data of the stream from it,
+// once whatever the players of the edge, until the last one leaves. An
+// edge subscribes again every ping, and the origin drops the subscribers
+// which have not for nodeTimeout, so that lost messages and reconnects
+// cost at most a few seconds of data. Data lost to a full link is made up
+// for by a resync, which has the players of the edge wait for a keyframe
+// behind the codec headers sent again.
+
+// Publish tells the other nodes that this one holds the master of name,
+// which it stops pulling if it did.
+func (c *Cluster) Publish(name string) {
+	c.Lock()
+	if c.id == 0 {
+		c.Unlock()
+		return
+	}
+	c.streams.local[name] = true
+	c.Unlock()
+	c.Unpull(name)
+	c.counts.Count("cluster.stream.publish", 1)
+	c.sendAll(&Message{Code: CodePublish, Name: name})
+}
+
+func (c *Cluster) Unpublish(name string) {
+	c.Lock()
+	if c.id == 0 || !c.streams.local[name] {
+		c.Unlock()
+		return
+	}
+	delete(c.streams.local, name)
+	delete(c.streams.subs, name)
+	c.Unlock()
+	c.counts.Count("cluster.stream.unpublish", 1)
+	c.sendAll(&Message{Code: CodeUnpublish, Name: name})
+}
+
+// Stream sends data of name, published on this node, to the nodes pulling
+// it.
+func (c *Cluster) Stream(name string, data []byte, reliable bool) {
+	c.push(name, &Message{Code: CodeStream, Name: name, Data: data, Reliable: reliable})
+}
+
+// maxPending bounds the reliable data kept for a subscriber whose link is
+// full, past which it is lost as the rest.
+const maxPending = 1024
+
+// push hands m, data of name, to the links of its subscribers, behind what
+// is pending for each, or only sends what is pending if m is nil. Reliable
+// data a link has no room for waits for the next push, other data is lost,
+// and a subscriber which lost some gets a resync and the codec headers
+// before anything else.
+func (c *Cluster) push(name string, m *Message) {
+	c.Lock()
+	subs := c.streams.subs[name]
+	n, resync := len(subs), false
+	for _, sub := range subs {
+		resync = resync || sub.resync
+	}
+	node, h := c.id, c.handler
+	c.Unlock()
+	if n == 0 {
+		return
+	}
+	var bs []byte
+	if m != nil {
+		m.Node = node
+		if bs = c.encode(m); bs == nil {
+			return
+		}
+	}
+	var codecs [][]byte
+	if resync {
+		msgs := []*Message{{Code: CodeResync, Node: node, Name: name}}
+		if h != nil {
+			for _, data := range h.Codecs(name) {
+				msgs = append(msgs, &Message{Code: CodeStream, Node: node, Name: name, Data: data, Reliable: true})
+			}
+		}
+		for _, msg := range msgs {
+			if b := c.encode(msg); b != nil {
+				codecs = append(codecs, b)
+			}
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	for id, sub := range c.streams.subs[name] {
+		if sub.resync {
+			if !resync {
+				continue
+			}
+			sub.pending, sub.resync = append([][]byte(nil), codecs...), false
+		}
+		l := c.byid[id]
+		if l == nil {
+			c.counts.Count("cluster.send.nolink", 1)
+			continue
+		}
+		for len(sub.pending) != 0 && l.Offer(sub.pending[0]) {
+			sub.pending = sub.pending[1:]
+			c.counts.Count("cluster.send", 1)
+		}
+		if len(sub.pending) == 0 {
+			sub.pending = nil
+		}
+		switch {
+		case bs == nil:
+		case len(sub.pending) == 0 && l.Offer(bs):
+			c.counts.Count("cluster.send", 1)
+		case m.Reliable && len(sub.pending) < maxPending:
+			sub.pending = append(sub.pending, bs)
+			c.counts.Count("cluster.stream.pending", 1)
+		default:
+			sub.pending, sub.resync = nil, true
+			c.counts.Count("cluster.stream.lost", 1)
+		}
+	}
+}
+
+// repush sends the data left pending, and the resyncs owed, to the
+// subscribers of streams which have not pushed anything since.
+func (c *Cluster) repush() {
+	c.Lock()
+	var names []string
+	for name, subs := range c.streams.subs {
+		for _, sub := range subs {
+			if sub.resync || len(sub.pending) != 0 {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	c.Unlock()
+	for _, name := range names {
+		c.push(name, nil)
+	}
+}
+
+// Origin returns the node holding the master of name, 0 if none does but
+// this one.
+func (c *Cluster) Origin(name string) uint8 {
+	c.Lock()
+	defer c.Unlock()
+	return c.streams.origins[name]
+}
+
+// Pull subscribes to name on its origin, unless it does already, and
+// tells whether there is one.
+func (c *Cluster) Pull(name string) bool {
+	c.Lock()
+	id := c.streams.origins[name]
+	if id == 0 {
+		c.Unlock()
+		return false
+	}
+	if c.streams.pulls[name] == id {
+		c.Unlock()
+		return true
+	}
+	c.streams.pulls[name] = id
+	c.Unlock()
+	c.counts.Count("cluster.stream.pull", 1)
+	c.logs.SssLog.Printf("[cluster] pull %s from node %d\n", name, id)
+	c.send(id, &Message{Code: CodeSubscribe, Name: name})
+	return true
+}
+
+// Unpull stops pulling name, as its last player has left.
+func (c *Cluster) Unpull(name string) {
+	c.Lock()
+	id := c.streams.pulls[name]
+	if id == 0 {
+		c.Unlock()
+		return
+	}
+	delete(c.streams.pulls, name)
+	c.Unlock()
+	c.counts.Count("cluster.stream.unpull", 1)
+	c.logs.SssLog.Printf("[cluster] unpull %s from node %d\n", name, id)
+	c.send(id, &Message{Code: CodeUnsubscribe, Name: name})
+}
+
+func (c *Cluster) handleStream(m *Message) {
+	switch m.Code {
+	case CodePublish:
+		c.Lock()
+		r := c.nodes[m.Node]
+		if r != nil {
+			r.streams[m.Name] = true
+			c.streams.origins[m.Name] = m.Node
+		}
+		h := c.handler
+		c.Unlock()
+		if r != nil && h != nil {
+			h.Publish(m.Name)
+		}
+	case CodeUnpublish:
+		c.Lock()
+		ok := false
+		if r := c.nodes[m.Node]; r != nil {
+			delete(r.streams, m.Name)
+			if ok = c.unorigin(m.Node, m.Name); ok && c.streams.pulls[m.Name] == m.Node {
+				delete(c.streams.pulls, m.Name)
+			}
+		}
+		h := c.handler
+		c.Unlock()
+		if ok && h != nil {
+			h.Unpublish(m.Name)
+		}
+	case CodeSubscribe:
+		c.Lock()
+		ok, first := c.streams.local[m.Name], false
+		if ok {
+			subs := c.streams.subs[m.Name]
+			if subs == nil {
+				subs = make(map[uint8]*subscriber)
+				c.streams.subs[m.Name] = subs
+			}
+			sub := subs[m.Node]
+			if first = sub == nil; first {
+				sub = &subscriber{resync: true}
+				subs[m.Node] = sub
+			}
+			sub.lasttime = time.Now().UnixNano()
+		}
+		c.Unlock()
+		if !ok {
+			c.counts.Count("cluster.stream.notfound", 1)
+			return
+		}
+		if first {
+			c.counts.Count("cluster.stream.subscribe", 1)
+			c.logs.SssLog.Printf("[cluster] node %d pulls %s\n", m.Node, m.Name)
+			c.push(m.Name, nil)
+		}
+	case CodeUnsubscribe:
+		c.Lock()
+		if subs := c.streams.subs[m.Name]; subs != nil {
+			delete(subs, m.Node)
+		}
+		c.Unlock()
+		c.counts.Count("cluster.stream.unsubscribe", 1)
+	case CodeStream:
+		c.Lock()
+		ok := c.streams.pulls[m.Name] == m.Node
+		h := c.handler
+		c.Unlock()
+		if ok && h != nil {
+			h.Stream(m.Name, m.Data, m.Reliable)
+		}
+	case CodeResync:
+		c.Lock()
+		ok := c.streams.pulls[m.Name] == m.Node
+		h := c.handler
+		c.Unlock()
+		if ok && h != nil {
+			c.counts.Count("cluster.stream.resync", 1)
+			h.Resync(m.Name)
+		}
+	}
+}
+
+// resubscribe renews the subscriptions of this node on the origins.
+func (c *Cluster) resubscribe() {
+	c.Lock()
+	pulls := make(map[string]uint8, len(c.streams.pulls))
+	for name, id := range c.streams.pulls {
+		pulls[name] = id
+	}
+	c.Unlock()
+	for name, id := range pulls {
+		c.send(id, &Message{Code: CodeSubscribe, Name: name})
+	}
+}
+
+// The helpers below are called with the lock held.
+
+func (c *Cluster) unorigin(id uint8, name string) bool {
+	if c.streams.origins[name] != id {
+		return false
+	}
+	delete(c.streams.origins, name)
+	return true
+}
+
+func (c *Cluster) unsubscribeAll(id uint8) {
+	for _, subs := range c.streams.subs {
+		delete(subs, id)
+	}
+}
+
+func (c *Cluster) unpullAll(id uint8) {
+	for name, origin := range c.streams.pulls {
+		if origin == id {
+			delete(c.streams.pulls, name)
+		}
+	}
+}
+
+// expire drops the subscribers which have not renewed since expired.
+func (c *Cluster) expire(expired int64) {
+	for name, subs := range c.streams.subs {
+		for id, sub := range subs {
+			if sub.lasttime < expired {
+				delete(subs, id)
+				c.counts.Count("cluster.stream.expire", 1)
+				c.logs.SssLog.Printf("[cluster] node %d no longer pulls %s\n", id, name)
+			}
+		}
+	}
+}
+
+// Streams returns how many streams this node pulls from the others, and
+// how many it pushes to them, once per node.
+func (c *Cluster) Streams() (int, int) {
+	c.Lock()
+	defer c.Unlock()
+	pushes := 0
+	for _, subs := range c.streams.subs {
+		pushes += len(subs)
+	}
+	return len(c.streams.pulls), pushes
+}
@@ -0,0 +1,57 @@
+package xserver
+
+import (
+	"github.com/golang/protobuf/proto"
+
+	"github.com/spinlock/xserver/pkg/xserver/rpc"
+)
+
+// control runs the request of x other than broadcast and close, and returns
+// the reply to send back, or nil when x has none of them. As the reply has
+// room for the result of one request only, x is rejected, and nothing run,
+// when it has more than one.
+func (s *Server) control(x *rpc.XMessage) *rpc.XReply {
+	n := 0
+	for _, set := range []bool{x.Kick != nil, x.Push != nil, x.Query != nil, x.Members != nil, x.Unpublish != nil} {
+		if set {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	s.counts.Count("rpc.control", 1)
+	id := x.GetId()
+	r := &rpc.XReply{Id: &id}
+	if n != 1 {
+		s.counts.Count("rpc.control.rejected", 1)
+		s.logs.ErrLog.Printf("[control]: id = %d, %d requests in one message, rejected\n", id, n)
+		r.Rejected = proto.Bool(true)
+		return r
+	}
+	if k := x.Kick; k != nil {
+		pids := make([]string, len(k.Pids))
+		for i, pid := range k.Pids {
+			pids[i] = string(pid)
+		}
+		r.Xids = append(r.Xids, s.sessions.KickByPid(pids)...)
+		r.Xids = append(r.Xids, s.sessions.KickByAddr(k.Addrs)...)
+	}
+	if p := x.Push; p != nil {
+		if s.sessions.Push(p.GetXid(), p.GetName(), p.GetCallback(), p.Data, p.GetReliable()) {
+			r.Xids = append(r.Xids, p.GetXid())
+		}
+	}
+	if q := x.Query; q != nil {
+		r.Xids = append(r.Xids, s.sessions.Alive(q.Xids)...)
+	}
+	if m := x.Members; m != nil {
+		master, slaves, found := s.sessions.Members(m.GetStream())
+		r.Found, r.Master, r.Slaves = &found, &master, slaves
+	}
+	if u := x.Unpublish; u != nil {
+		master, found := s.sessions.Unpublish(u.GetStream())
+		r.Found, r.Master = &found, &master
+	}
+	return r
+}
@@ -14,79 +14,107 @@ const (
 	CookieSize = 0x40
 )
 
-var cookies struct {
+// Cookies are the cookies a server has handed out in hellos and not seen
+// an assign for yet.
+type Cookies struct {
 	values map[string]*Cookie
+	counts *counts.Counts
+	quit   chan struct{}
+	done   sync.WaitGroup
 	sync.Mutex
 }
 
-func init() {
-	cookies.values = make(map[string]*Cookie, 16384)
-	go func() {
+func New(c *counts.Counts) *Cookies {
+	cs := &Cookies{counts: c}
+	cs.values = make(map[string]*Cookie, 16384)
+	return cs
+}
+
+func (cs *Cookies) Start() {
+	cs.quit = make(chan struct{})
+	cs.done.Add(1)
+	go func(quit <-chan struct{}) {
+		defer cs.done.Done()
 		for {
 			limit := time.Now().UnixNano() - int64(time.Minute)*5
 			count := 0
-			cookies.Lock()
-			for value, cookie := range cookies.values {
+			cs.Lock()
+			for value, cookie := range cs.values {
 				if cookie.alloctime < limit {
-					delete(cookies.values, value)
+					delete(cs.values, value)
 					count++
 				}
 			}
-			cookies.Unlock()
+			cs.Unlock()
 			if count != 0 {
-				counts.Count("cookie.timeout", count)
+				cs.counts.Count("cookie.timeout", count)
+			}
+			select {
+			case <-quit:
+				return
+			case <-time.After(time.Second * 15):
 			}
-			time.Sleep(time.Second * 15)
 		}
-	}()
+	}(cs.quit)
+}
+
+func (cs *Cookies) Stop() {
+	if cs.quit != nil {
+		close(cs.quit)
+		cs.done.Wait()
+		cs.quit = nil
+	}
+	cs.Lock()
+	cs.values = make(map[string]*Cookie, 16384)
+	cs.Unlock()
 }
 
-func Count() int {
-	cookies.Lock()
-	n := len(cookies.values)
-	cookies.Unlock()
+func (cs *Cookies) Count() int {
+	cs.Lock()
+	n := len(cs.values)
+	cs.Unlock()
 	return n
 }
 
-func New() *Cookie {
-	cookies.Lock()
-	defer cookies.Unlock()
+func (cs *Cookies) New() *Cookie {
+	cs.Lock()
+	defer cs.Unlock()
 	now := time.Now().UnixNano()
 	buf := make([]byte, CookieSize)
-	for i, v := 0, now; i < 8; i, v = i + 1, v >> 8 {
+	for i, v := 0, now; i < 8; i, v = i+1, v>>8 {
 		buf[i] = uint8(v)
 	}
 	rnd := xio.NewRandomReader(now)
 	for i := 0; i < 4; i++ {
 		rnd.ReadBytes(buf[8:])
 		value := string(buf)
-		if c := cookies.values[value]; c != nil {
+		if c := cs.values[value]; c != nil {
 			continue
 		}
 		c := &Cookie{}
 		c.value = value
 		c.alloctime = now
-		cookies.values[value] = c
-		counts.Count("cookie.new", 1)
+		cs.values[value] = c
+		cs.counts.Count("cookie.new", 1)
 		return c
 	}
-	counts.Count("cookie.null", 1)
+	cs.counts.Count("cookie.null", 1)
 	return nil
 }
 
-func Find(value string) *Cookie {
-	cookies.Lock()
-	c := cookies.values[value]
-	cookies.Unlock()
+func (cs *Cookies) Find(value string) *Cookie {
+	cs.Lock()
+	c := cs.values[value]
+	cs.Unlock()
 	if c == nil {
-		counts.Count("cookie.notfound", 1)
+		cs.counts.Count("cookie.notfound", 1)
 	}
 	return c
 }
 
-func Commit(value string) {
-	cookies.Lock()
-	delete(cookies.values, value)
-	cookies.Unlock()
-	counts.Count("cookie.commit", 1)
+func (cs *Cookies) Commit(value string) {
+	cs.Lock()
+	delete(cs.values, value)
+	cs.Unlock()
+	cs.counts.Count("cookie.commit", 1)
 }
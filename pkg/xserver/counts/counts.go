@@ -6,25 +6,52 @@ import (
 	"time"
 )
 
-var counts struct {
+type Sink func(key string, cnt int)
+
+// Counts keeps the counters and histograms of a server. A nil *Counts
+// counts nothing, for the packages used apart from a server.
+type Counts struct {
 	buckets [128]struct {
-		vmap map[string]int64
+		vmap  map[string]int64
+		total map[string]int64
+		sync.Mutex
+	}
+	snapshot   map[string]int64
+	histograms struct {
+		list []*Histogram
 		sync.Mutex
 	}
-	snapshot map[string]int64
+	sink Sink
+	quit chan struct{}
+	done sync.WaitGroup
+	sync.Mutex
 }
 
-func init() {
-	for i := 0; i < len(counts.buckets); i++ {
-		counts.buckets[i].vmap = make(map[string]int64)
+func New(sink Sink) *Counts {
+	c := &Counts{}
+	for i := 0; i < len(c.buckets); i++ {
+		c.buckets[i].vmap = make(map[string]int64)
+		c.buckets[i].total = make(map[string]int64)
 	}
-	counts.snapshot = make(map[string]int64)
-	go func() {
+	c.snapshot = make(map[string]int64)
+	c.sink = sink
+	return c
+}
+
+func (c *Counts) Start() {
+	c.quit = make(chan struct{})
+	c.done.Add(1)
+	go func(quit <-chan struct{}) {
+		defer c.done.Done()
 		for {
-			time.Sleep(time.Minute)
+			select {
+			case <-quit:
+				return
+			case <-time.After(time.Minute):
+			}
 			list := list.New()
-			for i := 0; i < len(counts.buckets); i++ {
-				b := &counts.buckets[i]
+			for i := 0; i < len(c.buckets); i++ {
+				b := &c.buckets[i]
 				b.Lock()
 				if len(b.vmap) != 0 {
 					list.PushBack(b.vmap)
@@ -38,19 +65,53 @@ func init() {
 					sum[k] += v
 				}
 			}
-			counts.snapshot = sum
+			c.Lock()
+			c.snapshot = sum
+			c.Unlock()
 		}
-	}()
+	}(c.quit)
 }
 
-func Count(key string, cnt int) {
-	idx := uint16(time.Now().UnixNano()) % uint16(len(counts.buckets))
-	b := &counts.buckets[idx]
+func (c *Counts) Stop() {
+	if c.quit != nil {
+		close(c.quit)
+		c.done.Wait()
+		c.quit = nil
+	}
+}
+
+func (c *Counts) Count(key string, cnt int) {
+	if c == nil {
+		return
+	}
+	idx := uint16(time.Now().UnixNano()) % uint16(len(c.buckets))
+	b := &c.buckets[idx]
 	b.Lock()
 	b.vmap[key] += int64(cnt)
+	b.total[key] += int64(cnt)
 	b.Unlock()
+	if sink := c.sink; sink != nil {
+		sink(key, cnt)
+	}
 }
 
-func Snapshot() map[string]int64 {
-	return counts.snapshot
+func (c *Counts) Snapshot() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.snapshot
+}
+
+// Totals returns the sum of every Count since the server started. Unlike
+// Snapshot the values never reset, which is what /metrics exports.
+func (c *Counts) Totals() map[string]int64 {
+	sum := make(map[string]int64)
+	for i := 0; i < len(c.buckets); i++ {
+		b := &c.buckets[i]
+		b.Lock()
+		for k, v := range b.total {
+			sum[k] += v
+		}
+		b.Unlock()
+	}
+	return sum
 }
@@ -0,0 +1,77 @@
+package counts
+
+import (
+	"sort"
+	"sync"
+)
+
+// Histogram counts observations into cumulative buckets with the given upper
+// bounds, the way /metrics exports them.
+type Histogram struct {
+	name   string
+	bounds []float64
+	values []uint64
+	count  uint64
+	sum    float64
+	sync.Mutex
+}
+
+// NewHistogram registers a histogram of c, or returns the one registered
+// under name already, which the observers of a kind share. A nil *Counts
+// returns a nil *Histogram, which observes nothing.
+func (c *Counts) NewHistogram(name string, bounds ...float64) *Histogram {
+	if c == nil {
+		return nil
+	}
+	c.histograms.Lock()
+	defer c.histograms.Unlock()
+	for _, h := range c.histograms.list {
+		if h.name == name {
+			return h
+		}
+	}
+	h := &Histogram{}
+	h.name = name
+	h.bounds = append([]float64{}, bounds...)
+	sort.Float64s(h.bounds)
+	h.values = make([]uint64, len(h.bounds))
+	c.histograms.list = append(c.histograms.list, h)
+	return h
+}
+
+func (h *Histogram) Name() string {
+	return h.name
+}
+
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	idx := sort.SearchFloat64s(h.bounds, v)
+	h.Lock()
+	if idx < len(h.values) {
+		h.values[idx]++
+	}
+	h.count++
+	h.sum += v
+	h.Unlock()
+}
+
+// Snapshot returns the bucket bounds with the cumulative count of each, and
+// the total count and sum of all observations.
+func (h *Histogram) Snapshot() ([]float64, []uint64, uint64, float64) {
+	h.Lock()
+	defer h.Unlock()
+	values := make([]uint64, len(h.values))
+	for i, acc := 0, uint64(0); i < len(h.values); i++ {
+		acc += h.values[i]
+		values[i] = acc
+	}
+	return h.bounds, values, h.count, h.sum
+}
+
+func (c *Counts) Histograms() []*Histogram {
+	c.histograms.Lock()
+	defer c.histograms.Unlock()
+	return append([]*Histogram{}, c.histograms.list...)
+}
@@ -0,0 +1,229 @@
+package e2e
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/golang/protobuf/proto"
+
+	"github.com/spinlock/xserver/pkg/xserver/amf/amf0"
+	"github.com/spinlock/xserver/pkg/xserver/rpc"
+	"github.com/spinlock/xserver/pkg/xserver/tcp"
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+// Backend stands in for the rpc server that xserver dials with -remote. It
+// records every XRequest and answers the ones carrying a callback by echoing
+// their data back, so a client 'request' returns its own arguments. An 'auth'
+// request is accepted unless the tcUrl of the connect object asks for 'deny'.
+// Every request is acknowledged, unless NoAck was called, and a replayed one
+// is skipped by its seq.
+type Backend struct {
+	ln    *net.TCPListener
+	reqs  chan *rpc.XRequest
+	sec   *tcp.Security
+	conns map[*net.TCPConn]bool
+	seqs  map[uint64]uint64
+	dups  int
+	noack bool
+	quit  chan struct{}
+	done  sync.WaitGroup
+	sync.Mutex
+}
+
+// NewBackend listens on loopback, accepting only the peers passing sec when
+// it is not nil.
+func NewBackend(sec *tcp.Security) (*Backend, error) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	b := &Backend{}
+	b.ln = ln
+	b.sec = sec
+	b.reqs = make(chan *rpc.XRequest, 4096)
+	b.conns = make(map[*net.TCPConn]bool)
+	b.seqs = make(map[uint64]uint64)
+	b.quit = make(chan struct{})
+	b.done.Add(1)
+	go b.accept()
+	return b, nil
+}
+
+func (b *Backend) Addr() string {
+	return b.ln.Addr().String()
+}
+
+// Requests delivers the decoded XRequests in the order they were received,
+// and is closed by Close.
+func (b *Backend) Requests() <-chan *rpc.XRequest {
+	return b.reqs
+}
+
+// Drop closes the connections from the server, which will dial again.
+func (b *Backend) Drop() {
+	b.Lock()
+	defer b.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// NoAck has the backend stop acknowledging requests, as an older one would.
+func (b *Backend) NoAck() {
+	b.Lock()
+	defer b.Unlock()
+	b.noack = true
+}
+
+// Duplicates is the number of replayed requests which had been handled.
+func (b *Backend) Duplicates() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.dups
+}
+
+// handled tells whether x was already seen, or records it otherwise.
+func (b *Backend) handled(x *rpc.XRequest) bool {
+	b.Lock()
+	defer b.Unlock()
+	if x.GetSeq() <= b.seqs[x.GetEpoch()] {
+		b.dups++
+		return true
+	}
+	b.seqs[x.GetEpoch()] = x.GetSeq()
+	return false
+}
+
+func (b *Backend) acking() bool {
+	b.Lock()
+	defer b.Unlock()
+	return !b.noack
+}
+
+func (b *Backend) Close() {
+	close(b.quit)
+	b.ln.Close()
+	b.Lock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.Unlock()
+	b.done.Wait()
+	close(b.reqs)
+}
+
+func (b *Backend) accept() {
+	defer b.done.Done()
+	for {
+		conn, err := b.ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		b.Lock()
+		b.conns[conn] = true
+		b.Unlock()
+		b.done.Add(1)
+		go func() {
+			defer b.done.Done()
+			b.serve(conn)
+			b.Lock()
+			delete(b.conns, conn)
+			b.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (b *Backend) serve(tc *net.TCPConn) {
+	conn, err := tcp.Secure(tc, b.sec, true)
+	if err != nil {
+		return
+	}
+	for {
+		data, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		x := &rpc.XRequest{}
+		if err := proto.Unmarshal(data, x); err != nil {
+			continue
+		}
+		rsp := &rpc.XResponse{}
+		rsp.Xid, rsp.Callback, rsp.Reliable = new(uint32), new(float64), new(bool)
+		if b.acking() {
+			rsp.Ack = x.Seq
+		}
+		if !b.handled(x) {
+			select {
+			case b.reqs <- x:
+			case <-b.quit:
+				return
+			}
+			switch x.GetCode() {
+			case "call":
+				if x.GetCallback() != 0 && len(x.Data) != 0 {
+					rsp.Xid, rsp.Callback, rsp.Reliable = x.Xid, x.Callback, x.Reliable
+					rsp.Data = x.Data
+				}
+			case "auth":
+				rsp.Xid, rsp.Callback, rsp.Reliable = x.Xid, x.Callback, x.Reliable
+				rsp.Data = authorize(x.Data)
+			}
+		}
+		if bs, err := proto.Marshal(rsp); err != nil {
+			continue
+		} else if err := writeFrame(conn, bs); err != nil {
+			return
+		}
+	}
+}
+
+func authorize(data []byte) []byte {
+	accept, reason := true, ""
+	if obj, err := amf0.NewReader(xio.NewPacketReader(data)).ReadObject(); err != nil {
+		accept, reason = false, "bad connect object"
+	} else if tcUrl, _ := obj.GetString("tcUrl"); strings.Contains(tcUrl, "deny") {
+		accept, reason = false, "denied by backend"
+	}
+	w := amf0.NewWriter(xio.NewPacketWriter(nil))
+	w.WriteBoolean(accept)
+	if !accept {
+		w.WriteString(reason)
+	}
+	return w.Bytes()
+}
+
+func readFrame(conn net.Conn) ([]byte, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(head) != 0xdeadbeaf {
+		return nil, errors.New("backend.bad magic")
+	}
+	size := binary.BigEndian.Uint32(head[4:])
+	if size > tcp.MaxPacketSize {
+		return nil, errors.New("backend.too big frame")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeFrame(conn net.Conn, data []byte) error {
+	buf := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(buf, 0xdeadbeaf)
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(data)))
+	copy(buf[8:], data)
+	_, err := conn.Write(buf)
+	return err
+}
@@ -0,0 +1,1630 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/golang/protobuf/proto"
+
+	"github.com/spinlock/xserver/pkg/xserver"
+	"github.com/spinlock/xserver/pkg/xserver/amf/amf0"
+	"github.com/spinlock/xserver/pkg/xserver/auth"
+	"github.com/spinlock/xserver/pkg/xserver/client"
+	"github.com/spinlock/xserver/pkg/xserver/cluster"
+	"github.com/spinlock/xserver/pkg/xserver/rpc"
+	"github.com/spinlock/xserver/pkg/xserver/tcp"
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+// cases run each against a server of its own, which must not count any
+// error on the way.
+var cases = []Case{
+	{"connect", testConnect, nil},
+	{"publish-play", testPublishPlay, nil},
+	{"relay", testRelay, nil},
+	{"broadcast", testBroadcast, nil},
+	{"proxy-send", testProxySend, nil},
+	{"request", testRequest, nil},
+	{"ipv6", testIPv6, nil},
+	{"auth-hmac", testAuthHMAC, configAuthHMAC},
+	{"auth-rpc", testAuthRPC, configAuthRPC},
+	{"auth-pipelined", testAuthPipelined, configAuthRPC},
+	{"rpc-replay", testReplay, nil},
+	{"rpc-replay-unacked", testReplayUnacked, nil},
+	{"rpc-failover", testFailover, nil},
+	{"secure-link", testSecureLink, nil},
+	{"control", testControl, nil},
+	{"admin", testAdmin, nil},
+	{"migrate", testMigrate, nil},
+	{"lossy-relay", testLossyRelay, nil},
+	{"lossy-proxy-send", testLossyProxySend, nil},
+	{"ack-ranges", testAckRanges, nil},
+	{"congestion", testCongestion, nil},
+	{"recovery", testRecovery, nil},
+	{"credit", testCredit, nil},
+	{"overrun", testOverrun, nil},
+	{"backlog", testBacklog, nil},
+	{"backlog-main", testBacklogMain, nil},
+	{"async", testAsync, nil},
+	{"cluster", testCluster, nil},
+	{"cluster-stream", testClusterStream, nil},
+	{"cluster-bind", testClusterBind, nil},
+	{"drain", testDrain, nil},
+}
+
+var lossy = Link{Loss: 0.1, Reorder: 0.1, Duplicate: 0.1}
+
+func testConnect(e *Env) error {
+	hello, assign := e.Count("handshake.hello"), e.Count("handshake.assign")
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	if code, _ := c.Info().GetString("code"); code != "NetConnection.Connect.Success" {
+		return errors.New(fmt.Sprintf("connect code = '%s'", code))
+	}
+	if sid, _ := c.Info().GetNumber("sessionId"); uint32(sid) != c.Xid() {
+		return errors.New(fmt.Sprintf("sessionId = %v, xid = %d", sid, c.Xid()))
+	}
+	if e.Count("handshake.hello") <= hello || e.Count("handshake.assign") <= assign {
+		return errors.New("handshake not counted")
+	}
+	if _, err := e.expect(c.Xid(), "join"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func testPublishPlay(e *Env) error {
+	a, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	b, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	pub, err := a.CreateStream()
+	if err != nil {
+		return err
+	}
+	if err := pub.Publish("e2e-publish-play"); err != nil {
+		return err
+	}
+	sub, err := b.CreateStream()
+	if err != nil {
+		return err
+	}
+	if err := sub.Play("e2e-publish-play"); err != nil {
+		return err
+	}
+	video := payload(5000, 0x17)
+	if err := pub.SendVideo(40, video); err != nil {
+		return err
+	}
+	if err := pub.SendAudio(50, []byte{0xaf, 0x01, 0x02}); err != nil {
+		return err
+	}
+	const n = 20
+	for i := 0; i < n; i++ {
+		if err := pub.Send("onSeq", i); err != nil {
+			return err
+		}
+	}
+	if m, err := e.recv(sub.Messages(), func(m *client.Message) bool { return m.Code == 0x09 }); err != nil {
+		return err
+	} else if m.Time != 40 || !bytes.Equal(m.Data, video) {
+		return errors.New(fmt.Sprintf("video time = %d, len = %d", m.Time, len(m.Data)))
+	}
+	if m, err := e.recv(sub.Messages(), func(m *client.Message) bool { return m.Code == 0x08 }); err != nil {
+		return err
+	} else if m.Time != 50 {
+		return errors.New(fmt.Sprintf("audio time = %d", m.Time))
+	}
+	return e.sequence(sub.Messages(), "onSeq", 0, n)
+}
+
+func testRelay(e *Env) error {
+	return relay(e, e.Addr(), 100, 100)
+}
+
+func testLossyRelay(e *Env) error {
+	p, err := e.NewProxy(lossy, lossy)
+	if err != nil {
+		return err
+	}
+	if err := relay(e, p.Addr(), 100, 2500); err != nil {
+		return err
+	}
+	if s := p.Stats(); s.Dropped == 0 || s.Reordered == 0 || s.Duplicated == 0 {
+		return errors.New(fmt.Sprintf("proxy injected nothing, stats = %+v", s))
+	}
+	return nil
+}
+
+// relay sends n messages of size bytes from one client to another and checks
+// they arrive once each, in order and intact.
+func relay(e *Env, addr string, n int, size int) error {
+	a, err := e.Dial(addr)
+	if err != nil {
+		return err
+	}
+	b, err := e.Dial(addr)
+	if err != nil {
+		return err
+	}
+	data := string(payload(size, 0))
+	for i := 0; i < n; i++ {
+		if err := a.Relay(b.Pid(), float64(i), data); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < n; i++ {
+		m, err := e.recv(b.Messages(), func(m *client.Message) bool { return m.Name == "onRelay" })
+		if err != nil {
+			return errors.New(fmt.Sprintf("relay %d/%d: %v", i, n, err))
+		}
+		if len(m.Args) != 3 {
+			return errors.New(fmt.Sprintf("relay args = %d", len(m.Args)))
+		}
+		if pid, _ := m.Args[0].(string); pid != a.Pid() {
+			return errors.New(fmt.Sprintf("relay from = %s", pid))
+		}
+		if seq, _ := m.Args[1].(float64); int(seq) != i {
+			return errors.New(fmt.Sprintf("relay seq = %v, expect %d", m.Args[1], i))
+		}
+		if s, _ := m.Args[2].(string); s != data {
+			return errors.New(fmt.Sprintf("relay %d corrupted, len = %d", i, len(s)))
+		}
+	}
+	return nil
+}
+
+func testBroadcast(e *Env) error {
+	var cs []*client.Client
+	for i := 0; i < 3; i++ {
+		c, err := e.Dial(e.Addr())
+		if err != nil {
+			return err
+		}
+		cs = append(cs, c)
+	}
+	xids := fmt.Sprintf("%d_%d", cs[1].Xid(), cs[2].Xid())
+	if err := cs[0].Send("broadcastBySessionId", xids, "hello"); err != nil {
+		return err
+	}
+	for _, c := range cs[1:] {
+		m, err := e.recv(c.Messages(), func(m *client.Message) bool { return m.Name == "broadcastBySessionId" })
+		if err != nil {
+			return err
+		}
+		if len(m.Args) != 2 || m.Args[0] != "hello" || m.Args[1] != float64(cs[0].Xid()) {
+			return errors.New(fmt.Sprintf("broadcast args = %v", m.Args))
+		}
+	}
+	return nil
+}
+
+func testProxySend(e *Env) error {
+	return proxySend(e, e.Addr(), 50)
+}
+
+func testLossyProxySend(e *Env) error {
+	p, err := e.NewProxy(lossy, lossy)
+	if err != nil {
+		return err
+	}
+	return proxySend(e, p.Addr(), 100)
+}
+
+// proxySend checks the backend gets n 'proxySend' calls once each, in the
+// order the client made them.
+func proxySend(e *Env, addr string, n int) error {
+	c, err := e.Dial(addr)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := c.Send("proxySend", float64(i)); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < n; i++ {
+		x, err := e.expect(c.Xid(), "call")
+		if err != nil {
+			return errors.New(fmt.Sprintf("proxySend %d/%d: %v", i, n, err))
+		}
+		if x.GetCallback() != 0 || !x.GetReliable() {
+			return errors.New(fmt.Sprintf("proxySend callback = %v, reliable = %v", x.GetCallback(), x.GetReliable()))
+		}
+		if v, err := amf0.NewReader(xio.NewPacketReader(x.Data)).ReadNumber(); err != nil {
+			return err
+		} else if int(v) != i {
+			return errors.New(fmt.Sprintf("proxySend seq = %v, expect %d", v, i))
+		}
+	}
+	return nil
+}
+
+func testRequest(e *Env) error {
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	m, err := c.Call("request", "ping", float64(7))
+	if err != nil {
+		return err
+	}
+	if len(m.Args) != 2 || m.Args[0] != "ping" || m.Args[1] != float64(7) {
+		return errors.New(fmt.Sprintf("request result = %v", m.Args))
+	}
+	return nil
+}
+
+// testIPv6 connects one client over ::1 and one over 127.0.0.1 and relays
+// between them. Hosts without an ipv6 loopback pass trivially.
+func testIPv6(e *Env) error {
+	if conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		return nil
+	} else {
+		conn.Close()
+	}
+	a, err := e.Dial(net.JoinHostPort("::1", strconv.Itoa(int(e.port))))
+	if err != nil {
+		return err
+	}
+	b, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	if addr, _ := a.Info().GetString("address"); !strings.HasPrefix(addr, "[::1]:") {
+		return errors.New(fmt.Sprintf("ipv6 address = '%s'", addr))
+	}
+	if addr, _ := b.Info().GetString("address"); !strings.HasPrefix(addr, "127.0.0.1:") {
+		return errors.New(fmt.Sprintf("ipv4 address = '%s'", addr))
+	}
+	if x, err := e.expect(a.Xid(), "join"); err != nil {
+		return err
+	} else if addr, _ := a.Info().GetString("address"); x.GetAddr() != addr {
+		return errors.New(fmt.Sprintf("rpc addr = '%s', expect '%s'", x.GetAddr(), addr))
+	}
+	if err := a.Relay(b.Pid(), "v6"); err != nil {
+		return err
+	}
+	if m, err := e.recv(b.Messages(), func(m *client.Message) bool { return m.Name == "onRelay" }); err != nil {
+		return err
+	} else if len(m.Args) != 2 || m.Args[1] != "v6" {
+		return errors.New(fmt.Sprintf("relay args = %v", m.Args))
+	}
+	return nil
+}
+
+var hmacSecret = []byte("e2e-secret")
+
+func configAuthHMAC(cfg *xserver.Config) {
+	cfg.Authorizer = auth.NewHMAC(hmacSecret, []string{app})
+}
+
+func configAuthRPC(cfg *xserver.Config) {
+	cfg.Auth = "rpc"
+}
+
+// testAuthHMAC runs with an hmac authorizer: a signed token is accepted and
+// a connect without one is rejected.
+func testAuthHMAC(e *Env) error {
+	token := auth.SignToken(hmacSecret, app, time.Now().Add(time.Minute))
+	if _, err := e.DialQuery(e.Addr(), "token="+url.QueryEscape(token)); err != nil {
+		return err
+	}
+	return e.rejected("")
+}
+
+// testAuthRPC runs with an rpc authorizer, which the fake backend answers.
+func testAuthRPC(e *Env) error {
+	asks := e.Count("rpc.ask")
+	if c, err := e.DialQuery(e.Addr(), "user=a"); err != nil {
+		return err
+	} else if _, err := e.expect(c.Xid(), "auth"); err != nil {
+		return err
+	}
+	if err := e.rejected("user=deny"); err != nil {
+		return err
+	}
+	if e.Count("rpc.ask") < asks+2 {
+		return errors.New("rpc ask not counted")
+	}
+	return nil
+}
+
+// testAuthPipelined has a client create a stream right behind its connect,
+// which the rpc authorizer answers later: the call waits for the answer
+// rather than fail, and the stream plays.
+func testAuthPipelined(e *Env) error {
+	addr := e.Addr()
+	c, connected, err := client.DialAsync(addr, "rtmfp://"+addr+"/"+app+"?user=a", e.Timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	s, err := c.CreateStream()
+	if err != nil {
+		return err
+	}
+	if err := s.Play("e2e-pipelined"); err != nil {
+		return err
+	}
+	if err := connected(); err != nil {
+		return err
+	}
+	if e.Count("flow.reader.refused") != 0 {
+		return errors.New("flow refused")
+	}
+	return nil
+}
+
+// testReplay drops the links to every backend, then makes a request which
+// can only be answered once the server has dialed again and replayed it.
+func testReplay(e *Env) error {
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	if _, err := e.expect(c.Xid(), "join"); err != nil {
+		return err
+	}
+	replays := e.Count("rpc.replay")
+	for _, b := range e.Backends() {
+		b.Drop()
+	}
+	m, err := c.Call("request", "replay")
+	if err != nil {
+		return err
+	}
+	if len(m.Args) != 1 || m.Args[0] != "replay" {
+		return errors.New(fmt.Sprintf("request result = %v", m.Args))
+	}
+	if e.Count("rpc.replay") <= replays {
+		return errors.New("replay not counted")
+	}
+	return nil
+}
+
+// testReplayUnacked is testReplay against backends which never ack, whose
+// requests are replayed all the same.
+func testReplayUnacked(e *Env) error {
+	for _, b := range e.Backends() {
+		b.NoAck()
+	}
+	return testReplay(e)
+}
+
+// testFailover drops the backend a client joined: the client joins the
+// other backend at once, where its requests go from then on.
+func testFailover(e *Env) error {
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	b, _, err := e.expectFrom(c.Xid(), "join")
+	if err != nil {
+		return err
+	}
+	b.Drop()
+	if to, _, err := e.expectFrom(c.Xid(), "join"); err != nil {
+		return err
+	} else if to == b {
+		return errors.New("joined the dropped backend again")
+	}
+	m, err := c.Call("request", "failover")
+	if err != nil {
+		return err
+	}
+	if len(m.Args) != 1 || m.Args[0] != "failover" {
+		return errors.New(fmt.Sprintf("request result = %v", m.Args))
+	}
+	if e.Count("rpc.failover") == 0 {
+		return errors.New("failover not counted")
+	}
+	return nil
+}
+
+// testSecureLink closes a session through the -listen port: a peer without
+// the certificate and secret is turned away, one with them is obeyed.
+func testSecureLink(e *Env) error {
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	if _, err := e.expect(c.Xid(), "join"); err != nil {
+		return err
+	}
+	msg := &rpc.XMessage{Close: &rpc.XMessage_Close{Xids: []uint32{c.Xid()}}}
+	bs, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(e.listen)}
+
+	rejected := e.Count("tcp.accept.unauthorized")
+	if conn, err := net.DialTCP("tcp", nil, addr); err != nil {
+		return err
+	} else {
+		writeFrame(conn, bs)
+		conn.Close()
+	}
+	if err := e.counted("tcp.accept.unauthorized", rejected); err != nil {
+		return errors.New("plain peer not rejected")
+	}
+	if _, err := c.Call("request", "alive"); err != nil {
+		return err
+	}
+
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	secured, err := tcp.Secure(conn, e.sec, false)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(secured, bs); err != nil {
+		return err
+	}
+	if _, err := e.expect(c.Xid(), "exit"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// testControl drives a publisher and a player through the requests the
+// backend may send over the -listen port, checking every reply.
+func testControl(e *Env) error {
+	a, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	b, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	pub, err := a.CreateStream()
+	if err != nil {
+		return err
+	}
+	if err := pub.Publish("e2e-control"); err != nil {
+		return err
+	}
+	sub, err := b.CreateStream()
+	if err != nil {
+		return err
+	}
+	if err := sub.Play("e2e-control"); err != nil {
+		return err
+	}
+	control, err := e.control()
+	if err != nil {
+		return err
+	}
+
+	both := &rpc.XMessage{
+		Query:     &rpc.XMessage_Query{Xids: []uint32{a.Xid()}},
+		Unpublish: &rpc.XMessage_Unpublish{Stream: proto.String("e2e-control")},
+	}
+	if r, err := control(both); err != nil {
+		return err
+	} else if !r.GetRejected() || len(r.Xids) != 0 || r.Found != nil {
+		return errors.New(fmt.Sprintf("query and unpublish = %v", r))
+	}
+
+	if r, err := control(&rpc.XMessage{Query: &rpc.XMessage_Query{Xids: []uint32{a.Xid(), 0xffffffff, b.Xid()}}}); err != nil {
+		return err
+	} else if fmt.Sprint(r.Xids) != fmt.Sprint([]uint32{a.Xid(), b.Xid()}) {
+		return errors.New(fmt.Sprintf("query alive = %v", r.Xids))
+	}
+
+	members := &rpc.XMessage{Members: &rpc.XMessage_Members{Stream: proto.String("e2e-control")}}
+	if r, err := control(members); err != nil {
+		return err
+	} else if !r.GetFound() || r.GetMaster() != a.Xid() || fmt.Sprint(r.Slaves) != fmt.Sprint([]uint32{b.Xid()}) {
+		return errors.New(fmt.Sprintf("members = %v", r))
+	}
+
+	w := amf0.NewWriter(xio.NewPacketWriter(nil))
+	if err := w.WriteString("pushed"); err != nil {
+		return err
+	}
+	push := &rpc.XMessage{Push: &rpc.XMessage_Push{Xid: proto.Uint32(b.Xid()), Name: proto.String("onControl"), Data: w.Bytes(), Reliable: proto.Bool(true)}}
+	if r, err := control(push); err != nil {
+		return err
+	} else if len(r.Xids) != 1 {
+		return errors.New(fmt.Sprintf("push to = %v", r.Xids))
+	}
+	if m, err := e.recv(b.Messages(), func(m *client.Message) bool { return m.Name == "onControl" }); err != nil {
+		return err
+	} else if len(m.Args) != 1 || m.Args[0] != "pushed" {
+		return errors.New(fmt.Sprintf("push args = %v", m.Args))
+	}
+
+	if r, err := control(&rpc.XMessage{Unpublish: &rpc.XMessage_Unpublish{Stream: proto.String("e2e-control")}}); err != nil {
+		return err
+	} else if !r.GetFound() || r.GetMaster() != a.Xid() {
+		return errors.New(fmt.Sprintf("unpublish = %v", r))
+	}
+	if _, err := e.recv(sub.Messages(), func(m *client.Message) bool {
+		code, _ := m.Status()
+		return code == "NetStream.Play.UnpublishNotify"
+	}); err != nil {
+		return err
+	}
+
+	pid, err := hex.DecodeString(b.Pid())
+	if err != nil {
+		return err
+	}
+	kick := &rpc.XMessage{Kick: &rpc.XMessage_Kick{Pids: [][]byte{pid}, Addrs: []string{a.LocalAddr().String()}}}
+	if r, err := control(kick); err != nil {
+		return err
+	} else if len(r.Xids) != 2 {
+		return errors.New(fmt.Sprintf("kicked = %v", r.Xids))
+	}
+	exits := map[uint32]bool{a.Xid(): true, b.Xid(): true}
+	timeout := time.After(e.Timeout)
+	for len(exits) != 0 {
+		select {
+		case r := <-e.reqs:
+			if r.x.GetCode() == "exit" {
+				delete(exits, r.x.GetXid())
+			}
+		case <-timeout:
+			return errors.New(fmt.Sprintf("backend timeout, no exit of %v", exits))
+		}
+	}
+	return nil
+}
+
+// testMigrate moves a client behind a proxy to another port, which the
+// server must validate before following it, then replays one of its packets
+// from a spoofed source, which must not take the session away.
+func testMigrate(e *Env) error {
+	p, err := e.NewProxy(Link{}, Link{})
+	if err != nil {
+		return err
+	}
+	c, err := e.Dial(p.Addr())
+	if err != nil {
+		return err
+	}
+	join, err := e.expect(c.Xid(), "join")
+	if err != nil {
+		return err
+	}
+	captured := make(chan []byte, 1)
+	p.SetFilter(func(up bool, data []byte) bool {
+		if up {
+			select {
+			case captured <- append([]byte{}, data...):
+			default:
+			}
+		}
+		return false
+	})
+	if err := c.Send("setAddressChangeInform"); err != nil {
+		return err
+	}
+	if _, err := c.Call("request", "before"); err != nil {
+		return err
+	}
+
+	migrated := e.Count("session.migrate")
+	if err := p.Rebind(); err != nil {
+		return err
+	}
+	if _, err := c.Call("request", "after"); err != nil {
+		return err
+	}
+	x, err := e.expect(c.Xid(), "migrate")
+	if err != nil {
+		return err
+	}
+	if string(x.Data) != join.GetAddr() || x.GetAddr() == join.GetAddr() {
+		return errors.New(fmt.Sprintf("migrate from [%s] to [%s], joined from [%s]", x.Data, x.GetAddr(), join.GetAddr()))
+	}
+	if m, err := e.recv(c.Messages(), func(m *client.Message) bool { return m.Name == "onIPChange" }); err != nil {
+		return err
+	} else if len(m.Args) != 1 || m.Args[0] != x.GetAddr() {
+		return errors.New(fmt.Sprintf("onIPChange args = %v", m.Args))
+	}
+	if e.Count("session.migrate") != migrated+1 {
+		return errors.New("migration not counted")
+	}
+
+	spoof, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(e.port)})
+	if err != nil {
+		return err
+	}
+	defer spoof.Close()
+	probes := e.Count("session.migrate.probe")
+	if _, err := spoof.Write(<-captured); err != nil {
+		return err
+	}
+	spoof.SetReadDeadline(time.Now().Add(e.Timeout))
+	if _, err := spoof.Read(make([]byte, 2048)); err != nil {
+		return errors.New(fmt.Sprintf("no probe on the spoofed path, error = '%v'", err))
+	}
+	if err := e.counted("session.migrate.probe", probes); err != nil {
+		return err
+	}
+	if _, err := c.Call("request", "still"); err != nil {
+		return err
+	}
+	if e.Count("session.migrate") != migrated+1 {
+		return errors.New("spoofed path taken")
+	}
+	return nil
+}
+
+const adminToken = "e2e-admin-token"
+
+// testAdmin looks a session up, pushes to it and closes it through the http
+// admin endpoints.
+func testAdmin(e *Env) error {
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	if _, err := e.expect(c.Xid(), "join"); err != nil {
+		return err
+	}
+	xid := strconv.Itoa(int(c.Xid()))
+	if code, _, err := e.admin("GET", "/admin/session?xid="+xid, "", nil, "wrong"); err != nil {
+		return err
+	} else if code != 403 {
+		return errors.New(fmt.Sprintf("wrong token, status = %d", code))
+	}
+
+	var found []map[string]interface{}
+	if code, body, err := e.admin("GET", "/admin/session?xid="+xid, "", nil, adminToken); err != nil {
+		return err
+	} else if code != 200 || json.Unmarshal(body, &found) != nil || len(found) != 1 || found[0]["pid"] != c.Pid() {
+		return errors.New(fmt.Sprintf("session, status = %d, body = %s", code, body))
+	}
+
+	var page struct {
+		Total    int
+		Sessions []map[string]interface{}
+	}
+	if code, body, err := e.admin("GET", "/admin/sessions?limit=1&addr="+url.QueryEscape(c.LocalAddr().String()), "", nil, adminToken); err != nil {
+		return err
+	} else if code != 200 || json.Unmarshal(body, &page) != nil || page.Total != 1 || len(page.Sessions) != 1 {
+		return errors.New(fmt.Sprintf("sessions, status = %d, body = %s", code, body))
+	}
+
+	if code, body, err := e.admin("POST", "/admin/push?xid="+xid, "application/json", []byte(`["admin", 7]`), adminToken); err != nil {
+		return err
+	} else if code != 200 {
+		return errors.New(fmt.Sprintf("push, status = %d, body = %s", code, body))
+	}
+	if m, err := e.recv(c.Messages(), func(m *client.Message) bool { return m.Name == "recvPull" }); err != nil {
+		return err
+	} else if len(m.Args) != 2 || m.Args[0] != "admin" || m.Args[1] != float64(7) {
+		return errors.New(fmt.Sprintf("push args = %v", m.Args))
+	}
+
+	if code, body, err := e.admin("POST", "/admin/close?pid="+c.Pid(), "", nil, adminToken); err != nil {
+		return err
+	} else if code != 200 || !strings.Contains(string(body), xid) {
+		return errors.New(fmt.Sprintf("close, status = %d, body = %s", code, body))
+	}
+	if _, err := e.expect(c.Xid(), "exit"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (e *Env) admin(method, path, kind string, data []byte, token string) (int, []byte, error) {
+	r, err := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1:%d%s", e.http, path), bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	if len(kind) != 0 {
+		r.Header.Set("Content-Type", kind)
+	}
+	hc := &http.Client{Timeout: e.Timeout}
+	rsp, err := hc.Do(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	return rsp.StatusCode, body, err
+}
+
+// control connects to the -listen port like a backend does, and returns a
+// function sending one request there and waiting for its reply.
+func (e *Env) control() (func(x *rpc.XMessage) (*rpc.XReply, error), error) {
+	conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(e.listen)})
+	if err != nil {
+		return nil, err
+	}
+	e.closers = append(e.closers, func() {
+		conn.Close()
+	})
+	secured, err := tcp.Secure(conn, e.sec, false)
+	if err != nil {
+		return nil, err
+	}
+	id := uint64(0)
+	return func(x *rpc.XMessage) (*rpc.XReply, error) {
+		id++
+		x.Id = proto.Uint64(id)
+		bs, err := proto.Marshal(x)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFrame(secured, bs); err != nil {
+			return nil, err
+		}
+		secured.SetReadDeadline(time.Now().Add(e.Timeout))
+		if bs, err = readFrame(secured); err != nil {
+			return nil, err
+		}
+		r := &rpc.XReply{}
+		if err := proto.Unmarshal(bs, r); err != nil {
+			return nil, err
+		}
+		if r.GetId() != id {
+			return nil, errors.New(fmt.Sprintf("reply id = %d, expect %d", r.GetId(), id))
+		}
+		return r, nil
+	}, nil
+}
+
+func (e *Env) rejected(queries ...string) error {
+	for _, q := range queries {
+		rejected := e.Count("conn.connect.rejected")
+		if _, err := e.DialQuery(e.Addr(), q); err == nil {
+			return errors.New(fmt.Sprintf("query = '%s' accepted", q))
+		} else if err.Error() != "NetConnection.Connect.Rejected" {
+			return errors.New(fmt.Sprintf("query = '%s', error = '%v'", q, err))
+		}
+		if e.Count("conn.connect.rejected") <= rejected {
+			return errors.New("rejection not counted")
+		}
+	}
+	return nil
+}
+
+// testAckRanges drops the second full sized packet of a fragmented message,
+// so the server has to acknowledge the fragments after the hole as a range
+// and the client has to retransmit only the missing one.
+func testAckRanges(e *Env) error {
+	p, err := e.NewProxy(Link{}, Link{})
+	if err != nil {
+		return err
+	}
+	a, err := e.Dial(p.Addr())
+	if err != nil {
+		return err
+	}
+	b, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	big := 0
+	p.SetFilter(func(up bool, data []byte) bool {
+		if up && len(data) > 1000 {
+			big++
+			return big == 2
+		}
+		return false
+	})
+	before := a.Stats()
+	data := string(payload(5000, 0))
+	if err := a.Relay(b.Pid(), data); err != nil {
+		return err
+	}
+	m, err := e.recv(b.Messages(), func(m *client.Message) bool { return m.Name == "onRelay" })
+	if err != nil {
+		return err
+	}
+	if len(m.Args) != 2 || m.Args[1] != data {
+		return errors.New("relay corrupted")
+	}
+	after := a.Stats()
+	if after.AckRanges == before.AckRanges {
+		return errors.New(fmt.Sprintf("no ack range, stats = %+v", after))
+	}
+	if n := after.Retrans - before.Retrans; n != 1 {
+		return errors.New(fmt.Sprintf("retrans = %d, expect 1", n))
+	}
+	return nil
+}
+
+// testCongestion pushes a message far larger than the initial window over a
+// slow link, and checks it waits in the queue, arrives intact, and that the
+// session measured the round trip of the link.
+func testCongestion(e *Env) error {
+	delay := Link{Delay: time.Millisecond * 40}
+	p, err := e.NewProxy(delay, delay)
+	if err != nil {
+		return err
+	}
+	c, err := e.Dial(p.Addr())
+	if err != nil {
+		return err
+	}
+	window := e.Count("session.cc.window")
+	data := string(payload(40000, 0))
+	body, _ := json.Marshal([]interface{}{data})
+	xid := strconv.Itoa(int(c.Xid()))
+	if code, body, err := e.admin("POST", "/admin/push?xid="+xid, "application/json", body, adminToken); err != nil {
+		return err
+	} else if code != 200 {
+		return errors.New(fmt.Sprintf("push, status = %d, body = %s", code, body))
+	}
+	if m, err := e.recv(c.Messages(), func(m *client.Message) bool { return m.Name == "recvPull" }); err != nil {
+		return err
+	} else if len(m.Args) != 1 || m.Args[0] != data {
+		return errors.New("push corrupted")
+	}
+	if err := e.counted("session.cc.window", window); err != nil {
+		return err
+	}
+	var found []struct {
+		Rtt struct {
+			Srtt int
+		}
+	}
+	if code, body, err := e.admin("GET", "/admin/session?xid="+xid, "", nil, adminToken); err != nil {
+		return err
+	} else if code != 200 || json.Unmarshal(body, &found) != nil || len(found) != 1 {
+		return errors.New(fmt.Sprintf("session, status = %d, body = %s", code, body))
+	} else if srtt := found[0].Rtt.Srtt; srtt < 80 || srtt > 1000 {
+		return errors.New(fmt.Sprintf("srtt = %dms, expect about 80ms", srtt))
+	}
+	return nil
+}
+
+// testRecovery drops one datagram of a large push on its way to the client,
+// and checks the fragments it held are resent as soon as the acks show the
+// gap, without waiting for the retransmission timer.
+func testRecovery(e *Env) error {
+	p, err := e.NewProxy(Link{}, Link{Delay: time.Millisecond * 20})
+	if err != nil {
+		return err
+	}
+	c, err := e.Dial(p.Addr())
+	if err != nil {
+		return err
+	}
+	big := 0
+	p.SetFilter(func(up bool, data []byte) bool {
+		if !up && len(data) > 1000 {
+			big++
+			return big == 2
+		}
+		return false
+	})
+	data := string(payload(20000, 0))
+	body, _ := json.Marshal([]interface{}{data})
+	xid := strconv.Itoa(int(c.Xid()))
+	if code, body, err := e.admin("POST", "/admin/push?xid="+xid, "application/json", body, adminToken); err != nil {
+		return err
+	} else if code != 200 {
+		return errors.New(fmt.Sprintf("push, status = %d, body = %s", code, body))
+	}
+	if m, err := e.recv(c.Messages(), func(m *client.Message) bool { return m.Name == "recvPull" }); err != nil {
+		return err
+	} else if len(m.Args) != 1 || m.Args[0] != data {
+		return errors.New("push corrupted")
+	}
+	var found []struct {
+		Retrans struct {
+			Lost     int
+			Timeouts int
+		}
+	}
+	if code, body, err := e.admin("GET", "/admin/session?xid="+xid, "", nil, adminToken); err != nil {
+		return err
+	} else if code != 200 || json.Unmarshal(body, &found) != nil || len(found) != 1 {
+		return errors.New(fmt.Sprintf("session, status = %d, body = %s", code, body))
+	} else if r := found[0].Retrans; r.Lost == 0 || r.Timeouts != 0 {
+		return errors.New(fmt.Sprintf("retrans = %+v, expect losses and no timeout", r))
+	}
+	return nil
+}
+
+// testCredit has the client offer no buffer, and checks a push waits for it
+// while the server probes, then goes through once the client has room again.
+func testCredit(e *Env) error {
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	xid := strconv.Itoa(int(c.Xid()))
+	push := func(data string) error {
+		body, _ := json.Marshal([]interface{}{data})
+		if code, body, err := e.admin("POST", "/admin/push?xid="+xid, "application/json", body, adminToken); err != nil {
+			return err
+		} else if code != 200 {
+			return errors.New(fmt.Sprintf("push, status = %d, body = %s", code, body))
+		}
+		return nil
+	}
+	c.SetCredit(0)
+	if err := push("first"); err != nil {
+		return err
+	}
+	if _, err := e.recv(c.Messages(), func(m *client.Message) bool { return m.Name == "recvPull" }); err != nil {
+		return err
+	}
+	probes := e.Count("flow.credit.probe")
+	data := string(payload(20000, 0))
+	if err := push(data); err != nil {
+		return err
+	}
+	if err := e.counted("flow.credit.probe", probes); err != nil {
+		return err
+	}
+	select {
+	case m := <-c.Messages():
+		return errors.New(fmt.Sprintf("message %s passed a closed credit", m.Name))
+	default:
+	}
+	c.SetCredit(-1)
+	if m, err := e.recv(c.Messages(), func(m *client.Message) bool { return m.Name == "recvPull" }); err != nil {
+		return err
+	} else if len(m.Args) != 1 || m.Args[0] != data {
+		return errors.New("push corrupted")
+	}
+	return nil
+}
+
+// testOverrun sends a video message larger than -recvbuf on a stream, and
+// checks the server closes that flow but keeps the session.
+func testOverrun(e *Env) error {
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	s, err := c.CreateStream()
+	if err != nil {
+		return err
+	}
+	overrun := e.Count("flow.reader.overrun")
+	if err := s.SendVideo(0, payload(1100*1024, 0)); err != nil {
+		return err
+	}
+	if err := e.counted("flow.reader.overrun", overrun); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(e.Timeout)
+	for c.Stats().Exceptions == 0 {
+		if time.Now().After(deadline) {
+			return errors.New("no flow exception")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if m, err := c.Call("request", "ping", float64(1)); err != nil {
+		return err
+	} else if len(m.Args) != 2 || m.Args[0] != "ping" {
+		return errors.New(fmt.Sprintf("request args = %v", m.Args))
+	}
+	return nil
+}
+
+// testBacklog stalls a player with no credit and has the publisher send it
+// more than -flowbacklog: the data older than -backlogexpiry is abandoned
+// while the backlog shows in /metrics, and once the credit reopens the
+// newest still arrive whole and in order.
+func testBacklog(e *Env) error {
+	const name = "e2e-backlog"
+	a, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	pub, err := a.CreateStream()
+	if err != nil {
+		return err
+	}
+	if err := pub.Publish(name); err != nil {
+		return err
+	}
+	b, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	sub, err := b.CreateStream()
+	if err != nil {
+		return err
+	}
+	if err := sub.Play(name); err != nil {
+		return err
+	}
+	data := func(m *client.Message) bool { return m.Name == "onData" }
+	b.SetCredit(0)
+	if err := pub.Send("onData", "first"); err != nil {
+		return err
+	}
+	if _, err := e.recv(sub.Messages(), data); err != nil {
+		return err
+	}
+	abandoned := e.Count("flow.backlog.abandoned")
+	const n = 32
+	sent := make(map[string]int, n)
+	send := func(from, to int) error {
+		for i := from; i < to; i++ {
+			data := string(payload(60000, byte('A'+i)))
+			sent[data] = i
+			if err := pub.Send("onData", data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// the first half expires before the second one overflows
+	if err := send(0, n/2); err != nil {
+		return err
+	}
+	time.Sleep(backlogExpiry * 2)
+	if err := send(n/2, n); err != nil {
+		return err
+	}
+	if err := e.counted("flow.backlog.abandoned", abandoned); err != nil {
+		return err
+	}
+	if code, body, err := e.admin("GET", "/metrics", "", nil, ""); err != nil {
+		return err
+	} else if code != 200 || !strings.Contains(string(body), "\nxserver_backlog_bytes ") {
+		return errors.New(fmt.Sprintf("metrics, status = %d, no backlog gauge", code))
+	} else if strings.Contains(string(body), "\nxserver_backlog_bytes 0\n") {
+		return errors.New("metrics, empty backlog")
+	}
+	b.SetCredit(-1)
+	last, got := -1, 0
+	for last != n-1 {
+		m, err := e.recv(sub.Messages(), data)
+		if err != nil {
+			return errors.New(fmt.Sprintf("data %d: %v", last+1, err))
+		}
+		var i int
+		if len(m.Args) != 1 {
+			return errors.New("data corrupted")
+		} else if data, ok := m.Args[0].(string); !ok {
+			return errors.New("data corrupted")
+		} else if i, ok = sent[data]; !ok || i <= last {
+			return errors.New("data corrupted or out of order")
+		}
+		last, got = i, got+1
+	}
+	if got == n {
+		return errors.New("nothing abandoned")
+	}
+	return nil
+}
+
+// testBacklogMain stalls a client with no credit and pushes more than
+// -flowbacklog to it: the answers and pushes of its main flow are not
+// abandoned one by one, its session is closed instead.
+func testBacklogMain(e *Env) error {
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	xid := strconv.Itoa(int(c.Xid()))
+	c.SetCredit(0)
+	closed := e.Count("session.backlog.close")
+	for i := 0; i < 32; i++ {
+		body, _ := json.Marshal([]interface{}{string(payload(60000, byte('A'+i)))})
+		if code, body, err := e.admin("POST", "/admin/push?xid="+xid, "application/json", body, adminToken); err != nil {
+			return err
+		} else if code != 200 {
+			return errors.New(fmt.Sprintf("push, status = %d, body = %s", code, body))
+		}
+	}
+	if err := e.counted("session.backlog.close", closed); err != nil {
+		return err
+	}
+	select {
+	case <-c.Closed():
+		return nil
+	case <-time.After(e.Timeout):
+		return errors.New("session not closed")
+	}
+}
+
+// testAsync holds a gid of a group and fills its queue with offers: the
+// offer past it waits and is rejected, a call still goes in, and all run in
+// order.
+func testAsync(e *Env) error {
+	const gid = 7
+	release := make(chan struct{})
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+	pool := e.srv.Async()
+	if !pool.Call(gid, func() { <-release }) {
+		return errors.New("call rejected")
+	}
+	var lock sync.Mutex
+	ran := make([]int, 0, asyncQueue)
+	rejected := e.Count("async.rejected")
+	n := 0
+	call := func(i int) func() {
+		return func() {
+			lock.Lock()
+			ran = append(ran, i)
+			lock.Unlock()
+		}
+	}
+	for ; n < asyncQueue*2; n++ {
+		if !pool.Offer(gid, call(n), true) {
+			break
+		}
+	}
+	if n < asyncQueue-1 || n > asyncQueue {
+		return errors.New(fmt.Sprintf("%d offers queued, queue = %d", n, asyncQueue))
+	}
+	if err := e.counted("async.rejected", rejected); err != nil {
+		return err
+	}
+	// a call goes past the full queue, after the offers of its gid
+	if !pool.Call(gid, call(n)) {
+		return errors.New("call rejected by a full group")
+	}
+	n++
+	gauge := fmt.Sprintf("\nxserver_async_group_depth{group=\"%d\"} ", gid)
+	if code, body, err := e.admin("GET", "/metrics", "", nil, ""); err != nil {
+		return err
+	} else if code != 200 || !strings.Contains(string(body), gauge) {
+		return errors.New(fmt.Sprintf("metrics, status = %d, no async depth gauge", code))
+	} else if strings.Contains(string(body), gauge+"0\n") {
+		return errors.New("metrics, empty async group")
+	}
+	close(release)
+	deadline := time.Now().Add(e.Timeout)
+	for {
+		lock.Lock()
+		done := len(ran)
+		lock.Unlock()
+		if done == n {
+			break
+		} else if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("%d of %d calls run", done, n))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	for i, v := range ran {
+		if v != i {
+			return errors.New(fmt.Sprintf("call %d run as %d", v, i))
+		}
+	}
+	return nil
+}
+
+// testClusterBind has the node speak on its link as another node: the
+// server drops what it says, a hello included, and the session the node
+// holds stays.
+func testClusterBind(e *Env) error {
+	xid := uint32(peerNode)<<24 | 1
+	pid := string(payload(0x20, 0x81))
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 4000}
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeJoin, Xid: xid, Pid: pid, Addrs: []*net.UDPAddr{raddr}}); err != nil {
+		return err
+	}
+	if err := e.clusterSessions(1); err != nil {
+		return err
+	}
+	const other = peerNode + 1
+	for _, m := range []*cluster.Message{
+		{Code: cluster.CodeHello},
+		{Code: cluster.CodeExit, Xid: xid},
+	} {
+		mismatch := e.Count("cluster.node.mismatch")
+		if err := e.node.SendAs(other, m); err != nil {
+			return err
+		}
+		if err := e.counted("cluster.node.mismatch", mismatch); err != nil {
+			return err
+		}
+	}
+	if err := e.clusterSessions(1); err != nil {
+		return err
+	}
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeExit, Xid: xid}); err != nil {
+		return err
+	}
+	return e.clusterSessions(0)
+}
+
+// clusterSessions waits for the server to know of n sessions held by other
+// nodes.
+func (e *Env) clusterSessions(n int) error {
+	gauge := fmt.Sprintf("\nxserver_cluster_sessions %d\n", n)
+	deadline := time.Now().Add(e.Timeout)
+	for {
+		if code, body, err := e.admin("GET", "/metrics", "", nil, ""); err != nil {
+			return err
+		} else if code == 200 && strings.Contains(string(body), gauge) {
+			return nil
+		} else if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("cluster sessions != %d", n))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// testCluster has the fake node hold a session of its own: the server
+// announces its sessions to the node, answers a lookup of the remote one
+// with its address, forwards a relay and a broadcast to it, and delivers
+// what the node sends back.
+func testCluster(e *Env) error {
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	if node := c.Xid() >> 24; node != serverNode {
+		return errors.New(fmt.Sprintf("xid = %d, node = %d", c.Xid(), node))
+	}
+	pid := string(payload(0x20, 0x80))
+	if _, err := e.node.expect(cluster.CodeJoin, func(m *cluster.Message) bool {
+		return m.Xid == c.Xid() && hex.EncodeToString([]byte(m.Pid)) == c.Pid() && len(m.Addrs) != 0
+	}, e.Timeout); err != nil {
+		return err
+	}
+
+	xid := uint32(peerNode)<<24 | 1
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 4000}
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeJoin, Xid: xid, Pid: pid, Addrs: []*net.UDPAddr{raddr}}); err != nil {
+		return err
+	}
+	// a lookup before the join is in would fail the handshake, and be
+	// counted as an error
+	if err := e.clusterSessions(1); err != nil {
+		return err
+	}
+	if addrs, err := client.Lookup(e.Addr(), hex.EncodeToString([]byte(pid)), e.Timeout); err != nil {
+		return err
+	} else if len(addrs) != 1 || addrs[0].String() != raddr.String() {
+		return errors.New(fmt.Sprintf("lookup addrs = %v", addrs))
+	}
+	if _, err := e.node.expect(cluster.CodeIntroduce, func(m *cluster.Message) bool {
+		return m.Pid == pid && len(m.Tag) != 0 && len(m.Addrs) == 1
+	}, e.Timeout); err != nil {
+		return err
+	}
+
+	if err := c.Relay(hex.EncodeToString([]byte(pid)), "ping"); err != nil {
+		return err
+	}
+	relay, err := e.node.expect(cluster.CodeRelay, func(m *cluster.Message) bool { return m.Pid == pid }, e.Timeout)
+	if err != nil {
+		return err
+	}
+	if err := c.Send("broadcastBySessionId", fmt.Sprintf("%d", xid), "hello"); err != nil {
+		return err
+	}
+	broadcast, err := e.node.expect(cluster.CodeBroadcast, func(m *cluster.Message) bool {
+		return len(m.Xids) == 1 && m.Xids[0] == xid
+	}, e.Timeout)
+	if err != nil {
+		return err
+	}
+
+	// the node hands back what it got to the session of the server, which
+	// gets its own relay and broadcast
+	pidc, _ := hex.DecodeString(c.Pid())
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeRelay, Pid: string(pidc), Data: relay.Data}); err != nil {
+		return err
+	}
+	if m, err := e.recv(c.Messages(), func(m *client.Message) bool { return m.Name == "onRelay" }); err != nil {
+		return err
+	} else if len(m.Args) != 2 || m.Args[0] != c.Pid() || m.Args[1] != "ping" {
+		return errors.New(fmt.Sprintf("relay args = %v", m.Args))
+	}
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeBroadcast, Xids: []uint32{c.Xid()}, Data: broadcast.Data, Reliable: true}); err != nil {
+		return err
+	}
+	if m, err := e.recv(c.Messages(), func(m *client.Message) bool { return m.Name == "broadcastBySessionId" }); err != nil {
+		return err
+	} else if len(m.Args) != 2 || m.Args[0] != "hello" || m.Args[1] != float64(c.Xid()) {
+		return errors.New(fmt.Sprintf("broadcast args = %v", m.Args))
+	}
+
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeExit, Xid: xid}); err != nil {
+		return err
+	}
+	c.Close()
+	if _, err := e.node.expect(cluster.CodeExit, func(m *cluster.Message) bool { return m.Xid == c.Xid() }, e.Timeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+// testClusterStream plays a stream published on the fake node, which gets
+// pulled, and has the node pull a stream published on the server.
+func testClusterStream(e *Env) error {
+	const edge, origin = "e2e-cluster-edge", "e2e-cluster-origin"
+	named := func(code uint8, name string) func(m *cluster.Message) bool {
+		return func(m *cluster.Message) bool { return m.Code == code && m.Name == name }
+	}
+	status := func(msgs <-chan *client.Message, code string) error {
+		_, err := e.recv(msgs, func(m *client.Message) bool {
+			s, _ := m.Status()
+			return s == code
+		})
+		return err
+	}
+	media := func(code uint8, time uint32, body []byte) []byte {
+		w := xio.NewPacketWriter(nil)
+		w.Write8(code)
+		w.Write32(time)
+		w.WriteBytes(body)
+		return w.Bytes()
+	}
+
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodePublish, Name: edge}); err != nil {
+		return err
+	}
+	b, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	sub, err := b.CreateStream()
+	if err != nil {
+		return err
+	}
+	if err := sub.Play(edge); err != nil {
+		return err
+	}
+	if _, err := e.node.expect(cluster.CodeSubscribe, named(cluster.CodeSubscribe, edge), e.Timeout); err != nil {
+		return err
+	}
+	video := payload(3000, 0x17)
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeStream, Name: edge, Data: media(0x09, 40, video), Reliable: true}); err != nil {
+		return err
+	}
+	if m, err := e.recv(sub.Messages(), func(m *client.Message) bool { return m.Code == 0x09 }); err != nil {
+		return err
+	} else if m.Time != 40 || !bytes.Equal(m.Data, video) {
+		return errors.New(fmt.Sprintf("pulled video time = %d, len = %d", m.Time, len(m.Data)))
+	}
+	// after a resync the player waits for the next keyframe
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeResync, Name: edge}); err != nil {
+		return err
+	}
+	for i, body := range [][]byte{payload(800, 0x27), payload(3000, 0x17)} {
+		if err := e.node.Send(&cluster.Message{Code: cluster.CodeStream, Name: edge, Data: media(0x09, uint32(80+i*40), body), Reliable: true}); err != nil {
+			return err
+		}
+	}
+	if m, err := e.recv(sub.Messages(), func(m *client.Message) bool { return m.Code == 0x09 }); err != nil {
+		return err
+	} else if m.Time != 120 {
+		return errors.New(fmt.Sprintf("video after resync time = %d", m.Time))
+	}
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeUnpublish, Name: edge}); err != nil {
+		return err
+	}
+	if err := status(sub.Messages(), "NetStream.Play.UnpublishNotify"); err != nil {
+		return err
+	}
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodePublish, Name: edge}); err != nil {
+		return err
+	}
+	if err := status(sub.Messages(), "NetStream.Play.PublishNotify"); err != nil {
+		return err
+	}
+	if _, err := e.node.expect(cluster.CodeSubscribe, named(cluster.CodeSubscribe, edge), e.Timeout); err != nil {
+		return err
+	}
+	if err := sub.Close(); err != nil {
+		return err
+	}
+	if _, err := e.node.expect(cluster.CodeUnsubscribe, named(cluster.CodeUnsubscribe, edge), e.Timeout); err != nil {
+		return err
+	}
+
+	a, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	pub, err := a.CreateStream()
+	if err != nil {
+		return err
+	}
+	if err := pub.Publish(origin); err != nil {
+		return err
+	}
+	if _, err := e.node.expect(cluster.CodePublish, named(cluster.CodePublish, origin), e.Timeout); err != nil {
+		return err
+	}
+	// the codec header comes first, kept by the server or sent as it is
+	codec := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}
+	if err := pub.SendVideo(0, codec); err != nil {
+		return err
+	}
+	if err := e.node.Send(&cluster.Message{Code: cluster.CodeSubscribe, Name: origin}); err != nil {
+		return err
+	}
+	if _, err := e.node.expect(cluster.CodeResync, named(cluster.CodeResync, origin), e.Timeout); err != nil {
+		return err
+	}
+	if _, err := e.node.expect(cluster.CodeStream, func(m *cluster.Message) bool {
+		return m.Name == origin && bytes.Equal(m.Data, media(0x09, 0, codec))
+	}, e.Timeout); err != nil {
+		return err
+	}
+	if err := pub.SendVideo(40, video); err != nil {
+		return err
+	}
+	if _, err := e.node.expect(cluster.CodeStream, func(m *cluster.Message) bool {
+		return m.Name == origin && bytes.Equal(m.Data, media(0x09, 40, video))
+	}, e.Timeout); err != nil {
+		return err
+	}
+	if err := pub.Close(); err != nil {
+		return err
+	}
+	if _, err := e.node.expect(cluster.CodeUnpublish, named(cluster.CodeUnpublish, origin), e.Timeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+// testDrain shuts the server down with one client idle and another behind
+// a link gone dead, which never acks a push: the drain times out, and still
+// the idle client is told its session is closed and the backend gets the
+// exits of both.
+func testDrain(e *Env) error {
+	a, err := e.Dial(e.Addr())
+	if err != nil {
+		return err
+	}
+	p, err := e.NewProxy(Link{}, Link{})
+	if err != nil {
+		return err
+	}
+	b, err := e.Dial(p.Addr())
+	if err != nil {
+		return err
+	}
+	for _, c := range []*client.Client{a, b} {
+		if _, err := e.expect(c.Xid(), "join"); err != nil {
+			return err
+		}
+	}
+	p.SetFilter(func(up bool, data []byte) bool {
+		return true
+	})
+	body, _ := json.Marshal([]interface{}{"unacked"})
+	if code, body, err := e.admin("POST", "/admin/push?xid="+strconv.Itoa(int(b.Xid())), "application/json", body, adminToken); err != nil {
+		return err
+	} else if code != 200 {
+		return errors.New(fmt.Sprintf("push, status = %d, body = %s", code, body))
+	}
+
+	timeouts := e.Count("session.drain.timeout")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := e.srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	if e.Count("session.drain.timeout") <= timeouts {
+		return errors.New("drain did not time out")
+	}
+	if n := e.Count("session.drain"); n != 2 {
+		return errors.New(fmt.Sprintf("%d session(s) drained, expect 2", n))
+	}
+	select {
+	case <-a.Closed():
+	case <-time.After(e.Timeout):
+		return errors.New("idle client not closed")
+	}
+	exits := map[uint32]bool{a.Xid(): true, b.Xid(): true}
+	timeout := time.After(e.Timeout)
+	for len(exits) != 0 {
+		select {
+		case r := <-e.reqs:
+			if r.x.GetCode() == "exit" {
+				delete(exits, r.x.GetXid())
+			}
+		case <-timeout:
+			return errors.New(fmt.Sprintf("backend timeout, no exit of %v", exits))
+		}
+	}
+	return nil
+}
+
+// counted waits for the count of key to go past n, as counts arrive a bit
+// after what they count.
+func (e *Env) counted(key string, n int64) error {
+	deadline := time.Now().Add(e.Timeout)
+	for e.Count(key) <= n {
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("%s not counted", key))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nil
+}
+
+// expect waits for the next XRequest with the given xid and code, skipping
+// the ones left over by other clients.
+func (e *Env) expect(xid uint32, code string) (*rpc.XRequest, error) {
+	_, x, err := e.expectFrom(xid, code)
+	return x, err
+}
+
+// expectFrom is expect telling which backend got the request.
+func (e *Env) expectFrom(xid uint32, code string) (*Backend, *rpc.XRequest, error) {
+	timeout := time.After(e.Timeout)
+	for {
+		select {
+		case r := <-e.reqs:
+			if r.x.GetXid() == xid && r.x.GetCode() == code {
+				return r.b, r.x, nil
+			}
+		case <-timeout:
+			return nil, nil, errors.New(fmt.Sprintf("backend timeout, xid = %d, code = %s", xid, code))
+		}
+	}
+}
+
+// recv waits for the next message accepted by match, skipping the others.
+func (e *Env) recv(msgs <-chan *client.Message, match func(m *client.Message) bool) (*client.Message, error) {
+	timeout := time.After(e.Timeout)
+	for {
+		select {
+		case m := <-msgs:
+			if match(m) {
+				return m, nil
+			}
+		case <-timeout:
+			return nil, errors.New("recv timeout")
+		}
+	}
+}
+
+// sequence checks that the messages named name carry first, first+1, ...
+// up to first+n-1 as their only argument.
+func (e *Env) sequence(msgs <-chan *client.Message, name string, first, n int) error {
+	for i := first; i < first+n; i++ {
+		m, err := e.recv(msgs, func(m *client.Message) bool { return m.Name == name })
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s %d: %v", name, i, err))
+		}
+		if len(m.Args) != 1 || m.Args[0] != float64(i) {
+			return errors.New(fmt.Sprintf("%s args = %v, expect %d", name, m.Args, i))
+		}
+	}
+	return nil
+}
+
+func payload(size int, first byte) []byte {
+	b := []byte(strings.Repeat("0123456789abcdef", size/16+1))[:size]
+	if size != 0 && first != 0 {
+		b[0] = first
+	}
+	return b
+}
@@ -0,0 +1,347 @@
+// Package e2e drives a real xserver over loopback udp with the Go client,
+// directly or through a Proxy that loses, reorders and duplicates packets,
+// and checks what arrives at the other end. Every case runs as a subtest
+// of TestE2E against a server and fixtures of its own ('make e2e').
+package e2e
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver"
+	"github.com/spinlock/xserver/pkg/xserver/client"
+	"github.com/spinlock/xserver/pkg/xserver/rpc"
+	"github.com/spinlock/xserver/pkg/xserver/tcp"
+)
+
+const (
+	app        = "e2e"
+	asyncQueue = 64
+	serverNode = 1
+	peerNode   = 2
+
+	backlogExpiry = time.Millisecond * 200
+)
+
+var (
+	seed = flag.Int64("seed", time.Now().UnixNano(), "seed of the lossy proxies")
+	wait = flag.Duration("wait", time.Second*10, "timeout of every call and receive")
+	logs = flag.Bool("logs", false, "log what the servers log")
+)
+
+// Case is one e2e test. Config, when set, changes the config of the server
+// the Case runs against before it starts.
+type Case struct {
+	Name   string
+	Run    func(e *Env) error
+	Config func(cfg *xserver.Config)
+}
+
+type received struct {
+	b *Backend
+	x *rpc.XRequest
+}
+
+type suite struct {
+	addr     string
+	port     uint16
+	listen   uint16
+	http     uint16
+	cluster  uint16
+	sec      *tcp.Security
+	srv      *xserver.Server
+	backends []*Backend
+	node     *Node
+	reqs     chan *received
+	counts   struct {
+		m map[string]int64
+		sync.Mutex
+	}
+}
+
+// Env is what a Case gets: the server address, the fake rpc backends and
+// helpers whose clients and proxies are closed when the Case returns.
+type Env struct {
+	*suite
+	Seed    int64
+	Timeout time.Duration
+	closers []func()
+}
+
+// Addr is the udp address of the server under test.
+func (e *Env) Addr() string {
+	return e.addr
+}
+
+func (e *Env) Backends() []*Backend {
+	return e.backends
+}
+
+// Count returns the sum of every counts.Count made for key since the server
+// of the Case started.
+func (e *Env) Count(key string) int64 {
+	e.counts.Lock()
+	defer e.counts.Unlock()
+	return e.counts.m[key]
+}
+
+// Dial connects a client to addr, which is either Addr or a Proxy's Addr.
+func (e *Env) Dial(addr string) (*client.Client, error) {
+	return e.DialQuery(addr, "")
+}
+
+// DialQuery is Dial with a query added to the url, as tokens are passed.
+func (e *Env) DialQuery(addr string, query string) (*client.Client, error) {
+	uri := "rtmfp://" + addr + "/" + app
+	if len(query) != 0 {
+		uri += "?" + query
+	}
+	c, err := client.Dial(addr, uri, e.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	e.closers = append(e.closers, func() {
+		c.Close()
+	})
+	return c, nil
+}
+
+func (e *Env) NewProxy(up, down Link) (*Proxy, error) {
+	p, err := NewProxy(e.addr, up, down, e.Seed)
+	if err != nil {
+		return nil, err
+	}
+	e.closers = append(e.closers, p.Close)
+	return p, nil
+}
+
+func (e *Env) close() {
+	for i := len(e.closers) - 1; i >= 0; i-- {
+		e.closers[i]()
+	}
+	e.closers = nil
+}
+
+func TestE2E(t *testing.T) {
+	t.Logf("seed = %d", *seed)
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			e, err := newEnv(t, c.Config)
+			for i := 0; i < 3 && errors.Is(err, syscall.EADDRINUSE); i++ {
+				// a port freePort found may be taken before the server binds it
+				e, err = newEnv(t, c.Config)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := run(e, c); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.errors(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestTwoServers runs two servers of one process at once, each with its own
+// ports, backends and counts: a client of either reaches its own backend
+// only, and one keeps serving after the other shuts down.
+func TestTwoServers(t *testing.T) {
+	envs := make([]*Env, 2)
+	for i := range envs {
+		e, err := newEnv(t, nil)
+		for j := 0; j < 3 && errors.Is(err, syscall.EADDRINUSE); j++ {
+			e, err = newEnv(t, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.close()
+		envs[i] = e
+	}
+	if envs[0].port == envs[1].port {
+		t.Fatalf("both servers on port %d", envs[0].port)
+	}
+	for i, e := range envs {
+		c, err := e.Dial(e.Addr())
+		if err != nil {
+			t.Fatalf("server %d: %v", i, err)
+		}
+		if _, err := e.expect(c.Xid(), "join"); err != nil {
+			t.Fatalf("server %d: %v", i, err)
+		}
+		if n := e.Count("session.new"); n != 1 {
+			t.Fatalf("server %d: session.new = %d", i, n)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := envs[0].srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	e := envs[1]
+	c, err := e.Dial(e.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.expect(c.Xid(), "join"); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range envs {
+		if err := e.errors(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newEnv starts a server wired to two fake backends and a fake cluster node
+// on ephemeral ports, all of them stopped when t ends. config, when not nil,
+// changes the config of the server.
+func newEnv(t *testing.T, config func(cfg *xserver.Config)) (*Env, error) {
+	s := &suite{}
+	s.counts.m = make(map[string]int64)
+	s.reqs = make(chan *received, 4096)
+	dir := t.TempDir()
+	var err error
+	if s.sec, err = newSecurity(dir); err != nil {
+		return nil, err
+	}
+	if s.listen, err = freePort(); err != nil {
+		return nil, err
+	}
+	if s.http, err = freePort(); err != nil {
+		return nil, err
+	}
+	if s.cluster, err = freePort(); err != nil {
+		return nil, err
+	}
+	remotes := []string{}
+	for i := 0; i < 2; i++ {
+		b, err := NewBackend(s.sec)
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(b.Close)
+		go func() {
+			for x := range b.Requests() {
+				s.reqs <- &received{b, x}
+			}
+		}()
+		s.backends = append(s.backends, b)
+		remotes = append(remotes, b.Addr())
+	}
+	if s.node, err = NewNode(peerNode, s.sec); err != nil {
+		return nil, err
+	}
+	t.Cleanup(s.node.Close)
+
+	cfg := xserver.DefaultConfig()
+	cfg.Ports = []uint16{0}
+	cfg.Sockets = 4
+	cfg.Remote = strings.Join(remotes, ",")
+	cfg.Listen = s.listen
+	cfg.TLSCert = filepath.Join(dir, "cert.pem")
+	cfg.TLSKey = filepath.Join(dir, "key.pem")
+	cfg.TLSCA = filepath.Join(dir, "ca.pem")
+	cfg.Secret = linkSecret
+	cfg.Http = s.http
+	cfg.Admin = adminToken
+	cfg.Apps = []string{app}
+	cfg.Manage = 100
+	cfg.Retrans = []int{200, 200, 400, 600, 800, 1000, 1500, 2000, 3000, 4000, 5000, 7500}
+	cfg.Drain = 1
+	cfg.FlowBacklog = 1024
+	cfg.BacklogExpiry = int(backlogExpiry / time.Millisecond)
+	cfg.AsyncQueue = asyncQueue
+	cfg.AsyncWait = 50
+	cfg.Node = serverNode
+	cfg.NodeListen = s.cluster
+	cfg.Nodes = s.node.Addr()
+	cfg.Metrics = func(key string, cnt int) {
+		s.counts.Lock()
+		s.counts.m[key] += int64(cnt)
+		s.counts.Unlock()
+	}
+	cfg.Logger = func(name string, format string, v ...interface{}) {
+		if *logs {
+			t.Logf(name+": "+strings.TrimSuffix(format, "\n"), v...)
+		}
+	}
+	if config != nil {
+		config(cfg)
+	}
+	if s.srv, err = xserver.New(cfg); err != nil {
+		return nil, err
+	}
+	if err := s.srv.Start(context.Background()); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		s.srv.Shutdown(ctx)
+	})
+	s.port = s.srv.Ports()[0]
+	s.addr = fmt.Sprintf("127.0.0.1:%d", s.port)
+	if err := s.node.Dial(s.cluster); err != nil {
+		return nil, err
+	}
+	return &Env{suite: s, Seed: *seed, Timeout: *wait}, nil
+}
+
+// errors fails a Case that left any of the error counters behind.
+func (e *Env) errors() error {
+	for _, key := range []string{
+		"server.panic",
+		"handshake.decode.error",
+		"handshake.handle.error",
+		"session.decode.error",
+		"session.handle.error",
+		"session.flow.error",
+		"session.parse10.error",
+		"session.parse11.error",
+		"session.parse51.error",
+		"rpc.call.error",
+		"rpc.xresponse.error",
+		"cluster.decode.error",
+		"cluster.encode.error",
+	} {
+		if n := e.Count(key); n != 0 {
+			return errors.New(fmt.Sprintf("%s = %d", key, n))
+		}
+	}
+	return nil
+}
+
+func freePort() (uint16, error) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port), nil
+}
+
+func run(e *Env, c Case) (err error) {
+	defer e.close()
+	defer func() {
+		if x := recover(); x != nil {
+			err = errors.New(fmt.Sprintf("panic = %v", x))
+		}
+	}()
+	return c.Run(e)
+}
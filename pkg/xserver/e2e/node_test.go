@@ -0,0 +1,206 @@
+package e2e
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/cluster"
+	"github.com/spinlock/xserver/pkg/xserver/tcp"
+)
+
+// Node stands in for another node of the cluster the server is part of. It
+// takes the link the server dials with -nodes, answering its hello, and
+// dials the server at -nodelisten with a link of its own, saying hello and
+// pinging it. What the server sends over its link is delivered by Messages.
+type Node struct {
+	id    uint8
+	ln    *net.TCPListener
+	out   net.Conn
+	sec   *tcp.Security
+	conns map[*net.TCPConn]bool
+	msgs  chan *cluster.Message
+	quit  chan struct{}
+	done  sync.WaitGroup
+	sync.Mutex
+}
+
+// NewNode listens on loopback as node id, accepting only the peers passing
+// sec when it is not nil.
+func NewNode(id uint8, sec *tcp.Security) (*Node, error) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{}
+	n.id = id
+	n.ln = ln
+	n.sec = sec
+	n.conns = make(map[*net.TCPConn]bool)
+	n.msgs = make(chan *cluster.Message, 4096)
+	n.quit = make(chan struct{})
+	n.done.Add(1)
+	go n.accept()
+	return n, nil
+}
+
+func (n *Node) Addr() string {
+	return n.ln.Addr().String()
+}
+
+// Dial links the node to the server, which listens at port. The link is
+// not dialed again if it breaks, the server outliving no case.
+func (n *Node) Dial(port uint16) error {
+	tc, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		return err
+	}
+	conn, err := tcp.Secure(tc, n.sec, false)
+	if err != nil {
+		tc.Close()
+		return err
+	}
+	n.Lock()
+	n.out = conn
+	n.Unlock()
+	if err := n.Send(&cluster.Message{Code: cluster.CodeHello}); err != nil {
+		return err
+	}
+	n.done.Add(2)
+	go n.ping()
+	go func() {
+		defer n.done.Done()
+		for {
+			if _, err := readFrame(conn); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Messages delivers what the server sends, but its hellos and pings.
+func (n *Node) Messages() <-chan *cluster.Message {
+	return n.msgs
+}
+
+// Send sends m to the server, from the node.
+func (n *Node) Send(m *cluster.Message) error {
+	return n.SendAs(n.id, m)
+}
+
+// SendAs sends m to the server over the link of the node, naming node id.
+func (n *Node) SendAs(id uint8, m *cluster.Message) error {
+	m.Node = id
+	bs, err := cluster.Encode(m)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	defer n.Unlock()
+	if n.out == nil {
+		return errors.New("node.not dialed")
+	}
+	return writeFrame(n.out, bs)
+}
+
+func (n *Node) Close() {
+	close(n.quit)
+	n.ln.Close()
+	n.Lock()
+	for conn := range n.conns {
+		conn.Close()
+	}
+	if n.out != nil {
+		n.out.Close()
+	}
+	n.Unlock()
+	n.done.Wait()
+}
+
+func (n *Node) accept() {
+	defer n.done.Done()
+	for {
+		conn, err := n.ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		n.Lock()
+		n.conns[conn] = true
+		n.Unlock()
+		n.done.Add(1)
+		go func() {
+			defer n.done.Done()
+			n.serve(conn)
+			n.Lock()
+			delete(n.conns, conn)
+			n.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (n *Node) serve(tc *net.TCPConn) {
+	conn, err := tcp.Secure(tc, n.sec, true)
+	if err != nil {
+		return
+	}
+	for {
+		data, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		m, err := cluster.Decode(data)
+		if err != nil {
+			continue
+		}
+		switch m.Code {
+		case cluster.CodeHello:
+			if bs, err := cluster.Encode(&cluster.Message{Code: cluster.CodeHello, Node: n.id}); err != nil {
+				continue
+			} else if err := writeFrame(conn, bs); err != nil {
+				return
+			}
+		case cluster.CodePing:
+		default:
+			select {
+			case n.msgs <- m:
+			case <-n.quit:
+				return
+			}
+		}
+	}
+}
+
+func (n *Node) ping() {
+	defer n.done.Done()
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-time.After(time.Millisecond * 500):
+		}
+		if err := n.Send(&cluster.Message{Code: cluster.CodePing}); err != nil {
+			return
+		}
+	}
+}
+
+// expect waits for a message of code from the server matching match.
+func (n *Node) expect(code uint8, match func(m *cluster.Message) bool, timeout time.Duration) (*cluster.Message, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-n.msgs:
+			if m.Code == code && (match == nil || match(m)) {
+				return m, nil
+			}
+		case <-deadline:
+			return nil, errors.New(fmt.Sprintf("node.timeout, code = '%c'", code))
+		}
+	}
+}
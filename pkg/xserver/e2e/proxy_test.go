@@ -0,0 +1,272 @@
+package e2e
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Link describes the faults injected on one direction of a Proxy. A packet
+// is dropped with probability Loss, held back until a later packet has passed
+// with probability Reorder, and sent twice with probability Duplicate. What
+// passes is delayed by Delay.
+type Link struct {
+	Loss      float64
+	Reorder   float64
+	Duplicate float64
+	Delay     time.Duration
+}
+
+type ProxyStats struct {
+	Forwarded  uint64
+	Dropped    uint64
+	Reordered  uint64
+	Duplicated uint64
+}
+
+// Proxy relays udp packets between clients and the server through a faulty
+// Link in each direction. Every client address gets its own upstream socket,
+// so the server sees one peer per client.
+type Proxy struct {
+	conn   *net.UDPConn
+	target *net.UDPAddr
+	up     Link
+	down   Link
+	rnd    *rand.Rand
+	peers  map[string]*peer
+	filter func(up bool, data []byte) bool
+	stats  ProxyStats
+	closed bool
+	quit   chan struct{}
+	done   sync.WaitGroup
+	sync.Mutex
+}
+
+type peer struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+	held [2][]byte
+}
+
+func NewProxy(target string, up, down Link, seed int64) (*Proxy, error) {
+	raddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: raddr.IP})
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{}
+	p.conn = conn
+	p.target = raddr
+	p.up, p.down = up, down
+	p.rnd = rand.New(rand.NewSource(seed))
+	p.peers = make(map[string]*peer)
+	p.quit = make(chan struct{})
+	p.done.Add(2)
+	go p.recv()
+	go p.release()
+	return p, nil
+}
+
+func (p *Proxy) Addr() string {
+	return p.conn.LocalAddr().String()
+}
+
+// SetFilter installs f to be asked about every packet before the Link
+// applies; a packet is dropped when f returns true.
+func (p *Proxy) SetFilter(f func(up bool, data []byte) bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.filter = f
+}
+
+func (p *Proxy) Stats() ProxyStats {
+	p.Lock()
+	defer p.Unlock()
+	return p.stats
+}
+
+func (p *Proxy) Close() {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.quit)
+	p.conn.Close()
+	for _, x := range p.peers {
+		x.conn.Close()
+	}
+	p.Unlock()
+	p.done.Wait()
+}
+
+func (p *Proxy) recv() {
+	defer p.done.Done()
+	for {
+		buf := make([]byte, 2048)
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-p.quit:
+				return
+			default:
+				continue
+			}
+		}
+		if x := p.getPeer(addr); x != nil {
+			p.forward(true, x, buf[:n])
+		}
+	}
+}
+
+func (p *Proxy) getPeer(addr *net.UDPAddr) *peer {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return nil
+	}
+	if x := p.peers[addr.String()]; x != nil {
+		return x
+	}
+	conn, err := net.DialUDP("udp", nil, p.target)
+	if err != nil {
+		return nil
+	}
+	x := &peer{conn: conn, addr: addr}
+	p.peers[addr.String()] = x
+	p.serve(x, conn)
+	return x
+}
+
+// serve relays what the server sends to conn, until conn is replaced.
+func (p *Proxy) serve(x *peer, conn *net.UDPConn) {
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		for {
+			buf := make([]byte, 2048)
+			n, err := conn.Read(buf)
+			if err != nil {
+				select {
+				case <-p.quit:
+					return
+				default:
+				}
+				p.Lock()
+				replaced := x.conn != conn
+				p.Unlock()
+				if replaced {
+					return
+				}
+				continue
+			}
+			p.forward(false, x, buf[:n])
+		}
+	}()
+}
+
+// Rebind moves every client to a new upstream socket, as a nat does when its
+// mapping changes, so the server sees them come from another port.
+func (p *Proxy) Rebind() error {
+	p.Lock()
+	defer p.Unlock()
+	for _, x := range p.peers {
+		conn, err := net.DialUDP("udp", nil, p.target)
+		if err != nil {
+			return err
+		}
+		old := x.conn
+		x.conn = conn
+		old.Close()
+		p.serve(x, conn)
+	}
+	return nil
+}
+
+func (p *Proxy) forward(up bool, x *peer, data []byte) {
+	p.Lock()
+	link, dir := p.down, 0
+	if up {
+		link, dir = p.up, 1
+	}
+	var out [][]byte
+	if p.filter != nil && p.filter(up, data) {
+		p.stats.Dropped++
+	} else if p.rnd.Float64() < link.Loss {
+		p.stats.Dropped++
+	} else if x.held[dir] == nil && p.rnd.Float64() < link.Reorder {
+		x.held[dir] = data
+		p.stats.Reordered++
+	} else {
+		out = append(out, data)
+		if p.rnd.Float64() < link.Duplicate {
+			out = append(out, data)
+			p.stats.Duplicated++
+		}
+	}
+	if held := x.held[dir]; held != nil && len(out) != 0 {
+		out = append(out, held)
+		x.held[dir] = nil
+	}
+	p.stats.Forwarded += uint64(len(out))
+	p.Unlock()
+	for _, bs := range out {
+		if link.Delay != 0 {
+			bs := bs
+			time.AfterFunc(link.Delay, func() {
+				p.write(up, x, bs)
+			})
+		} else {
+			p.write(up, x, bs)
+		}
+	}
+}
+
+func (p *Proxy) write(up bool, x *peer, data []byte) {
+	if up {
+		p.Lock()
+		conn := x.conn
+		p.Unlock()
+		conn.Write(data)
+	} else {
+		p.conn.WriteToUDP(data, x.addr)
+	}
+}
+
+// release lets go of packets that are still held back because nothing else
+// has been sent in their direction.
+func (p *Proxy) release() {
+	defer p.done.Done()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-time.After(time.Millisecond * 50):
+		}
+		type held struct {
+			up   bool
+			x    *peer
+			data []byte
+		}
+		var out []held
+		p.Lock()
+		for _, x := range p.peers {
+			for dir, data := range x.held {
+				if data != nil {
+					out = append(out, held{dir == 1, x, data})
+					x.held[dir] = nil
+				}
+			}
+		}
+		p.stats.Forwarded += uint64(len(out))
+		p.Unlock()
+		for _, h := range out {
+			p.write(h.up, h.x, h.data)
+		}
+	}
+}
@@ -5,16 +5,12 @@ import (
 	"fmt"
 	"net"
 	"net/url"
-	"strings"
+	"time"
 )
 
 import (
-	"github.com/spinlock/xserver/pkg/xserver/args"
-	"github.com/spinlock/xserver/pkg/xserver/cookies"
-	"github.com/spinlock/xserver/pkg/xserver/counts"
+	"github.com/spinlock/xserver/pkg/xserver/auth"
 	"github.com/spinlock/xserver/pkg/xserver/rtmfp"
-	"github.com/spinlock/xserver/pkg/xserver/session"
-	"github.com/spinlock/xserver/pkg/xserver/udp"
 	"github.com/spinlock/xserver/pkg/xserver/utils"
 	"github.com/spinlock/xserver/pkg/xserver/xio"
 	"github.com/spinlock/xserver/pkg/xserver/xlog"
@@ -25,63 +21,95 @@ var (
 )
 
 type Handshake struct {
+	handshakes *Handshakes
 	rtmfp.AESEngine
-	rtmfp.DHEngine
+	dh struct {
+		engine   rtmfp.DHEngine
+		lasttime int64
+	}
 	lport uint16
 	raddr *net.UDPAddr
 }
 
-func newHandshake() *Handshake {
+func (hs *Handshakes) newHandshake() *Handshake {
 	h := &Handshake{}
+	h.handshakes = hs
 	h.AESEngine = rtmfp.NewAESEngine()
 	if err := h.SetKey(cryptkey, cryptkey); err != nil {
 		utils.Panic(fmt.Sprintf("handshake init error = '%v'", err))
 	}
-	h.DHEngine = rtmfp.NewDHEngine()
-	counts.Count("handshake.new", 1)
+	h.dh.engine, h.dh.lasttime = nil, 0
+	hs.counts.Count("handshake.new", 1)
 	return h
 }
 
-func HandlePacket(lport uint16, raddr *net.UDPAddr, data []byte) {
-	h := getHandshake()
+func (h *Handshake) getDHEngine() (rtmfp.DHEngine, error) {
+	now, dhrotate := time.Now().UnixNano(), int64(h.handshakes.args.DHRotate())
+	if e := h.dh.engine; e != nil && dhrotate != 0 {
+		if h.dh.lasttime >= now-int64(time.Second)*dhrotate {
+			return e, nil
+		}
+		h.handshakes.counts.Count("dh.rotate", 1)
+	}
+	h.dh.engine, h.dh.lasttime = nil, 0
+	if e, err := rtmfp.NewDHEngine(); err != nil {
+		h.handshakes.counts.Count("dh.keygen.error", 1)
+		return nil, err
+	} else {
+		cost := time.Now().UnixNano() - now
+		h.handshakes.counts.Count("dh.keygen", 1)
+		h.handshakes.counts.Count("dh.keygen.usec", int(cost/int64(time.Microsecond)))
+		if dhrotate != 0 {
+			h.dh.engine, h.dh.lasttime = e, now
+		}
+		return e, nil
+	}
+}
+
+func (hs *Handshakes) HandlePacket(lport uint16, raddr *net.UDPAddr, data []byte) {
+	if hs.isDraining() {
+		hs.counts.Count("handshake.draining", 1)
+		return
+	}
+	h := hs.getHandshake()
 	if h == nil {
 		return
 	}
-	defer putHandshake(h)
+	defer hs.putHandshake(h)
 
 	var err error
 	if data, err = rtmfp.DecodePacket(h, data); err != nil {
-		counts.Count("handshake.decode.error", 1)
-		xlog.ErrLog.Printf("[handshake]: decode error = '%v'\n", err)
+		hs.counts.Count("handshake.decode.error", 1)
+		hs.logs.ErrLog.Printf("[handshake]: decode error = '%v'\n", err)
 		return
 	}
-	xlog.OutLog.Printf("[handshake]: recv addr = [%s], data.len = %d\n%s\n", raddr, len(data), utils.Formatted(data))
+	hs.logs.OutLog.Printf("[handshake]: recv addr = [%s], data.len = %d\n%s\n", raddr, len(data), utils.Formatted(data))
 
 	h.lport, h.raddr = lport, raddr
 
 	var pkt *packet
 	if pkt, err = h.handle(xio.NewPacketReader(data[6:])); err != nil {
-		counts.Count("handshake.handle.error", 1)
-		xlog.ErrLog.Printf("[handshake]: handle error = '%v'\n", err)
+		hs.counts.Count("handshake.handle.error", 1)
+		hs.logs.ErrLog.Printf("[handshake]: handle error = '%v'\n", err)
 		return
 	} else if pkt == nil {
-		xlog.OutLog.Printf("[handshake]: response packet is empty\n")
+		hs.logs.OutLog.Printf("[handshake]: response packet is empty\n")
 		return
 	}
 
 	if data, err = rtmfp.PacketToBytes(pkt); err != nil {
-		counts.Count("handshake.tobytes.error", 1)
-		xlog.ErrLog.Printf("[handshake]: packet to bytes error = '%v'\n", err)
+		hs.counts.Count("handshake.tobytes.error", 1)
+		hs.logs.ErrLog.Printf("[handshake]: packet to bytes error = '%v'\n", err)
 		return
 	}
-	xlog.OutLog.Printf("[handshake]: send addr = [%s], data.len = %d\n%s\n", raddr, len(data), utils.Formatted(data))
+	hs.logs.OutLog.Printf("[handshake]: send addr = [%s], data.len = %d\n%s\n", raddr, len(data), utils.Formatted(data))
 
 	if data, err = rtmfp.EncodePacket(h, pkt.yid, data); err != nil {
-		counts.Count("handshake.encode.error", 1)
-		xlog.ErrLog.Printf("[handshake]: encode packet error = '%v'\n", err)
+		hs.counts.Count("handshake.encode.error", 1)
+		hs.logs.ErrLog.Printf("[handshake]: encode packet error = '%v'\n", err)
 		return
 	}
-	udp.Send(lport, raddr, data)
+	hs.udp.Send(lport, raddr, data)
 }
 
 func (h *Handshake) handle(r *xio.PacketReader) (*packet, error) {
@@ -92,7 +120,7 @@ func (h *Handshake) handle(r *xio.PacketReader) (*packet, error) {
 			return nil, errors.New("packet.read time")
 		}
 		if marker != 0x0b {
-			counts.Count("handshake.marker.unknown", 1)
+			h.handshakes.counts.Count("handshake.marker.unknown", 1)
 			return nil, errors.New(fmt.Sprintf("packet.unknown marker = 0x%02x", marker))
 		}
 	}
@@ -101,18 +129,18 @@ func (h *Handshake) handle(r *xio.PacketReader) (*packet, error) {
 	} else {
 		switch msg.Code {
 		default:
-			counts.Count("handshake.code.unknown", 1)
+			h.handshakes.counts.Count("handshake.code.unknown", 1)
 			return nil, errors.New(fmt.Sprintf("message.unknown code = 0x%02x", msg.Code))
 		case 0x30:
 			if rsp, err := h.handleHello(msg.PacketReader); err != nil {
-				counts.Count("handshake.hello.error", 1)
+				h.handshakes.counts.Count("handshake.hello.error", 1)
 				return nil, err
 			} else {
 				return &packet{0, rsp}, nil
 			}
 		case 0x38:
 			if rsp, yid, err := h.handleAssign(msg.PacketReader); err != nil {
-				counts.Count("handshake.assign.error", 1)
+				h.handshakes.counts.Count("handshake.assign.error", 1)
 				return nil, err
 			} else {
 				return &packet{yid, rsp}, nil
@@ -139,44 +167,40 @@ func (h *Handshake) handleHello(r *xio.PacketReader) (rtmfp.ResponseMessage, err
 		default:
 			return nil, errors.New(fmt.Sprintf("hello.unknown mode = 0x%02x", req.mode))
 		case 0x0f:
-			if s := session.FindByPid(string(req.epd)); s == nil {
-				counts.Count("p2p.session.notfound", 1)
+			if s := h.handshakes.sessions.FindByPid(string(req.epd)); s == nil {
+				if addrs, ok := h.handshakes.cluster.Introduce(string(req.epd), req.tag, h.raddr); ok {
+					h.handshakes.counts.Count("p2p.cluster.handshake", 1)
+					return &handshakeResponse{req.tag, addrs}, nil
+				}
+				h.handshakes.counts.Count("p2p.session.notfound", 1)
 				return nil, &handshakeError{"hello.handshake.session not found", req.epd, h.raddr}
 			} else if addrs, ok := s.Handshake(req.tag, h.raddr); !ok {
-				counts.Count("p2p.session.hasclosed", 1)
+				h.handshakes.counts.Count("p2p.session.hasclosed", 1)
 				return nil, &handshakeError{"hello.handshake.session has been closed", req.epd, h.raddr}
 			} else {
-				counts.Count("p2p.handshake", 1)
+				h.handshakes.counts.Count("p2p.handshake", 1)
 				return &handshakeResponse{req.tag, addrs}, nil
 			}
 		case 0x0a:
 			if uri, err := url.ParseRequestURI(string(req.epd)); err != nil {
 				return nil, errors.New("hello.parse uri")
-			} else if app := uri.Path; len(app) == 0 {
+			} else if len(uri.Path) == 0 {
 				return nil, errors.New("hello.parse app")
 			} else {
-				if ss := strings.Split(app, "/"); len(ss) != 1 {
-					app = ""
-					for _, s := range ss {
-						if len(s) != 0 {
-							app = s
-							break
-						}
-					}
-				}
-				if len(app) == 0 || !args.IsAuthorizedApp(app) {
-					counts.Count("handshake.app.unauthorized", 1)
-					return nil, errors.New(fmt.Sprintf("hello.unauthorized app = %s", app))
+				app := auth.AppName(uri.Path)
+				if err := h.handshakes.auth.AuthorizeHello(&auth.Hello{App: app, Query: uri.Query(), Addr: h.raddr}); err != nil {
+					h.handshakes.counts.Count("handshake.app.unauthorized", 1)
+					return nil, errors.New(fmt.Sprintf("hello.unauthorized app = %s, %v", app, err))
 				}
 			}
-			cookie := cookies.New()
+			cookie := h.handshakes.cookies.New()
 			if cookie == nil {
 				return nil, errors.New("hello.null cookie")
 			}
 			cookie.Lock()
 			defer cookie.Unlock()
-			counts.Count("handshake.hello", 1)
-			xlog.OutLog.Printf("[handshake]: new cookie from [%s]\n", h.raddr)
+			h.handshakes.counts.Count("handshake.hello", 1)
+			h.handshakes.logs.OutLog.Printf("[handshake]: new cookie from [%s]\n", h.raddr)
 			return &helloResponse{req.tag, cookie.Value()}, nil
 		}
 	}
@@ -186,25 +210,33 @@ func (h *Handshake) handleAssign(r *xio.PacketReader) (rtmfp.ResponseMessage, ui
 	if req, err := parseAssignRequest(r); err != nil {
 		return nil, 0, err
 	} else {
-		cookie := cookies.Find(string(req.cookie))
+		cookie := h.handshakes.cookies.Find(string(req.cookie))
 		if cookie == nil {
 			return nil, 0, errors.New("assign.cookie not found")
 		}
 		cookie.Lock()
 		defer cookie.Unlock()
 		if cookie.Xid == 0 {
-			responder, encrypt, decrypt := rtmfp.ComputeSharedKeys(h, req.pubkey, req.initiator)
+			engine, err := h.getDHEngine()
+			if err != nil {
+				return nil, 0, errors.New(fmt.Sprintf("assign.dh engine = %v", err))
+			}
+			responder, encrypt, decrypt, err := rtmfp.ComputeSharedKeys(engine, req.pubkey, req.initiator)
+			if err != nil {
+				h.handshakes.counts.Count("dh.pubkey.error", 1)
+				return nil, 0, errors.New(fmt.Sprintf("assign.shared keys = %v", err))
+			}
 			cookie.Pid = req.pid
 			cookie.Responder = responder
-			if xid, err := session.Create(req.yid, cookie.Pid, cookie.Value(), encrypt, decrypt, h.lport, h.raddr); err != nil {
-				counts.Count("handshake.session.error", 1)
+			if xid, err := h.handshakes.sessions.Create(req.yid, cookie.Pid, cookie.Value(), encrypt, decrypt, h.lport, h.raddr); err != nil {
+				h.handshakes.counts.Count("handshake.session.error", 1)
 				return nil, 0, errors.New(fmt.Sprintf("assign.create session = %v", err))
 			} else {
 				cookie.Xid = xid
-				counts.Count("handshake.assign", 1)
-				xlog.SssLog.Printf("[join] %s [%s] xid = %d\n", xlog.StringToHex(cookie.Pid), h.raddr, xid)
+				h.handshakes.counts.Count("handshake.assign", 1)
+				h.handshakes.logs.SssLog.Printf("[join] %s [%s] xid = %d\n", xlog.StringToHex(cookie.Pid), h.raddr, xid)
 			}
-			xlog.OutLog.Printf("[handshake]: new session xid = %d from [%s]\n", cookie.Xid, h.raddr)
+			h.handshakes.logs.OutLog.Printf("[handshake]: new session xid = %d from [%s]\n", cookie.Xid, h.raddr)
 		}
 		return &assignResponse{cookie.Xid, cookie.Responder}, req.yid, nil
 	}
@@ -0,0 +1,41 @@
+package handshake
+
+import (
+	"bytes"
+	"testing"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/args"
+	"github.com/spinlock/xserver/pkg/xserver/rtmfp"
+	"github.com/spinlock/xserver/pkg/xserver/xlog"
+)
+
+// Handshakes taken from and given back to the pool one after the other, as
+// they are under a light load, must not share a secret with the same peer.
+func TestHandshakeSecrets(t *testing.T) {
+	hs := New(args.New(args.Default()), nil, xlog.New(false, nil), nil, nil, nil, nil, nil)
+	peer, err := rtmfp.NewDHEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secrets [][]byte
+	for i := 0; i < 8; i++ {
+		h := hs.getHandshake()
+		e, err := h.getDHEngine()
+		hs.putHandshake(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := e.ComputeSecretKey(peer.GetPublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, x := range secrets {
+			if bytes.Equal(s, x) {
+				t.Fatalf("handshakes %d and %d share a secret", j, i)
+			}
+		}
+		secrets = append(secrets, s)
+	}
+}
@@ -3,55 +3,119 @@ package handshake
 import (
 	"container/list"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 import (
+	"github.com/spinlock/xserver/pkg/xserver/args"
+	"github.com/spinlock/xserver/pkg/xserver/auth"
+	"github.com/spinlock/xserver/pkg/xserver/cluster"
+	"github.com/spinlock/xserver/pkg/xserver/cookies"
 	"github.com/spinlock/xserver/pkg/xserver/counts"
+	"github.com/spinlock/xserver/pkg/xserver/session"
+	"github.com/spinlock/xserver/pkg/xserver/udp"
+	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
-var handshakes struct {
+// Handshakes answer the packets of the peers which have no session yet,
+// from a pool of prepared handshakes.
+type Handshakes struct {
 	list.List
+	draining int32
+	quit     chan struct{}
+	done     sync.WaitGroup
 	sync.Mutex
+
+	args     *args.Args
+	counts   *counts.Counts
+	logs     *xlog.Logs
+	auth     auth.Authorizer
+	cluster  *cluster.Cluster
+	cookies  *cookies.Cookies
+	sessions *session.Sessions
+	udp      *udp.Servers
+}
+
+func New(a *args.Args, c *counts.Counts, l *xlog.Logs, au auth.Authorizer, cl *cluster.Cluster,
+	cs *cookies.Cookies, ss *session.Sessions, us *udp.Servers) *Handshakes {
+	hs := &Handshakes{}
+	hs.Init()
+	hs.args, hs.counts, hs.logs, hs.auth = a, c, l, au
+	hs.cluster, hs.cookies, hs.sessions, hs.udp = cl, cs, ss, us
+	return hs
 }
 
-func init() {
-	handshakes.Init()
-	go func() {
+func (hs *Handshakes) Start() {
+	atomic.StoreInt32(&hs.draining, 0)
+	hs.quit = make(chan struct{})
+	hs.done.Add(1)
+	go func(quit <-chan struct{}) {
+		defer hs.done.Done()
 		for {
-			handshakes.Lock()
-			if e := handshakes.Back(); e != nil {
-				handshakes.Remove(e)
-				counts.Count("handshake.release", 1)
+			hs.Lock()
+			if e := hs.Back(); e != nil {
+				hs.Remove(e)
+				hs.counts.Count("handshake.release", 1)
 			}
-			n := handshakes.Len()
-			handshakes.Unlock()
+			n := hs.Len()
+			hs.Unlock()
+			wait := time.Second * 30
 			if n > 512 {
-				time.Sleep(time.Second * 2)
+				wait = time.Second * 2
 			} else if n > 128 {
-				time.Sleep(time.Second * 5)
-			} else {
-				time.Sleep(time.Second * 30)
+				wait = time.Second * 5
+			}
+			select {
+			case <-quit:
+				return
+			case <-time.After(wait):
 			}
 		}
-	}()
+	}(hs.quit)
+}
+
+func (hs *Handshakes) Stop() {
+	if hs.quit != nil {
+		close(hs.quit)
+		hs.done.Wait()
+		hs.quit = nil
+	}
+	hs.Lock()
+	hs.Init()
+	hs.Unlock()
+}
+
+// Pool is the number of prepared handshakes waiting to be used.
+func (hs *Handshakes) Pool() int {
+	hs.Lock()
+	defer hs.Unlock()
+	return hs.Len()
+}
+
+func (hs *Handshakes) Drain() {
+	atomic.StoreInt32(&hs.draining, 1)
+}
+
+func (hs *Handshakes) isDraining() bool {
+	return atomic.LoadInt32(&hs.draining) != 0
 }
 
-func getHandshake() *Handshake {
-	handshakes.Lock()
-	defer handshakes.Unlock()
-	if e := handshakes.Front(); e != nil {
-		return handshakes.Remove(e).(*Handshake)
+func (hs *Handshakes) getHandshake() *Handshake {
+	hs.Lock()
+	defer hs.Unlock()
+	if e := hs.Front(); e != nil {
+		return hs.Remove(e).(*Handshake)
 	} else {
-		return newHandshake()
+		return hs.newHandshake()
 	}
 }
 
-func putHandshake(h *Handshake) {
+func (hs *Handshakes) putHandshake(h *Handshake) {
 	if h == nil {
 		return
 	}
-	handshakes.Lock()
-	handshakes.PushFront(h)
-	handshakes.Unlock()
+	hs.Lock()
+	hs.PushFront(h)
+	hs.Unlock()
 }
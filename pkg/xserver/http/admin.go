@@ -0,0 +1,310 @@
+package xserver
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/amf"
+	"github.com/spinlock/xserver/pkg/xserver/amf/amf0"
+	"github.com/spinlock/xserver/pkg/xserver/session"
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+	maxPushSize     = 1024 * 64
+)
+
+// handleAdmin registers the endpoints which act on sessions and streams.
+// Every request must carry 'Authorization: Bearer <token>'; with no token
+// configured they all answer 403.
+//
+//	GET  /admin/session?xid=|pid=|addr=   the sessions found
+//	GET  /admin/sessions?addr=&closed=&idle=&offset=&limit=
+//	POST /admin/close?xid=&pid=&addr=     close the sessions found
+//	POST /admin/push?xid=&reliable=       recvPull the body to xids
+//	POST /admin/unpublish?stream=         stop the publisher of stream
+//
+// xid and pid may list several values separated by comma, pids in hex. The
+// body of push is a json array of values when its Content-Type says so, and
+// amf0 values otherwise.
+func handleAdmin(mux *http.ServeMux, token string, st *Status) {
+	admin := func(path string, method string, f func(r *http.Request) (int, interface{})) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			code, v := http.StatusOK, interface{}(nil)
+			if !authorized(r, token) {
+				st.Counts.Count("http.admin.unauthorized", 1)
+				code, v = http.StatusForbidden, errors.New("forbidden")
+			} else if r.Method != method {
+				code, v = http.StatusMethodNotAllowed, errors.New("use "+method)
+			} else {
+				st.Counts.Count("http.admin", 1)
+				code, v = f(r)
+			}
+			if err, ok := v.(error); ok {
+				v = map[string]string{"error": err.Error()}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			if b, err := json.MarshalIndent(v, "", "    "); err != nil {
+				fmt.Fprintf(w, "json: error = '%v'\n", err)
+			} else {
+				fmt.Fprintf(w, "%s\n", string(b))
+			}
+		})
+	}
+	admin("/admin/session", "GET", st.adminSession)
+	admin("/admin/sessions", "GET", st.adminSessions)
+	admin("/admin/close", "POST", st.adminClose)
+	admin("/admin/push", "POST", st.adminPush)
+	admin("/admin/unpublish", "POST", st.adminUnpublish)
+}
+
+func authorized(r *http.Request, token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(token)) == 1
+}
+
+// find returns the sessions named by the xid, pid and addr parameters.
+func (st *Status) find(r *http.Request) ([]*session.Session, error) {
+	q := r.URL.Query()
+	found := make([]*session.Session, 0)
+	seen := make(map[uint32]bool)
+	add := func(s *session.Session) {
+		if s != nil && !seen[s.Xid()] {
+			seen[s.Xid()] = true
+			found = append(found, s)
+		}
+	}
+	xids, err := parseXids(q.Get("xid"))
+	if err != nil {
+		return nil, err
+	}
+	for _, xid := range xids {
+		add(st.Sessions.FindByXid(xid))
+	}
+	for _, v := range split(q.Get("pid")) {
+		if pid, err := hex.DecodeString(v); err != nil {
+			return nil, errors.New(fmt.Sprintf("bad pid = '%s'", v))
+		} else {
+			add(st.Sessions.FindByPid(string(pid)))
+		}
+	}
+	if addrs := split(q.Get("addr")); len(addrs) != 0 {
+		for _, s := range st.Sessions.FindByAddr(addrs...) {
+			add(s)
+		}
+	}
+	if len(xids) == 0 && len(q.Get("pid")) == 0 && len(q.Get("addr")) == 0 {
+		return nil, errors.New("missing xid, pid or addr")
+	}
+	return found, nil
+}
+
+func (st *Status) adminSession(r *http.Request) (int, interface{}) {
+	found, err := st.find(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(found) == 0 {
+		return http.StatusNotFound, errors.New("session not found")
+	}
+	all := make([]map[string]interface{}, len(found))
+	for i, s := range found {
+		all[i] = s.Dump()
+	}
+	return http.StatusOK, all
+}
+
+func (st *Status) adminSessions(r *http.Request) (int, interface{}) {
+	q := r.URL.Query()
+	f := &session.Filter{Addr: q.Get("addr")}
+	if v := q.Get("closed"); len(v) != 0 {
+		if closed, err := strconv.ParseBool(v); err != nil {
+			return http.StatusBadRequest, errors.New(fmt.Sprintf("bad closed = '%s'", v))
+		} else {
+			f.Closed = &closed
+		}
+	}
+	if v := q.Get("idle"); len(v) != 0 {
+		if idle, err := strconv.Atoi(v); err != nil || idle < 0 {
+			return http.StatusBadRequest, errors.New(fmt.Sprintf("bad idle = '%s'", v))
+		} else {
+			f.Idle = time.Second * time.Duration(idle)
+		}
+	}
+	offset, limit := 0, defaultPageSize
+	if v := q.Get("offset"); len(v) != 0 {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return http.StatusBadRequest, errors.New(fmt.Sprintf("bad offset = '%s'", v))
+		} else {
+			offset = n
+		}
+	}
+	if v := q.Get("limit"); len(v) != 0 {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 || n > maxPageSize {
+			return http.StatusBadRequest, errors.New(fmt.Sprintf("bad limit = '%s'", v))
+		} else {
+			limit = n
+		}
+	}
+	total, page := st.Sessions.List(f, offset, limit)
+	return http.StatusOK, map[string]interface{}{
+		"total":    total,
+		"offset":   offset,
+		"limit":    limit,
+		"sessions": page,
+	}
+}
+
+func (st *Status) adminClose(r *http.Request) (int, interface{}) {
+	found, err := st.find(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	xids := make([]uint32, len(found))
+	for i, s := range found {
+		xids[i] = s.Xid()
+	}
+	if len(xids) != 0 {
+		st.Counts.Count("http.admin.close", len(xids))
+		log.Printf("[http]: admin close xids = %v\n", xids)
+		st.Sessions.CloseAll(xids)
+	}
+	return http.StatusOK, map[string]interface{}{"xids": xids}
+}
+
+func (st *Status) adminPush(r *http.Request) (int, interface{}) {
+	q := r.URL.Query()
+	xids, err := parseXids(q.Get("xid"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	} else if len(xids) == 0 {
+		return http.StatusBadRequest, errors.New("missing xid")
+	}
+	reliable := true
+	if v := q.Get("reliable"); len(v) != 0 {
+		if reliable, err = strconv.ParseBool(v); err != nil {
+			return http.StatusBadRequest, errors.New(fmt.Sprintf("bad reliable = '%s'", v))
+		}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPushSize+1))
+	if err != nil {
+		return http.StatusBadRequest, err
+	} else if len(body) > maxPushSize {
+		return http.StatusRequestEntityTooLarge, errors.New("body too large")
+	}
+	data := body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if data, err = jsonToAmf(body); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	if len(data) == 0 {
+		return http.StatusBadRequest, errors.New("empty body")
+	}
+	alive := make([]uint32, 0, len(xids))
+	for _, xid := range xids {
+		if st.Sessions.FindByXid(xid) != nil {
+			alive = append(alive, xid)
+		}
+	}
+	if len(alive) != 0 {
+		st.Counts.Count("http.admin.push", len(alive))
+		st.Sessions.RecvPull(alive, data, reliable)
+	}
+	return http.StatusOK, map[string]interface{}{"xids": alive}
+}
+
+func (st *Status) adminUnpublish(r *http.Request) (int, interface{}) {
+	stream := r.URL.Query().Get("stream")
+	if len(stream) == 0 {
+		return http.StatusBadRequest, errors.New("missing stream")
+	}
+	xid, ok := st.Sessions.Unpublish(stream)
+	if !ok {
+		return http.StatusNotFound, errors.New("stream not published")
+	}
+	log.Printf("[http]: admin unpublish stream = '%s', xid = %d\n", stream, xid)
+	return http.StatusOK, map[string]interface{}{"xid": xid}
+}
+
+func split(s string) []string {
+	vs := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) != 0 {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+func parseXids(s string) ([]uint32, error) {
+	xids := make([]uint32, 0)
+	for _, v := range split(s) {
+		if xid, err := strconv.ParseUint(v, 10, 32); err != nil || xid == 0 {
+			return nil, errors.New(fmt.Sprintf("bad xid = '%s'", v))
+		} else {
+			xids = append(xids, uint32(xid))
+		}
+	}
+	return xids, nil
+}
+
+// jsonToAmf encodes the values of a json array one after the other in amf0,
+// objects included; nested arrays are not supported.
+func jsonToAmf(body []byte) ([]byte, error) {
+	var values []interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	if err := d.Decode(&values); err != nil {
+		return nil, err
+	}
+	w := amf0.NewWriter(xio.NewPacketWriter(nil))
+	for _, v := range values {
+		if x, err := toAmf(v); err != nil {
+			return nil, err
+		} else if err := w.Write(x); err != nil {
+			return nil, err
+		}
+	}
+	return w.Bytes(), nil
+}
+
+func toAmf(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		o := amf.NewObject()
+		for field, x := range v {
+			if x, err := toAmf(x); err != nil {
+				return nil, err
+			} else if err := o.Set(field, x); err != nil {
+				return nil, err
+			}
+		}
+		return o, nil
+	case []interface{}:
+		return nil, errors.New("json arrays are not supported")
+	default:
+		return v, nil
+	}
+}
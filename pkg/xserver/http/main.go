@@ -3,81 +3,121 @@ package xserver
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"runtime"
 	"time"
 )
 
 import (
-	"github.com/spinlock/xserver/pkg/xserver/args"
+	"github.com/spinlock/xserver/pkg/xserver/async"
+	"github.com/spinlock/xserver/pkg/xserver/cluster"
 	"github.com/spinlock/xserver/pkg/xserver/cookies"
 	"github.com/spinlock/xserver/pkg/xserver/counts"
+	"github.com/spinlock/xserver/pkg/xserver/handshake"
+	"github.com/spinlock/xserver/pkg/xserver/rpc"
 	"github.com/spinlock/xserver/pkg/xserver/session"
 	"github.com/spinlock/xserver/pkg/xserver/utils"
 )
 
-func init() {
-	if port := args.HttpPort(); port != 0 {
-		go func() {
-			http.HandleFunc("/summary", func(w http.ResponseWriter, r *http.Request) {
-				const divMB = uint64(1024 * 1024)
-				var mem runtime.MemStats
-				runtime.ReadMemStats(&mem)
-				s := map[string]interface{}{
-					"time": map[string]interface{}{
-						"current": time.Now().Unix(),
-						"boot":    utils.Starttime,
-					},
-					"heap": map[string]interface{}{
-						"alloc":   mem.HeapAlloc / divMB,
-						"sys":     mem.HeapSys / divMB,
-						"idle":    mem.HeapIdle / divMB,
-						"inuse":   mem.HeapInuse / divMB,
-						"objects": mem.HeapObjects / divMB,
-					},
-					"runtime": map[string]interface{}{
-						"routines": runtime.NumGoroutine(),
-						"nproc":    runtime.GOMAXPROCS(0),
-					},
-					"build": map[string]interface{}{
-						"version": utils.Version,
-						"compile": utils.Compile,
-					},
-					"cookies": cookies.Count(),
-					"session": session.Summary(),
-					"streams": session.Streams(),
-					"counts":  counts.Snapshot(),
-				}
-				if b, err := json.MarshalIndent(s, "", "    "); err != nil {
-					fmt.Fprintf(w, "json: error = '%v'\n", err)
-				} else {
-					fmt.Fprintf(w, "%s\n", string(b))
-				}
-			})
-			http.HandleFunc("/mapsize", func(w http.ResponseWriter, r *http.Request) {
-				if b, err := json.Marshal(session.MapSize()); err != nil {
-					fmt.Fprintf(w, "json: error = '%v'\n", err)
-				} else {
-					fmt.Fprintf(w, "%s\n", string(b))
-				}
-			})
-			http.HandleFunc("/dumpall", func(w http.ResponseWriter, r *http.Request) {
-				if b, err := json.MarshalIndent(session.DumpAll(), "", "    "); err != nil {
-					fmt.Fprintf(w, "json: error = '%v'\n", err)
-				} else {
-					fmt.Fprintf(w, "%s\n", string(b))
-				}
-			})
-			http.HandleFunc("/streams", func(w http.ResponseWriter, r *http.Request) {
-				if b, err := json.MarshalIndent(session.DumpStreams(), "", "    "); err != nil {
-					fmt.Fprintf(w, "json: error = '%v'\n", err)
-				} else {
-					fmt.Fprintf(w, "%s\n", string(b))
-				}
-			})
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-				utils.Panic(fmt.Sprintf("http.listen = %d, error = '%v'", port, err))
-			}
-		}()
+// Status are the parts of a server its pages show and act on.
+type Status struct {
+	Counts     *counts.Counts
+	Async      *async.Pool
+	Cookies    *cookies.Cookies
+	Sessions   *session.Sessions
+	Handshakes *handshake.Handshakes
+	Cluster    *cluster.Cluster
+	Link       *rpc.Link
+}
+
+// Start serves the status pages of st on port, and the /admin/ endpoints to
+// the requests carrying token.
+func Start(port uint16, token string, st *Status) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/summary", func(w http.ResponseWriter, r *http.Request) {
+		const divMB = uint64(1024 * 1024)
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		s := map[string]interface{}{
+			"time": map[string]interface{}{
+				"current": time.Now().Unix(),
+				"boot":    utils.Starttime,
+			},
+			"heap": map[string]interface{}{
+				"alloc":   mem.HeapAlloc / divMB,
+				"sys":     mem.HeapSys / divMB,
+				"idle":    mem.HeapIdle / divMB,
+				"inuse":   mem.HeapInuse / divMB,
+				"objects": mem.HeapObjects / divMB,
+			},
+			"runtime": map[string]interface{}{
+				"routines": runtime.NumGoroutine(),
+				"nproc":    runtime.GOMAXPROCS(0),
+			},
+			"build": map[string]interface{}{
+				"version": utils.Version,
+				"compile": utils.Compile,
+			},
+			"cookies": st.Cookies.Count(),
+			"session": st.Sessions.Summary(),
+			"streams": st.Sessions.Streams(),
+			"groups":  st.Sessions.Groups(),
+			"cluster": st.Cluster.Summary(),
+			"counts":  st.Counts.Snapshot(),
+		}
+		if b, err := json.MarshalIndent(s, "", "    "); err != nil {
+			fmt.Fprintf(w, "json: error = '%v'\n", err)
+		} else {
+			fmt.Fprintf(w, "%s\n", string(b))
+		}
+	})
+	mux.HandleFunc("/mapsize", func(w http.ResponseWriter, r *http.Request) {
+		if b, err := json.Marshal(st.Sessions.MapSize()); err != nil {
+			fmt.Fprintf(w, "json: error = '%v'\n", err)
+		} else {
+			fmt.Fprintf(w, "%s\n", string(b))
+		}
+	})
+	mux.HandleFunc("/dumpall", func(w http.ResponseWriter, r *http.Request) {
+		if b, err := json.MarshalIndent(st.Sessions.DumpAll(), "", "    "); err != nil {
+			fmt.Fprintf(w, "json: error = '%v'\n", err)
+		} else {
+			fmt.Fprintf(w, "%s\n", string(b))
+		}
+	})
+	mux.HandleFunc("/streams", func(w http.ResponseWriter, r *http.Request) {
+		if b, err := json.MarshalIndent(st.Sessions.DumpStreams(), "", "    "); err != nil {
+			fmt.Fprintf(w, "json: error = '%v'\n", err)
+		} else {
+			fmt.Fprintf(w, "%s\n", string(b))
+		}
+	})
+	mux.HandleFunc("/groups", func(w http.ResponseWriter, r *http.Request) {
+		if b, err := json.MarshalIndent(st.Sessions.DumpGroups(), "", "    "); err != nil {
+			fmt.Fprintf(w, "json: error = '%v'\n", err)
+		} else {
+			fmt.Fprintf(w, "%s\n", string(b))
+		}
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := st.writeMetrics(w); err != nil {
+			log.Printf("[http]: write metrics error = '%v'\n", err)
+		}
+	})
+	handleAdmin(mux, token, st)
+	mux.Handle("/debug/", http.DefaultServeMux)
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
 	}
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("[http]: serve port %d failed '%v'\n", port, err)
+		}
+	}()
+	return srv, nil
 }
@@ -0,0 +1,112 @@
+package xserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/async"
+)
+
+// writeMetrics writes every counts key as a counter, the table sizes as
+// gauges, the async groups with a group label and the registered
+// histograms, in the Prometheus text format.
+func (st *Status) writeMetrics(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	totals := st.Counts.Totals()
+	keys := make([]string, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := metricName(k) + "_total"
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		fmt.Fprintf(w, "%s %d\n", name, totals[k])
+	}
+
+	backlog, maxBacklog := st.Sessions.Backlog()
+	nodes, remotes := st.Cluster.Nodes()
+	pulls, pushes := st.Cluster.Streams()
+	gauges := []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"sessions", "sessions in the session table", st.Sessions.Count()},
+		{"session_timers", "sessions waiting for a deadline on the timing wheels", st.Sessions.Timers()},
+		{"publications", "streams being published", st.Sessions.Streams()},
+		{"cookies", "handshake cookies waiting for an assign", st.Cookies.Count()},
+		{"handshakes_pool", "prepared handshakes in the pool", st.Handshakes.Pool()},
+		{"rpc_backends_up", "rpc backends connected", st.Link.Healthy()},
+		{"cluster_nodes", "other nodes of the cluster heard from", nodes},
+		{"cluster_sessions", "sessions held by the other nodes of the cluster", remotes},
+		{"cluster_pulls", "streams pulled from the other nodes of the cluster", pulls},
+		{"cluster_pushes", "streams pushed to the other nodes of the cluster, once per node", pushes},
+		{"backlog_bytes", "data held by the outgoing flows of all sessions", backlog},
+		{"backlog_max_bytes", "data held by the outgoing flows of the busiest session", maxBacklog},
+	}
+	for _, g := range gauges {
+		name := metricName(g.name)
+		fmt.Fprintf(w, "# HELP %s %s\n", name, g.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(w, "%s %d\n", name, g.value)
+	}
+
+	groups := st.Async.Groups()
+	for _, m := range []struct {
+		name  string
+		kind  string
+		help  string
+		value func(s *async.Stats) string
+	}{
+		{"async_group_depth", "gauge", "calls queued in the async group", func(s *async.Stats) string { return strconv.Itoa(s.Depth) }},
+		{"async_group_calls_total", "counter", "calls made to the async group", func(s *async.Stats) string { return strconv.FormatUint(s.Calls, 10) }},
+		{"async_group_done_total", "counter", "calls run by the async group", func(s *async.Stats) string { return strconv.FormatUint(s.Done, 10) }},
+		{"async_group_rejected_total", "counter", "calls the async group had no room for", func(s *async.Stats) string { return strconv.FormatUint(s.Rejected, 10) }},
+		{"async_group_dropped_total", "counter", "queued calls the async group dropped for newer ones", func(s *async.Stats) string { return strconv.FormatUint(s.Dropped, 10) }},
+		{"async_group_wait_seconds_total", "counter", "time the calls run by the async group waited in its queue", func(s *async.Stats) string { return formatFloat(s.Wait.Seconds()) }},
+		{"async_group_run_seconds_total", "counter", "time the calls run by the async group took", func(s *async.Stats) string { return formatFloat(s.Run.Seconds()) }},
+	} {
+		name := metricName(m.name)
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind)
+		for i := range groups {
+			fmt.Fprintf(w, "%s{group=\"%d\"} %s\n", name, i, m.value(&groups[i]))
+		}
+	}
+
+	for _, h := range st.Counts.Histograms() {
+		name := metricName(h.Name())
+		bounds, values, count, sum := h.Snapshot()
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for i, b := range bounds {
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), values[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+		fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count %d\n", name, count)
+	}
+	return w.Flush()
+}
+
+func metricName(key string) string {
+	b := []byte("xserver_" + key)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		default:
+			b[i] = '_'
+		}
+	}
+	return strings.ToLower(string(b))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
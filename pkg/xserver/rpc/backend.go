@@ -0,0 +1,268 @@
+package rpc
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+import (
+	"github.com/golang/protobuf/proto"
+
+	"github.com/spinlock/xserver/pkg/xserver/tcp"
+)
+
+type request struct {
+	seq uint64
+	bs  []byte
+}
+
+// Backend is one rpc server of the -remote list. It is up while connected,
+// and keeps the requests it has not acknowledged yet, in the order they were
+// sent, so they can be replayed after a reconnect, whether or not it has
+// ever acked. A backend which does not ack skips the replays by seq, or
+// gets the last maxPendingRequests requests again.
+type Backend struct {
+	*tcp.Client
+	link  *Link
+	addr  string
+	state struct {
+		list  []*request
+		seq   uint64
+		acked bool
+		up    bool
+		sync.Mutex
+	}
+	// ordered is held from numbering a request until it is queued, so the
+	// connection carries requests in seq order.
+	ordered sync.Mutex
+}
+
+const maxPendingRequests = 1024 * 16
+
+func (l *Link) NewBackend(ip string, port uint16, sec *tcp.Security) *Backend {
+	b := &Backend{}
+	b.link = l
+	b.addr = net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	b.Client = tcp.DialHooks(ip, port, sec, &tcp.Hooks{
+		Connect:    b.connect,
+		Disconnect: b.disconnect,
+	}, l.counts, l.logs.TcpLog)
+	return b
+}
+
+func (b *Backend) Addr() string {
+	return b.addr
+}
+
+func (b *Backend) Up() bool {
+	b.state.Lock()
+	defer b.state.Unlock()
+	return b.state.up
+}
+
+// connect returns the unacknowledged requests, to be sent first on the new
+// connection.
+func (b *Backend) connect() [][]byte {
+	b.state.Lock()
+	defer b.state.Unlock()
+	b.state.up = true
+	b.link.counts.Count("rpc.backend.up", 1)
+	bss := make([][]byte, len(b.state.list))
+	for i, r := range b.state.list {
+		bss[i] = r.bs
+	}
+	b.link.counts.Count("rpc.replay", len(bss))
+	return bss
+}
+
+func (b *Backend) disconnect() {
+	b.state.Lock()
+	b.state.up = false
+	b.state.Unlock()
+	b.link.counts.Count("rpc.backend.down", 1)
+	log.Printf("[rpc]: backend %s is down\n", b.addr)
+	b.link.failover(b)
+}
+
+// Acked drops the requests the backend has handled, up to seq.
+func (b *Backend) Acked(seq uint64) {
+	if seq == 0 {
+		return
+	}
+	b.state.Lock()
+	defer b.state.Unlock()
+	b.state.acked = true
+	n := 0
+	for n < len(b.state.list) && b.state.list[n].seq <= seq {
+		b.state.list[n] = nil
+		n++
+	}
+	b.state.list = b.state.list[n:]
+	b.link.counts.Count("rpc.acked", n)
+}
+
+// send numbers x, keeps it for replay and queues it. A replay taken while a
+// request waits to be queued resends it too, which the backend skips by seq.
+func (b *Backend) send(x *XRequest) error {
+	if b == nil {
+		return errors.New("rpc.send.no backend")
+	}
+	b.link.Lock()
+	epoch := b.link.epoch
+	b.link.Unlock()
+	b.ordered.Lock()
+	defer b.ordered.Unlock()
+	b.state.Lock()
+	seq := b.state.seq + 1
+	x.Seq, x.Epoch = &seq, &epoch
+	bs, err := proto.Marshal(x)
+	if err != nil {
+		b.state.Unlock()
+		return err
+	}
+	b.state.seq = seq
+	if len(b.state.list) >= maxPendingRequests {
+		if b.state.acked {
+			b.link.counts.Count("rpc.pending.overflow", 1)
+		}
+		b.state.list[0] = nil
+		b.state.list = b.state.list[1:]
+	}
+	b.state.list = append(b.state.list, &request{seq, bs})
+	b.state.Unlock()
+	b.Send(bs)
+	return nil
+}
+
+type point struct {
+	hash uint32
+	b    *Backend
+}
+
+const pointsPerBackend = 64
+
+// newRing places every backend at many points of a hash ring, so that the
+// xids of a failed backend spread over the others.
+func newRing(backends []*Backend) []point {
+	ring := make([]point, 0, len(backends)*pointsPerBackend)
+	for _, b := range backends {
+		for i := 0; i < pointsPerBackend; i++ {
+			h := fnv.New32a()
+			h.Write([]byte(b.addr + "#" + strconv.Itoa(i)))
+			ring = append(ring, point{h.Sum32(), b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+// lookup walks the ring from the hash of xid to the first backend that is
+// up, or returns the first one met when all of them are down.
+func lookup(ring []point, xid uint32) *Backend {
+	if len(ring) == 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte{uint8(xid >> 24), uint8(xid >> 16), uint8(xid >> 8), uint8(xid)})
+	x := h.Sum32()
+	i := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= x
+	})
+	for n := 0; n < len(ring); n++ {
+		if b := ring[(i+n)%len(ring)].b; b.Up() {
+			return b
+		}
+	}
+	return ring[i%len(ring)].b
+}
+
+type owner struct {
+	b     *Backend
+	raddr *net.UDPAddr
+}
+
+// route returns the backend for the requests of xid: the one it joined
+// while that one is up. Otherwise xid moves to the backend the ring gives,
+// leaving the old one with an exit and arriving at the new one with a fresh
+// join. Callers run in the async routine of xid, which keeps the order.
+func (l *Link) route(xid uint32, raddr *net.UDPAddr) *Backend {
+	l.Lock()
+	if l.owners == nil {
+		l.Unlock()
+		return nil
+	}
+	o := l.owners[xid]
+	if o == nil {
+		o = &owner{}
+		l.owners[xid] = o
+	}
+	if raddr != nil {
+		o.raddr = raddr
+	}
+	from := o.b
+	if from != nil && from.Up() {
+		l.Unlock()
+		return from
+	}
+	to := lookup(l.ring, xid)
+	if from != nil && !to.Up() {
+		to = from
+	}
+	o.b = to
+	raddr = o.raddr
+	l.Unlock()
+	if from != nil && from != to {
+		l.counts.Count("rpc.failover", 1)
+		from.send(l.newXRequest(xid, raddr, "exit", 0, nil, true))
+		to.send(l.newXRequest(xid, raddr, "join", 0, nil, true))
+	}
+	return to
+}
+
+// Forget drops the backend xid is routed to. The exit of xid does it, and
+// so does the cleanup of its session, in case the exit was lost.
+func (l *Link) Forget(xid uint32) {
+	l.Lock()
+	delete(l.owners, xid)
+	l.Unlock()
+}
+
+// failover moves the xids of b as soon as it goes down, rather than at
+// their next request.
+func (l *Link) failover(b *Backend) {
+	l.Lock()
+	xids := make([]uint32, 0)
+	for xid, o := range l.owners {
+		if o.b == b {
+			xids = append(xids, xid)
+		}
+	}
+	l.Unlock()
+	for _, xid := range xids {
+		xid := xid
+		l.async.Call(uint64(xid), func() {
+			l.route(xid, nil)
+		})
+	}
+}
+
+// Healthy returns the number of backends that are up.
+func (l *Link) Healthy() int {
+	l.Lock()
+	backends := l.backends
+	l.Unlock()
+	n := 0
+	for _, b := range backends {
+		if b.Up() {
+			n++
+		}
+	}
+	return n
+}
@@ -2,63 +2,264 @@ package rpc
 
 import (
 	"net"
+	"sync"
+	"time"
 )
 
 import (
 	"github.com/golang/protobuf/proto"
 
-	"github.com/spinlock/xserver/pkg/xserver/args"
 	"github.com/spinlock/xserver/pkg/xserver/async"
 	"github.com/spinlock/xserver/pkg/xserver/counts"
-	"github.com/spinlock/xserver/pkg/xserver/tcp"
 	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
-func Join(xid uint32, raddr *net.UDPAddr) {
-	if clt := tcp.GetClient(); clt == nil {
+// Link routes the requests of a server to its backends.
+type Link struct {
+	backends []*Backend
+	ring     []point
+	owners   map[uint32]*owner
+	port     uint16
+	epoch    uint64
+	sync.Mutex
+
+	// calls remembers when each call expecting an answer was sent, so
+	// Answered can time the round trip through the backend.
+	calls struct {
+		m map[callKey]int64
+		sync.Mutex
+	}
+	// asks are requests made by the server itself, see Ask.
+	asks struct {
+		m    map[callKey]*ask
+		last float64
+		sync.Mutex
+	}
+
+	counts  *counts.Counts
+	logs    *xlog.Logs
+	async   *async.Pool
+	latency *counts.Histogram
+}
+
+type callKey struct {
+	xid      uint32
+	callback float64
+}
+
+const maxPendingCalls = 1024 * 64
+
+type ask struct {
+	reply func([]byte, bool)
+	timer *time.Timer
+}
+
+func New(c *counts.Counts, logs *xlog.Logs, a *async.Pool) *Link {
+	l := &Link{}
+	l.calls.m = make(map[callKey]int64)
+	l.asks.m = make(map[callKey]*ask)
+	l.counts, l.logs, l.async = c, logs, a
+	l.latency = c.NewHistogram("rpc.latency.seconds", 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5)
+	return l
+}
+
+// Start routes requests to backends. The epoch tells the backends that the
+// seq of a new process starts over.
+func (l *Link) Start(backends []*Backend, port uint16) {
+	l.Lock()
+	defer l.Unlock()
+	l.backends, l.port = backends, port
+	l.ring = newRing(backends)
+	l.owners = make(map[uint32]*owner)
+	l.epoch = uint64(time.Now().UnixNano())
+}
+
+func (l *Link) Stop() {
+	l.Lock()
+	defer l.Unlock()
+	l.backends, l.port = nil, 0
+	l.ring, l.owners = nil, nil
+}
+
+func (l *Link) enabled() bool {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.backends) != 0
+}
+
+func (l *Link) Join(xid uint32, raddr *net.UDPAddr) {
+	if !l.enabled() {
+		return
+	} else {
+		l.counts.Count("rpc.join", 1)
+		x := l.newXRequest(xid, raddr, "join", 0, nil, true)
+		l.async.Call(uint64(xid), func() {
+			if err := l.route(xid, raddr).send(x); err != nil {
+				l.counts.Count("rpc.join.error", 1)
+				l.logs.ErrLog.Printf("[rpc]: rpc join error = '%v'\n", err)
+			}
+		})
+	}
+}
+
+func (l *Link) Exit(xid uint32, raddr *net.UDPAddr) {
+	if !l.enabled() {
 		return
-	} else if bs, err := newXRequest(xid, raddr, "join", 0, nil, true); err != nil {
-		counts.Count("rpc.join.error", 1)
-		xlog.ErrLog.Printf("[rpc]: rpc join error = '%v'\n", err)
 	} else {
-		counts.Count("rpc.join", 1)
-		async.Call(uint64(xid), func() {
-			clt.Send(bs)
+		l.counts.Count("rpc.exit", 1)
+		x := l.newXRequest(xid, raddr, "exit", 0, nil, true)
+		l.async.Call(uint64(xid), func() {
+			if err := l.route(xid, raddr).send(x); err != nil {
+				l.counts.Count("rpc.exit.error", 1)
+				l.logs.ErrLog.Printf("[rpc]: rpc exit error = '%v'\n", err)
+			}
+			l.Forget(xid)
 		})
 	}
 }
 
-func Exit(xid uint32, raddr *net.UDPAddr) {
-	if clt := tcp.GetClient(); clt == nil {
+// Migrate tells the backend that xid has moved from one address to another:
+// the request carries the new address, and the old one as data.
+func (l *Link) Migrate(xid uint32, from, to *net.UDPAddr) {
+	if !l.enabled() {
 		return
-	} else if bs, err := newXRequest(xid, raddr, "exit", 0, nil, true); err != nil {
-		counts.Count("rpc.exit.error", 1)
-		xlog.ErrLog.Printf("[rpc]: rpc exit error = '%v'\n", err)
 	} else {
-		counts.Count("rpc.exit", 1)
-		async.Call(uint64(xid), func() {
-			clt.Send(bs)
+		l.counts.Count("rpc.migrate", 1)
+		x := l.newXRequest(xid, to, "migrate", 0, []byte(from.String()), true)
+		l.async.Call(uint64(xid), func() {
+			if err := l.route(xid, to).send(x); err != nil {
+				l.counts.Count("rpc.migrate.error", 1)
+				l.logs.ErrLog.Printf("[rpc]: rpc migrate error = '%v'\n", err)
+			}
 		})
 	}
 }
 
-func Call(xid uint32, raddr *net.UDPAddr, callback float64, data []byte, reliable bool) {
-	if clt := tcp.GetClient(); clt == nil {
-		counts.Count("rpc.call.noclient", 1)
-		xlog.ErrLog.Printf("[rpc]: rpc is disabled\n")
-	} else if bs, err := newXRequest(xid, raddr, "call", callback, data, reliable); err != nil {
-		counts.Count("rpc.call.error", 1)
-		xlog.ErrLog.Printf("[rpc]: rpc call error = '%v'\n", err)
+func (l *Link) ExitAll(xids []uint32, raddrs []*net.UDPAddr) {
+	if !l.enabled() || len(xids) == 0 {
+		return
+	} else {
+		l.counts.Count("rpc.exit", len(xids))
+		for i, xid := range xids {
+			if err := l.route(xid, raddrs[i]).send(l.newXRequest(xid, raddrs[i], "exit", 0, nil, true)); err != nil {
+				l.counts.Count("rpc.exit.error", 1)
+				l.logs.ErrLog.Printf("[rpc]: rpc exit error = '%v'\n", err)
+			}
+			l.Forget(xid)
+		}
+	}
+}
+
+func (l *Link) Call(xid uint32, raddr *net.UDPAddr, callback float64, data []byte, reliable bool) {
+	if !l.enabled() {
+		l.counts.Count("rpc.call.noclient", 1)
+		l.logs.ErrLog.Printf("[rpc]: rpc is disabled\n")
 	} else {
-		counts.Count("rpc.call", 1)
-		async.Call(uint64(xid), func() {
-			clt.Send(bs)
+		l.counts.Count("rpc.call", 1)
+		if callback != 0 {
+			l.track(callKey{xid, callback})
+		}
+		x := l.newXRequest(xid, raddr, "call", callback, data, reliable)
+		l.async.Call(uint64(xid), func() {
+			if err := l.route(xid, raddr).send(x); err != nil {
+				l.counts.Count("rpc.call.error", 1)
+				l.logs.ErrLog.Printf("[rpc]: rpc call error = '%v'\n", err)
+			}
 		})
 	}
 }
 
-func newXRequest(xid uint32, raddr *net.UDPAddr, code string, callback float64, data []byte, reliable bool) ([]byte, error) {
-	port := uint32(args.RpcListenPort())
+func (l *Link) track(key callKey) {
+	now := time.Now().UnixNano()
+	l.calls.Lock()
+	defer l.calls.Unlock()
+	if len(l.calls.m) >= maxPendingCalls {
+		expired := now - int64(time.Minute)
+		for k, t := range l.calls.m {
+			if t < expired {
+				delete(l.calls.m, k)
+			}
+		}
+		if len(l.calls.m) >= maxPendingCalls {
+			l.counts.Count("rpc.track.full", 1)
+			return
+		}
+	}
+	l.calls.m[key] = now
+}
+
+// Ask sends code and data about xid to the backend and calls reply with the
+// data of the XResponse answering it, or with false if none comes within
+// timeout. Asks use negative callbacks, which clients never do.
+func (l *Link) Ask(xid uint32, raddr *net.UDPAddr, code string, data []byte, timeout time.Duration, reply func([]byte, bool)) {
+	if !l.enabled() {
+		l.counts.Count("rpc.ask.noclient", 1)
+		reply(nil, false)
+		return
+	}
+	l.asks.Lock()
+	l.asks.last--
+	key := callKey{xid, l.asks.last}
+	a := &ask{reply: reply}
+	l.asks.m[key] = a
+	a.timer = time.AfterFunc(timeout, func() {
+		if l.takeAsk(key) != nil {
+			l.counts.Count("rpc.ask.timeout", 1)
+			reply(nil, false)
+		}
+	})
+	l.asks.Unlock()
+	l.counts.Count("rpc.ask", 1)
+	l.track(key)
+	x := l.newXRequest(xid, raddr, code, key.callback, data, true)
+	l.async.Call(uint64(xid), func() {
+		if err := l.route(xid, raddr).send(x); err != nil {
+			l.counts.Count("rpc.ask.error", 1)
+			l.logs.ErrLog.Printf("[rpc]: rpc ask error = '%v'\n", err)
+			if l.takeAsk(key) != nil {
+				reply(nil, false)
+			}
+		}
+	})
+}
+
+func (l *Link) takeAsk(key callKey) *ask {
+	l.asks.Lock()
+	defer l.asks.Unlock()
+	if a := l.asks.m[key]; a != nil {
+		delete(l.asks.m, key)
+		a.timer.Stop()
+		return a
+	}
+	return nil
+}
+
+// Answered is called for every XResponse. It records the latency of the call
+// answered, and returns true when the response belongs to an Ask rather than
+// to a client.
+func (l *Link) Answered(xid uint32, callback float64, data []byte) bool {
+	key := callKey{xid, callback}
+	defer func() {
+		if callback < 0 {
+			if a := l.takeAsk(key); a != nil {
+				a.reply(data, true)
+			}
+		}
+	}()
+	l.calls.Lock()
+	t, ok := l.calls.m[key]
+	delete(l.calls.m, key)
+	l.calls.Unlock()
+	if ok {
+		l.latency.Observe(float64(time.Now().UnixNano()-t) / float64(time.Second))
+	}
+	return callback < 0
+}
+
+func (l *Link) newXRequest(xid uint32, raddr *net.UDPAddr, code string, callback float64, data []byte, reliable bool) *XRequest {
+	l.Lock()
+	port := uint32(l.port)
+	l.Unlock()
 	x := &XRequest{}
 	x.Port = &port
 	x.Code = &code
@@ -72,25 +273,35 @@ func newXRequest(xid uint32, raddr *net.UDPAddr, code string, callback float64,
 		x.Data = data
 	}
 	x.Xid = &xid
-	return proto.Marshal(x)
+	return x
 }
 
-func DecodeXResponse(bs []byte) *XResponse {
+func (l *Link) DecodeXResponse(bs []byte) *XResponse {
 	x := &XResponse{}
 	if err := proto.Unmarshal(bs, x); err != nil {
-		counts.Count("rpc.xresponse.error", 1)
-		xlog.ErrLog.Printf("[rpc]: rpc decode.xresponse error = '%v'\n", err)
+		l.counts.Count("rpc.xresponse.error", 1)
+		l.logs.ErrLog.Printf("[rpc]: rpc decode.xresponse error = '%v'\n", err)
 		return nil
 	}
 	return x
 }
 
-func DecodeXMessage(bs []byte) *XMessage {
+func (l *Link) DecodeXMessage(bs []byte) *XMessage {
 	x := &XMessage{}
 	if err := proto.Unmarshal(bs, x); err != nil {
-		counts.Count("rpc.xmessage.error", 1)
-		xlog.ErrLog.Printf("[rpc]: rpc decode.xmessage error = '%v'\n", err)
+		l.counts.Count("rpc.xmessage.error", 1)
+		l.logs.ErrLog.Printf("[rpc]: rpc decode.xmessage error = '%v'\n", err)
 		return nil
 	}
 	return x
 }
+
+func (l *Link) EncodeXReply(x *XReply) []byte {
+	bs, err := proto.Marshal(x)
+	if err != nil {
+		l.counts.Count("rpc.xreply.error", 1)
+		l.logs.ErrLog.Printf("[rpc]: rpc encode.xreply error = '%v'\n", err)
+		return nil
+	}
+	return bs
+}
@@ -1,15 +1,17 @@
 package rtmfp
 
 import (
+	"crypto/rand"
+	"errors"
 	"math/big"
 )
 
-import (
-	"github.com/spinlock/xserver/pkg/xserver/utils"
+const (
+	DHKeySize = 0x80
 )
 
 var dh struct {
-	p, g, a, xa *big.Int
+	p, g, pm1 *big.Int
 }
 
 func init() {
@@ -33,35 +35,53 @@ func init() {
 		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
 	})
 	g := big.NewInt(2)
-	a := big.NewInt(2048)
-	xa := &big.Int{}
-	xa.Exp(g, a, p)
-	if len(xa.Bytes()) != 0x80 {
-		utils.Panic("invalid private key, public key size should be 0x80")
-	}
-	dh.p, dh.g, dh.a, dh.xa = p, g, a, xa
+	dh.p, dh.g = p, g
+	dh.pm1 = (&big.Int{}).Sub(p, big.NewInt(1))
 }
 
 type DHEngine interface {
 	GetPublicKey() []byte
-	ComputeSecretKey(pubkey []byte) []byte
+	ComputeSecretKey(pubkey []byte) ([]byte, error)
 }
 
 type dhEngine struct {
+	a, xa *big.Int
 }
 
-func NewDHEngine() *dhEngine {
-	return &dhEngine{}
+func NewDHEngine() (*dhEngine, error) {
+	buf := make([]byte, DHKeySize)
+	for i := 0; i < 8; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		a := &big.Int{}
+		a.SetBytes(buf)
+		if a.Sign() == 0 {
+			continue
+		}
+		xa := &big.Int{}
+		xa.Exp(dh.g, a, dh.p)
+		if len(xa.Bytes()) != DHKeySize {
+			continue
+		}
+		return &dhEngine{a, xa}, nil
+	}
+	return nil, errors.New("dh.generate private key")
 }
 
 func (e *dhEngine) GetPublicKey() []byte {
-	return dh.xa.Bytes()
+	return e.xa.Bytes()
 }
 
-func (e *dhEngine) ComputeSecretKey(pubkey []byte) []byte {
+// ComputeSecretKey refuses the public keys in {0, 1, p-1} or not below p,
+// which would force the secret to one of a few known values.
+func (e *dhEngine) ComputeSecretKey(pubkey []byte) ([]byte, error) {
 	xb := &big.Int{}
 	xb.SetBytes(pubkey)
+	if xb.Cmp(big.NewInt(1)) <= 0 || xb.Cmp(dh.pm1) >= 0 {
+		return nil, errors.New("dh.bad public key")
+	}
 	s := &big.Int{}
-	s.Exp(xb, dh.a, dh.p)
-	return s.Bytes()
+	s.Exp(xb, e.a, dh.p)
+	return s.Bytes(), nil
 }
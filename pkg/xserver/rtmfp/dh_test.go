@@ -0,0 +1,48 @@
+package rtmfp
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestComputeSecretKey(t *testing.T) {
+	a, err := NewDHEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewDHEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, err := a.ComputeSecretKey(b.GetPublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := b.ComputeSecretKey(a.GetPublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sa, sb) {
+		t.Fatal("secrets differ")
+	}
+}
+
+func TestComputeSecretKeyBadPublicKey(t *testing.T) {
+	e, err := NewDHEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := big.NewInt(1)
+	for _, x := range []*big.Int{
+		big.NewInt(0),
+		one,
+		(&big.Int{}).Sub(dh.p, one),
+		dh.p,
+		(&big.Int{}).Add(dh.p, one),
+	} {
+		if _, err := e.ComputeSecretKey(x.Bytes()); err == nil {
+			t.Errorf("public key %x accepted", x)
+		}
+	}
+}
@@ -3,12 +3,33 @@ package rtmfp
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
 )
 
-func ComputeSharedKeys(engine DHEngine, pubkey []byte, initiator []byte) (responder []byte, encrypt, decrypt []byte) {
+func ComputeSharedKeys(engine DHEngine, pubkey []byte, initiator []byte) (responder []byte, encrypt, decrypt []byte, err error) {
 	var sharedkey []byte
-	sharedkey = engine.ComputeSecretKey(pubkey)
+	if sharedkey, err = engine.ComputeSecretKey(pubkey); err != nil {
+		return
+	}
 	responder = append([]byte{0x03, 0x1a, 0x00, 0x00, 0x02, 0x1e, 0x00, 0x81, 0x02, 0x0d, 0x02}, engine.GetPublicKey()...)
+	encrypt, decrypt = computeKeys(sharedkey, initiator, responder)
+	return
+}
+
+func ComputeInitiatorKeys(engine DHEngine, responder []byte, initiator []byte) (encrypt, decrypt []byte, err error) {
+	if len(responder) <= DHKeySize {
+		return nil, nil, errors.New("responder.too small")
+	}
+	pubkey := responder[len(responder)-DHKeySize:]
+	sharedkey, err := engine.ComputeSecretKey(pubkey)
+	if err != nil {
+		return nil, nil, err
+	}
+	decrypt, encrypt = computeKeys(sharedkey, initiator, responder)
+	return
+}
+
+func computeKeys(sharedkey []byte, initiator, responder []byte) (encrypt, decrypt []byte) {
 	hashx := hmac.New(sha256.New, sharedkey)
 	hash1 := hmac.New(sha256.New, initiator)
 	hash1.Write(responder)
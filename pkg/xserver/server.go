@@ -1,11 +1,21 @@
 package xserver
 
 import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
 	"time"
 )
 
 import (
 	"github.com/spinlock/xserver/pkg/xserver/args"
+	"github.com/spinlock/xserver/pkg/xserver/async"
+	"github.com/spinlock/xserver/pkg/xserver/auth"
+	"github.com/spinlock/xserver/pkg/xserver/cluster"
+	"github.com/spinlock/xserver/pkg/xserver/cookies"
 	"github.com/spinlock/xserver/pkg/xserver/counts"
 	"github.com/spinlock/xserver/pkg/xserver/handshake"
 	"github.com/spinlock/xserver/pkg/xserver/rpc"
@@ -18,85 +28,387 @@ import (
 )
 
 import (
-	_ "github.com/spinlock/xserver/pkg/xserver/http"
+	httpd "github.com/spinlock/xserver/pkg/xserver/http"
 )
 
-func Start() {
+// Config holds everything a Server needs. The embedded args.Config carries
+// the values that used to come from the command line; Logger and Metrics
+// replace the default log/ files and receive every counts.Count call.
+// Authorizer, when set, overrides the one selected by Auth.
+type Config struct {
+	args.Config
+	Logger     xlog.Sink
+	Metrics    counts.Sink
+	Authorizer auth.Authorizer
+}
+
+func DefaultConfig() *Config {
+	return &Config{Config: *args.Default()}
+}
+
+// Server owns the listeners, background routines and tables of one xserver.
+// Nothing is shared between the Servers of a process but GOMAXPROCS, which
+// each sets to its Ncpu on Start.
+type Server struct {
+	cfg  Config
+	sec  *tcp.Security
+	udps []*udp.Server
+	tcp  struct {
+		srv  *tcp.Server
+		clts []*rpc.Backend
+	}
+	http *http.Server
+
+	args       *args.Args
+	logs       *xlog.Logs
+	counts     *counts.Counts
+	async      *async.Pool
+	cookies    *cookies.Cookies
+	link       *rpc.Link
+	cluster    *cluster.Cluster
+	udp        *udp.Servers
+	sessions   *session.Sessions
+	handshakes *handshake.Handshakes
+
+	quit    chan struct{}
+	done    sync.WaitGroup
+	stopped bool
+	sync.Mutex
+}
+
+const (
+	flushTimeout = time.Second
+)
+
+func New(cfg *Config) (*Server, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Server{}
+	s.cfg = *cfg
+	s.cfg.Ports = append([]uint16{}, cfg.Ports...)
+	s.cfg.Retrans = append([]int{}, cfg.Retrans...)
+	s.cfg.Apps = append([]string{}, cfg.Apps...)
+	if sec, err := tcp.NewSecurity(s.cfg.TLSCert, s.cfg.TLSKey, s.cfg.TLSCA, s.cfg.Secret); err != nil {
+		return nil, err
+	} else {
+		s.sec = sec
+	}
+	s.args = args.New(&s.cfg.Config)
+	s.logs = xlog.New(s.cfg.Debug, s.cfg.Logger)
+	s.counts = counts.New(s.cfg.Metrics)
+	s.async = async.New(s.args, s.counts, s.logs)
+	s.cookies = cookies.New(s.counts)
+	s.link = rpc.New(s.counts, s.logs, s.async)
+	s.cluster = cluster.New(s.counts, s.logs)
+	s.udp = udp.NewServers(s.counts, s.logs.ErrLog)
+	if s.cfg.Authorizer == nil {
+		if a, err := auth.New(s.cfg.Auth, s.cfg.Apps, s.link); err != nil {
+			return nil, err
+		} else {
+			s.cfg.Authorizer = a
+		}
+	}
+	s.sessions = session.New(s.args, s.counts, s.logs, s.async, s.link, s.cluster, s.cookies, s.cfg.Authorizer, s.udp)
+	s.handshakes = handshake.New(s.args, s.counts, s.logs, s.cfg.Authorizer, s.cluster, s.cookies, s.sessions, s.udp)
+	return s, nil
+}
+
+// Start opens every listener and returns once they are ready. The server
+// keeps running until ctx is done or Shutdown is called.
+func (s *Server) Start(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.quit != nil {
+		return errors.New("xserver: server has already been started")
+	}
+	s.quit = make(chan struct{})
+
+	log.Printf("[compile]: %s\n", utils.Compile)
+	log.Printf("[version]: %s\n", utils.Version)
+
+	runtime.GOMAXPROCS(s.args.Ncpu())
+	s.logs.Start()
+	s.counts.Start()
+	s.async.Start()
+	s.cookies.Start()
+	s.handshakes.Start()
+	s.sessions.Start()
+
+	if err := s.listen(); err != nil {
+		s.stop(context.Background())
+		return err
+	}
+
+	s.serve()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Shutdown(context.Background())
+		case <-s.quit:
+		}
+	}()
+	return nil
+}
+
+func (s *Server) listen() error {
+	for _, port := range s.cfg.Ports {
+		if u, err := s.udp.Listen(port, s.args.Sockets(), s.args.Batch()); err != nil {
+			return err
+		} else {
+			s.udps = append(s.udps, u)
+		}
+	}
+	if port := s.cfg.Listen; port != 0 {
+		if srv, err := tcp.ListenSecure(port, s.sec, s.counts, s.logs.TcpLog); err != nil {
+			return err
+		} else {
+			s.tcp.srv = srv
+		}
+	}
+	if remotes := s.args.RpcRemotes(); len(remotes) != 0 {
+		for _, r := range remotes {
+			s.tcp.clts = append(s.tcp.clts, s.link.NewBackend(r.IP, r.Port, s.sec))
+		}
+		s.link.Start(s.tcp.clts, s.cfg.Listen)
+	}
+	if err := s.cluster.Start(s.args.Node(), s.args.NodeListenPort(), s.args.NodeRemotes(), s.sec, s.sessions.ClusterHandler()); err != nil {
+		return err
+	}
+	if port := s.cfg.Http; port != 0 {
+		if srv, err := httpd.Start(port, s.cfg.Admin, &httpd.Status{
+			Counts:     s.counts,
+			Async:      s.async,
+			Cookies:    s.cookies,
+			Sessions:   s.sessions,
+			Handshakes: s.handshakes,
+			Cluster:    s.cluster,
+			Link:       s.link,
+		}); err != nil {
+			return err
+		} else {
+			s.http = srv
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve() {
 	shell := func(f func()) {
-		s := func() {
-			defer func() {
-				if x := recover(); x != nil {
-					counts.Count("server.panic", 1)
-					xlog.ErrLog.Printf("[server]: panic = %v\n%s\n", x, utils.Trace())
+		s.done.Add(1)
+		go func() {
+			defer s.done.Done()
+			for {
+				exit := func() bool {
+					defer func() {
+						if x := recover(); x != nil {
+							s.counts.Count("server.panic", 1)
+							s.logs.ErrLog.Printf("[server]: panic = %v\n%s\n", x, utils.Trace())
+						}
+					}()
+					f()
+					return true
+				}()
+				if exit {
+					return
 				}
-			}()
-			f()
-		}
-		for {
-			s()
+			}
+		}()
+	}
+	handle := func(dg *udp.Datagram) {
+		defer dg.Free()
+		if xid, err := rtmfp.PacketXid(dg.Data); err != nil {
+			return
+		} else if xid == 0 {
+			s.handshakes.HandlePacket(dg.Port, dg.Addr, dg.Data)
+		} else {
+			s.sessions.HandlePacket(dg.Port, dg.Addr, xid, dg.Data)
 		}
 	}
-	for _, udpsrv := range udp.GetServers() {
-		s := udpsrv
+	for _, udpsrv := range s.udps {
+		u := udpsrv
 		f := func() {
 			for {
-				if lport, addr, data := s.Recv(); addr != nil && len(data) != 0 {
-					if xid, err := rtmfp.PacketXid(data); err != nil {
-						continue
-					} else if xid == 0 {
-						handshake.HandlePacket(lport, addr, data)
-					} else {
-						session.HandlePacket(lport, addr, xid, data)
+				dgs := u.Recv()
+				if len(dgs) == 0 {
+					if u.Closed() {
+						return
 					}
+					continue
+				}
+				for _, dg := range dgs {
+					handle(dg)
 				}
 			}
 		}
-		for i := 0; i < args.Parallel(); i++ {
-			go shell(f)
+		for i := 0; i < s.cfg.Parallel; i++ {
+			shell(f)
 		}
 	}
-	if s := tcp.GetServer(); s != nil {
+	if srv := s.tcp.srv; srv != nil {
 		f := func() {
 			for {
-				if bs := s.Recv(); len(bs) != 0 {
-					if x := rpc.DecodeXMessage(bs); x != nil {
-						if b := x.Broadcast; b != nil {
-							xids, data, reliable := b.Xids, b.Data, *b.Reliable
-							if len(xids) == 0 || len(data) == 0 {
-								continue
-							}
-							session.RecvPull(xids, data, reliable)
+				p := srv.Recv()
+				if p == nil || len(p.Data) == 0 {
+					if srv.Closed() {
+						return
+					}
+					continue
+				}
+				if x := s.link.DecodeXMessage(p.Data); x != nil {
+					if b := x.Broadcast; b != nil {
+						xids, data, reliable := b.Xids, b.Data, *b.Reliable
+						if len(xids) != 0 && len(data) != 0 {
+							s.sessions.RecvPull(xids, data, reliable)
 						}
-						if c := x.Close; c != nil {
-							xids := c.Xids
-							if len(xids) == 0 {
-								continue
-							}
-							session.CloseAll(xids)
+					}
+					if c := x.Close; c != nil {
+						if xids := c.Xids; len(xids) != 0 {
+							s.sessions.CloseAll(xids)
+						}
+					}
+					if r := s.control(x); r != nil {
+						if bs := s.link.EncodeXReply(r); bs != nil {
+							p.Reply(bs)
 						}
 					}
 				}
 			}
 		}
-		go shell(f)
+		shell(f)
 	}
-	if c := tcp.GetClient(); c != nil {
+	for _, clt := range s.tcp.clts {
+		clt := clt
 		f := func() {
 			for {
-				if bs := c.Recv(); len(bs) != 0 {
-					if x := rpc.DecodeXResponse(bs); x != nil {
-						xid, data, callback, reliable := *x.Xid, x.Data, *x.Callback, *x.Reliable
-						if xid == 0 || len(data) == 0 {
-							continue
-						}
-						session.Callback(xid, data, callback, reliable)
+				bs := clt.Recv()
+				if len(bs) == 0 {
+					if clt.Closed() {
+						return
 					}
+					continue
 				}
+				if x := s.link.DecodeXResponse(bs); x != nil {
+					clt.Acked(x.GetAck())
+					xid, data, callback, reliable := *x.Xid, x.Data, *x.Callback, *x.Reliable
+					if s.link.Answered(xid, callback, data) {
+						continue
+					}
+					if xid == 0 || len(data) == 0 {
+						continue
+					}
+					s.sessions.Callback(xid, data, callback, reliable)
+				}
+			}
+		}
+		shell(f)
+	}
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-time.After(time.Minute * 5):
+				runtime.GC()
 			}
 		}
-		go shell(f)
+	}()
+}
+
+// Ports returns the bound rtmfp ports, which differ from the configured ones
+// when port 0 is used.
+func (s *Server) Ports() []uint16 {
+	s.Lock()
+	defer s.Unlock()
+	ports := make([]uint16, 0, len(s.udps))
+	for _, u := range s.udps {
+		ports = append(ports, u.Port())
+	}
+	return ports
+}
+
+// Async returns the async groups of the server, which run the calls of each
+// gid in order.
+func (s *Server) Async() *async.Pool {
+	return s.async
+}
+
+// Shutdown stops accepting handshakes, closes every session once its reliable
+// fragments are acknowledged or the drain timeout expires, and then closes all
+// listeners and background routines. It waits for the packet workers to return
+// until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.quit == nil || s.stopped {
+		return nil
+	}
+	return s.stop(ctx)
+}
+
+func (s *Server) stop(ctx context.Context) error {
+	s.stopped = true
+
+	s.handshakes.Drain()
+	drain, cancel := context.WithTimeout(ctx, time.Second*time.Duration(s.args.Drain()))
+	if n := s.sessions.Drain(drain); n != 0 {
+		log.Printf("[server]: drain %d session(s)\n", n)
+	}
+	cancel()
+
+	// the exits and the last packets of the sessions get a budget of their
+	// own, which a drain timing out does not eat up
+	flush, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	for _, clt := range s.tcp.clts {
+		clt.Flush(flush)
+	}
+	for _, u := range s.udps {
+		u.Flush(flush)
+	}
+	cancel()
+
+	close(s.quit)
+
+	for _, u := range s.udps {
+		u.Close()
+	}
+	if srv := s.tcp.srv; srv != nil {
+		srv.Close()
+	}
+	if len(s.tcp.clts) != 0 {
+		s.link.Stop()
+		for _, clt := range s.tcp.clts {
+			clt.Close()
+		}
 	}
-	for {
-		time.Sleep(time.Minute)
+	s.cluster.Stop()
+	var err error
+	if srv := s.http; srv != nil {
+		err = srv.Shutdown(ctx)
 	}
+
+	wait := make(chan struct{})
+	go func() {
+		s.done.Wait()
+		close(wait)
+	}()
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.sessions.Stop()
+	s.handshakes.Stop()
+	s.cookies.Stop()
+	s.async.Stop()
+	s.counts.Stop()
+	s.logs.Stop()
+	return err
 }
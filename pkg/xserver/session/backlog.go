@@ -0,0 +1,151 @@
+package session
+
+import (
+	"math"
+	"time"
+)
+
+// The backlog of a flow writer is the data it holds: the fragments waiting
+// in the queue of the session and the reliable ones sent and not acked yet.
+// Past -flowbacklog, or past -sessionbacklog for all the writers of the
+// session, the oldest unreliable fragments still queued are dropped first.
+// What is left over is then abandoned, oldest first, as far as it is older
+// than -backlogexpiry, and down to half the limit, so that a slow peer does
+// not overflow on every message. The main flow, which carries the answers
+// to calls, is never abandoned. A backlog still past its limit, or any with
+// -overflow=close, has the player stopped with NetStream.Play.InsufficientBW
+// and any other flow close its session.
+
+func (fw *flowWriter) grow(size int) {
+	fw.backlog += size
+	fw.session.backlog += size
+}
+
+func (fw *flowWriter) shrink(size int) {
+	fw.backlog -= size
+	fw.session.backlog -= size
+}
+
+// overflow sheds the backlog once fw has added fragments.
+func (s *Session) overflow(fw *flowWriter) {
+	flowmax, sessionmax := s.sessions.args.FlowBacklog()*1024, s.sessions.args.SessionBacklog()*1024
+	if fw.backlog <= flowmax && s.backlog <= sessionmax {
+		return
+	}
+	s.counts.Count("flow.backlog.overflow", 1)
+	s.logs.ErrLog.Printf("[flows]: xid = %d, writer.fid = %d, backlog overflow, flow = %d, session = %d\n", s.xid, fw.fid, fw.backlog, s.backlog)
+	need := func(x *flowWriter) bool {
+		return (x == fw && x.backlog > flowmax/2) || s.backlog > sessionmax/2
+	}
+	writers := make([]*flowWriter, 0, len(s.writers))
+	writers = append(writers, fw)
+	for _, x := range s.writers {
+		if x != fw {
+			writers = append(writers, x)
+		}
+	}
+	for _, x := range writers {
+		s.dropUnreliable(x, need)
+	}
+	if !need(fw) {
+		return
+	}
+	if s.sessions.args.CloseOnOverflow() || (fw == s.mainfw && fw.backlog > flowmax) {
+		s.closeOnOverflow(fw)
+		return
+	}
+	expired := time.Now().UnixNano() - int64(s.sessions.args.BacklogExpiry())*int64(time.Millisecond)
+	for _, x := range writers {
+		if x != s.mainfw {
+			x.abandon(need, expired)
+		}
+	}
+	if fw.backlog > flowmax || s.backlog > sessionmax {
+		s.closeOnOverflow(fw)
+	}
+}
+
+// dropUnreliable drops the unreliable fragments of fw still queued, from
+// the oldest, while need holds, and up to the end of the last message hit.
+func (s *Session) dropUnreliable(fw *flowWriter, need func(*flowWriter) bool) {
+	dropped := 0
+	for e := s.cc.queue.Front(); e != nil; {
+		q := e.Value.(*queued)
+		if q.fw != fw || q.reliable {
+			e = e.Next()
+			continue
+		}
+		if !need(fw) && !q.f.WithBefore() {
+			break
+		}
+		enext := e.Next()
+		s.cc.queue.Remove(e)
+		e = enext
+		fw.shrink(len(q.f.data))
+		dropped++
+	}
+	if dropped != 0 {
+		s.counts.Count("flow.backlog.dropped", dropped)
+	}
+}
+
+// abandon turns the reliable fragments of fw added before expired, from the
+// oldest, into empty ones with the abandon flag while need holds, and up to
+// the end of the last message hit. They keep their stages and are still
+// sent, or resent, so that the peer skips them; those in flight leave the
+// window.
+func (fw *flowWriter) abandon(need func(*flowWriter) bool, expired int64) {
+	abandoned := 0
+	for e := fw.frags.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*fragment)
+		if f.Abandoned() {
+			continue
+		}
+		if (!need(fw) || f.addtime > expired) && !f.WithBefore() {
+			break
+		}
+		size := len(f.data)
+		if f.sendtime != 0 {
+			fw.session.cc.onDropped(size)
+			fw.inflight -= size
+		}
+		fw.shrink(size)
+		f.flags, f.data = flagsAbandoned, nil
+		abandoned++
+	}
+	if abandoned != 0 {
+		fw.session.counts.Count("flow.backlog.abandoned", abandoned)
+	}
+}
+
+// closeOnOverflow stops fw when it plays a stream, and otherwise closes the
+// session; the backlog of fw is abandoned all the same, as nobody waits for
+// it any more.
+func (s *Session) closeOnOverflow(fw *flowWriter) {
+	fw.abandon(func(*flowWriter) bool { return true }, math.MaxInt64)
+	if h, ok := fw.reader.handler.(*streamHandler); ok && h.play.p != nil {
+		s.counts.Count("flow.backlog.insufficientbw", 1)
+		if err := h.insufficientBW(); err != nil {
+			s.logs.ErrLog.Printf("[session]: xid = %d, writer.fid = %d, insufficient bw error = '%v'\n", s.xid, fw.fid, err)
+		}
+		return
+	}
+	s.counts.Count("session.backlog.close", 1)
+	s.logs.SssLog.Printf("[backlog] close xid = %d\n", s.xid)
+	s.sessions.CloseAll([]uint32{s.xid})
+}
+
+// Backlog returns the data held by the flow writers of all the sessions,
+// and the most any single session holds.
+func (ss *Sessions) Backlog() (int, int) {
+	total, max := 0, 0
+	for _, s := range ss.allSessions() {
+		s.Lock()
+		n := s.backlog
+		s.Unlock()
+		if total += n; n > max {
+			max = n
+		}
+	}
+	return total, max
+}
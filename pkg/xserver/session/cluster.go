@@ -0,0 +1,192 @@
+package session
+
+import (
+	"net"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/cluster"
+	"github.com/spinlock/xserver/pkg/xserver/utils"
+)
+
+// announce tells the other nodes of the cluster where s is reached now,
+// once it is connected.
+func (s *Session) announce() {
+	if !s.connected {
+		return
+	}
+	addrs := make([]*net.UDPAddr, 0, 1+len(s.addrs))
+	addrs = append(addrs, s.raddr)
+	addrs = append(addrs, s.addrs...)
+	s.sessions.cluster.Join(s.xid, s.pid, addrs)
+}
+
+type clusterHandler struct {
+	sessions *Sessions
+}
+
+// ClusterHandler delivers to the sessions of this node what the other nodes
+// of the cluster send them; it never forwards anything back.
+func (ss *Sessions) ClusterHandler() cluster.Handler {
+	return &clusterHandler{ss}
+}
+
+func push(s *Session, reliable bool, data [][]byte) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	defer s.flush()
+	if fw := s.mainfw; fw != nil {
+		fw.AddFragments(reliable, data...)
+	}
+}
+
+func (h *clusterHandler) Relay(pid string, data []byte) {
+	h.sessions.async.Call(uint64(utils.Hash16S(pid)), func() {
+		if s := h.sessions.FindByPid(pid); s != nil {
+			push(s, true, split(data))
+		} else {
+			h.sessions.counts.Count("cluster.relay.notfound", 1)
+		}
+	})
+}
+
+func (h *clusterHandler) Broadcast(xids []uint32, data []byte, reliable bool) {
+	if len(xids) == 0 {
+		return
+	}
+	frags := split(data)
+	h.sessions.async.Offer(uint64(xids[0]), func() {
+		for _, xid := range xids {
+			if s := h.sessions.FindByXid(xid); s != nil {
+				push(s, reliable, frags)
+			}
+		}
+	}, true)
+}
+
+// pull has the cluster bring the stream from the node publishing it, as
+// the first player of p joins an edge.
+func (p *publication) pull() {
+	p.Lock()
+	local := p.master != nil || p.closed
+	p.Unlock()
+	if !local {
+		p.sessions.cluster.Pull(p.name)
+	}
+}
+
+// edge returns the publication of name with players and no publisher on
+// this node.
+func (ss *Sessions) edge(name string) *publication {
+	p := ss.findPublication(name)
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.closed || p.master != nil || p.slaves == nil || p.slaves.Len() == 0 {
+		return nil
+	}
+	return p
+}
+
+// notify sends the players of p its publish or unpublish notification.
+func (p *publication) notify(publish bool) {
+	call := func(x *streamHandler) {
+		s := x.session
+		s.Lock()
+		defer s.Unlock()
+		if s.closed || x.play.p != p {
+			return
+		}
+		defer s.flush()
+		if publish {
+			x.newPublishNotifyResponse(p.name, x.play.callback)
+		} else {
+			x.newUnpublishNotifyResponse(p.name, x.play.callback)
+		}
+	}
+	p.sessions.async.Call(p.gid, func() {
+		if l, _ := p.list(); l != nil {
+			for e := l.Front(); e != nil; e = e.Next() {
+				call(e.Value.(*streamHandler))
+			}
+		}
+	})
+}
+
+func (h *clusterHandler) Publish(name string) {
+	if p := h.sessions.edge(name); p != nil {
+		h.sessions.cluster.Pull(name)
+		p.notify(true)
+	}
+}
+
+func (h *clusterHandler) Unpublish(name string) {
+	if p := h.sessions.edge(name); p != nil {
+		p.notify(false)
+	}
+}
+
+// Stream delivers data pulled from the origin of name as onMedia and
+// onDefault do what the publisher sends.
+func (h *clusterHandler) Stream(name string, data []byte, reliable bool) {
+	if p := h.sessions.edge(name); p != nil && len(data) != 0 {
+		p.fanout(data, reliable, true)
+	}
+}
+
+// Resync has the players of name wait for a keyframe again, as the origin
+// lost some of its data on the way and sends the codec headers next.
+func (h *clusterHandler) Resync(name string) {
+	p := h.sessions.edge(name)
+	if p == nil {
+		return
+	}
+	call := func(x *streamHandler) {
+		s := x.session
+		s.Lock()
+		defer s.Unlock()
+		if s.closed || x.play.p != p {
+			return
+		}
+		x.keyframe = false
+	}
+	h.sessions.async.Call(p.gid, func() {
+		if l, ok := p.list(); ok && l != nil {
+			for e := l.Front(); e != nil; e = e.Next() {
+				call(e.Value.(*streamHandler))
+			}
+		}
+	})
+}
+
+func (h *clusterHandler) Codecs(name string) [][]byte {
+	p := h.sessions.findPublication(name)
+	if p == nil {
+		return nil
+	}
+	var codecs [][]byte
+	if audio, video := p.getCodecs(); audio != nil || video != nil {
+		if audio != nil {
+			codecs = append(codecs, audio)
+		}
+		if video != nil {
+			codecs = append(codecs, video)
+		}
+	}
+	return codecs
+}
+
+func (h *clusterHandler) Introduce(pid string, tag []byte, raddr *net.UDPAddr) {
+	h.sessions.async.Call(uint64(utils.Hash16S(pid)), func() {
+		if s := h.sessions.FindByPid(pid); s != nil {
+			s.Handshake(tag, raddr)
+		} else {
+			h.sessions.counts.Count("cluster.introduce.notfound", 1)
+		}
+	})
+}
@@ -0,0 +1,385 @@
+package session
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	segmentSize   = 1320
+	minWindow     = segmentSize * 2
+	initialWindow = segmentSize * 4
+	maxWindow     = segmentSize * 1024
+	maxBurst      = segmentSize * 4
+	initialRtt    = time.Millisecond * 100
+	maxEchoRtt    = 30000
+	initialRto    = time.Second
+	minRto        = time.Millisecond * 200
+	rtoGranule    = time.Millisecond * 10
+)
+
+// congestion is shared by the flow writers of a session. Its window counts
+// the bytes of the reliable fragments sent and not acked yet: it grows with
+// acks, doubling each round trip below ssthresh and by a segment per round
+// trip above, and shrinks on loss, at most once per round trip, or back to
+// minWindow on a retransmission timeout.
+//
+// Fragments which do not fit wait in the queue and leave it at the pace of
+// a window per round trip. Unreliable fragments are never acked, so they do
+// not count in the window, but they queue behind the others to keep the
+// order of their flow and are paced all the same.
+//
+// The round trip is smoothed as tcp does, from the times clients echo and
+// from the acks of fragments sent once, and gives the retransmission timeout.
+type congestion struct {
+	sessions *Sessions
+	cwnd     int
+	ssthresh int
+	inflight int
+	growth   int
+	srtt     int64
+	rttvar   int64
+	lastcut  int64
+	queue    list.List
+	pacing   struct {
+		tokens   int
+		lasttime int64
+		timer    *time.Timer
+	}
+	stats struct {
+		samples  uint64
+		sent     uint64
+		retrans  uint64
+		lost     uint64
+		timeouts uint64
+	}
+}
+
+type queued struct {
+	fw       *flowWriter
+	f        *fragment
+	stageack uint64
+	reliable bool
+}
+
+func (cc *congestion) init(ss *Sessions) {
+	cc.sessions = ss
+	cc.cwnd, cc.ssthresh = initialWindow, maxWindow
+	cc.inflight, cc.growth = 0, 0
+	cc.srtt, cc.rttvar = 0, 0
+	cc.lastcut = 0
+	cc.queue.Init()
+	cc.pacing.tokens, cc.pacing.lasttime = maxBurst, 0
+	cc.pacing.timer = nil
+}
+
+func (cc *congestion) rtt() int64 {
+	if cc.srtt == 0 {
+		return int64(initialRtt)
+	}
+	return cc.srtt
+}
+
+// onEcho takes a round trip sample from the time a client echoes, which is
+// ours in milliseconds modulo 1<<16, as PacketToBytes writes it, plus the
+// time the client held it.
+func (cc *congestion) onEcho(now int64, echo uint16) {
+	ms := uint16(now/int64(time.Millisecond)) - echo
+	if ms > maxEchoRtt {
+		cc.sessions.counts.Count("session.cc.badecho", 1)
+		return
+	}
+	cc.sample(int64(ms) * int64(time.Millisecond))
+}
+
+func (cc *congestion) sample(r int64) {
+	if r < int64(time.Millisecond) {
+		r = int64(time.Millisecond)
+	}
+	cc.stats.samples++
+	if cc.srtt == 0 {
+		cc.srtt, cc.rttvar = r, r/2
+	} else {
+		d := cc.srtt - r
+		if d < 0 {
+			d = -d
+		}
+		cc.rttvar = (cc.rttvar*3 + d) / 4
+		cc.srtt = (cc.srtt*7 + r) / 8
+	}
+}
+
+// rto returns the retransmission timeout, srtt + 4 * rttvar but no less
+// than minRto.
+func (cc *congestion) rto() int64 {
+	if cc.srtt == 0 {
+		return int64(initialRto)
+	}
+	v := cc.rttvar * 4
+	if v < int64(rtoGranule) {
+		v = int64(rtoGranule)
+	}
+	if rto := cc.srtt + v; rto > int64(minRto) {
+		return rto
+	}
+	return int64(minRto)
+}
+
+// timeout returns the timeout after idx expirations in a row: the rto
+// doubled each time, bounded by the idx-th interval of -retrans.
+func (cc *congestion) timeout(idx int) int64 {
+	retrans := cc.sessions.args.Retrans()
+	if max := len(retrans) - 1; idx > max {
+		idx = max
+	}
+	limit := int64(time.Millisecond) * int64(retrans[idx])
+	t := cc.rto()
+	for i := 0; i < idx && t < limit; i++ {
+		t *= 2
+	}
+	if t > limit {
+		return limit
+	}
+	return t
+}
+
+func (cc *congestion) onSent(size int) {
+	cc.inflight += size
+	cc.stats.sent++
+}
+
+// onAcked releases size bytes of the window, and grows it unless the
+// writers do not use half of it.
+func (cc *congestion) onAcked(size int) {
+	limited := cc.inflight*2 < cc.cwnd && cc.queue.Len() == 0
+	if cc.inflight -= size; cc.inflight < 0 {
+		cc.inflight = 0
+	}
+	if limited {
+		return
+	}
+	if cc.cwnd < cc.ssthresh {
+		cc.cwnd += size
+	} else if cc.growth += size; cc.growth >= cc.cwnd {
+		cc.growth -= cc.cwnd
+		cc.cwnd += segmentSize
+	}
+	if cc.cwnd > maxWindow {
+		cc.cwnd = maxWindow
+	}
+}
+
+// onDropped forgets size bytes in flight that will never be acked.
+func (cc *congestion) onDropped(size int) {
+	if cc.inflight -= size; cc.inflight < 0 {
+		cc.inflight = 0
+	}
+}
+
+func (cc *congestion) onLoss(now int64) {
+	if now-cc.lastcut < cc.rtt() {
+		return
+	}
+	cc.ssthresh = cc.cwnd / 2
+	if cc.ssthresh < minWindow {
+		cc.ssthresh = minWindow
+	}
+	cc.cwnd, cc.growth, cc.lastcut = cc.ssthresh, 0, now
+	cc.sessions.counts.Count("session.cc.loss", 1)
+}
+
+func (cc *congestion) onTimeout(now int64) {
+	cc.ssthresh = cc.cwnd / 2
+	if cc.ssthresh < minWindow {
+		cc.ssthresh = minWindow
+	}
+	cc.cwnd, cc.growth, cc.lastcut = minWindow, 0, now
+	cc.stats.timeouts++
+	cc.sessions.counts.Count("session.cc.timeout", 1)
+}
+
+// rate returns the pacing rate in bytes per second, a little above a window
+// per round trip so that the window, not the pacing, is what limits.
+func (cc *congestion) rate() float64 {
+	gain := 1.25
+	if cc.cwnd < cc.ssthresh {
+		gain = 2
+	}
+	return float64(cc.cwnd) * gain * float64(time.Second) / float64(cc.rtt())
+}
+
+func (cc *congestion) refill(now int64) {
+	if last := cc.pacing.lasttime; last != 0 && now > last {
+		cc.pacing.tokens += int(float64(now-last) * cc.rate() / float64(time.Second))
+		if cc.pacing.tokens > maxBurst {
+			cc.pacing.tokens = maxBurst
+		}
+	}
+	cc.pacing.lasttime = now
+}
+
+// dump adds the window, the round trip and the retransmissions of the
+// session to m, times in milliseconds.
+func (cc *congestion) dump(m map[string]interface{}) {
+	const ms = int64(time.Millisecond)
+	m["cc"] = map[string]interface{}{
+		"cwnd":     cc.cwnd,
+		"ssthresh": cc.ssthresh,
+		"inflight": cc.inflight,
+		"queued":   cc.queue.Len(),
+	}
+	m["rtt"] = map[string]interface{}{
+		"srtt":    cc.srtt / ms,
+		"rttvar":  cc.rttvar / ms,
+		"rto":     cc.rto() / ms,
+		"samples": cc.stats.samples,
+	}
+	m["retrans"] = map[string]interface{}{
+		"sent":     cc.stats.sent,
+		"retrans":  cc.stats.retrans,
+		"lost":     cc.stats.lost,
+		"timeouts": cc.stats.timeouts,
+	}
+}
+
+// enqueue keeps f of fw for release, with the stageack it was made with.
+func (s *Session) enqueue(fw *flowWriter, f *fragment, stageack uint64, reliable bool) {
+	s.cc.queue.PushBack(&queued{fw, f, stageack, reliable})
+}
+
+// dequeue drops the fragments of fw still waiting, as the flow is ended.
+func (s *Session) dequeue(fw *flowWriter) {
+	for e := s.cc.queue.Front(); e != nil; {
+		enext := e.Next()
+		if e.Value.(*queued).fw == fw {
+			s.cc.queue.Remove(e)
+		}
+		e = enext
+	}
+}
+
+// release sends the queued fragments the window and the pacing let go. When
+// the pacing holds the next one, the timer releases it later; when the
+// window does, an ack will. A flow out of credit keeps its fragments in the
+// queue, and the others go past them.
+func (s *Session) release() {
+	cc := &s.cc
+	if cc.queue.Len() == 0 || s.closed {
+		return
+	}
+	now := time.Now().UnixNano()
+	cc.refill(now)
+	var blocked map[*flowWriter]bool
+	for e := cc.queue.Front(); e != nil; {
+		q := e.Value.(*queued)
+		size := len(q.f.data)
+		if blocked[q.fw] {
+			e = e.Next()
+			continue
+		}
+		ok, probe := q.fw.allows(size, now)
+		if !ok {
+			if blocked == nil {
+				blocked = make(map[*flowWriter]bool)
+			}
+			blocked[q.fw] = true
+			e = e.Next()
+			continue
+		}
+		if q.reliable && cc.inflight != 0 && cc.inflight+size > cc.cwnd {
+			s.counts.Count("session.cc.window", 1)
+			return
+		}
+		if cc.pacing.tokens < size && cc.pacing.tokens < maxBurst {
+			s.pace(size)
+			return
+		}
+		enext := e.Next()
+		cc.queue.Remove(e)
+		e = enext
+		cc.pacing.tokens -= size
+		if q.reliable {
+			cc.onSent(size)
+			q.fw.inflight += size
+		} else {
+			q.fw.shrink(size)
+		}
+		if probe {
+			q.fw.probed()
+		}
+		q.f.sendtime = now
+		s.send(newFlowResponse(q.fw, q.f, q.stageack))
+		s.logs.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, send: stage = %d, stageack = %d, frag = %v\n", s.xid, q.fw.fid, q.fw.stage, q.stageack, q.f)
+	}
+}
+
+// pace arms the timer for when the tokens are enough to send size bytes.
+func (s *Session) pace(size int) {
+	cc := &s.cc
+	if cc.pacing.timer != nil {
+		return
+	}
+	if size > maxBurst {
+		size = maxBurst
+	}
+	wait := time.Duration(float64(size-cc.pacing.tokens) * float64(time.Second) / cc.rate())
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	s.counts.Count("session.cc.paced", 1)
+	cc.pacing.timer = time.AfterFunc(wait, func() {
+		s.Lock()
+		defer s.Unlock()
+		s.cc.pacing.timer = nil
+		if s.closed {
+			return
+		}
+		s.flush()
+	})
+}
+
+// rearm sets the timer of the session to its next deadline: a keepalive,
+// the retransmission timer or the credit probe of a flow writer, a path
+// probe, or the removal of a flow closed, unless it is set to expire before.
+func (s *Session) rearm() {
+	if s.closed {
+		return
+	}
+	now := time.Now().UnixNano()
+	at := s.manage.lasttime + int64(time.Second)*int64(s.sessions.args.Heartbeat())
+	earlier := func(d int64) {
+		if d != 0 && d < at {
+			at = d
+		}
+	}
+	if p := s.probe; p != nil {
+		earlier(p.sent + int64(probeInterval))
+	}
+	for _, fw := range s.writers {
+		earlier(fw.deadline())
+		earlier(fw.credit.probeat)
+		if fw.closed && fw.frags.Len() == 0 {
+			earlier(now + int64(time.Millisecond)*int64(s.sessions.args.Manage()))
+		}
+	}
+	s.schedule(at)
+}
+
+// schedule moves the timer of the session to at when that is earlier than
+// the deadline it is set to; a timer which fires early only costs a Manage.
+func (s *Session) schedule(at int64) {
+	if s.manage.due != 0 && s.manage.due <= at {
+		return
+	}
+	s.manage.due = at
+	s.manage.wheel.Schedule(s.manage.timer, at)
+}
+
+// stopTimers drops the queue of a closed session.
+func (s *Session) stopTimers() {
+	if t := s.cc.pacing.timer; t != nil {
+		t.Stop()
+		s.cc.pacing.timer = nil
+	}
+	s.cc.queue.Init()
+}
@@ -6,15 +6,14 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 import (
 	"github.com/spinlock/xserver/pkg/xserver/amf"
 	"github.com/spinlock/xserver/pkg/xserver/amf/amf0"
-	"github.com/spinlock/xserver/pkg/xserver/async"
-	"github.com/spinlock/xserver/pkg/xserver/rpc"
+	"github.com/spinlock/xserver/pkg/xserver/auth"
 	"github.com/spinlock/xserver/pkg/xserver/xio"
-	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
 type connHandler struct {
@@ -22,16 +21,25 @@ type connHandler struct {
 	fr       *flowReader
 	fw       *flowWriter
 	addrchgi bool
+	rejected bool
 }
 
 func newConnHandler(session *Session, fr *flowReader, fw *flowWriter) *connHandler {
-	return &connHandler{session, fr, fw, false}
+	return &connHandler{session, fr, fw, false, false}
 }
 
+// rejectLinger is how long a rejected session stays open, so that the
+// rejection reaches the client before the session is closed.
+const rejectLinger = time.Second * 2
+
 func (h *connHandler) OnAmfMessage(name string, callback float64, r *amf0.Reader) error {
 	if h.fw.closed {
 		return errors.New("conn.onAmfMessage.closed")
 	}
+	if name != "connect" && !h.session.connected {
+		h.session.counts.Count("conn.unauthorized", 1)
+		return errors.New("conn.onAmfMessage.unauthorized " + name)
+	}
 	switch name {
 	default:
 		return h.onDefault(name, callback, r)
@@ -68,7 +76,7 @@ func (h *connHandler) OnClose() {
 	if !h.fw.closed {
 		h.fw.closed = true
 		h.fw.End()
-		xlog.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, flow closed\n", h.session.xid, h.fr.fid, h.fw.fid)
+		h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, flow closed\n", h.session.xid, h.fr.fid, h.fw.fid)
 	}
 	h.session.Close()
 }
@@ -86,19 +94,84 @@ func (h *connHandler) onDefault(name string, callback float64, r *amf0.Reader) e
 }
 
 func (h *connHandler) onConnect(callback float64, r *amf0.Reader) error {
+	if h.rejected {
+		return errors.New("conn.onConnect.rejected")
+	}
 	if obj, err := r.ReadObject(); err != nil {
 		return errors.New("conn.onConnect.read object")
 	} else if amfx, ok := obj.GetNumber("objectEncoding"); !ok {
 		return errors.New("conn.onConnect.amf version")
 	} else if amfx == 0 {
-		if err := h.newAmf0RejectResponse(callback); err != nil {
+		if err := h.newRejectResponse(callback, "ObjectEncoding client must be in a AMF3 format (not AMF0)"); err != nil {
 			return errors.New("conn.onConnect.reject amf0 response")
 		}
 	} else {
-		if err := h.newSuccessResponse(callback, h.session.xid, h.session.raddr); err != nil {
-			return errors.New("conn.onConnect.success response")
+		args := []interface{}{}
+		for r.Len() != 0 {
+			if v, err := r.Read(); err != nil {
+				return errors.New("conn.onConnect.read argument")
+			} else {
+				args = append(args, v)
+			}
+		}
+		done := make(chan error, 1)
+		h.session.sessions.auth.AuthorizeConnect(auth.NewConnect(h.session.xid, h.session.raddr, obj, args), func(err error) {
+			done <- err
+		})
+		select {
+		case err := <-done:
+			return h.onAuthorized(callback, err)
+		default:
+		}
+		// what follows on the flow waits for the answer
+		h.fr.hold = true
+		s := h.session
+		go func() {
+			err := <-done
+			h.session.sessions.async.Call(uint64(s.xid), func() {
+				s.Lock()
+				defer s.Unlock()
+				if s.closed || h.fw.closed {
+					return
+				}
+				defer s.flush()
+				if err := h.onAuthorized(callback, err); err != nil {
+					h.session.logs.ErrLog.Printf("[session]: xid = %d, connect error = '%v'\n", s.xid, err)
+				}
+			})
+		}()
+	}
+	return nil
+}
+
+// onAuthorized answers the connect once the authorizer has decided; a
+// rejected session is closed shortly after.
+func (h *connHandler) onAuthorized(callback float64, reason error) error {
+	if reason != nil {
+		h.session.counts.Count("conn.connect.rejected", 1)
+		h.session.logs.ErrLog.Printf("[session]: xid = %d, raddr = [%s], connect rejected, reason = '%v'\n", h.session.xid, h.session.raddr, reason)
+		h.rejected = true
+		xid := h.session.xid
+		time.AfterFunc(rejectLinger, func() {
+			h.session.sessions.CloseAll([]uint32{xid})
+		})
+		if err := h.newRejectResponse(callback, "Connection rejected"); err != nil {
+			return errors.New("conn.onConnect.reject response")
 		}
+		h.session.authorized(false)
+		return nil
 	}
+	h.session.counts.Count("conn.connect.accepted", 1)
+	s := h.session
+	if !s.connected {
+		s.connected = true
+		h.session.sessions.rpc.Join(s.xid, s.raddr)
+		s.announce()
+	}
+	if err := h.newSuccessResponse(callback, s.xid, s.raddr); err != nil {
+		return errors.New("conn.onConnect.success response")
+	}
+	s.authorized(true)
 	return nil
 }
 
@@ -111,23 +184,46 @@ func (h *connHandler) onSetPeerInfo(callback float64, r *amf0.Reader) error {
 		if s, err := r.ReadString(); err != nil {
 			return errors.New("conn.onSetPeerInfo.read address")
 		} else if len(s) != 0 {
-			if addr, err := net.ResolveUDPAddr("udp", s); err == nil {
-				if ip4 := addr.IP.To4(); ip4 != nil {
-					addr.IP = ip4
-				}
+			if addr, err := parsePeerAddr(s); err == nil {
 				addrs = append(addrs, addr)
 			} else {
-				xlog.ErrLog.Printf("[session]: parse addr = %s, error = '%v', addr = [%s]\n", s, addr)
+				h.session.logs.ErrLog.Printf("[session]: parse addr = %s, error = '%v', addr = [%s]\n", s, err, h.session.raddr)
 			}
 		}
 	}
 	h.session.addrs = addrs
+	h.session.announce()
 	if err := h.newKeepAliveResponse(keepAliveServer, keepAlivePeer); err != nil {
 		return errors.New("conn.onSetPeerInfo.keep alive response")
 	}
 	return nil
 }
 
+// parsePeerAddr accepts 'ip:port' and '[ipv6]:port', and also the bare
+// 'ipv6:port' some players send, where the port follows the last colon.
+func parsePeerAddr(s string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		idx := strings.LastIndex(s, ":")
+		if idx <= 0 || net.ParseIP(s[:idx]) == nil {
+			return nil, err
+		}
+		host, port = s[:idx], s[idx+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("conn.parsePeerAddr.bad ip")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return nil, errors.New("conn.parsePeerAddr.bad port")
+	}
+	return &net.UDPAddr{IP: ip, Port: int(p)}, nil
+}
+
 func (h *connHandler) onCreateStream(callback float64, r *amf0.Reader) error {
 	for {
 		h.session.lastsid++
@@ -147,7 +243,7 @@ func (h *connHandler) onSetAddressChangeInform(callback float64, r *amf0.Reader)
 }
 
 func (h *connHandler) onRequest(callback float64, r *amf0.Reader) error {
-	rpc.Call(h.session.xid, h.session.raddr, callback, r.Bytes(), true)
+	h.session.sessions.rpc.Call(h.session.xid, h.session.raddr, callback, r.Bytes(), true)
 	return nil
 }
 
@@ -159,8 +255,10 @@ func (h *connHandler) onRelay(callback float64, r *amf0.Reader) error {
 	} else if bs, err := newRelayMessage(h.session.pid, r.Bytes()); err != nil {
 		return errors.New("conn.onRelay.generate response")
 	} else {
-		async.Call(uint64(h.session.xid), func() {
-			if s := FindByPid(string(pidbs)); s != nil {
+		h.session.sessions.async.Call(uint64(h.session.xid), func() {
+			if s := h.session.sessions.FindByPid(string(pidbs)); s == nil {
+				h.session.sessions.cluster.Relay(string(pidbs), bs)
+			} else {
 				s.Lock()
 				defer s.Unlock()
 				if s.closed {
@@ -186,7 +284,7 @@ func (h *connHandler) onAddressChange(callback float64, r *amf0.Reader) error {
 }
 
 func (h *connHandler) onProxySend(callback float64, r *amf0.Reader, reliable bool) error {
-	rpc.Call(h.session.xid, h.session.raddr, 0, r.Bytes(), reliable)
+	h.session.sessions.rpc.Call(h.session.xid, h.session.raddr, 0, r.Bytes(), reliable)
 	return nil
 }
 
@@ -204,19 +302,19 @@ func (h *connHandler) onBroadcastByXid(callback float64, r *amf0.Reader, reliabl
 				xids = append(xids, uint32(x))
 			}
 		}
-		BroadcastByXid(xids, r.Bytes(), h.session.xid, reliable)
+		h.session.sessions.BroadcastByXid(xids, r.Bytes(), h.session.xid, reliable)
 		return nil
 	}
 }
 
-func (h *connHandler) newAmf0RejectResponse(callback float64) error {
+func (h *connHandler) newRejectResponse(callback float64, description string) error {
 	if w, err := newAmfMessageWriter("_error", callback); err != nil {
 		return err
 	} else {
 		obj := amf.NewObject()
 		obj.SetString("level", "error")
 		obj.SetString("code", "NetConnection.Connect.Rejected")
-		obj.SetString("description", "ObjectEncoding client must be in a AMF3 format (not AMF0)")
+		obj.SetString("description", description)
 		if err := w.WriteObject(obj); err != nil {
 			return err
 		}
@@ -0,0 +1,213 @@
+package session
+
+import (
+	"net"
+	"strconv"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/utils"
+)
+
+// KickByPid closes the sessions of the peer ids given and returns their xids.
+func (ss *Sessions) KickByPid(pids []string) []uint32 {
+	xids := make([]uint32, 0, len(pids))
+	for _, pid := range pids {
+		if s := ss.FindByPid(pid); s != nil && s.alive() {
+			xids = append(xids, s.xid)
+		}
+	}
+	ss.kick(xids)
+	return xids
+}
+
+// KickByAddr closes the sessions coming from the addresses given and returns
+// their xids. An address without a port matches every port of its host.
+func (ss *Sessions) KickByAddr(addrs []string) []uint32 {
+	xids := make([]uint32, 0)
+	for _, s := range ss.FindByAddr(addrs...) {
+		xids = append(xids, s.xid)
+	}
+	ss.kick(xids)
+	return xids
+}
+
+// FindByAddr returns the open sessions coming from any of addrs, which match
+// as in KickByAddr.
+func (ss *Sessions) FindByAddr(addrs ...string) []*Session {
+	match := make([]func(*net.UDPAddr) bool, 0, len(addrs))
+	for _, addr := range addrs {
+		if f := addrMatcher(addr); f != nil {
+			match = append(match, f)
+		}
+	}
+	found := make([]*Session, 0)
+	if len(match) == 0 {
+		return found
+	}
+	for _, s := range ss.allSessions() {
+		s.Lock()
+		raddr, closed := s.raddr, s.closed
+		s.Unlock()
+		if closed || raddr == nil {
+			continue
+		}
+		for _, f := range match {
+			if f(raddr) {
+				found = append(found, s)
+				break
+			}
+		}
+	}
+	return found
+}
+
+func addrMatcher(addr string) func(*net.UDPAddr) bool {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		ip := net.ParseIP(host)
+		port, err := strconv.Atoi(port)
+		if ip == nil || err != nil {
+			return nil
+		}
+		return func(raddr *net.UDPAddr) bool {
+			return raddr.IP.Equal(ip) && raddr.Port == port
+		}
+	} else if ip := net.ParseIP(addr); ip != nil {
+		return func(raddr *net.UDPAddr) bool {
+			return raddr.IP.Equal(ip)
+		}
+	}
+	return nil
+}
+
+// allSessions returns every session in the table, so they can be locked one
+// by one without holding a bucket.
+func (ss *Sessions) allSessions() []*Session {
+	all := make([]*Session, 0, 1024)
+	for i := 0; i < len(ss.buckets); i++ {
+		b := &ss.buckets[i]
+		b.RLock()
+		for _, s := range b.xidmap {
+			all = append(all, s)
+		}
+		b.RUnlock()
+	}
+	return all
+}
+
+func (ss *Sessions) kick(xids []uint32) {
+	if len(xids) == 0 {
+		return
+	}
+	ss.counts.Count("session.kick", len(xids))
+	ss.logs.SssLog.Printf("[kick] xids = %v\n", xids)
+	ss.CloseAll(xids)
+}
+
+// Alive returns the xids of the sessions which are still open.
+func (ss *Sessions) Alive(xids []uint32) []uint32 {
+	alive := make([]uint32, 0, len(xids))
+	for _, xid := range xids {
+		if s := ss.FindByXid(xid); s != nil && s.alive() {
+			alive = append(alive, xid)
+		}
+	}
+	return alive
+}
+
+func (s *Session) alive() bool {
+	s.Lock()
+	defer s.Unlock()
+	return !s.closed
+}
+
+// Push sends the message name, '_result' by default, with callback and the
+// amf0 values of data to xid over its main flow. It returns false when the
+// session is gone.
+func (ss *Sessions) Push(xid uint32, name string, callback float64, data []byte, reliable bool) bool {
+	if len(name) == 0 {
+		name = "_result"
+	}
+	w, err := newAmfMessageWriter(name, callback)
+	if err == nil {
+		err = w.WriteBytes(data)
+	}
+	if err != nil {
+		ss.logs.ErrLog.Printf("[session]: push error = '%v'\n", err)
+		return false
+	}
+	s := ss.FindByXid(xid)
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return false
+	}
+	defer s.flush()
+	fw := s.mainfw
+	if fw == nil {
+		return false
+	}
+	ss.counts.Count("session.push", 1)
+	fw.AddFragments(reliable, split(w.Bytes())...)
+	return true
+}
+
+func (ss *Sessions) findPublication(name string) *publication {
+	b := &ss.streams.buckets[utils.Hash16S(name)%uint16(len(ss.streams.buckets))]
+	b.Lock()
+	defer b.Unlock()
+	return b.pubmap[name]
+}
+
+// Members returns the xids of the publisher, 0 if none, and of the players of
+// stream, or false when nobody publishes or plays it.
+func (ss *Sessions) Members(stream string) (uint32, []uint32, bool) {
+	p := ss.findPublication(stream)
+	if p == nil {
+		return 0, nil, false
+	}
+	p.Lock()
+	master, l := p.master, p.slaves
+	p.Unlock()
+	xid := uint32(0)
+	if master != nil {
+		xid = master.session.xid
+	}
+	slaves := make([]uint32, 0)
+	if l != nil {
+		for e := l.Front(); e != nil; e = e.Next() {
+			slaves = append(slaves, e.Value.(*streamHandler).session.xid)
+		}
+	}
+	return xid, slaves, true
+}
+
+// Unpublish stops the publisher of stream as if it had closed the stream
+// itself, and returns its xid, or false when nobody publishes it.
+func (ss *Sessions) Unpublish(stream string) (uint32, bool) {
+	p := ss.findPublication(stream)
+	if p == nil {
+		return 0, false
+	}
+	p.Lock()
+	h := p.master
+	p.Unlock()
+	if h == nil {
+		return 0, false
+	}
+	s := h.session
+	s.Lock()
+	defer s.Unlock()
+	if s.closed || h.publish.p != p {
+		return 0, false
+	}
+	defer s.flush()
+	if err := h.disenage(); err != nil {
+		ss.logs.ErrLog.Printf("[session]: unpublish error = '%v'\n", err)
+	}
+	ss.counts.Count("session.unpublish", 1)
+	return s.xid, true
+}
@@ -6,9 +6,16 @@ import (
 
 import (
 	"github.com/spinlock/xserver/pkg/xserver/xio"
-	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
+const maxStages = 8192
+
+// flowReader reassembles the messages of an incoming flow. The fragments it
+// holds, out of order or waiting for the rest of their message, must fit in
+// -recvbuf: acks offer the peer what is left of it, in blocks of 1024 bytes,
+// and a peer that sends more has its flow closed. A flow opened before its
+// session is connected holds its messages, counted as buffered, until the
+// connect is answered.
 type flowReader struct {
 	session   *Session
 	signature string
@@ -16,6 +23,11 @@ type flowReader struct {
 	frags     list.List
 	stage     uint64
 	ready     list.List
+	buffered  int
+	closed    bool
+	hold      bool
+	held      [][]byte
+	ended     bool
 	handler   messageHandler
 }
 
@@ -27,10 +39,16 @@ func newFlowReader(session *Session, signature string, fid uint64) *flowReader {
 	fr.frags.Init()
 	fr.stage = 0
 	fr.ready.Init()
+	fr.buffered = 0
+	fr.closed = false
 	return fr
 }
 
 func (fr *flowReader) CommitAck() {
+	if fr.closed {
+		fr.session.send(newFlowErrorResponse(fr.fid))
+		return
+	}
 	ack := newFlowAck(fr.stage)
 	if e := fr.frags.Front(); e != nil {
 		f := e.Value.(*fragment)
@@ -47,17 +65,18 @@ func (fr *flowReader) CommitAck() {
 		ack.AddRange(beg, end)
 	}
 	cnt := uint64(0)
-	if size := fr.frags.Len(); size == 0 {
-		cnt = 0x7f
-	} else if size < 0x3f00 {
-		cnt = 0x3f00 - uint64(size)
+	if free := fr.session.sessions.args.RecvBuf()*1024 - fr.buffered; free > 0 {
+		cnt = uint64(free / 1024)
 	}
 	fr.session.send(newFlowAckResponse(fr.fid, cnt, ack))
-	xlog.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, send: stage = %d, ack = %v\n", fr.session.xid, fr.fid, fr.stage, ack)
+	fr.session.logs.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, send: stage = %d, ack = %v\n", fr.session.xid, fr.fid, fr.stage, ack)
 }
 
 func (fr *flowReader) AddFragments(stageack uint64, frags ...*fragment) {
-	xlog.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, recv: stage = %d, stageack = %d, frags = %v\n", fr.session.xid, fr.fid, fr.stage, stageack, frags)
+	fr.session.logs.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, recv: stage = %d, stageack = %d, frags = %v\n", fr.session.xid, fr.fid, fr.stage, stageack, frags)
+	if fr.closed {
+		return
+	}
 	if fr.handler.DeceptiveAck() {
 		for _, f := range frags {
 			if f.WithBefore() || f.WithAfter() {
@@ -65,7 +84,7 @@ func (fr *flowReader) AddFragments(stageack uint64, frags ...*fragment) {
 			}
 			if stageack+1 < f.stage {
 				stageack = f.stage - 1
-				xlog.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, skip: set stageack = %d\n", fr.session.xid, fr.fid, stageack)
+				fr.session.logs.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, skip: set stageack = %d\n", fr.session.xid, fr.fid, stageack)
 			}
 		}
 	}
@@ -75,6 +94,7 @@ func (fr *flowReader) AddFragments(stageack uint64, frags ...*fragment) {
 			if e := fr.frags.Front(); e != nil {
 				if f := e.Value.(*fragment); f.stage <= stageack {
 					fr.frags.Remove(e)
+					fr.buffered -= len(f.data)
 					if fr.accept(f) {
 						return
 					}
@@ -86,7 +106,7 @@ func (fr *flowReader) AddFragments(stageack uint64, frags ...*fragment) {
 		if fr.stage < stageack {
 			fr.stage = stageack
 			fr.deliver()
-			xlog.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, skip to stage %d\n", fr.session.xid, fr.fid, fr.stage)
+			fr.session.logs.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, skip to stage %d\n", fr.session.xid, fr.fid, fr.stage)
 		}
 		nothing = false
 	}
@@ -94,19 +114,21 @@ func (fr *flowReader) AddFragments(stageack uint64, frags ...*fragment) {
 		lower, enext := fr.stage, fr.frags.Front()
 		for _, f := range frags {
 			if f.stage <= lower {
-				xlog.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, stage %d has already been received\n", fr.session.xid, fr.fid, f.stage)
+				fr.session.logs.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, stage %d has already been received\n", fr.session.xid, fr.fid, f.stage)
 				continue
 			}
 			for {
 				if enext == nil {
 					fr.frags.PushBack(f)
+					fr.buffered += len(f.data)
 					nothing = false
 				} else if fnext := enext.Value.(*fragment); f.stage < fnext.stage {
 					fr.frags.InsertBefore(f, enext)
+					fr.buffered += len(f.data)
 					nothing = false
 				} else if fnext.stage == f.stage {
 					enext = enext.Next()
-					xlog.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, stage %d has already been received\n", fr.session.xid, fr.fid, f.stage)
+					fr.session.logs.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, stage %d has already been received\n", fr.session.xid, fr.fid, f.stage)
 				} else {
 					enext = enext.Next()
 					continue
@@ -123,6 +145,7 @@ func (fr *flowReader) AddFragments(stageack uint64, frags ...*fragment) {
 		if e := fr.frags.Front(); e != nil {
 			if f := e.Value.(*fragment); f.stage == fr.stage+1 {
 				fr.frags.Remove(e)
+				fr.buffered -= len(f.data)
 				if fr.accept(f) {
 					return
 				}
@@ -131,35 +154,84 @@ func (fr *flowReader) AddFragments(stageack uint64, frags ...*fragment) {
 		}
 		break
 	}
-	if sum := fr.frags.Len() + fr.ready.Len(); sum > 128 {
-		xlog.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, too many stages = %d\n", fr.session.xid, fr.fid, sum)
+	if sum := fr.frags.Len() + fr.ready.Len(); sum > maxStages || fr.buffered > fr.session.sessions.args.RecvBuf()*1024 {
+		fr.overrun(sum)
+	}
+}
+
+// overrun closes the flow, as its peer sent more than it was offered. The
+// acks of the flow become exceptions, until the peer gives up on it, and
+// the reader stays in the session so that the fragments still coming do not
+// open the flow again.
+func (fr *flowReader) overrun(stages int) {
+	fr.session.counts.Count("flow.reader.overrun", 1)
+	fr.session.logs.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, overrun, stages = %d, buffered = %d\n", fr.session.xid, fr.fid, stages, fr.buffered)
+	fr.closed = true
+	fr.frags.Init()
+	fr.ready.Init()
+	fr.hold, fr.held = false, nil
+	fr.buffered = 0
+	fr.handler.OnClose()
+}
+
+// refuse closes the flow, as its session was not let connect, the same way
+// overrun does.
+func (fr *flowReader) refuse() {
+	fr.session.counts.Count("flow.reader.refused", 1)
+	fr.session.logs.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, refused, not connected\n", fr.session.xid, fr.fid)
+	fr.closed = true
+	fr.hold, fr.held = false, nil
+	fr.buffered = 0
+	fr.handler.OnClose()
+}
+
+// release delivers what the flow held, as its session is now connected.
+func (fr *flowReader) release() {
+	held := fr.held
+	fr.hold, fr.held = false, nil
+	for _, bs := range held {
+		fr.buffered -= len(bs)
+		if fr.closed {
+			continue
+		}
+		if err := handleMessage(fr.handler, xio.NewPacketReader(bs)); err != nil {
+			fr.session.logs.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, deliver error = '%v'\n", fr.session.xid, fr.fid, err)
+		}
+	}
+	if fr.ended && !fr.closed {
+		fr.handler.OnClose()
 	}
 }
 
 func (fr *flowReader) accept(f *fragment) bool {
 	if next := fr.stage + 1; next > f.stage {
-		xlog.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, accept invalid stage\n", fr.session.xid, fr.fid)
+		fr.session.logs.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, accept invalid stage\n", fr.session.xid, fr.fid)
 	} else {
 		fr.stage = f.stage
 		if next != f.stage {
 			fr.deliver()
-			xlog.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, skip stage in accept\n", fr.session.xid, fr.fid)
+			fr.session.logs.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, skip stage in accept\n", fr.session.xid, fr.fid)
 		}
 		if f.Abandoned() {
 			fr.deliver()
-			xlog.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, abandoned fragment\n", fr.session.xid, fr.fid)
+			fr.session.logs.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, abandoned fragment\n", fr.session.xid, fr.fid)
 		} else {
 			if !f.WithBefore() {
 				fr.deliver()
 			}
 			fr.ready.PushBack(f)
+			fr.buffered += len(f.data)
 			if !f.WithAfter() {
 				fr.deliver()
 			}
 		}
 		if f.End() {
 			fr.deliver()
-			fr.handler.OnClose()
+			if fr.hold {
+				fr.ended = true
+			} else {
+				fr.handler.OnClose()
+			}
 			return true
 		}
 	}
@@ -169,10 +241,16 @@ func (fr *flowReader) accept(f *fragment) bool {
 func (fr *flowReader) deliver() {
 	if fr.ready.Len() != 0 {
 		bs := fr.merge()
+		for e := fr.ready.Front(); e != nil; e = e.Next() {
+			fr.buffered -= len(e.Value.(*fragment).data)
+		}
 		fr.ready.Init()
-		if len(bs) != 0 {
+		if len(bs) != 0 && fr.hold {
+			fr.held = append(fr.held, bs)
+			fr.buffered += len(bs)
+		} else if len(bs) != 0 {
 			if err := handleMessage(fr.handler, xio.NewPacketReader(bs)); err != nil {
-				xlog.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, deliver error = '%v'\n", fr.session.xid, fr.fid, err)
+				fr.session.logs.OutLog.Printf("[flows]: xid = %d, reader.fid = %d, deliver error = '%v'\n", fr.session.xid, fr.fid, err)
 			}
 		}
 	}
@@ -185,13 +263,13 @@ func (fr *flowReader) merge() []byte {
 	case 1:
 		f := fr.ready.Front().Value.(*fragment)
 		if f.WithBefore() || f.WithAfter() {
-			xlog.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, merge fragments failed\n", fr.session.xid, fr.fid)
+			fr.session.logs.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, merge fragments failed\n", fr.session.xid, fr.fid)
 			return nil
 		}
 		return f.data
 	default:
 		if fr.ready.Front().Value.(*fragment).WithBefore() || fr.ready.Back().Value.(*fragment).WithAfter() {
-			xlog.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, merge fragments failed\n", fr.session.xid, fr.fid)
+			fr.session.logs.ErrLog.Printf("[flows]: xid = %d, reader.fid = %d, merge fragments failed\n", fr.session.xid, fr.fid)
 			return nil
 		}
 		size := 0
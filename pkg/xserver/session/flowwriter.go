@@ -5,15 +5,12 @@ import (
 	"time"
 )
 
-import (
-	"github.com/spinlock/xserver/pkg/xserver/args"
-	"github.com/spinlock/xserver/pkg/xserver/xlog"
-)
-
-var (
-	retrans = args.Retrans()
-)
+const initialCredit = 64 * 1024
 
+// flowWriter sends the messages of an outgoing flow. Besides the window of
+// the session, it keeps to the credit its peer offers in acks: the reliable
+// bytes in flight stay within it, and when it is used up with nothing in
+// flight, a fragment goes now and then as a probe to learn when it reopens.
 type flowWriter struct {
 	session   *Session
 	signature string
@@ -23,8 +20,15 @@ type flowWriter struct {
 		idx      int
 		lasttime int64
 	}
-	frags  list.List
-	stage  uint64
+	frags    list.List
+	stage    uint64
+	inflight int
+	backlog  int
+	credit   struct {
+		avail   int
+		probes  int
+		probeat int64
+	}
 	reader *flowReader
 }
 
@@ -37,64 +41,109 @@ func newFlowWriter(session *Session, signature string, fid uint64) *flowWriter {
 	fw.manage.idx, fw.manage.lasttime = 0, 0
 	fw.frags.Init()
 	fw.stage = 0
+	fw.inflight, fw.backlog = 0, 0
+	fw.credit.avail, fw.credit.probes, fw.credit.probeat = initialCredit, 0, 0
 	return fw
 }
 
 func (fw *flowWriter) End() {
+	for e := fw.frags.Front(); e != nil; e = e.Next() {
+		if f := e.Value.(*fragment); f.sendtime != 0 {
+			fw.session.cc.onDropped(len(f.data))
+		}
+	}
 	fw.frags.Init()
+	fw.inflight = 0
+	fw.shrink(fw.backlog)
+	fw.session.dequeue(fw)
 	fw.stage++
 	flags := uint8(flagsAbandoned | flagsEnd)
-	f := &fragment{fw.stage, flags, nil, time.Now().UnixNano()}
+	f := &fragment{fw.stage, flags, nil, time.Now().UnixNano(), 0, 0}
 	fw.session.send(newFlowResponse(fw, f, f.stage-1))
-	xlog.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, send: stage = %d, stageack = %d, frag = %v\n", fw.session.xid, fw.fid, fw.stage, f.stage-1, f)
+	fw.session.logs.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, send: stage = %d, stageack = %d, frag = %v\n", fw.session.xid, fw.fid, fw.stage, f.stage-1, f)
 }
 
 func (fw *flowWriter) CommitAck(cnt uint64, ack *flowAck) {
-	xlog.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, recv: stage = %d, ack = %v\n", fw.session.xid, fw.fid, fw.stage, ack)
-	for {
-		if e := fw.frags.Front(); e != nil {
-			if f := e.Value.(*fragment); f.stage <= ack.stage {
-				fw.frags.Remove(e)
-				continue
-			}
+	fw.session.logs.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, recv: stage = %d, ack = %v\n", fw.session.xid, fw.fid, fw.stage, ack)
+	now, newest := time.Now().UnixNano(), int64(0)
+	fw.setCredit(cnt)
+	take := func(e *list.Element) {
+		f := e.Value.(*fragment)
+		fw.frags.Remove(e)
+		fw.shrink(len(f.data))
+		if f.sendtime > newest {
+			newest = f.sendtime
 		}
-		break
+		fw.acked(f, now)
 	}
-	now := time.Now().UnixNano()
-	fw.manage.idx, fw.manage.lasttime = 0, now
-	if e := fw.frags.Front(); e != nil {
-		lastsend := now - int64(time.Millisecond)*100
-		stageack := e.Value.(*fragment).stage - 1
-		for econt := ack.conts.Front(); econt != nil && e != nil; econt = econt.Next() {
-			r := econt.Value.(*flowAckRange)
-			for e != nil {
-				f := e.Value.(*fragment)
-				if f.stage < r.beg {
-					if f.sendtime < lastsend {
-						f.sendtime = now
-						fw.session.send(newFlowResponse(fw, f, stageack))
-						xlog.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, send: stage = %d, stageack = %d, frag = %v\n", fw.session.xid, fw.fid, fw.stage, stageack, f)
-					}
-					e = e.Next()
-				} else if f.stage <= r.end {
-					enext := e.Next()
-					fw.frags.Remove(e)
-					e = enext
-				} else {
-					break
-				}
+	for e := fw.frags.Front(); e != nil && e.Value.(*fragment).stage <= ack.stage; e = fw.frags.Front() {
+		take(e)
+	}
+	highest := ack.stage
+	e := fw.frags.Front()
+	for econt := ack.conts.Front(); econt != nil; econt = econt.Next() {
+		r := econt.Value.(*flowAckRange)
+		for e != nil && e.Value.(*fragment).stage <= r.end {
+			enext := e.Next()
+			if e.Value.(*fragment).stage >= r.beg {
+				take(e)
 			}
+			e = enext
 		}
-		for e != nil {
-			f := e.Value.(*fragment)
-			if f.sendtime < lastsend {
-				f.sendtime = now
-				fw.session.send(newFlowResponse(fw, f, stageack))
-				xlog.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, send: stage = %d, stageack = %d, frag = %v\n", fw.session.xid, fw.fid, fw.stage, stageack, f)
-			}
-			e = e.Next()
+		highest = r.end
+	}
+	if newest != 0 {
+		fw.manage.idx, fw.manage.lasttime = 0, now
+	}
+	fw.recover(now, newest, highest, ack)
+}
+
+// recover resends the fragments the ack shows lost: those below the highest
+// stage acked which were sent before a fragment acked now, allowing for a
+// bit of reordering, or which have three acked stages above them. A resent
+// fragment is only lost again once a fragment sent after it is acked.
+func (fw *flowWriter) recover(now, newest int64, highest uint64, ack *flowAck) {
+	e := fw.frags.Front()
+	if e == nil {
+		return
+	}
+	cc := &fw.session.cc
+	reorder := cc.rtt() / 4
+	stageack := e.Value.(*fragment).stage - 1
+	lost := 0
+	for ; e != nil; e = e.Next() {
+		f := e.Value.(*fragment)
+		if f.stage >= highest || f.sendtime == 0 {
+			break
+		}
+		if f.sendtime+reorder < newest || (f.retrans == 0 && above(ack, f.stage) >= 3) {
+			lost++
+			fw.resend(f, now, stageack)
 		}
 	}
+	if lost != 0 {
+		cc.stats.lost += uint64(lost)
+		cc.onLoss(now)
+	}
+}
+
+// above returns how many stages after stage the ranges of ack hold.
+func above(ack *flowAck, stage uint64) uint64 {
+	n := uint64(0)
+	for e := ack.conts.Front(); e != nil; e = e.Next() {
+		if r := e.Value.(*flowAckRange); r.beg > stage {
+			n += r.end - r.beg + 1
+		}
+	}
+	return n
+}
+
+func (fw *flowWriter) resend(f *fragment, now int64, stageack uint64) {
+	f.sendtime = now
+	f.retrans++
+	fw.session.cc.stats.retrans++
+	fw.session.send(newFlowResponse(fw, f, stageack))
+	fw.session.logs.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, send: stage = %d, stageack = %d, frag = %v\n", fw.session.xid, fw.fid, fw.stage, stageack, f)
 }
 
 func (fw *flowWriter) AddFragments(reliable bool, frags ...[]byte) {
@@ -105,8 +154,7 @@ func (fw *flowWriter) AddFragments(reliable bool, frags ...[]byte) {
 	if e := fw.frags.Front(); e != nil {
 		stageack = e.Value.(*fragment).stage - 1
 	}
-	cnt := len(frags)
-	now := time.Now().UnixNano()
+	cnt, now := len(frags), time.Now().UnixNano()
 	for i := 0; i < cnt; i++ {
 		flags := uint8(0)
 		if i != 0 {
@@ -116,34 +164,115 @@ func (fw *flowWriter) AddFragments(reliable bool, frags ...[]byte) {
 			flags |= flagsWithAfter
 		}
 		fw.stage++
-		f := &fragment{fw.stage, flags, frags[i], now}
+		f := &fragment{fw.stage, flags, frags[i], 0, 0, now}
 		if reliable {
 			fw.frags.PushBack(f)
 		}
-		fw.session.send(newFlowResponse(fw, f, stageack))
-		xlog.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, send: stage = %d, stageack = %d, frag = %v\n", fw.session.xid, fw.fid, fw.stage, stageack, f)
+		fw.session.enqueue(fw, f, stageack, reliable)
+		fw.grow(len(f.data))
+	}
+	fw.session.overflow(fw)
+}
+
+// setCredit takes the buffer the peer has left, in blocks of 1024 bytes.
+func (fw *flowWriter) setCredit(cnt uint64) {
+	const max = maxWindow / 1024
+	if cnt > max {
+		cnt = max
+	}
+	fw.credit.avail = int(cnt) * 1024
+	if fw.credit.avail > fw.inflight {
+		fw.credit.probes, fw.credit.probeat = 0, 0
+	}
+}
+
+// allows tells whether size more bytes may be sent on fw now, and whether
+// they would be a probe, to be told to probed once sent.
+func (fw *flowWriter) allows(size int, now int64) (bool, bool) {
+	c := &fw.credit
+	if fw.inflight+size <= c.avail || (fw.inflight == 0 && c.avail != 0) {
+		return true, false
+	}
+	if fw.inflight != 0 {
+		return false, false
+	}
+	if c.probeat == 0 {
+		fw.session.counts.Count("flow.credit.blocked", 1)
+		c.probeat = now + fw.session.cc.timeout(c.probes)
 	}
+	return now >= c.probeat, true
+}
+
+func (fw *flowWriter) probed() {
+	fw.session.counts.Count("flow.credit.probe", 1)
+	fw.credit.probes, fw.credit.probeat = fw.credit.probes+1, 0
 }
 
 func (fw *flowWriter) Manage() bool {
 	if fw.frags.Len() == 0 {
 		return true
 	}
-	now := time.Now().UnixNano()
-	if fw.manage.lasttime < now-int64(time.Millisecond)*int64(retrans[fw.manage.idx]) {
-		if max := len(retrans) - 1; fw.manage.idx < max {
-			fw.manage.idx++
-		}
-		fw.manage.lasttime = now
-		lastsend := now - int64(time.Millisecond)*100
-		if f := fw.frags.Back().Value.(*fragment); f.sendtime < lastsend {
-			stageack := fw.frags.Front().Value.(*fragment).stage - 1
-			f.sendtime = now
-			fw.session.send(newFlowResponse(fw, f, stageack))
-			xlog.OutLog.Printf("[flows]: xid = %d, writer.fid = %d, send: stage = %d, stageack = %d, frag = %v\n", fw.session.xid, fw.fid, fw.stage, stageack, f)
+	fw.retransmit(time.Now().UnixNano())
+	return false
+}
+
+// deadline returns when the retransmission timer of fw expires, or 0 when
+// it has nothing in flight. The timer runs from the last ack which made
+// progress or the last send of the oldest fragment, whichever is later.
+func (fw *flowWriter) deadline() int64 {
+	e := fw.frags.Front()
+	if e == nil {
+		return 0
+	}
+	f := e.Value.(*fragment)
+	if f.sendtime == 0 {
+		return 0
+	}
+	base := fw.manage.lasttime
+	if f.sendtime > base {
+		base = f.sendtime
+	}
+	return base + fw.session.cc.timeout(fw.manage.idx)
+}
+
+// retransmit resends, once the timer has expired, the fragments in flight
+// from the oldest one, as many as the window shrunk by the timeout holds,
+// and backs the timer off.
+func (fw *flowWriter) retransmit(now int64) {
+	if d := fw.deadline(); d == 0 || now < d {
+		return
+	}
+	cc := &fw.session.cc
+	cc.onTimeout(now)
+	if max := len(fw.session.sessions.args.Retrans()) - 1; fw.manage.idx < max {
+		fw.manage.idx++
+	}
+	stageack := fw.frags.Front().Value.(*fragment).stage - 1
+	size := 0
+	for e := fw.frags.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*fragment)
+		if f.sendtime == 0 || (size != 0 && size+len(f.data) > cc.cwnd) {
+			break
 		}
+		size += len(f.data)
+		fw.resend(f, now, stageack)
+	}
+}
+
+// acked feeds the window, the rtt estimate and the flow histograms; the
+// round trip of a retransmitted fragment is ambiguous, so only first
+// transmissions are timed.
+func (fw *flowWriter) acked(f *fragment, now int64) {
+	if f.sendtime == 0 {
+		return
+	}
+	fw.session.cc.onAcked(len(f.data))
+	fw.inflight -= len(f.data)
+	fw.session.sessions.retrans.Observe(float64(f.retrans))
+	if f.retrans == 0 {
+		fw.session.cc.sample(now - f.sendtime)
+		fw.session.sessions.rtt.Observe(float64(now-f.sendtime) / float64(time.Second))
 	}
-	return false
 }
 
 func split(data []byte) [][]byte {
@@ -18,6 +18,8 @@ type fragment struct {
 	flags    uint8
 	data     []byte
 	sendtime int64
+	retrans  int
+	addtime  int64
 }
 
 func (f *fragment) WithAfter() bool {
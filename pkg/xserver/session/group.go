@@ -0,0 +1,116 @@
+package session
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/amf/amf0"
+	"github.com/spinlock/xserver/pkg/xserver/xio"
+	"github.com/spinlock/xserver/pkg/xserver/xlog"
+)
+
+type groupHandler struct {
+	session *Session
+	fr      *flowReader
+	fw      *flowWriter
+	g       *group
+}
+
+func newGroupHandler(session *Session, fr *flowReader, fw *flowWriter) *groupHandler {
+	h := &groupHandler{}
+	h.session = session
+	h.fr, h.fw = fr, fw
+	h.g = nil
+	return h
+}
+
+func (h *groupHandler) OnAmfMessage(name string, callback float64, r *amf0.Reader) error {
+	if h.fw.closed {
+		return errors.New("group.onAmfMessage.closed")
+	}
+	h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, unhandled call '%s' on group flow\n", h.session.xid, h.fr.fid, h.fw.fid, name)
+	return nil
+}
+
+func (h *groupHandler) OnRawMessage(code uint8, r *xio.PacketReader) error {
+	if h.fw.closed {
+		return errors.New("group.onRawMessage.closed")
+	}
+	switch code {
+	default:
+		h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, unhandled code = 0x%02x on group flow\n", h.session.xid, h.fr.fid, h.fw.fid, code)
+		return nil
+	case 0x01:
+		return h.onJoin(r)
+	}
+}
+
+func (h *groupHandler) OnClose() {
+	h.disenage()
+	if !h.fw.closed {
+		h.fw.closed = true
+		h.fw.End()
+		h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, flow closed\n", h.session.xid, h.fr.fid, h.fw.fid)
+	}
+}
+
+func (h *groupHandler) DeceptiveAck() bool {
+	return false
+}
+
+func (h *groupHandler) disenage() {
+	if g := h.g; g != nil {
+		h.g = nil
+		g.leave(h)
+		h.session.counts.Count("group.leave", 1)
+	}
+}
+
+func (h *groupHandler) onJoin(r *xio.PacketReader) error {
+	size := uint64(0)
+	if v, err := r.Read7BitValue64(); err != nil {
+		return errors.New("group.onJoin.read size")
+	} else if v <= 1 || v > uint64(r.Len()) {
+		return errors.New("group.onJoin.bad size")
+	} else {
+		size = v - 1
+	}
+	if err := r.Skip(1); err != nil {
+		return errors.New("group.onJoin.skip flag")
+	}
+	spec := make([]byte, int(size))
+	if err := r.ReadBytes(spec); err != nil {
+		return errors.New("group.onJoin.read groupspec")
+	}
+	id := string(spec)
+	if len(id) != sha256.Size {
+		sum := sha256.Sum256(spec)
+		id = string(sum[:])
+	}
+	h.disenage()
+	s := h.session
+	h.g = h.session.sessions.joinGroup(id, member{h: h, xid: s.xid, pid: s.pid, raddr: s.raddr})
+	h.session.counts.Count("group.join", 1)
+	h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, join group = %s\n", h.session.xid, h.fr.fid, h.fw.fid, xlog.StringToHex(id))
+
+	for _, x := range nearby(s.raddr, h.g.peers(h), maxGroupPeers) {
+		if err := h.newPeerResponse(x.pid); err != nil {
+			return errors.New("group.onJoin.peer response")
+		}
+	}
+	return nil
+}
+
+func (h *groupHandler) newPeerResponse(pid string) error {
+	w := xio.NewPacketWriter(nil)
+	if err := w.Write8(0x0b); err != nil {
+		return err
+	}
+	if err := w.WriteBytes([]byte(pid)); err != nil {
+		return err
+	}
+	h.fw.AddFragments(true, split(w.Bytes())...)
+	return nil
+}
@@ -0,0 +1,190 @@
+package session
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/utils"
+)
+
+const (
+	maxGroupPeers  = 6
+	maxGroupSample = 64
+)
+
+// member is what a group keeps of a handler joining it, as it was then, so
+// that other members read it without a lock of the handler's session.
+type member struct {
+	h     *groupHandler
+	xid   uint32
+	pid   string
+	raddr *net.UDPAddr
+}
+
+type group struct {
+	sessions *Sessions
+	id       string
+	closed   bool
+	members  []member
+	index    map[*groupHandler]int
+	bid      uint16
+	sync.Mutex
+}
+
+func (ss *Sessions) joinGroup(id string, m member) *group {
+	bid := utils.Hash16S(id) % uint16(len(ss.groups.buckets))
+
+	b := &ss.groups.buckets[bid]
+	b.Lock()
+	defer b.Unlock()
+	g := b.gmap[id]
+	if g == nil {
+		g = &group{}
+		g.sessions = ss
+		g.id = id
+		g.closed = false
+		g.members = make([]member, 0, 16)
+		g.index = make(map[*groupHandler]int)
+		g.bid = bid
+		b.gmap[id] = g
+	}
+	g.Lock()
+	if _, ok := g.index[m.h]; !ok {
+		g.index[m.h] = len(g.members)
+		g.members = append(g.members, m)
+	}
+	g.Unlock()
+	return g
+}
+
+func (g *group) leave(h *groupHandler) {
+	b := &g.sessions.groups.buckets[g.bid]
+	b.Lock()
+	defer b.Unlock()
+	g.Lock()
+	if i, ok := g.index[h]; ok {
+		last := len(g.members) - 1
+		if i != last {
+			m := g.members[last]
+			g.members[i], g.index[m.h] = m, i
+		}
+		g.members[last] = member{}
+		g.members = g.members[:last]
+		delete(g.index, h)
+	}
+	if len(g.members) == 0 && !g.closed {
+		g.closed = true
+		delete(b.gmap, g.id)
+	}
+	g.Unlock()
+}
+
+func (g *group) peers(h *groupHandler) []member {
+	g.Lock()
+	defer g.Unlock()
+	n := len(g.members)
+	if n <= 1 {
+		return nil
+	}
+	sample := make([]member, 0, maxGroupSample)
+	if n <= maxGroupSample {
+		for _, m := range g.members {
+			if m.h != h {
+				sample = append(sample, m)
+			}
+		}
+		for i := len(sample) - 1; i > 0; i-- {
+			j := rand.Intn(i + 1)
+			sample[i], sample[j] = sample[j], sample[i]
+		}
+	} else {
+		seen := make(map[int]bool, maxGroupSample)
+		for len(seen) < maxGroupSample {
+			i := rand.Intn(n)
+			if seen[i] {
+				continue
+			}
+			seen[i] = true
+			if m := g.members[i]; m.h != h {
+				sample = append(sample, m)
+			}
+		}
+	}
+	return sample
+}
+
+func nearby(raddr *net.UDPAddr, peers []member, max int) []member {
+	if len(peers) <= max || raddr == nil {
+		if len(peers) > max {
+			peers = peers[:max]
+		}
+		return peers
+	}
+	distance := func(x member) int {
+		if x.raddr == nil {
+			return net.IPv6len
+		}
+		a, b := raddr.IP.To16(), x.raddr.IP.To16()
+		if a == nil || b == nil {
+			return net.IPv6len
+		}
+		for i := 0; i < len(a); i++ {
+			if a[i] != b[i] {
+				return len(a) - i
+			}
+		}
+		return 0
+	}
+	ret := make([]member, 0, max)
+	for len(ret) < max {
+		idx, min := -1, 0
+		for i, x := range peers {
+			if x.h == nil {
+				continue
+			}
+			if d := distance(x); idx < 0 || d < min {
+				idx, min = i, d
+			}
+		}
+		if idx < 0 {
+			break
+		}
+		ret = append(ret, peers[idx])
+		peers[idx] = member{}
+	}
+	return ret
+}
+
+func (ss *Sessions) Groups() int {
+	count := 0
+	for i := 0; i < len(ss.groups.buckets); i++ {
+		b := &ss.groups.buckets[i]
+		b.Lock()
+		count += len(b.gmap)
+		b.Unlock()
+	}
+	return count
+}
+
+func (ss *Sessions) DumpGroups() map[string]interface{} {
+	all := make(map[string]interface{}, 1024)
+	for i := 0; i < len(ss.groups.buckets); i++ {
+		b := &ss.groups.buckets[i]
+		b.Lock()
+		for id, g := range b.gmap {
+			g.Lock()
+			s := make([]uint32, 0, len(g.members))
+			for _, m := range g.members {
+				s = append(s, m.xid)
+			}
+			g.Unlock()
+			all[hex.EncodeToString([]byte(id))] = s
+		}
+		b.Unlock()
+	}
+	return all
+}
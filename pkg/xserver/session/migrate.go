@@ -0,0 +1,110 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/rtmfp"
+	"github.com/spinlock/xserver/pkg/xserver/xlog"
+)
+
+const (
+	probeInterval = time.Second
+	maxProbes     = 5
+)
+
+// probe validates a new path of a session. A packet that decrypts proves the
+// sender has the key, not that it owns the source address, since it may be
+// a replay from a spoofed one. The session keeps sending to its old path
+// until the client echoes, from the new one, a ping carrying a nonce that
+// was sent there.
+type probe struct {
+	lport uint16
+	raddr *net.UDPAddr
+	nonce []byte
+	sent  int64
+	tries int
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// migrate is called for a packet which came from another path than the
+// current one, and starts probing that path unless it is already.
+func (s *Session) migrate(lport uint16, raddr *net.UDPAddr) {
+	if p := s.probe; p != nil && p.lport == lport && sameAddr(p.raddr, raddr) {
+		return
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		s.logs.ErrLog.Printf("[session]: probe nonce error = '%v'\n", err)
+		return
+	}
+	if s.probe != nil {
+		s.counts.Count("session.migrate.replaced", 1)
+	}
+	s.probe = &probe{lport: lport, raddr: raddr, nonce: nonce}
+	s.logs.OutLog.Printf("[session]: xid = %d, raddr = [%s], probe new path [%s]\n", s.xid, s.raddr, raddr)
+	s.sendProbe()
+}
+
+func (s *Session) sendProbe() {
+	p := s.probe
+	p.sent, p.tries = time.Now().UnixNano(), p.tries+1
+	s.counts.Count("session.migrate.probe", 1)
+	flush(s, p.lport, p.raddr, []rtmfp.ResponseMessage{newKeepAliveResponse(false, p.nonce)})
+}
+
+// manageProbe resends the probe until it has been tried maxProbes times,
+// then gives the path up.
+func (s *Session) manageProbe() {
+	p := s.probe
+	if p == nil || time.Now().UnixNano()-p.sent < int64(probeInterval) {
+		return
+	}
+	if p.tries < maxProbes {
+		s.sendProbe()
+		return
+	}
+	s.probe = nil
+	s.counts.Count("session.migrate.failed", 1)
+	s.logs.SssLog.Printf("[migrate] %s [%s] xid = %d, path [%s] not validated\n", xlog.StringToHex(s.pid), s.raddr, s.xid, p.raddr)
+}
+
+// onPingReply moves the session to the probed path once the reply comes
+// from it with the nonce, and tells the backend and the client.
+func (s *Session) onPingReply(lport uint16, raddr *net.UDPAddr, data []byte) {
+	p := s.probe
+	if p == nil || p.lport != lport || !sameAddr(p.raddr, raddr) {
+		return
+	}
+	if !bytes.Equal(data, p.nonce) {
+		s.counts.Count("session.migrate.mismatch", 1)
+		return
+	}
+	s.probe = nil
+	from := s.raddr
+	s.lport, s.raddr = lport, raddr
+	s.heard()
+	s.counts.Count("session.migrate", 1)
+	s.logs.SssLog.Printf("[migrate] %s [%s] xid = %d, to [%s]\n", xlog.StringToHex(s.pid), from, s.xid, raddr)
+	if s.connected {
+		s.sessions.rpc.Migrate(s.xid, from, raddr)
+	}
+	s.announce()
+	if fw := s.mainfw; fw != nil {
+		if h, ok := fw.reader.handler.(*connHandler); ok && h.addrchgi {
+			if err := h.newAddressChangeResponse(raddr); err != nil {
+				s.logs.ErrLog.Printf("[session]: address change error = '%v'\n", err)
+			}
+		}
+	}
+}
@@ -31,12 +31,14 @@ type flowErrorRequest struct {
 	fid uint64
 }
 
+// Fragments copy the data of the slices, as the packet they were read from
+// goes back to the pool of its udp server.
 func (req *flowRequest) Fragments() []*fragment {
 	frags := make([]*fragment, len(req.slices))
 	for i := 0; i < len(req.slices); i++ {
 		stage := req.stage + uint64(i)
 		flags, data := req.slices[i].flags, req.slices[i].data
-		frags[i] = &fragment{stage, flags, data, 0}
+		frags[i] = &fragment{stage, flags, append([]byte(nil), data...), 0, 0, 0}
 	}
 	return frags
 }
@@ -169,12 +169,15 @@ func (rsp *flowResponse) WriteTo(w *xio.PacketWriter) error {
 	return nil
 }
 
+// keepAliveResponse is a ping, or a ping reply when passive, whose data the
+// other side echoes back.
 type keepAliveResponse struct {
 	passive bool
+	data    []byte
 }
 
-func newKeepAliveResponse(passive bool) *keepAliveResponse {
-	return &keepAliveResponse{passive}
+func newKeepAliveResponse(passive bool, data []byte) *keepAliveResponse {
+	return &keepAliveResponse{passive, data}
 }
 
 func (rsp *keepAliveResponse) Info() (uint64, uint64) {
@@ -182,7 +185,7 @@ func (rsp *keepAliveResponse) Info() (uint64, uint64) {
 }
 
 func (rsp *keepAliveResponse) SetLastInfo(lastfid, laststage uint64) int {
-	return 0
+	return len(rsp.data)
 }
 
 func (rsp *keepAliveResponse) Code() uint8 {
@@ -194,7 +197,7 @@ func (rsp *keepAliveResponse) Code() uint8 {
 }
 
 func (rsp *keepAliveResponse) WriteTo(w *xio.PacketWriter) error {
-	return nil
+	return w.WriteBytes(rsp.data)
 }
 
 type flowAckResponse struct {
@@ -242,6 +245,37 @@ func (rsp *flowAckResponse) WriteTo(w *xio.PacketWriter) error {
 	return nil
 }
 
+type flowErrorResponse struct {
+	fid uint64
+}
+
+func newFlowErrorResponse(fid uint64) *flowErrorResponse {
+	return &flowErrorResponse{fid}
+}
+
+func (rsp *flowErrorResponse) Info() (uint64, uint64) {
+	return 0, 0
+}
+
+func (rsp *flowErrorResponse) SetLastInfo(lastfid, laststage uint64) int {
+	size := 1
+	if add, err := xio.SizeOf7BitValue64(rsp.fid); err == nil {
+		size += add
+	}
+	return size
+}
+
+func (rsp *flowErrorResponse) Code() uint8 {
+	return 0x5e
+}
+
+func (rsp *flowErrorResponse) WriteTo(w *xio.PacketWriter) error {
+	if err := w.Write7BitValue64(rsp.fid); err != nil {
+		return err
+	}
+	return w.Write8(0)
+}
+
 type errorResponse struct {
 }
 
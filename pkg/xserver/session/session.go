@@ -10,14 +10,10 @@ import (
 )
 
 import (
-	"github.com/spinlock/xserver/pkg/xserver/args"
-	"github.com/spinlock/xserver/pkg/xserver/async"
-	"github.com/spinlock/xserver/pkg/xserver/cookies"
 	"github.com/spinlock/xserver/pkg/xserver/counts"
-	"github.com/spinlock/xserver/pkg/xserver/rpc"
 	"github.com/spinlock/xserver/pkg/xserver/rtmfp"
-	"github.com/spinlock/xserver/pkg/xserver/udp"
 	"github.com/spinlock/xserver/pkg/xserver/utils"
+	"github.com/spinlock/xserver/pkg/xserver/wheel"
 	"github.com/spinlock/xserver/pkg/xserver/xio"
 	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
@@ -26,22 +22,25 @@ const (
 	maxKeepalive = 6
 )
 
-var (
-	intKeepalive = int64(args.Heartbeat())
-)
-
 type Session struct {
-	xid    uint32
-	yid    uint32
-	pid    string
-	cookie string
-	lport  uint16
-	raddr  *net.UDPAddr
-	addrs  []*net.UDPAddr
-	closed bool
-	manage struct {
+	sessions  *Sessions
+	counts    *counts.Counts
+	logs      *xlog.Logs
+	xid       uint32
+	yid       uint32
+	pid       string
+	cookie    string
+	lport     uint16
+	raddr     *net.UDPAddr
+	addrs     []*net.UDPAddr
+	closed    bool
+	connected bool
+	manage    struct {
 		cnt      int
 		lasttime int64
+		due      int64
+		timer    *wheel.Timer
+		wheel    *wheel.Wheel
 	}
 	stmptime uint16
 	rtmfp.AESEngine
@@ -51,6 +50,9 @@ type Session struct {
 	readers map[uint64]*flowReader
 	writers map[uint64]*flowWriter
 	rsplist list.List
+	probe   *probe
+	cc      congestion
+	backlog int
 	sync.Mutex
 }
 
@@ -58,12 +60,12 @@ func (s *Session) Handshake(tag []byte, raddr *net.UDPAddr) ([]*net.UDPAddr, boo
 	s.Lock()
 	defer s.Unlock()
 	if s.closed {
-		counts.Count("session.p2p.closed", 1)
+		s.counts.Count("session.p2p.closed", 1)
 		return nil, false
 	}
 	defer s.flush()
 
-	xlog.OutLog.Printf("[session]: xid = %d, raddr = [%s], handshake to [%s]\n", s.xid, s.raddr, raddr)
+	s.logs.OutLog.Printf("[session]: xid = %d, raddr = [%s], handshake to [%s]\n", s.xid, s.raddr, raddr)
 
 	s.send(&handshakeResponse{s.pid, tag, raddr, true})
 
@@ -73,45 +75,53 @@ func (s *Session) Handshake(tag []byte, raddr *net.UDPAddr) ([]*net.UDPAddr, boo
 	return addrs, true
 }
 
-func HandlePacket(lport uint16, raddr *net.UDPAddr, xid uint32, data []byte) {
-	s := FindByXid(xid)
+func (ss *Sessions) HandlePacket(lport uint16, raddr *net.UDPAddr, xid uint32, data []byte) {
+	s := ss.FindByXid(xid)
 	if s == nil {
-		counts.Count("session.notfound", 1)
+		ss.counts.Count("session.notfound", 1)
 		return
 	}
 	s.Lock()
 	defer s.Unlock()
 	if s.closed {
-		counts.Count("session.hasclosed", 1)
+		ss.counts.Count("session.hasclosed", 1)
 		return
 	}
 	defer s.flush()
 
 	var err error
 	if data, err = rtmfp.DecodePacket(s, data); err != nil {
-		counts.Count("session.decode.error", 1)
-		xlog.ErrLog.Printf("[session]: decode error = '%v'\n", err)
+		ss.counts.Count("session.decode.error", 1)
+		ss.logs.ErrLog.Printf("[session]: decode error = '%v'\n", err)
 		return
 	}
-	xlog.OutLog.Printf("[session]: recv addr = [%s], data.len = %d\n%s\n", raddr, len(data), utils.Formatted(data))
-
-	s.lport, s.raddr = lport, raddr
+	ss.logs.OutLog.Printf("[session]: recv addr = [%s], data.len = %d\n%s\n", raddr, len(data), utils.Formatted(data))
 
 	if len(s.cookie) != 0 {
-		cookies.Commit(s.cookie)
+		s.lport, s.raddr = lport, raddr
+		ss.cookies.Commit(s.cookie)
 		s.cookie = ""
-		rpc.Join(s.xid, s.raddr)
+	} else if lport != s.lport || !sameAddr(raddr, s.raddr) {
+		s.migrate(lport, raddr)
 	}
 
-	s.manage.cnt, s.manage.lasttime = 0, time.Now().UnixNano()
+	// a packet replayed from another path decrypts as well, so only those of
+	// the current path keep the session alive until the probe validates one
+	if lport == s.lport && sameAddr(raddr, s.raddr) {
+		s.heard()
+	}
 
-	if err = s.handle(xio.NewPacketReader(data[6:])); err != nil {
-		counts.Count("session.handle.error", 1)
-		xlog.ErrLog.Printf("[session]: handle error = '%v'\n", err)
+	if err = s.handle(lport, raddr, xio.NewPacketReader(data[6:])); err != nil {
+		ss.counts.Count("session.handle.error", 1)
+		ss.logs.ErrLog.Printf("[session]: handle error = '%v'\n", err)
 	}
 }
 
-func (s *Session) handle(r *xio.PacketReader) error {
+func (s *Session) heard() {
+	s.manage.cnt, s.manage.lasttime = 0, time.Now().UnixNano()
+}
+
+func (s *Session) handle(lport uint16, raddr *net.UDPAddr, r *xio.PacketReader) error {
 	if marker, err := r.Read8(); err != nil {
 		return errors.New("packet.read marker")
 	} else {
@@ -120,11 +130,13 @@ func (s *Session) handle(r *xio.PacketReader) error {
 		}
 		switch marker | 0xf0 {
 		default:
-			counts.Count("session.marker.unknown", 1)
+			s.counts.Count("session.marker.unknown", 1)
 			return errors.New(fmt.Sprintf("packet.unknown marker = 0x%02x", marker))
 		case 0xfd:
-			if _, err = r.Read16(); err != nil {
+			if echo, err := r.Read16(); err != nil {
 				return errors.New("packet.read ping time")
+			} else {
+				s.cc.onEcho(time.Now().UnixNano(), echo)
 			}
 		case 0xf9:
 		}
@@ -154,48 +166,49 @@ func (s *Session) handle(r *xio.PacketReader) error {
 		switch msg.Code {
 		default:
 			s.Close()
-			counts.Count("session.code.unknown", 1)
+			s.counts.Count("session.code.unknown", 1)
 			return errors.New(fmt.Sprintf("message.close code = 0x%02x", msg.Code))
 		case 0x4c:
 			s.Close()
-			counts.Count("session.code.close", 1)
+			s.counts.Count("session.code.close", 1)
 			return nil
 		case 0x01:
-			s.send(newKeepAliveResponse(true))
+			s.send(newKeepAliveResponse(true, msg.Bytes()))
 		case 0x41:
+			s.onPingReply(lport, raddr, msg.Bytes())
 		case 0x5e:
 			if req, err := parseFlowErrorRequest(msg.PacketReader); err != nil {
-				counts.Count("session.parse5e.error", 1)
+				s.counts.Count("session.parse5e.error", 1)
 				return err
 			} else if fw := s.writers[req.fid]; fw != nil {
 				fw.reader.handler.OnClose()
 			} else {
-				xlog.OutLog.Printf("[session]: xid = %d, writer.fid = %d, flow not found 0x5e\n", s.xid, req.fid)
+				s.logs.OutLog.Printf("[session]: xid = %d, writer.fid = %d, flow not found 0x5e\n", s.xid, req.fid)
 			}
 		case 0x51:
 			if req, err := parseFlowAckRequest(msg.PacketReader); err != nil {
-				counts.Count("session.parse51.error", 1)
+				s.counts.Count("session.parse51.error", 1)
 				return err
 			} else if fw := s.writers[req.fid]; fw != nil {
 				fw.CommitAck(req.cnt, req.ack)
 			} else {
-				xlog.OutLog.Printf("[session]: xid = %d, writer.fid = %d, flow not found 0x51\n", s.xid, req.fid)
+				s.logs.OutLog.Printf("[session]: xid = %d, writer.fid = %d, flow not found 0x51\n", s.xid, req.fid)
 			}
 		case 0x10:
 			if req, err := parseFlowRequest(msg.PacketReader); err != nil {
-				counts.Count("session.parse10.error", 1)
+				s.counts.Count("session.parse10.error", 1)
 				return err
 			} else {
 				lastreq = req
 			}
 		case 0x11:
 			if req, err := parseFlowRequestSlice(msg.PacketReader); err != nil {
-				counts.Count("session.parse11.error", 1)
+				s.counts.Count("session.parse11.error", 1)
 				return err
 			} else if lastreq != nil {
 				lastreq.AddSlice(req)
 			} else {
-				xlog.OutLog.Printf("[session]: xid = %d, not following message\n", s.xid)
+				s.logs.OutLog.Printf("[session]: xid = %d, not following message\n", s.xid)
 			}
 		}
 	}
@@ -207,14 +220,14 @@ func (s *Session) handle(r *xio.PacketReader) error {
 
 func (s *Session) handleFlowRequest(req *flowRequest) error {
 	if fr, err := s.getFlowReader(req.fid, req.signature); err != nil {
-		counts.Count("session.flow.error", 1)
+		s.counts.Count("session.flow.error", 1)
 		return errors.New("flow.create flow reader")
 	} else if fr != nil {
 		fr.AddFragments(req.stageack, req.Fragments()...)
 		fr.CommitAck()
 		return nil
 	} else {
-		xlog.OutLog.Printf("[session]: xid = %d, reader.fid = %d, flow not found\n", s.xid, req.fid)
+		s.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, flow not found\n", s.xid, req.fid)
 		return nil
 	}
 }
@@ -229,7 +242,12 @@ func (s *Session) getFlowReader(fid uint64, signature string) (*flowReader, erro
 		if len(signature) == 0 || s.closed {
 			return nil, nil
 		}
-		if len(signature) <= 4 || signature[:4] != "\x00\x54\x43\x04" {
+		group := false
+		if len(signature) > 4 && signature[:4] == "\x00\x54\x43\x04" {
+			group = false
+		} else if len(signature) >= 3 && signature[:3] == "\x00\x47\x43" {
+			group = true
+		} else {
 			return nil, errors.New("reader.signature.unsupported")
 		}
 
@@ -238,7 +256,9 @@ func (s *Session) getFlowReader(fid uint64, signature string) (*flowReader, erro
 		fr := newFlowReader(s, signature, fid)
 
 		var h messageHandler
-		if signature[4:] == "\x00" {
+		if group {
+			h = newGroupHandler(s, fr, fw)
+		} else if signature[4:] == "\x00" {
 			s.mainfw = fw
 			h = newConnHandler(s, fr, fw)
 		} else {
@@ -249,53 +269,136 @@ func (s *Session) getFlowReader(fid uint64, signature string) (*flowReader, erro
 
 		s.writers[fw.fid] = fw
 		s.readers[fr.fid] = fr
-		xlog.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, flow created\n", s.xid, fr.fid, fw.fid)
+		s.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, flow created\n", s.xid, fr.fid, fw.fid)
+		// streams and groups wait for the connect to be authorized
+		if s.mainfw != fw && !s.connected {
+			if s.rejected() {
+				fr.refuse()
+			} else {
+				fr.hold = true
+			}
+		}
 		return fr, nil
 	}
 }
 
+// rejected tells whether the connect of s was rejected.
+func (s *Session) rejected() bool {
+	if fw := s.mainfw; fw != nil {
+		if h, ok := fw.reader.handler.(*connHandler); ok {
+			return h.rejected
+		}
+	}
+	return false
+}
+
+// authorized releases the flows held while the connect of s was pending,
+// the main one first, or refuses them but the main one if it was rejected,
+// whose messages are then refused one by one.
+func (s *Session) authorized(accepted bool) {
+	var main *flowReader
+	if fw := s.mainfw; fw != nil {
+		if main = fw.reader; main.hold {
+			main.release()
+		}
+	}
+	for _, fr := range s.readers {
+		if fr == main || !fr.hold {
+			continue
+		}
+		if accepted {
+			fr.release()
+		} else {
+			fr.refuse()
+		}
+	}
+}
+
 func (s *Session) Close() {
+	if s.shutdown() && s.connected {
+		s.sessions.rpc.Exit(s.xid, s.raddr)
+	}
+}
+
+func (s *Session) shutdown() bool {
 	if s.closed {
-		return
+		return false
 	}
 	s.closed = true
 	for _, fw := range s.writers {
 		fw.reader.handler.OnClose()
 	}
+	s.stopTimers()
+	s.schedule(time.Now().UnixNano())
 	s.send(newErrorResponse())
-	counts.Count("session.close", 1)
-	xlog.OutLog.Printf("[session]: xid = %d, session closed\n", s.xid)
-	rpc.Exit(s.xid, s.raddr)
+	s.counts.Count("session.close", 1)
+	s.logs.OutLog.Printf("[session]: xid = %d, session closed\n", s.xid)
+	return true
+}
+
+func (s *Session) pending() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.cc.queue.Len() != 0 {
+		return true
+	}
+	for _, fw := range s.writers {
+		if fw.frags.Len() != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// onTimer manages s once its deadline is due, and forgets it once closed.
+func (s *Session) onTimer() {
+	if !s.Manage() {
+		return
+	}
+	s.sessions.delSessionByXid(s.xid)
+	s.sessions.delSessionByPid(s.pid)
+	s.sessions.rpc.Forget(s.xid)
+	s.sessions.cluster.Exit(s.xid)
+	s.counts.Count("session.cleanup", 1)
+	s.logs.SssLog.Printf("[exit] %s [%s] xid = %d cnt = %d\n", xlog.StringToHex(s.pid), s.raddr, s.xid, s.manage.cnt)
 }
 
 func (s *Session) Manage() bool {
 	s.Lock()
 	defer s.Unlock()
+	s.manage.due = 0
 	if s.closed {
-		xlog.OutLog.Printf("[session]: xid = %d, session deleted, closed\n", s.xid)
+		s.logs.OutLog.Printf("[session]: xid = %d, session deleted, closed\n", s.xid)
 		return true
 	}
 	defer s.flush()
 
 	now := time.Now().UnixNano()
-	if s.manage.lasttime < now-int64(time.Second)*intKeepalive {
+	if s.manage.lasttime < now-int64(time.Second)*int64(s.sessions.args.Heartbeat()) {
 		if cnt := s.manage.cnt; cnt < maxKeepalive {
 			s.manage.cnt, s.manage.lasttime = cnt+1, now
-			s.send(newKeepAliveResponse(false))
+			s.send(newKeepAliveResponse(false, nil))
 		} else {
 			s.Close()
-			xlog.OutLog.Printf("[session]: xid = %d, session deleted, timeout\n", s.xid)
+			s.logs.OutLog.Printf("[session]: xid = %d, session deleted, timeout\n", s.xid)
 			return true
 		}
 	}
 
+	s.manageProbe()
+
 	for _, fw := range s.writers {
 		if fw.Manage() {
 			if fw.closed {
 				fr := fw.reader
-				delete(s.readers, fr.fid)
+				if !fr.closed {
+					delete(s.readers, fr.fid)
+				}
 				delete(s.writers, fw.fid)
-				xlog.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, flow deleted\n", s.xid, fr.fid, fw.fid)
+				s.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, flow deleted\n", s.xid, fr.fid, fw.fid)
 			}
 		}
 	}
@@ -307,10 +410,12 @@ func (s *Session) send(rsp response) {
 }
 
 func (s *Session) flush() {
+	s.release()
+	s.rearm()
 	if s.rsplist.Len() == 0 {
 		return
 	}
-	const limit = 1320
+	const limit = segmentSize
 	lastfid, laststage := uint64(0), uint64(0)
 	size := 0
 	msgs := make([]rtmfp.ResponseMessage, 0, 8)
@@ -323,51 +428,51 @@ func (s *Session) flush() {
 			msgs = append(msgs, rsp)
 			continue
 		}
-		flush(s, msgs)
+		flush(s, s.lport, s.raddr, msgs)
 		lastfid, laststage = 0, 0
 		size = 0
 		msgs = msgs[:0]
 	}
 	if len(msgs) != 0 {
-		flush(s, msgs)
+		flush(s, s.lport, s.raddr, msgs)
 	}
 }
 
-func flush(s *Session, msgs []rtmfp.ResponseMessage) {
-	lport, raddr := s.lport, s.raddr
+func flush(s *Session, lport uint16, raddr *net.UDPAddr, msgs []rtmfp.ResponseMessage) {
 	if data, err := rtmfp.PacketToBytes(&packet{s.yid, s.manage.lasttime, s.stmptime, msgs}); err != nil {
-		counts.Count("session.tobytes.error", 1)
-		xlog.ErrLog.Printf("[session]: packet to bytes error = '%v'\n", err)
+		s.counts.Count("session.tobytes.error", 1)
+		s.logs.ErrLog.Printf("[session]: packet to bytes error = '%v'\n", err)
 		return
 	} else {
-		xlog.OutLog.Printf("[session]: send addr = [%s], data.len = %d\n%s\n", raddr, len(data), utils.Formatted(data))
+		s.logs.OutLog.Printf("[session]: send addr = [%s], data.len = %d\n%s\n", raddr, len(data), utils.Formatted(data))
 		if data, err = rtmfp.EncodePacket(s, s.yid, data); err != nil {
-			counts.Count("session.encode.error", 1)
-			xlog.ErrLog.Printf("[session]: encode packet error = '%v'\n", err)
+			s.counts.Count("session.encode.error", 1)
+			s.logs.ErrLog.Printf("[session]: encode packet error = '%v'\n", err)
 			return
 		}
-		udp.Send(lport, raddr, data)
+		s.sessions.udp.Send(lport, raddr, data)
 	}
 }
 
-func CloseAll(xids []uint32) {
+func (ss *Sessions) CloseAll(xids []uint32) {
 	call := func(s *Session) {
 		s.Lock()
 		defer s.Unlock()
+		defer s.flush()
 		s.Close()
 	}
-	async.Call(uint64(time.Now().UnixNano()), func() {
+	ss.async.Call(uint64(time.Now().UnixNano()), func() {
 		for _, xid := range xids {
-			if s := FindByXid(xid); s != nil {
+			if s := ss.FindByXid(xid); s != nil {
 				call(s)
 			}
 		}
 	})
 }
 
-func RecvPull(xids []uint32, data []byte, reliable bool) {
+func (ss *Sessions) RecvPull(xids []uint32, data []byte, reliable bool) {
 	if bs, err := newRecvPullMessage(data, reliable); err != nil {
-		xlog.ErrLog.Printf("[session]: recvPull error = '%v'\n", err)
+		ss.logs.ErrLog.Printf("[session]: recvPull error = '%v'\n", err)
 	} else {
 		data := split(bs)
 		call := func(s *Session) {
@@ -381,22 +486,22 @@ func RecvPull(xids []uint32, data []byte, reliable bool) {
 				fw.AddFragments(reliable, data...)
 			}
 		}
-		async.Call(uint64(time.Now().UnixNano()), func() {
+		ss.async.Offer(uint64(time.Now().UnixNano()), func() {
 			for _, xid := range xids {
-				if s := FindByXid(xid); s != nil {
+				if s := ss.FindByXid(xid); s != nil {
 					call(s)
 				}
 			}
-		})
+		}, true)
 	}
 }
 
-func Callback(xid uint32, data []byte, callback float64, reliable bool) {
+func (ss *Sessions) Callback(xid uint32, data []byte, callback float64, reliable bool) {
 	if bs, err := newCallbackMessage(callback, data); err != nil {
-		xlog.ErrLog.Printf("[session]: callback error = '%v'\n", err)
+		ss.logs.ErrLog.Printf("[session]: callback error = '%v'\n", err)
 	} else {
-		async.Call(uint64(time.Now().UnixNano()), func() {
-			if s := FindByXid(xid); s != nil {
+		ss.async.Call(uint64(time.Now().UnixNano()), func() {
+			if s := ss.FindByXid(xid); s != nil {
 				s.Lock()
 				defer s.Unlock()
 				if s.closed {
@@ -411,9 +516,9 @@ func Callback(xid uint32, data []byte, callback float64, reliable bool) {
 	}
 }
 
-func BroadcastByXid(xids []uint32, data []byte, from uint32, reliable bool) {
+func (ss *Sessions) BroadcastByXid(xids []uint32, data []byte, from uint32, reliable bool) {
 	if bs, err := newBroadcastByXidMessage(data, from, reliable); err != nil {
-		xlog.ErrLog.Printf("[session]: broadcastByXid error = '%v'\n", err)
+		ss.logs.ErrLog.Printf("[session]: broadcastByXid error = '%v'\n", err)
 	} else {
 		data := split(bs)
 		call := func(s *Session) {
@@ -427,13 +532,19 @@ func BroadcastByXid(xids []uint32, data []byte, from uint32, reliable bool) {
 				fw.AddFragments(reliable, data...)
 			}
 		}
-		async.Call(uint64(time.Now().UnixNano()), func() {
+		ss.async.Offer(uint64(time.Now().UnixNano()), func() {
+			var remote []uint32
 			for _, xid := range xids {
-				if s := FindByXid(xid); s != nil {
+				if s := ss.FindByXid(xid); s != nil {
 					call(s)
+				} else {
+					remote = append(remote, xid)
 				}
 			}
-		})
+			if len(remote) != 0 {
+				ss.cluster.Broadcast(remote, bs, reliable)
+			}
+		}, false)
 	}
 }
 
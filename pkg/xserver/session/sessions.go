@@ -1,81 +1,182 @@
 package session
 
 import (
-	"container/list"
+	"context"
 	"encoding/hex"
 	"errors"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
 
 import (
 	"github.com/spinlock/xserver/pkg/xserver/args"
+	"github.com/spinlock/xserver/pkg/xserver/async"
+	"github.com/spinlock/xserver/pkg/xserver/auth"
+	"github.com/spinlock/xserver/pkg/xserver/cluster"
+	"github.com/spinlock/xserver/pkg/xserver/cookies"
 	"github.com/spinlock/xserver/pkg/xserver/counts"
+	"github.com/spinlock/xserver/pkg/xserver/rpc"
 	"github.com/spinlock/xserver/pkg/xserver/rtmfp"
+	"github.com/spinlock/xserver/pkg/xserver/udp"
 	"github.com/spinlock/xserver/pkg/xserver/utils"
+	"github.com/spinlock/xserver/pkg/xserver/wheel"
 	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
-var sessions struct {
+// Sessions are the sessions of a server, with the streams and the groups
+// they share, and the parts of the server they use.
+type Sessions struct {
 	buckets [256]struct {
 		xidmap map[uint32]*Session
 		pidmap map[string]*Session
 		sync.RWMutex
 	}
 	lastxid uint32
-	manages [32]struct {
-		freshlist *list.List
-		alivelist *list.List
-		sync.Mutex
-	}
+	wheels  [32]*wheel.Wheel
 	sync.Mutex
+
+	streams struct {
+		buckets [256]struct {
+			pubmap map[string]*publication
+			sync.Mutex
+		}
+	}
+	groups struct {
+		buckets [256]struct {
+			gmap map[string]*group
+			sync.Mutex
+		}
+	}
+
+	args    *args.Args
+	counts  *counts.Counts
+	logs    *xlog.Logs
+	async   *async.Pool
+	rpc     *rpc.Link
+	cluster *cluster.Cluster
+	cookies *cookies.Cookies
+	auth    auth.Authorizer
+	udp     *udp.Servers
+
+	retrans *counts.Histogram
+	rtt     *counts.Histogram
+}
+
+const (
+	manageTick = time.Millisecond * 10
+)
+
+func New(a *args.Args, c *counts.Counts, l *xlog.Logs, p *async.Pool, link *rpc.Link,
+	cl *cluster.Cluster, cs *cookies.Cookies, au auth.Authorizer, us *udp.Servers) *Sessions {
+	ss := &Sessions{}
+	ss.lastxid = 0
+	for i := 0; i < len(ss.buckets); i++ {
+		ss.buckets[i].xidmap = make(map[uint32]*Session, 8192)
+		ss.buckets[i].pidmap = make(map[string]*Session, 8192)
+	}
+	for i := 0; i < len(ss.streams.buckets); i++ {
+		ss.streams.buckets[i].pubmap = make(map[string]*publication, 8192)
+	}
+	for i := 0; i < len(ss.groups.buckets); i++ {
+		ss.groups.buckets[i].gmap = make(map[string]*group, 1024)
+	}
+	ss.args, ss.counts, ss.logs, ss.async = a, c, l, p
+	ss.rpc, ss.cluster, ss.cookies, ss.auth, ss.udp = link, cl, cs, au, us
+	ss.retrans = c.NewHistogram("flow.retrans", 0, 1, 2, 3, 5, 8, 13)
+	ss.rtt = c.NewHistogram("flow.rtt.seconds", 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5)
+	return ss
+}
+
+// Start turns the wheels the sessions are managed on. A session is not
+// visited every so often any more: it keeps one timer set to its next
+// deadline, a keepalive, a retransmission, a credit probe or a path probe,
+// and is managed when that fires.
+func (ss *Sessions) Start() {
+	for i := 0; i < len(ss.wheels); i++ {
+		ss.wheels[i] = wheel.Start(manageTick, ss.counts)
+	}
 }
 
-func init() {
-	sessions.lastxid = 0
-	for i := 0; i < len(sessions.buckets); i++ {
-		sessions.buckets[i].xidmap = make(map[uint32]*Session, 8192)
-		sessions.buckets[i].pidmap = make(map[string]*Session, 8192)
+func (ss *Sessions) Stop() {
+	for i := 0; i < len(ss.wheels); i++ {
+		if w := ss.wheels[i]; w != nil {
+			w.Stop()
+		}
+	}
+	for i := 0; i < len(ss.buckets); i++ {
+		b := &ss.buckets[i]
+		b.Lock()
+		b.xidmap = make(map[uint32]*Session, 8192)
+		b.pidmap = make(map[string]*Session, 8192)
+		b.Unlock()
+	}
+	for i := 0; i < len(ss.streams.buckets); i++ {
+		b := &ss.streams.buckets[i]
+		b.Lock()
+		b.pubmap = make(map[string]*publication, 8192)
+		b.Unlock()
+	}
+	for i := 0; i < len(ss.groups.buckets); i++ {
+		b := &ss.groups.buckets[i]
+		b.Lock()
+		b.gmap = make(map[string]*group, 1024)
+		b.Unlock()
 	}
-	for i := 0; i < len(sessions.manages); i++ {
-		m := &sessions.manages[i]
-		m.freshlist = list.New()
-		m.alivelist = list.New()
-		go func() {
-			manage := args.Manage()
-			for {
-				m.Lock()
-				if m.freshlist.Len() != 0 {
-					m.alivelist.PushBackList(m.freshlist)
-					m.freshlist.Init()
-				}
-				m.Unlock()
-				count := 0
-				if e := m.alivelist.Front(); e != nil {
-					for e != nil {
-						next := e.Next()
-						if s := e.Value.(*Session); s.Manage() {
-							delSessionByXid(s.xid)
-							delSessionByPid(s.pid)
-							m.alivelist.Remove(e)
-							count++
-							xlog.SssLog.Printf("[exit] %s [%s] xid = %d cnt = %d\n", xlog.StringToHex(s.pid), s.raddr, s.xid, s.manage.cnt)
-						}
-						e = next
-					}
-				}
-				if count != 0 {
-					counts.Count("session.cleanup", count)
-				}
-				time.Sleep(time.Millisecond * time.Duration(manage))
+}
+
+// Drain waits for every session to get its reliable fragments acknowledged,
+// or for ctx to be done, then closes all of them and reports the exits to
+// the rpc backend in one batch.
+func (ss *Sessions) Drain(ctx context.Context) int {
+	all := make([]*Session, 0, 8192)
+	for i := 0; i < len(ss.buckets); i++ {
+		b := &ss.buckets[i]
+		b.RLock()
+		for _, s := range b.xidmap {
+			all = append(all, s)
+		}
+		b.RUnlock()
+	}
+	for {
+		pending := 0
+		for _, s := range all {
+			if s.pending() {
+				pending++
 			}
-		}()
+		}
+		if pending == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			ss.counts.Count("session.drain.timeout", 1)
+			ss.logs.ErrLog.Printf("[session]: drain timeout, pending = %d\n", pending)
+		case <-time.After(time.Millisecond * 50):
+			continue
+		}
+		break
+	}
+	xids := make([]uint32, 0, len(all))
+	addrs := make([]*net.UDPAddr, 0, len(all))
+	for _, s := range all {
+		s.Lock()
+		if s.shutdown() && s.connected {
+			xids = append(xids, s.xid)
+			addrs = append(addrs, s.raddr)
+		}
+		s.flush()
+		s.Unlock()
 	}
+	ss.counts.Count("session.drain", len(xids))
+	ss.rpc.ExitAll(xids, addrs)
+	return len(xids)
 }
 
-func Create(yid uint32, pid string, cookie string, encrypt, decrypt []byte, lport uint16, raddr *net.UDPAddr) (uint32, error) {
+func (ss *Sessions) Create(yid uint32, pid string, cookie string, encrypt, decrypt []byte, lport uint16, raddr *net.UDPAddr) (uint32, error) {
 	s := &Session{}
+	s.sessions, s.counts, s.logs = ss, ss.counts, ss.logs
 	s.xid = 0
 	s.yid = yid
 	s.pid = pid
@@ -83,7 +184,9 @@ func Create(yid uint32, pid string, cookie string, encrypt, decrypt []byte, lpor
 	s.addrs = nil
 	s.cookie = cookie
 	s.closed = false
+	s.connected = false
 	s.manage.cnt, s.manage.lasttime = 0, time.Now().UnixNano()
+	s.manage.due, s.manage.timer = 0, wheel.NewTimer(s.onTimer)
 	s.stmptime = 0
 	s.AESEngine = rtmfp.NewAESEngine()
 	if err := s.SetKey(encrypt, decrypt); err != nil {
@@ -95,102 +198,129 @@ func Create(yid uint32, pid string, cookie string, encrypt, decrypt []byte, lpor
 	s.readers = make(map[uint64]*flowReader)
 	s.writers = make(map[uint64]*flowWriter)
 	s.rsplist.Init()
+	s.probe = nil
+	s.cc.init(ss)
+	s.backlog = 0
 
-	sessions.Lock()
-	defer sessions.Unlock()
+	ss.Lock()
+	defer ss.Unlock()
 
-	xid := sessions.lastxid
+	// in a cluster the node takes the top byte, so that xids stay unique
+	// among the nodes
+	node := uint32(ss.args.Node()) << 24
+	xid := ss.lastxid
 	for {
-		xid++
-		if xid == 0 {
+		if xid++; node != 0 {
+			xid = node | xid&0xffffff
+		}
+		if xid == 0 || xid == node {
 			continue
 		}
-		if xid == sessions.lastxid {
+		if xid == ss.lastxid {
 			return 0, errors.New("too many sessions")
 		}
-		if getSessionByXid(xid) == nil {
+		if ss.getSessionByXid(xid) == nil {
 			break
 		}
 	}
 	s.xid = xid
-	sessions.lastxid = xid
-	addSessionByXid(xid, s)
-	addSessionByPid(pid, s)
-
-	m := &sessions.manages[int(xid%uint32(len(sessions.manages)))]
-	m.Lock()
-	m.freshlist.PushBack(s)
-	m.Unlock()
+	s.manage.wheel = ss.wheels[int(xid%uint32(len(ss.wheels)))]
+	s.rearm()
+	ss.lastxid = xid
+	ss.addSessionByXid(xid, s)
+	ss.addSessionByPid(pid, s)
 
-	counts.Count("session.new", 1)
+	ss.counts.Count("session.new", 1)
 	return xid, nil
 }
 
-func hashXidToBid(xid uint32) uint16 {
-	return uint16(xid) % uint16(len(sessions.buckets))
+func (ss *Sessions) hashXidToBid(xid uint32) uint16 {
+	return uint16(xid) % uint16(len(ss.buckets))
 }
 
-func hashPidToBid(pid string) uint16 {
-	return utils.Hash16S(pid) % uint16(len(sessions.buckets))
+func (ss *Sessions) hashPidToBid(pid string) uint16 {
+	return utils.Hash16S(pid) % uint16(len(ss.buckets))
 }
 
-func FindByXid(xid uint32) *Session {
-	return getSessionByXid(xid)
+func (ss *Sessions) FindByXid(xid uint32) *Session {
+	return ss.getSessionByXid(xid)
 }
 
-func FindByPid(pid string) *Session {
-	return getSessionByPid(pid)
+func (ss *Sessions) FindByPid(pid string) *Session {
+	return ss.getSessionByPid(pid)
 }
 
-func addSessionByXid(xid uint32, s *Session) {
-	b := &sessions.buckets[hashXidToBid(xid)]
+func (ss *Sessions) addSessionByXid(xid uint32, s *Session) {
+	b := &ss.buckets[ss.hashXidToBid(xid)]
 	b.Lock()
 	b.xidmap[xid] = s
 	b.Unlock()
 }
 
-func addSessionByPid(pid string, s *Session) {
-	b := &sessions.buckets[hashPidToBid(pid)]
+func (ss *Sessions) addSessionByPid(pid string, s *Session) {
+	b := &ss.buckets[ss.hashPidToBid(pid)]
 	b.Lock()
 	b.pidmap[pid] = s
 	b.Unlock()
 }
 
-func delSessionByXid(xid uint32) {
-	b := &sessions.buckets[hashXidToBid(xid)]
+func (ss *Sessions) delSessionByXid(xid uint32) {
+	b := &ss.buckets[ss.hashXidToBid(xid)]
 	b.Lock()
 	delete(b.xidmap, xid)
 	b.Unlock()
 }
 
-func delSessionByPid(pid string) {
-	b := &sessions.buckets[hashPidToBid(pid)]
+func (ss *Sessions) delSessionByPid(pid string) {
+	b := &ss.buckets[ss.hashPidToBid(pid)]
 	b.Lock()
 	delete(b.pidmap, pid)
 	b.Unlock()
 }
 
-func getSessionByXid(xid uint32) *Session {
-	b := &sessions.buckets[hashXidToBid(xid)]
+func (ss *Sessions) getSessionByXid(xid uint32) *Session {
+	b := &ss.buckets[ss.hashXidToBid(xid)]
 	b.RLock()
 	s := b.xidmap[xid]
 	b.RUnlock()
 	return s
 }
 
-func getSessionByPid(pid string) *Session {
-	b := &sessions.buckets[hashPidToBid(pid)]
+func (ss *Sessions) getSessionByPid(pid string) *Session {
+	b := &ss.buckets[ss.hashPidToBid(pid)]
 	b.RLock()
 	s := b.pidmap[pid]
 	b.RUnlock()
 	return s
 }
 
-func Summary() map[string]interface{} {
+func (ss *Sessions) Count() int {
+	n := 0
+	for i := 0; i < len(ss.buckets); i++ {
+		b := &ss.buckets[i]
+		b.RLock()
+		n += len(b.xidmap)
+		b.RUnlock()
+	}
+	return n
+}
+
+// Timers returns how many sessions wait for a deadline on the wheels.
+func (ss *Sessions) Timers() int {
+	n := 0
+	for _, w := range ss.wheels {
+		if w != nil {
+			n += w.Len()
+		}
+	}
+	return n
+}
+
+func (ss *Sessions) Summary() map[string]interface{} {
 	xids, pids := 0, 0
 	zclosed, zmanage := 0, make([]int, maxKeepalive+1)
-	for i := 0; i < len(sessions.buckets); i++ {
-		b := &sessions.buckets[i]
+	for i := 0; i < len(ss.buckets); i++ {
+		b := &ss.buckets[i]
 		b.RLock()
 		xids += len(b.xidmap)
 		pids += len(b.pidmap)
@@ -213,12 +343,12 @@ func Summary() map[string]interface{} {
 	}
 }
 
-func MapSize() map[string]interface{} {
-	const n = len(sessions.buckets)
+func (ss *Sessions) MapSize() map[string]interface{} {
+	const n = len(ss.buckets)
 	xids := make([]int, n)
 	pids := make([]int, n)
 	for i := 0; i < n; i++ {
-		b := &sessions.buckets[i]
+		b := &ss.buckets[i]
 		b.RLock()
 		xids[i] = len(b.xidmap)
 		pids[i] = len(b.pidmap)
@@ -230,28 +360,94 @@ func MapSize() map[string]interface{} {
 	}
 }
 
-func DumpAll() []map[string]interface{} {
+func (ss *Sessions) DumpAll() []map[string]interface{} {
 	all := make([]map[string]interface{}, 0, 8192)
-	for i := 0; i < len(sessions.buckets); i++ {
-		b := &sessions.buckets[i]
+	for i := 0; i < len(ss.buckets); i++ {
+		b := &ss.buckets[i]
 		b.RLock()
 		for _, s := range b.xidmap {
 			s.Lock()
-			all = append(all, map[string]interface{}{
-				"xid":    s.xid,
-				"yid":    s.yid,
-				"pid":    hex.EncodeToString([]byte(s.pid)),
-				"raddr":  s.raddr.String(),
-				"addrs":  s.addrs,
-				"closed": s.closed,
-				"manage": map[string]interface{}{
-					"cnt":      s.manage.cnt,
-					"lasttime": s.manage.lasttime,
-				},
-			})
+			all = append(all, s.dump())
 			s.Unlock()
 		}
 		b.RUnlock()
 	}
 	return all
 }
+
+func (s *Session) Xid() uint32 {
+	return s.xid
+}
+
+// Dump describes s as DumpAll does.
+func (s *Session) Dump() map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	return s.dump()
+}
+
+func (s *Session) dump() map[string]interface{} {
+	m := map[string]interface{}{
+		"xid":     s.xid,
+		"yid":     s.yid,
+		"pid":     hex.EncodeToString([]byte(s.pid)),
+		"raddr":   s.raddr.String(),
+		"addrs":   s.addrs,
+		"closed":  s.closed,
+		"backlog": s.backlog,
+		"manage": map[string]interface{}{
+			"cnt":      s.manage.cnt,
+			"lasttime": s.manage.lasttime,
+			"due":      s.manage.due,
+		},
+	}
+	s.cc.dump(m)
+	return m
+}
+
+// Filter selects the sessions of List; zero fields match every session.
+// Addr matches as in KickByAddr, and Idle keeps the sessions silent for at
+// least that long.
+type Filter struct {
+	Addr   string
+	Closed *bool
+	Idle   time.Duration
+}
+
+// List returns how many sessions match f, and the page of them starting at
+// offset with at most limit entries, in xid order.
+func (ss *Sessions) List(f *Filter, offset, limit int) (int, []map[string]interface{}) {
+	var match func(*net.UDPAddr) bool
+	if len(f.Addr) != 0 {
+		if match = addrMatcher(f.Addr); match == nil {
+			return 0, []map[string]interface{}{}
+		}
+	}
+	all := ss.allSessions()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].xid < all[j].xid
+	})
+	now := time.Now().UnixNano()
+	total, page := 0, make([]map[string]interface{}, 0)
+	for _, s := range all {
+		s.Lock()
+		ok := true
+		if match != nil {
+			ok = s.raddr != nil && match(s.raddr)
+		}
+		if f.Closed != nil && s.closed != *f.Closed {
+			ok = false
+		}
+		if f.Idle != 0 && now-s.manage.lasttime < int64(f.Idle) {
+			ok = false
+		}
+		if ok {
+			if total >= offset && len(page) < limit {
+				page = append(page, s.dump())
+			}
+			total++
+		}
+		s.Unlock()
+	}
+	return total, page
+}
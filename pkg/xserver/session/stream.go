@@ -9,10 +9,7 @@ import (
 import (
 	"github.com/spinlock/xserver/pkg/xserver/amf"
 	"github.com/spinlock/xserver/pkg/xserver/amf/amf0"
-	"github.com/spinlock/xserver/pkg/xserver/async"
-	"github.com/spinlock/xserver/pkg/xserver/rpc"
 	"github.com/spinlock/xserver/pkg/xserver/xio"
-	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
 type streamHandler struct {
@@ -25,6 +22,7 @@ type streamHandler struct {
 	}
 	bound    uint32
 	unstable bool
+	keyframe bool
 }
 
 func newStreamHandler(session *Session, fr *flowReader, fw *flowWriter) *streamHandler {
@@ -34,6 +32,7 @@ func newStreamHandler(session *Session, fr *flowReader, fw *flowWriter) *streamH
 	h.play.p, h.publish.p = nil, nil
 	h.bound = 0
 	h.unstable = false
+	h.keyframe = false
 	return h
 }
 
@@ -66,7 +65,7 @@ func (h *streamHandler) OnClose() {
 	if !h.fw.closed {
 		h.fw.closed = true
 		h.fw.End()
-		xlog.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, flow closed\n", h.session.xid, h.fr.fid, h.fw.fid)
+		h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, flow closed\n", h.session.xid, h.fr.fid, h.fw.fid)
 	}
 }
 
@@ -88,6 +87,7 @@ func (h *streamHandler) disenage() error {
 		h.publish.p, h.unstable = nil, false
 		p.stop()
 		if !p.rpc {
+			h.session.sessions.cluster.Unpublish(p.name)
 			call := func(x *streamHandler) {
 				s := x.session
 				s.Lock()
@@ -98,7 +98,7 @@ func (h *streamHandler) disenage() error {
 				defer s.flush()
 				x.newUnpublishNotifyResponse(p.name, x.play.callback)
 			}
-			async.Call(p.gid, func() {
+			h.session.sessions.async.Call(p.gid, func() {
 				if l, _ := p.list(); l != nil {
 					for e := l.Front(); e != nil; e = e.Next() {
 						call(e.Value.(*streamHandler))
@@ -113,12 +113,21 @@ func (h *streamHandler) disenage() error {
 	return nil
 }
 
+// insufficientBW stops playing, as the player does not keep up with the
+// stream, and tells it so.
+func (h *streamHandler) insufficientBW() error {
+	p, callback := h.play.p, h.play.callback
+	h.play.p = nil
+	p.remove(h)
+	return h.newInsufficientBWResponse(p.name, callback)
+}
+
 func (h *streamHandler) onDefault(name string, callback float64, r *amf0.Reader) error {
 	if p := h.publish.p; p == nil {
-		xlog.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, message on non-published stream\n", h.session.xid, h.fr.fid, h.fw.fid)
+		h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, message on non-published stream\n", h.session.xid, h.fr.fid, h.fw.fid)
 		return nil
 	} else if p.rpc {
-		xlog.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, unhandled call on rpc stream\n", h.session.xid, h.fr.fid, h.fw.fid)
+		h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, unhandled call on rpc stream\n", h.session.xid, h.fr.fid, h.fw.fid)
 		return nil
 	} else {
 		if w, err := newAmfBytesWriter(name); err != nil {
@@ -126,24 +135,8 @@ func (h *streamHandler) onDefault(name string, callback float64, r *amf0.Reader)
 		} else if err := w.WriteBytes(r.Bytes()); err != nil {
 			return errors.New("stream.onAmfData.write body")
 		} else {
-			data := split(w.Bytes())
-			call := func(x *streamHandler) {
-				s := x.session
-				s.Lock()
-				defer s.Unlock()
-				if s.closed || x.play.p != p {
-					return
-				}
-				defer s.flush()
-				x.fw.AddFragments(p.reliable, data...)
-			}
-			async.Call(p.gid, func() {
-				if l, ok := p.list(); ok && l != nil {
-					for e := l.Front(); e != nil; e = e.Next() {
-						call(e.Value.(*streamHandler))
-					}
-				}
-			})
+			h.session.sessions.cluster.Stream(p.name, w.Bytes(), p.reliable)
+			p.fanout(w.Bytes(), p.reliable, false)
 		}
 		return nil
 	}
@@ -156,7 +149,7 @@ func (h *streamHandler) onPlay(callback float64, r *amf0.Reader) error {
 	if stream, err := r.ReadString(); err != nil {
 		return errors.New("stream.onPlay.read stream")
 	} else {
-		if p := newPublication(stream); p.add(h) {
+		if p := h.session.sessions.newPublication(stream); p.add(h) {
 			if err := h.newPlayResetResponse(stream, callback); err != nil {
 				return errors.New("stream.onPlay.reset response")
 			}
@@ -169,6 +162,18 @@ func (h *streamHandler) onPlay(callback float64, r *amf0.Reader) error {
 			if err := h.newPlayBoundResponse(h.bound); err != nil {
 				return errors.New("stream.onPlay.bound response")
 			}
+			h.keyframe = false
+			if !p.rpc {
+				p.pull()
+			}
+			if audio, video := p.getCodecs(); audio != nil || video != nil {
+				if audio != nil {
+					h.fw.AddFragments(p.reliable, split(audio)...)
+				}
+				if video != nil {
+					h.fw.AddFragments(p.reliable, split(video)...)
+				}
+			}
 		} else {
 			if err := h.newPlayFailedResponse(stream, callback); err != nil {
 				return errors.New("stream.onPlay.failed response")
@@ -185,13 +190,14 @@ func (h *streamHandler) onPublish(callback float64, r *amf0.Reader) error {
 	if stream, err := r.ReadString(); err != nil {
 		return errors.New("stream.onPublish.read stream")
 	} else {
-		if p := newPublication(stream); p.start(h) {
+		if p := h.session.sessions.newPublication(stream); p.start(h) {
 			if err := h.newPublishSuccessResponse(stream, callback); err != nil {
 				return errors.New("stream.onPublish.publish response")
 			}
 			h.publish.p, h.unstable = p, !p.reliable
 			h.publish.callback = callback
 			if !p.rpc {
+				h.session.sessions.cluster.Publish(p.name)
 				call := func(x *streamHandler) {
 					s := x.session
 					s.Lock()
@@ -202,7 +208,7 @@ func (h *streamHandler) onPublish(callback float64, r *amf0.Reader) error {
 					defer s.flush()
 					x.newPublishNotifyResponse(p.name, x.play.callback)
 				}
-				async.Call(p.gid, func() {
+				h.session.sessions.async.Call(p.gid, func() {
 					if l, _ := p.list(); l != nil {
 						for e := l.Front(); e != nil; e = e.Next() {
 							call(e.Value.(*streamHandler))
@@ -228,7 +234,7 @@ func (h *streamHandler) onCloseStream(callback float64, r *amf0.Reader) error {
 }
 
 func (h *streamHandler) onProxySend(callback float64, r *amf0.Reader, reliable bool) error {
-	rpc.Call(h.session.xid, h.session.raddr, 0, r.Bytes(), reliable)
+	h.session.sessions.rpc.Call(h.session.xid, h.session.raddr, 0, r.Bytes(), reliable)
 	return nil
 }
 
@@ -246,7 +252,7 @@ func (h *streamHandler) onBroadcastByXid(callback float64, r *amf0.Reader, relia
 				xids = append(xids, uint32(x))
 			}
 		}
-		BroadcastByXid(xids, r.Bytes(), h.session.xid, reliable)
+		h.session.sessions.BroadcastByXid(xids, r.Bytes(), h.session.xid, reliable)
 		return nil
 	}
 }
@@ -267,6 +273,22 @@ func (h *streamHandler) newUnplayResponse(stream string, callback float64) error
 	}
 }
 
+func (h *streamHandler) newInsufficientBWResponse(stream string, callback float64) error {
+	if w, err := newAmfMessageWriter("onStatus", callback); err != nil {
+		return err
+	} else {
+		obj := amf.NewObject()
+		obj.SetString("level", "warning")
+		obj.SetString("code", "NetStream.Play.InsufficientBW")
+		obj.SetString("description", "Stopped playing "+stream+", the client does not keep up")
+		if err := w.WriteObject(obj); err != nil {
+			return err
+		}
+		h.fw.AddFragments(true, split(w.Bytes())...)
+		return nil
+	}
+}
+
 func (h *streamHandler) newUnpublishResponse(stream string, callback float64) error {
 	if w, err := newAmfMessageWriter("onStatus", callback); err != nil {
 		return err
@@ -416,10 +438,132 @@ func (h *streamHandler) newPublishSuccessResponse(stream string, callback float6
 	}
 }
 
+func (h *streamHandler) onMedia(code uint8, r *xio.PacketReader) error {
+	if p := h.publish.p; p == nil {
+		h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, media on non-published stream\n", h.session.xid, h.fr.fid, h.fw.fid)
+		return nil
+	} else if p.rpc {
+		h.session.logs.OutLog.Printf("[session]: xid = %d, reader.fid = %d, writer.fid = %d, media on rpc stream\n", h.session.xid, h.fr.fid, h.fw.fid)
+		return nil
+	} else if time, err := r.Read32(); err != nil {
+		return errors.New("stream.onMedia.read time")
+	} else if body := r.Bytes(); len(body) == 0 {
+		return nil
+	} else {
+		bs, err := newMediaMessage(code, time, body)
+		if err != nil {
+			return errors.New("stream.onMedia.write message")
+		}
+		h.session.sessions.cluster.Stream(p.name, bs, p.reliable)
+		p.fanout(bs, p.reliable, false)
+		return nil
+	}
+}
+
+// fanout hands data of p to its players, keeping its codec headers for the
+// players to come. Media is offered and lost when the queue of the players
+// is full, which has them wait for a keyframe again behind the codec
+// headers; reliable data of other kinds is never lost.
+func (p *publication) fanout(data []byte, reliable bool, wait bool) {
+	code, keyframe := data[0], true
+	media := (code == 0x08 || code == 0x09) && len(data) > 5
+	if media {
+		body := data[5:]
+		if isCodecHeader(code, body) {
+			p.setCodec(code, data)
+		}
+		keyframe = code != 0x09 || isKeyFrame(body)
+	}
+	frags := split(data)
+	call := func(x *streamHandler, lost bool, codecs [][]byte) {
+		s := x.session
+		s.Lock()
+		defer s.Unlock()
+		if s.closed || x.play.p != p {
+			return
+		}
+		defer s.flush()
+		if lost {
+			x.keyframe = false
+			for _, data := range codecs {
+				x.fw.AddFragments(true, split(data)...)
+			}
+		}
+		if code == 0x09 && !x.keyframe {
+			if !keyframe {
+				return
+			}
+			x.keyframe = true
+		}
+		x.fw.AddFragments(reliable, frags...)
+	}
+	seq := p.offer()
+	run := func() {
+		var codecs [][]byte
+		lost := !p.play(seq)
+		if lost {
+			p.sessions.counts.Count("stream.gap", 1)
+			if audio, video := p.getCodecs(); audio != nil || video != nil {
+				if audio != nil {
+					codecs = append(codecs, audio)
+				}
+				if video != nil {
+					codecs = append(codecs, video)
+				}
+			}
+		}
+		if l, ok := p.list(); ok && l != nil {
+			for e := l.Front(); e != nil; e = e.Next() {
+				call(e.Value.(*streamHandler), lost, codecs)
+			}
+		}
+	}
+	if reliable && !media {
+		p.sessions.async.Call(p.gid, run)
+	} else {
+		p.sessions.async.Offer(p.gid, run, wait)
+	}
+}
+
+func newMediaMessage(code uint8, time uint32, body []byte) ([]byte, error) {
+	w := xio.NewPacketWriter(nil)
+	if err := w.Write8(code); err != nil {
+		return nil, err
+	}
+	if err := w.Write32(time); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBytes(body); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func isCodecHeader(code uint8, body []byte) bool {
+	if len(body) < 2 {
+		return false
+	}
+	switch code {
+	case 0x08:
+		return (body[0]>>4) == 0x0a && body[1] == 0
+	case 0x09:
+		return (body[0]&0x0f) == 0x07 && body[1] == 0
+	}
+	return false
+}
+
+func isKeyFrame(body []byte) bool {
+	return len(body) != 0 && (body[0]>>4) == 0x01
+}
+
 func (h *streamHandler) OnRawMessage(code uint8, r *xio.PacketReader) error {
 	if h.fw.closed {
 		return errors.New("stream.onRawMessage.closed")
 	}
+	switch code {
+	case 0x08, 0x09:
+		return h.onMedia(code, r)
+	}
 	if flag, err := r.Read16(); err != nil {
 		return errors.New("stream.onRawMessage.read flag")
 	} else if flag != 0x22 {
@@ -10,14 +10,8 @@ import (
 	"github.com/spinlock/xserver/pkg/xserver/utils"
 )
 
-var streams struct {
-	buckets [256]struct {
-		pubmap map[string]*publication
-		sync.Mutex
-	}
-}
-
 type publication struct {
+	sessions *Sessions
 	name     string
 	gid      uint64
 	rpc      bool
@@ -26,18 +20,19 @@ type publication struct {
 	slaves   *list.List
 	reliable bool
 	bid      uint16
-	sync.Mutex
-}
-
-func init() {
-	for i := 0; i < len(streams.buckets); i++ {
-		streams.buckets[i].pubmap = make(map[string]*publication, 8192)
+	codecs   struct {
+		audio, video []byte
+	}
+	seq struct {
+		offered, played uint64
 	}
+	sync.Mutex
 }
 
-func newPublication(name string) *publication {
+func (ss *Sessions) newPublication(name string) *publication {
 	if name == "recvPull" || name == "recvPull2" {
 		p := &publication{}
+		p.sessions = ss
 		p.name, p.gid = name, uint64(time.Now().UnixNano())
 		p.rpc = true
 		p.closed = false
@@ -50,13 +45,14 @@ func newPublication(name string) *publication {
 		return p
 	}
 
-	bid := utils.Hash16S(name) % uint16(len(streams.buckets))
+	bid := utils.Hash16S(name) % uint16(len(ss.streams.buckets))
 
-	b := &streams.buckets[bid]
+	b := &ss.streams.buckets[bid]
 	b.Lock()
 	p := b.pubmap[name]
 	if p == nil {
 		p = &publication{}
+		p.sessions = ss
 		p.name, p.gid = name, uint64(time.Now().UnixNano())
 		p.rpc = false
 		p.closed = false
@@ -69,10 +65,10 @@ func newPublication(name string) *publication {
 	return p
 }
 
-func Streams() int {
+func (ss *Sessions) Streams() int {
 	count := 0
-	for i := 0; i < len(streams.buckets); i++ {
-		b := &streams.buckets[i]
+	for i := 0; i < len(ss.streams.buckets); i++ {
+		b := &ss.streams.buckets[i]
 		b.Lock()
 		count += len(b.pubmap)
 		b.Unlock()
@@ -80,10 +76,10 @@ func Streams() int {
 	return count
 }
 
-func DumpStreams() map[string]interface{} {
+func (ss *Sessions) DumpStreams() map[string]interface{} {
 	all := make(map[string]interface{}, 8192)
-	for i := 0; i < len(streams.buckets); i++ {
-		b := &streams.buckets[i]
+	for i := 0; i < len(ss.streams.buckets); i++ {
+		b := &ss.streams.buckets[i]
 		b.Lock()
 		for name, p := range b.pubmap {
 			x := make(map[string]interface{})
@@ -93,6 +89,9 @@ func DumpStreams() map[string]interface{} {
 				} else {
 					x["master"] = 0
 				}
+				if origin := ss.cluster.Origin(name); origin != 0 {
+					x["origin"] = origin
+				}
 				if l, _ := p.list(); l != nil {
 					s := make([]uint32, 0, l.Len())
 					for e := l.Front(); e != nil; e = e.Next() {
@@ -115,6 +114,7 @@ func (p *publication) start(master *streamHandler) bool {
 	if !p.closed {
 		if p.master == nil {
 			p.master, ok = master, true
+			p.codecs.audio, p.codecs.video = nil, nil
 		}
 	}
 	p.Unlock()
@@ -132,13 +132,51 @@ func (p *publication) stop() {
 	}
 	p.Unlock()
 	if ok {
-		b := &streams.buckets[p.bid]
+		b := &p.sessions.streams.buckets[p.bid]
 		b.Lock()
 		delete(b.pubmap, p.name)
 		b.Unlock()
 	}
 }
 
+func (p *publication) setCodec(code uint8, data []byte) {
+	p.Lock()
+	if !p.closed {
+		switch code {
+		case 0x08:
+			p.codecs.audio = data
+		case 0x09:
+			p.codecs.video = data
+		}
+	}
+	p.Unlock()
+}
+
+func (p *publication) getCodecs() ([]byte, []byte) {
+	p.Lock()
+	audio, video := p.codecs.audio, p.codecs.video
+	p.Unlock()
+	return audio, video
+}
+
+// offer numbers the data of p as it is offered to its players.
+func (p *publication) offer() uint64 {
+	p.Lock()
+	defer p.Unlock()
+	p.seq.offered++
+	return p.seq.offered
+}
+
+// play tells whether the data numbered seq follows what the players of p
+// got last, which it does not once async has dropped or rejected some.
+func (p *publication) play(seq uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	last := p.seq.played
+	p.seq.played = seq
+	return seq == last+1
+}
+
 func (p *publication) list() (*list.List, bool) {
 	p.Lock()
 	l, ok := p.slaves, !p.closed
@@ -185,9 +223,10 @@ func (p *publication) remove(h *streamHandler) {
 	}
 	p.Unlock()
 	if ok {
-		b := &streams.buckets[p.bid]
+		b := &p.sessions.streams.buckets[p.bid]
 		b.Lock()
 		delete(b.pubmap, p.name)
 		b.Unlock()
+		p.sessions.cluster.Unpull(p.name)
 	}
 }
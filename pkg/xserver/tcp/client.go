@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"context"
 	"log"
 	"net"
 	"sync"
@@ -9,68 +10,235 @@ import (
 
 import (
 	"github.com/spinlock/xserver/pkg/xserver/counts"
+	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
+// Hooks are called from the routine of a Client. Connect returns packets to
+// send ahead of anything queued by Send; Disconnect follows a lost connection.
+type Hooks struct {
+	Connect    func() [][]byte
+	Disconnect func()
+}
+
 type Client struct {
-	ip   string
-	port uint16
-	send chan []byte
-	recv chan []byte
+	ip    string
+	port  uint16
+	sec   *Security
+	hooks Hooks
+	cnts  *counts.Counts
+	log   *xlog.Logger
+	send  chan []byte
+	recv  chan []byte
+	reset chan struct{}
+	quit  chan struct{}
+	done  sync.WaitGroup
 }
 
-func newClient(ip string, port uint16) *Client {
+func newClient(ip string, port uint16, sec *Security, hooks *Hooks, cnts *counts.Counts, l *xlog.Logger) *Client {
 	c := &Client{}
-	c.ip, c.port = ip, port
+	c.ip, c.port, c.sec = ip, port, sec
+	c.cnts, c.log = cnts, l
+	if hooks != nil {
+		c.hooks = *hooks
+	}
 	c.send = make(chan []byte, 1024)
 	c.recv = make(chan []byte, 1024)
+	c.reset = make(chan struct{}, 1)
+	c.quit = make(chan struct{})
+	c.done.Add(1)
 	go c.main()
 	return c
 }
 
 func (c *Client) Send(bs []byte) {
-	c.send <- bs
+	select {
+	case c.send <- bs:
+	case <-c.quit:
+	}
+}
+
+// Offer is Send when the queue has room, and tells whether it had.
+func (c *Client) Offer(bs []byte) bool {
+	select {
+	case c.send <- bs:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reset drops the connection and whatever is queued, so that the next one
+// starts over with what the Connect hook returns, at once.
+func (c *Client) Reset() {
+	select {
+	case c.reset <- struct{}{}:
+	default:
+	}
+}
+
+// discard drops what is queued, as a Reset asks.
+func (c *Client) discard() {
+	n := 0
+	for {
+		select {
+		case <-c.send:
+			n++
+		default:
+			c.cnts.Count("tcp.reset", 1)
+			c.cnts.Count("tcp.reset.discard", n)
+			return
+		}
+	}
 }
 
 func (c *Client) Recv() []byte {
-	bs := <-c.recv
-	return bs
+	select {
+	case bs := <-c.recv:
+		return bs
+	case <-c.quit:
+		return nil
+	}
+}
+
+// Flush waits until the queued packets have been handed to the socket.
+func (c *Client) Flush(ctx context.Context) error {
+	for len(c.send) != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.quit:
+			return nil
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	return nil
+}
+
+func (c *Client) Closed() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) Close() {
+	close(c.quit)
+	c.done.Wait()
+}
+
+// resend writes what the Connect hook returns before anything queued by
+// Send, so the packets lost with the previous connection keep their order.
+func (c *Client) resend(conn net.Conn) error {
+	if c.hooks.Connect == nil {
+		return nil
+	}
+	bss := c.hooks.Connect()
+	for _, bs := range bss {
+		if err := writeData(conn, bs); err != nil {
+			return err
+		}
+	}
+	if len(bss) != 0 {
+		c.cnts.Count("tcp.replay", len(bss))
+		log.Printf("[tcp]: replay %d packet(s) to %s\n", len(bss), conn.RemoteAddr())
+	}
+	return nil
 }
 
 func (c *Client) main() {
+	defer c.done.Done()
 	for {
-		conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP(c.ip), Port: int(c.port)})
+		conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP(c.ip), Port: int(c.port)})
 		if err != nil {
-			counts.Count("tcp.connect.error", 1)
+			c.cnts.Count("tcp.connect.error", 1)
 			log.Printf("[tcp]: connect %s:%d failed '%v'\n", c.ip, c.port, err)
 		} else {
-			counts.Count("tcp.connect", 1)
+			c.cnts.Count("tcp.connect", 1)
 			log.Printf("[tcp]: connect to %s\n", conn.RemoteAddr())
-			conn.SetWriteBuffer(MaxSendBufferSize)
-			conn.SetReadBuffer(MaxRecvBufferSize)
-			conn.SetNoDelay(true)
-			var once sync.Once
-			sig := make(chan int)
-			raise := func() {
-				once.Do(func() {
-					conn.Close()
-					close(sig)
-				})
+			quit, reset := c.serve(conn)
+			if f := c.hooks.Disconnect; f != nil {
+				f()
+			}
+			if quit {
+				return
+			}
+			c.cnts.Count("tcp.connect.close", 1)
+			if reset {
+				continue
 			}
-			go sender(conn, c.send, sig, raise)
-			go recver(conn, c.recv, sig, raise)
-			<-sig
-			counts.Count("tcp.connect.close", 1)
 		}
 		for i := 0; i < 50; i++ {
-			time.Sleep(time.Millisecond * 100)
-			for {
-				select {
-				case <-c.send:
-					continue
-				default:
-				}
-				break
+			select {
+			case <-c.quit:
+				return
+			case <-time.After(time.Millisecond * 100):
 			}
 		}
 	}
 }
+
+// serve runs conn until it fails, is reset, or the client is closed, which
+// it tells, in any case after its sender and recver have returned.
+func (c *Client) serve(conn *net.TCPConn) (quit, reset bool) {
+	conn.SetWriteBuffer(MaxSendBufferSize)
+	conn.SetReadBuffer(MaxRecvBufferSize)
+	conn.SetNoDelay(true)
+	secured, err := Secure(conn, c.sec, false)
+	if err != nil {
+		c.cnts.Count("tcp.connect.unauthorized", 1)
+		log.Printf("[tcp]: secure %s failed '%v'\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return false, false
+	}
+	select {
+	case <-c.reset:
+		c.discard()
+	default:
+	}
+	if err := c.resend(secured); err != nil {
+		c.cnts.Count("tcp.replay.error", 1)
+		log.Printf("[tcp]: replay error = '%v'\n", err)
+		conn.Close()
+		return false, false
+	}
+	var once sync.Once
+	sig := make(chan int)
+	raise := func() {
+		once.Do(func() {
+			close(sig)
+			conn.Close()
+		})
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sender(secured, c.send, sig, raise, c.log)
+	}()
+	go func() {
+		defer wg.Done()
+		recver(secured, func(data []byte) bool {
+			select {
+			case <-sig:
+				return false
+			case c.recv <- data:
+				return true
+			}
+		}, sig, raise, c.log)
+	}()
+	select {
+	case <-sig:
+		return false, false
+	case <-c.reset:
+		raise()
+		wg.Wait()
+		c.discard()
+		return false, true
+	case <-c.quit:
+		raise()
+		return true, false
+	}
+}
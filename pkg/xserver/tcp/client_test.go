@@ -0,0 +1,43 @@
+package tcp
+
+import (
+	"testing"
+	"time"
+)
+
+// TestClientReset has a client reset its connection, which it dials again
+// at once and starts over with what its Connect hook returns.
+func TestClientReset(t *testing.T) {
+	s, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := DialHooks("127.0.0.1", s.Port(), nil, &Hooks{
+		Connect: func() [][]byte {
+			return [][]byte{[]byte("hello")}
+		},
+	}, nil, nil)
+	defer c.Close()
+	recv := func() *Packet {
+		packets := make(chan *Packet, 1)
+		go func() {
+			packets <- s.Recv()
+		}()
+		select {
+		case p := <-packets:
+			if p == nil || string(p.Data) != "hello" {
+				t.Fatal("no hello")
+			}
+			return p
+		case <-time.After(time.Second * 2):
+			t.Fatal("no hello in time")
+		}
+		return nil
+	}
+	first := recv()
+	c.Reset()
+	if p := recv(); p.From() == first.From() {
+		t.Fatal("hello again on the same connection")
+	}
+}
@@ -1,27 +1,26 @@
 package tcp
 
 import (
-	"github.com/spinlock/xserver/pkg/xserver/args"
+	"github.com/spinlock/xserver/pkg/xserver/counts"
+	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
-var (
-	srv *Server
-	clt *Client
-)
+func Listen(port uint16) (*Server, error) {
+	return newServer(port, nil, nil, nil)
+}
 
-func init() {
-	if port := args.RpcListenPort(); port != 0 {
-		srv = newServer(port)
-	}
-	if ip, port := args.RpcRemote(); port != 0 {
-		clt = newClient(ip, port)
-	}
+// ListenSecure is Listen rejecting the peers which fail sec, counting into c
+// and logging the packets to l.
+func ListenSecure(port uint16, sec *Security, c *counts.Counts, l *xlog.Logger) (*Server, error) {
+	return newServer(port, sec, c, l)
 }
 
-func GetServer() *Server {
-	return srv
+func Dial(ip string, port uint16) *Client {
+	return newClient(ip, port, nil, nil, nil, nil)
 }
 
-func GetClient() *Client {
-	return clt
+// DialHooks is Dial over sec, when not nil, with hooks called as the
+// connection comes and goes, counting into c and logging the packets to l.
+func DialHooks(ip string, port uint16, sec *Security, hooks *Hooks, c *counts.Counts, l *xlog.Logger) *Client {
+	return newClient(ip, port, sec, hooks, c, l)
 }
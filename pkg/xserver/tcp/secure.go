@@ -0,0 +1,278 @@
+package tcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// Security protects the link with the backends. With TLS set, connections
+// run over tls and the listen side requires a client certificate signed by
+// the CA; with Secret set, both sides prove they know it by an HMAC-SHA256
+// challenge before the first packet. Either may be used alone: without TLS,
+// every frame that follows the challenge carries a mac of its own as well.
+type Security struct {
+	Server *tls.Config
+	Client *tls.Config
+	Secret []byte
+}
+
+// NewSecurity loads the certificate, key and CA files for TLS when cert is
+// not empty. It returns nil when neither TLS nor a secret is configured.
+func NewSecurity(cert, key, ca string, secret string) (*Security, error) {
+	if len(cert) == 0 && len(secret) == 0 {
+		return nil, nil
+	}
+	s := &Security{}
+	if len(secret) != 0 {
+		s.Secret = []byte(secret)
+	}
+	if len(cert) != 0 {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tcp.security.no certificate in ca")
+		}
+		s.Server = &tls.Config{
+			Certificates: []tls.Certificate{pair},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+			MinVersion:   tls.VersionTLS12,
+		}
+		s.Client = &tls.Config{
+			Certificates: []tls.Certificate{pair},
+			RootCAs:      pool,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	return s, nil
+}
+
+const secureTimeout = time.Second * 10
+
+// Secure runs the tls and secret handshakes of s on conn, as the listen side
+// when server is true, and returns the connection to use from then on.
+func Secure(conn *net.TCPConn, s *Security, server bool) (net.Conn, error) {
+	if s == nil {
+		return conn, nil
+	}
+	var c net.Conn = conn
+	c.SetDeadline(time.Now().Add(secureTimeout))
+	if server && s.Server != nil {
+		t := tls.Server(conn, s.Server)
+		if err := t.Handshake(); err != nil {
+			return nil, err
+		}
+		c = t
+	} else if !server && s.Client != nil {
+		config := s.Client.Clone()
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			config.ServerName = host
+		}
+		t := tls.Client(conn, config)
+		if err := t.Handshake(); err != nil {
+			return nil, err
+		}
+		c = t
+	}
+	if len(s.Secret) != 0 {
+		send, recv, err := challenge(c, s.Secret, server)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.(*tls.Conn); !ok {
+			c = newMacConn(conn, send, recv)
+		}
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+const nonceSize = 32
+
+// challenge has the listen side send a nonce, the dialing side answer with
+// its own nonce and a mac over both, and the listen side prove itself with a
+// mac over them in the other order. It returns the keys of the frames sent
+// and received afterwards, which both nonces make unique to the connection.
+func challenge(c net.Conn, secret []byte, server bool) ([]byte, []byte, error) {
+	mine := make([]byte, nonceSize)
+	if _, err := rand.Read(mine); err != nil {
+		return nil, nil, err
+	}
+	if server {
+		if err := writeData(c, mine); err != nil {
+			return nil, nil, err
+		}
+		data, err := readFrame(c, nonceSize+sha256.Size)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(data) != nonceSize+sha256.Size {
+			return nil, nil, errors.New("tcp.challenge.bad answer")
+		}
+		theirs := data[:nonceSize]
+		if !hmac.Equal(data[nonceSize:], sign(secret, "client", mine, theirs)) {
+			return nil, nil, errors.New("tcp.challenge.bad client mac")
+		}
+		if err := writeData(c, sign(secret, "server", theirs, mine)); err != nil {
+			return nil, nil, err
+		}
+		return sign(secret, "server.frames", mine, theirs), sign(secret, "client.frames", mine, theirs), nil
+	} else {
+		theirs, err := readFrame(c, nonceSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(theirs) != nonceSize {
+			return nil, nil, errors.New("tcp.challenge.bad nonce")
+		}
+		if err := writeData(c, append(mine, sign(secret, "client", theirs, mine)...)); err != nil {
+			return nil, nil, err
+		}
+		data, err := readFrame(c, sha256.Size)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !hmac.Equal(data, sign(secret, "server", mine, theirs)) {
+			return nil, nil, errors.New("tcp.challenge.bad server mac")
+		}
+		return sign(secret, "client.frames", theirs, mine), sign(secret, "server.frames", theirs, mine), nil
+	}
+}
+
+// readFrame reads one small frame within the deadline set on c, unlike
+// readData which waits for as long as the peer keeps quiet.
+func readFrame(c net.Conn, max int) ([]byte, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(head) != 0xdeadbeaf {
+		return nil, errors.New("tcp.challenge.bad magic")
+	}
+	size := int(binary.BigEndian.Uint32(head[4:]))
+	if size > max {
+		return nil, errors.New("tcp.challenge.bad size")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func sign(secret []byte, side string, a, b []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(side))
+	mac.Write(a)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+const maxRecordSize = 1024 * 64
+
+// macConn is the connection of a link secured by the secret alone. What is
+// written goes out in records of a size, the data and an HMAC-SHA256 over the
+// record and its sequence number, so that a frame forged, replayed or moved
+// by whoever sits on the path is refused rather than handled. One routine
+// may write and another read, as the sender and recver do.
+type macConn struct {
+	net.Conn
+	send struct {
+		key []byte
+		seq uint64
+	}
+	recv struct {
+		key  []byte
+		seq  uint64
+		data []byte
+		err  error
+	}
+}
+
+func newMacConn(conn net.Conn, send, recv []byte) *macConn {
+	c := &macConn{Conn: conn}
+	c.send.key, c.recv.key = send, recv
+	return c
+}
+
+func (c *macConn) Write(b []byte) (int, error) {
+	for off := 0; off != len(b); {
+		n := len(b) - off
+		if n > maxRecordSize {
+			n = maxRecordSize
+		}
+		record := make([]byte, 4+n, 4+n+sha256.Size)
+		binary.BigEndian.PutUint32(record, uint32(n))
+		copy(record[4:], b[off:off+n])
+		record = append(record, seal(c.send.key, c.send.seq, record)...)
+		c.send.seq++
+		if _, err := c.Conn.Write(record); err != nil {
+			return off, err
+		}
+		off += n
+	}
+	return len(b), nil
+}
+
+// Read fails for good once a record is refused or cut short, as the stream
+// can no longer be trusted; a timeout before a record begins can be retried.
+func (c *macConn) Read(b []byte) (int, error) {
+	if len(c.recv.data) == 0 {
+		if c.recv.err != nil {
+			return 0, c.recv.err
+		}
+		head := make([]byte, 4)
+		if n, err := io.ReadFull(c.Conn, head); err != nil {
+			if n != 0 {
+				c.recv.err = err
+			}
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint32(head))
+		if size == 0 || size > maxRecordSize {
+			c.recv.err = errors.New("tcp.record.bad size")
+			return 0, c.recv.err
+		}
+		record := make([]byte, 4+size+sha256.Size)
+		copy(record, head)
+		if _, err := io.ReadFull(c.Conn, record[4:]); err != nil {
+			c.recv.err = err
+			return 0, err
+		}
+		data, mac := record[:4+size], record[4+size:]
+		if !hmac.Equal(mac, seal(c.recv.key, c.recv.seq, data)) {
+			c.recv.err = errors.New("tcp.record.bad mac")
+			return 0, c.recv.err
+		}
+		c.recv.seq++
+		c.recv.data = data[4:]
+	}
+	n := copy(b, c.recv.data)
+	c.recv.data = c.recv.data[n:]
+	return n, nil
+}
+
+func seal(key []byte, seq uint64, record []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	mac.Write(b[:])
+	mac.Write(record)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,82 @@
+package tcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func securePair(t *testing.T, sec *Security) (*net.TCPConn, <-chan net.Conn) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		c, err := Secure(conn, sec, true)
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- c
+	}()
+	conn, err := net.DialTCP("tcp4", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn, accepted
+}
+
+func TestSecretFrames(t *testing.T) {
+	sec := &Security{Secret: []byte("secret")}
+	conn, accepted := securePair(t, sec)
+	c, err := Secure(conn, sec, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("secure failed on the listen side")
+	}
+	defer s.Close()
+	for _, data := range [][]byte{[]byte("hello"), bytes.Repeat([]byte{7}, maxRecordSize*2+5)} {
+		if err := writeData(c, data); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readData(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("got %d byte(s), want %d", len(got), len(data))
+		}
+	}
+}
+
+func TestSecretFramesForged(t *testing.T) {
+	sec := &Security{Secret: []byte("secret")}
+	conn, accepted := securePair(t, sec)
+	if _, _, err := challenge(conn, sec.Secret, false); err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("secure failed on the listen side")
+	}
+	defer s.Close()
+	// a well formed record, sealed by a key other than the one of the link
+	if err := writeData(newMacConn(conn, []byte("key"), nil), []byte("forged")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readData(s); err == nil {
+		t.Fatalf("forged frame accepted = %q", data)
+	}
+}
@@ -25,38 +25,142 @@ const (
 )
 
 type Server struct {
-	port uint16
-	recv chan []byte
+	port  uint16
+	sec   *Security
+	cnts  *counts.Counts
+	log   *xlog.Logger
+	recv  chan *Packet
+	quit  chan struct{}
+	done  sync.WaitGroup
+	conns struct {
+		m  map[*net.TCPConn]func()
+		wg sync.WaitGroup
+		sync.Mutex
+	}
 }
 
-func newServer(port uint16) *Server {
+func newServer(port uint16, sec *Security, cnts *counts.Counts, l *xlog.Logger) (*Server, error) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: int(port)})
+	if err != nil {
+		cnts.Count("tcp.listen.error", 1)
+		return nil, err
+	}
 	s := &Server{}
-	s.port = port
-	s.recv = make(chan []byte, 1024)
-	go s.main()
-	return s
+	s.port = uint16(ln.Addr().(*net.TCPAddr).Port)
+	s.sec = sec
+	s.cnts, s.log = cnts, l
+	s.recv = make(chan *Packet, 1024)
+	s.quit = make(chan struct{})
+	s.conns.m = make(map[*net.TCPConn]func())
+	s.done.Add(1)
+	go s.main(ln)
+	return s, nil
+}
+
+func (s *Server) Port() uint16 {
+	return s.port
+}
+
+// Packet is received by a Server from one of its peers.
+type Packet struct {
+	Data []byte
+	peer *Peer
+}
+
+// Peer is a connection accepted by a Server, which tells its packets apart
+// from those of the other connections.
+type Peer struct {
+	send chan []byte
+	sig  <-chan int
+	cnts *counts.Counts
+}
+
+// From returns the connection p came from.
+func (p *Packet) From() *Peer {
+	return p.peer
+}
+
+// Closed tells whether the connection is gone.
+func (p *Peer) Closed() bool {
+	select {
+	case <-p.sig:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reply queues bs to the connection p came from. It is dropped once that
+// connection is gone.
+func (p *Packet) Reply(bs []byte) {
+	select {
+	case p.peer.send <- bs:
+	case <-p.peer.sig:
+		p.peer.cnts.Count("tcp.reply.closed", 1)
+	}
+}
+
+func (s *Server) Recv() *Packet {
+	select {
+	case p := <-s.recv:
+		return p
+	case <-s.quit:
+		return nil
+	}
+}
+
+func (s *Server) Closed() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
 }
 
-func (s *Server) Recv() []byte {
-	bs := <-s.recv
-	return bs
+// Close returns once the routines of every connection have.
+func (s *Server) Close() {
+	close(s.quit)
+	s.done.Wait()
+	s.conns.Lock()
+	for _, raise := range s.conns.m {
+		raise()
+	}
+	s.conns.Unlock()
+	s.conns.wg.Wait()
 }
 
-func (s *Server) main() {
+func (s *Server) main(ln *net.TCPListener) {
+	defer s.done.Done()
 	for {
-		ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4zero, Port: int(s.port)})
-		if err != nil {
-			counts.Count("tcp.listen.error", 1)
-			log.Printf("[tcp]: listen port %d failed '%v'\n", s.port, err)
-		} else {
-			counts.Count("tcp.listen", 1)
+		if ln == nil {
+			var err error
+			if ln, err = net.ListenTCP("tcp", &net.TCPAddr{Port: int(s.port)}); err != nil {
+				s.cnts.Count("tcp.listen.error", 1)
+				log.Printf("[tcp]: listen port %d failed '%v'\n", s.port, err)
+			}
+		}
+		if ln != nil {
+			s.cnts.Count("tcp.listen", 1)
+			stop := make(chan int)
+			go func(ln *net.TCPListener) {
+				select {
+				case <-s.quit:
+					ln.Close()
+				case <-stop:
+				}
+			}(ln)
 			for {
 				if conn, err := ln.AcceptTCP(); err != nil {
-					counts.Count("tcp.accept.error", 1)
+					if s.Closed() {
+						log.Printf("[tcp]: close port %d\n", s.port)
+						return
+					}
+					s.cnts.Count("tcp.accept.error", 1)
 					log.Printf("[tcp]: accept port %d failed '%v'\n", s.port, err)
 					break
 				} else {
-					counts.Count("tcp.accept", 1)
+					s.cnts.Count("tcp.accept", 1)
 					log.Printf("[tcp]: accept port %d from [%s]\n", s.port, conn.RemoteAddr())
 					conn.SetWriteBuffer(MaxSendBufferSize)
 					conn.SetReadBuffer(MaxRecvBufferSize)
@@ -65,22 +169,57 @@ func (s *Server) main() {
 					sig := make(chan int)
 					raise := func() {
 						once.Do(func() {
-							conn.Close()
 							close(sig)
-							counts.Count("tcp.accept.close", 1)
+							conn.Close()
+							s.cnts.Count("tcp.accept.close", 1)
 						})
 					}
-					go recver(conn, s.recv, sig, raise)
+					s.conns.Lock()
+					s.conns.m[conn] = raise
+					s.conns.Unlock()
+					s.conns.wg.Add(1)
+					go func() {
+						defer s.conns.wg.Done()
+						if c, err := Secure(conn, s.sec, true); err != nil {
+							s.cnts.Count("tcp.accept.unauthorized", 1)
+							log.Printf("[tcp]: reject [%s], error = '%v'\n", conn.RemoteAddr(), err)
+							raise()
+						} else {
+							p := &Peer{make(chan []byte, 1024), sig, s.cnts}
+							s.conns.wg.Add(1)
+							go func() {
+								defer s.conns.wg.Done()
+								sender(c, p.send, sig, raise, s.log)
+							}()
+							recver(c, func(data []byte) bool {
+								select {
+								case <-sig:
+									return false
+								case s.recv <- &Packet{data, p}:
+									return true
+								}
+							}, sig, raise, s.log)
+						}
+						s.conns.Lock()
+						delete(s.conns.m, conn)
+						s.conns.Unlock()
+					}()
 				}
 			}
+			close(stop)
 			ln.Close()
-			counts.Count("tcp.listen.close", 1)
+			ln = nil
+			s.cnts.Count("tcp.listen.close", 1)
+		}
+		select {
+		case <-s.quit:
+			return
+		case <-time.After(time.Second * 5):
 		}
-		time.Sleep(time.Second * 5)
 	}
 }
 
-func sender(conn *net.TCPConn, send <-chan []byte, sig <-chan int, raise func()) {
+func sender(conn net.Conn, send <-chan []byte, sig <-chan int, raise func(), l *xlog.Logger) {
 	defer raise()
 	for {
 		select {
@@ -91,15 +230,19 @@ func sender(conn *net.TCPConn, send <-chan []byte, sig <-chan int, raise func())
 				continue
 			}
 			if err := writeData(conn, data); err != nil {
-				log.Printf("[tcp]: send error = '%v'\n", err)
+				if !raised(sig) {
+					log.Printf("[tcp]: send error = '%v'\n", err)
+				}
 				return
 			}
-			xlog.TcpLog.Printf("tcp.send:\n%s", utils.Formatted(data))
+			l.Printf("tcp.send:\n%s", utils.Formatted(data))
 		}
 	}
 }
 
-func recver(conn *net.TCPConn, recv chan<- []byte, sig <-chan int, raise func()) {
+// recver hands every packet read from conn to deliver, which returns false
+// once sig is raised.
+func recver(conn net.Conn, deliver func([]byte) bool, sig <-chan int, raise func(), l *xlog.Logger) {
 	defer raise()
 	for {
 		select {
@@ -107,25 +250,36 @@ func recver(conn *net.TCPConn, recv chan<- []byte, sig <-chan int, raise func())
 			return
 		default:
 			if data, err := readData(conn); err != nil {
-				log.Printf("[tcp]: recv error = '%v'\n", err)
+				if !raised(sig) {
+					log.Printf("[tcp]: recv error = '%v'\n", err)
+				}
 				return
 			} else if len(data) != 0 {
-				select {
-				case <-sig:
+				if !deliver(data) {
 					return
-				case recv <- data:
 				}
-				xlog.TcpLog.Printf("tcp.recv:\n%s", utils.Formatted(data))
+				l.Printf("tcp.recv:\n%s", utils.Formatted(data))
 			}
 		}
 	}
 }
 
-func readData(conn *net.TCPConn) ([]byte, error) {
+// raised tells whether sig is, so that the errors of the connection it
+// closes go unreported.
+func raised(sig <-chan int) bool {
+	select {
+	case <-sig:
+		return true
+	default:
+		return false
+	}
+}
+
+func readData(conn net.Conn) ([]byte, error) {
 	head := make([]byte, 8)
 	for {
 		if n, err := readBytes(conn, head); err != nil {
-			if e, ok := err.(*net.OpError); ok && e.Timeout() {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
 				if n == 0 {
 					continue
 				}
@@ -152,7 +306,7 @@ func readData(conn *net.TCPConn) ([]byte, error) {
 	}
 }
 
-func readBytes(conn *net.TCPConn, buf []byte) (int, error) {
+func readBytes(conn net.Conn, buf []byte) (int, error) {
 	off := 0
 	for off != len(buf) {
 		if err := conn.SetReadDeadline(time.Now().Add(time.Second * 90)); err != nil {
@@ -167,7 +321,7 @@ func readBytes(conn *net.TCPConn, buf []byte) (int, error) {
 	return off, nil
 }
 
-func writeData(conn *net.TCPConn, data []byte) error {
+func writeData(conn net.Conn, data []byte) error {
 	buff := make([]byte, 8+len(data))
 	magic := (uint64(0xdeadbeaf) << 32) + uint64(uint32(len(data)))
 	for i, shift := 0, uint(56); i < 8; i, shift = i+1, shift-8 {
@@ -177,7 +331,7 @@ func writeData(conn *net.TCPConn, data []byte) error {
 	return writeBytes(conn, buff)
 }
 
-func writeBytes(conn *net.TCPConn, buf []byte) error {
+func writeBytes(conn net.Conn, buf []byte) error {
 	off := 0
 	for off != len(buf) {
 		if err := conn.SetWriteDeadline(time.Now().Add(time.Second * 10)); err != nil {
@@ -0,0 +1,187 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	benchClients = 16
+	benchWindow  = 16
+	benchSize    = 1200
+)
+
+// BenchmarkEcho has clients on the loopback send datagrams to a server whose
+// workers echo them back, one op being a datagram echoed. The legacy run is
+// the path the package had before batching: a single socket, a new buffer
+// and datagram for every read, and a system call for every read and write.
+func BenchmarkEcho(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.SetWriteBuffer(MaxSendBufferSize)
+		conn.SetReadBuffer(MaxRecvBufferSize)
+		stop := legacyEcho(conn)
+		defer stop()
+		benchEcho(b, conn.LocalAddr().(*net.UDPAddr).Port)
+	})
+	for _, sockets := range []int{1, 4} {
+		for _, batch := range []int{1, 8, 32} {
+			if sockets > 1 && !reusePortSupported {
+				continue
+			}
+			b.Run(fmt.Sprintf("sockets=%d/batch=%d", sockets, batch), func(b *testing.B) {
+				s, err := newServer(0, sockets, batch, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var workers sync.WaitGroup
+				for i := 0; i < runtime.GOMAXPROCS(0)*2; i++ {
+					workers.Add(1)
+					go func() {
+						defer workers.Done()
+						for {
+							dgs := s.Recv()
+							if dgs == nil {
+								return
+							}
+							for _, dg := range dgs {
+								s.Send(dg.Addr, append([]byte(nil), dg.Data...))
+								dg.Free()
+							}
+						}
+					}()
+				}
+				defer func() {
+					s.close()
+					workers.Wait()
+				}()
+				benchEcho(b, int(s.Port()))
+			})
+		}
+	}
+}
+
+// legacyEcho serves conn the way the package used to, and returns what
+// stops it.
+func legacyEcho(conn *net.UDPConn) func() {
+	recv, send := make(chan *datagram, 2048), make(chan *datagram, 2048)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			bs := make([]byte, MaxPacketSize)
+			n, addr, err := conn.ReadFromUDP(bs)
+			if err != nil {
+				return
+			}
+			select {
+			case recv <- &datagram{addr, bs[:n]}:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case dg := <-send:
+				if _, err := conn.WriteToUDP(dg.data, dg.addr); err != nil {
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	for i := 0; i < runtime.GOMAXPROCS(0)*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case dg := <-recv:
+					select {
+					case send <- &datagram{dg.addr, dg.data}:
+					case <-quit:
+						return
+					}
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+	return func() {
+		close(quit)
+		conn.Close()
+		wg.Wait()
+	}
+}
+
+// benchEcho has b.N datagrams echoed by the server on port, and reports the
+// share of them lost on the way.
+func benchEcho(b *testing.B, port int) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	conns := make([]*net.UDPConn, benchClients)
+	for i := range conns {
+		c, err := net.DialUDP("udp4", nil, addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer c.Close()
+		conns[i] = c
+	}
+	var lost int64
+	b.ReportAllocs()
+	b.SetBytes(benchSize)
+	b.ResetTimer()
+	var clients sync.WaitGroup
+	for i, c := range conns {
+		n := b.N / benchClients
+		if i < b.N%benchClients {
+			n++
+		}
+		clients.Add(1)
+		go func(c *net.UDPConn, n int) {
+			defer clients.Done()
+			atomic.AddInt64(&lost, echo(c, n))
+		}(c, n)
+	}
+	clients.Wait()
+	b.StopTimer()
+	b.ReportMetric(float64(lost)/float64(b.N), "lost/op")
+}
+
+// echo keeps up to a window of datagrams in flight until n have been sent,
+// and returns how many of them did not come back.
+func echo(c *net.UDPConn, n int) int64 {
+	out := make([]byte, benchSize)
+	in := make([]byte, MaxPacketSize)
+	lost, sent, inflight := int64(0), 0, 0
+	for sent < n || inflight != 0 {
+		for sent < n && inflight < benchWindow {
+			if _, err := c.Write(out); err != nil {
+				return lost + int64(n-sent+inflight)
+			}
+			sent, inflight = sent+1, inflight+1
+		}
+		c.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		if _, err := c.Read(in); err != nil {
+			lost, inflight = lost+int64(inflight), 0
+			continue
+		}
+		inflight--
+	}
+	return lost
+}
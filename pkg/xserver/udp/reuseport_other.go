@@ -0,0 +1,14 @@
+//go:build !linux
+
+package udp
+
+import (
+	"syscall"
+)
+
+// Elsewhere a server has a single socket per family.
+const reusePortSupported = false
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -1,6 +1,8 @@
 package udp
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net"
 	"sync"
@@ -8,6 +10,8 @@ import (
 )
 
 import (
+	"golang.org/x/net/ipv4"
+
 	"github.com/spinlock/xserver/pkg/xserver/counts"
 )
 
@@ -20,111 +24,337 @@ const (
 	MaxPacketSize = 1024 * 2
 )
 
+// Datagram is a packet read from a port. It comes from a pool, and Free
+// gives it back once Data is not needed any more: whatever must outlive
+// the handling of the packet has to be copied out of Data first.
+type Datagram struct {
+	Port uint16
+	Addr *net.UDPAddr
+	Data []byte
+	buf  [MaxPacketSize]byte
+}
+
+var datagrams = sync.Pool{
+	New: func() interface{} {
+		return &Datagram{}
+	},
+}
+
+func newDatagram() *Datagram {
+	return datagrams.Get().(*Datagram)
+}
+
+func (dg *Datagram) Free() {
+	dg.Addr, dg.Data = nil, nil
+	datagrams.Put(dg)
+}
+
 type datagram struct {
 	addr *net.UDPAddr
 	data []byte
 }
 
+// Server reads and writes a port through a few sockets per address family,
+// a batch of datagrams per system call. The sockets of a family share the
+// port and the kernel spreads the peers over them, each peer always to the
+// same one. Packets to send are queued by family and any socket of that
+// family writes them.
 type Server struct {
-	port uint16
-	send chan *datagram
-	recv chan *datagram
+	port    uint16
+	sockets int
+	batch   int
+	v6      bool
+	owner   *Servers
+	counts  *counts.Counts
+	sendh   *counts.Histogram
+	recvh   *counts.Histogram
+	send    [2]chan datagram
+	recv    chan []*Datagram
+	quit    chan struct{}
+	done    sync.WaitGroup
 }
 
-func newServer(port uint16) *Server {
+func newServer(port uint16, sockets, batch int, c *counts.Counts) (*Server, error) {
+	if !reusePortSupported {
+		sockets = 1
+	}
+	socks, v6, err := listenFirst(port, sockets, batch)
+	if err != nil {
+		c.Count("udp.listen.error", 1)
+		return nil, err
+	}
 	s := &Server{}
-	s.port = port
-	s.send = make(chan *datagram, 2048)
-	s.recv = make(chan *datagram, 2048)
-	go s.main()
-	return s
+	s.port = uint16(socks[0].udp.LocalAddr().(*net.UDPAddr).Port)
+	s.sockets, s.batch, s.v6 = sockets, batch, v6
+	s.counts = c
+	s.recvh = c.NewHistogram("udp.recv.batch", 1, 2, 4, 8, 16, 32, 64, 128, 256)
+	s.sendh = c.NewHistogram("udp.send.batch", 1, 2, 4, 8, 16, 32, 64, 128, 256)
+	for i := 0; i < len(s.send); i++ {
+		s.send[i] = make(chan datagram, 2048)
+	}
+	s.recv = make(chan []*Datagram, 256)
+	s.quit = make(chan struct{})
+	s.done.Add(1)
+	go s.main(socks)
+	return s, nil
 }
 
-func (s *Server) Recv() (uint16, *net.UDPAddr, []byte) {
-	dg := <-s.recv
-	return s.port, dg.addr, dg.data
+// listenFirst opens the sockets of a new server, with ipv6 when the host
+// has it. A port 0 is picked for ipv4 and may be taken in ipv6, where the
+// claim of listen refuses to share it with anyone, so that case tries a few
+// ports.
+func listenFirst(port uint16, sockets, batch int) ([]*socket, bool, error) {
+	var err error
+	for i := 0; i < 4; i++ {
+		var socks []*socket
+		if socks, err = listen(port, sockets, batch, true); err == nil {
+			return socks, true, nil
+		} else if port != 0 {
+			break
+		}
+	}
+	log.Printf("[udp]: listen ipv6 failed '%v', ipv4 only\n", err)
+	socks, err := listen(port, sockets, batch, false)
+	return socks, false, err
+}
+
+func (s *Server) Port() uint16 {
+	return s.port
+}
+
+// Recv returns the next batch of datagrams read, or nil when the server is
+// closed. Each of them is to be freed once handled.
+func (s *Server) Recv() []*Datagram {
+	select {
+	case dgs := <-s.recv:
+		return dgs
+	case <-s.quit:
+		return nil
+	}
 }
 
 func (s *Server) Send(addr *net.UDPAddr, data []byte) {
-	s.send <- &datagram{addr, data}
+	f := family(addr.IP)
+	if f == familyIPv6 && !s.v6 {
+		s.counts.Count("udp.send.noipv6", 1)
+		return
+	}
+	select {
+	case s.send[f] <- datagram{addr, data}:
+	case <-s.quit:
+	}
+}
+
+// Flush waits until the queued packets have been handed to the sockets.
+func (s *Server) Flush(ctx context.Context) error {
+	for len(s.send[familyIPv4]) != 0 || len(s.send[familyIPv6]) != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.quit:
+			return nil
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	return nil
+}
+
+func (s *Server) Closed() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) close() {
+	close(s.quit)
+	s.done.Wait()
 }
 
-func (s *Server) main() {
+func (s *Server) main(socks []*socket) {
+	defer s.done.Done()
 	for {
-		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: int(s.port)})
-		if err != nil {
-			counts.Count("udp.listen.error", 1)
-			log.Printf("[udp]: listen port %d failed '%v'\n", s.port, err)
-		} else {
-			counts.Count("udp.listen", 1)
-			log.Printf("[udp]: listen port %d\n", s.port)
-			conn.SetWriteBuffer(MaxSendBufferSize)
-			conn.SetReadBuffer(MaxRecvBufferSize)
+		if socks == nil {
+			var err error
+			if socks, err = listen(s.port, s.sockets, s.batch, s.v6); err != nil {
+				s.counts.Count("udp.listen.error", 1)
+				log.Printf("[udp]: listen port %d failed '%v'\n", s.port, err)
+			}
+		}
+		if socks != nil {
+			s.counts.Count("udp.listen", 1)
+			log.Printf("[udp]: listen port %d, sockets = %d\n", s.port, len(socks))
 			var once sync.Once
 			sig := make(chan int)
 			raise := func() {
 				once.Do(func() {
-					conn.Close()
 					close(sig)
+					for _, c := range socks {
+						c.conn.Close()
+					}
 				})
 			}
-			go sender(conn, s.send, sig, raise)
-			go recver(conn, s.recv, sig, raise)
-			<-sig
-			counts.Count("udp.listen.close", 1)
+			var wg sync.WaitGroup
+			for _, c := range socks {
+				c := c
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					s.sender(c, sig, raise)
+				}()
+				go func() {
+					defer wg.Done()
+					s.recver(c, sig, raise)
+				}()
+			}
+			select {
+			case <-sig:
+				wg.Wait()
+			case <-s.quit:
+				raise()
+				wg.Wait()
+				log.Printf("[udp]: close port %d\n", s.port)
+				return
+			}
+			socks = nil
+			s.counts.Count("udp.listen.close", 1)
 		}
 		for i := 0; i < 50; i++ {
-			time.Sleep(time.Millisecond * 100)
-			for {
-				select {
-				case <-s.send:
-					continue
-				default:
+			select {
+			case <-s.quit:
+				return
+			case <-time.After(time.Millisecond * 100):
+			}
+			for _, send := range s.send {
+				for len(send) != 0 {
+					<-send
 				}
-				break
 			}
 		}
 	}
 }
 
-func sender(conn *net.UDPConn, send <-chan *datagram, sig <-chan int, raise func()) {
+// sender writes the datagrams queued for the family of c, as many as are
+// waiting, up to a batch, per call. A datagram the system refuses is
+// dropped; only a closed socket stops it.
+func (s *Server) sender(c *socket, sig <-chan int, raise func()) {
 	defer raise()
+	send := s.send[c.family]
+	ms := make([]ipv4.Message, s.batch)
+	for i := 0; i < len(ms); i++ {
+		ms[i].Buffers = make([][]byte, 1)
+	}
 	for {
+		var dg datagram
 		select {
 		case <-sig:
 			return
-		case dg := <-send:
-			addr, data := dg.addr, dg.data
-			if addr == nil || len(data) == 0 {
+		case dg = <-send:
+		}
+		n := 0
+		for {
+			if dg.addr != nil && len(dg.data) != 0 {
+				ms[n].Buffers[0], ms[n].Addr = dg.data, dg.addr
+				n++
+			}
+			if n == len(ms) {
+				break
+			}
+			select {
+			case dg = <-send:
 				continue
+			default:
 			}
-			if _, err := conn.WriteToUDP(data, addr); err != nil {
+			break
+		}
+		if n == 0 {
+			continue
+		}
+		s.sendh.Observe(float64(n))
+		err := c.writeAll(ms[:n], s.counts)
+		for i := 0; i < n; i++ {
+			ms[i].Buffers[0], ms[i].Addr = nil, nil
+		}
+		if err != nil {
+			if !raised(sig) {
 				log.Printf("[udp]: send error = '%v'\n", err)
-				return
 			}
+			return
 		}
 	}
 }
 
-func recver(conn *net.UDPConn, recv chan<- *datagram, sig <-chan int, raise func()) {
+// recver reads up to a batch of datagrams per call into buffers of the pool
+// and hands them over in one piece, taking new buffers for the slots used.
+func (s *Server) recver(c *socket, sig <-chan int, raise func()) {
 	defer raise()
+	ms := make([]ipv4.Message, s.batch)
+	dgs := make([]*Datagram, s.batch)
+	for i := 0; i < len(ms); i++ {
+		dgs[i] = newDatagram()
+		ms[i].Buffers = [][]byte{dgs[i].buf[:]}
+	}
 	for {
+		n, err := c.conn.ReadBatch(ms, 0)
+		if err != nil {
+			if !raised(sig) {
+				log.Printf("[udp]: recv error = '%v'\n", err)
+			}
+			return
+		}
+		s.recvh.Observe(float64(n))
+		batch := make([]*Datagram, 0, n)
+		for i := 0; i < n; i++ {
+			m := &ms[i]
+			addr, _ := m.Addr.(*net.UDPAddr)
+			if addr == nil || m.N == 0 {
+				continue
+			}
+			if ip4 := addr.IP.To4(); ip4 != nil {
+				addr.IP = ip4
+			}
+			dg := dgs[i]
+			dg.Port, dg.Addr, dg.Data = s.port, addr, dg.buf[:m.N]
+			batch = append(batch, dg)
+			dgs[i] = newDatagram()
+			m.Buffers[0] = dgs[i].buf[:]
+		}
+		if len(batch) == 0 {
+			continue
+		}
 		select {
 		case <-sig:
 			return
-		default:
-			bs := make([]byte, MaxPacketSize)
-			if n, addr, err := conn.ReadFromUDP(bs); err != nil {
-				log.Printf("[udp]: recv error = '%v'\n", err)
-				return
-			} else if addr != nil && n > 0 {
-				data := bs[:n]
-				select {
-				case <-sig:
-					return
-				case recv <- &datagram{addr, data}:
-				}
+		case s.recv <- batch:
+		}
+	}
+}
+
+// raised tells whether sig is, so that the errors of the sockets it closes
+// go unreported.
+func raised(sig <-chan int) bool {
+	select {
+	case <-sig:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *socket) writeAll(ms []ipv4.Message, cnts *counts.Counts) error {
+	for len(ms) != 0 {
+		n, err := c.conn.WriteBatch(ms, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
 			}
+			cnts.Count("udp.send.error", 1)
+			log.Printf("[udp]: send to %v error = '%v'\n", ms[n].Addr, err)
+			n++
 		}
+		ms = ms[n:]
 	}
+	return nil
 }
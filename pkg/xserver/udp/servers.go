@@ -1,46 +1,88 @@
 package udp
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"sync"
 )
 
 import (
-	"github.com/spinlock/xserver/pkg/xserver/args"
 	"github.com/spinlock/xserver/pkg/xserver/counts"
 	"github.com/spinlock/xserver/pkg/xserver/xlog"
 )
 
-var (
-	servers [65536]*Server
-)
+// Servers are the ports listened to by a server, by number.
+type Servers struct {
+	servers map[uint16]*Server
+	counts  *counts.Counts
+	errlog  *xlog.Logger
+	sync.RWMutex
+}
+
+func NewServers(c *counts.Counts, errlog *xlog.Logger) *Servers {
+	ss := &Servers{}
+	ss.servers = make(map[uint16]*Server)
+	ss.counts, ss.errlog = c, errlog
+	return ss
+}
+
+// Listen opens port with sockets sockets per address family, reading and
+// writing up to batch datagrams per system call.
+func (ss *Servers) Listen(port uint16, sockets, batch int) (*Server, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	if port != 0 && ss.servers[port] != nil {
+		return nil, errors.New(fmt.Sprintf("udp-%d is already listening", port))
+	}
+	if s, err := newServer(port, sockets, batch, ss.counts); err != nil {
+		return nil, err
+	} else if ss.servers[s.port] != nil {
+		s.close()
+		return nil, errors.New(fmt.Sprintf("udp-%d is already listening", s.port))
+	} else {
+		s.owner = ss
+		ss.servers[s.port] = s
+		return s, nil
+	}
+}
 
-func init() {
-	for _, port := range args.UdpListenPorts() {
-		if servers[port] != nil {
-			continue
+func (s *Server) Close() {
+	if ss := s.owner; ss != nil {
+		ss.Lock()
+		if ss.servers[s.port] == s {
+			delete(ss.servers, s.port)
 		}
-		servers[port] = newServer(port)
+		ss.Unlock()
 	}
+	s.close()
 }
 
-func GetServers() []*Server {
+func (ss *Servers) List() []*Server {
+	ss.RLock()
+	defer ss.RUnlock()
 	srvs := []*Server{}
-	for _, s := range servers {
-		if s != nil {
-			srvs = append(srvs, s)
-		}
+	for _, s := range ss.servers {
+		srvs = append(srvs, s)
 	}
 	return srvs
 }
 
-func Send(lport uint16, raddr *net.UDPAddr, data []byte) {
+func (ss *Servers) Send(lport uint16, raddr *net.UDPAddr, data []byte) {
 	if len(data) > 1400 {
-		counts.Count("udp.toobig", 1)
-		xlog.ErrLog.Printf("[udp]: udp-%d packet is too big, size = %d\n", lport, len(data))
-	} else if srv := servers[lport]; srv == nil {
-		counts.Count("udp.notfound", 1)
-		xlog.ErrLog.Printf("[udp]: udp-%d not found\n", lport)
+		ss.counts.Count("udp.toobig", 1)
+		ss.errlog.Printf("[udp]: udp-%d packet is too big, size = %d\n", lport, len(data))
+	} else if srv := ss.get(lport); srv == nil {
+		ss.counts.Count("udp.notfound", 1)
+		ss.errlog.Printf("[udp]: udp-%d not found\n", lport)
 	} else {
 		srv.Send(raddr, data)
 	}
 }
+
+func (ss *Servers) get(port uint16) *Server {
+	ss.RLock()
+	s := ss.servers[port]
+	ss.RUnlock()
+	return s
+}
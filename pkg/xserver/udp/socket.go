@@ -0,0 +1,107 @@
+package udp
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	familyIPv4 = 0
+	familyIPv6 = 1
+)
+
+// batchConn is what ipv4.PacketConn and ipv6.PacketConn have in common,
+// their messages being the same type.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	Close() error
+}
+
+type socket struct {
+	conn   batchConn
+	udp    *net.UDPConn
+	family int
+}
+
+func family(ip net.IP) int {
+	if ip.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+// listen opens n sockets on port for ipv4 and, with v6, as many for ipv6.
+// The ipv6 ones only take ipv6 peers, so that each family is written with
+// addresses of its own; when port is 0 they all get the one the kernel
+// picks for the first socket.
+//
+// A socket bound without SO_REUSEPORT first claims the port of each family:
+// it fails while any other socket holds the port, reuseport or not, so the
+// sockets of the server never join the group of another process. With more
+// than one socket the claim is released for them, leaving another process
+// only the time of a few binds to get in between.
+func listen(port uint16, n int, batch int, v6 bool) ([]*socket, error) {
+	socks := make([]*socket, 0, n*2)
+	fail := func(err error) ([]*socket, error) {
+		for _, c := range socks {
+			c.conn.Close()
+		}
+		return nil, err
+	}
+	networks := []string{"udp4"}
+	if v6 {
+		networks = append(networks, "udp6")
+	}
+	for _, network := range networks {
+		claim, err := listenUDP(network, port, false)
+		if err != nil {
+			return fail(err)
+		}
+		port = uint16(claim.LocalAddr().(*net.UDPAddr).Port)
+		conns := []*net.UDPConn{claim}
+		if n > 1 {
+			claim.Close()
+			conns = conns[:0]
+			for i := 0; i < n; i++ {
+				conn, err := listenUDP(network, port, true)
+				if err != nil {
+					for _, c := range conns {
+						c.Close()
+					}
+					return fail(err)
+				}
+				conns = append(conns, conn)
+			}
+		}
+		for _, conn := range conns {
+			if network == "udp4" {
+				socks = append(socks, &socket{ipv4.NewPacketConn(conn), conn, familyIPv4})
+			} else {
+				socks = append(socks, &socket{ipv6.NewPacketConn(conn), conn, familyIPv6})
+			}
+		}
+	}
+	return socks, nil
+}
+
+func listenUDP(network string, port uint16, reuse bool) (*net.UDPConn, error) {
+	lc := &net.ListenConfig{}
+	if reuse {
+		lc.Control = reusePort
+	}
+	pc, err := lc.ListenPacket(context.Background(), network, fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	conn.SetWriteBuffer(MaxSendBufferSize)
+	conn.SetReadBuffer(MaxRecvBufferSize)
+	return conn, nil
+}
@@ -0,0 +1,33 @@
+package udp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenClaimsPort(t *testing.T) {
+	socks, err := listen(0, 4, 8, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, c := range socks {
+			c.conn.Close()
+		}
+	}()
+	port := uint16(socks[0].udp.LocalAddr().(*net.UDPAddr).Port)
+	for _, c := range socks {
+		if p := uint16(c.udp.LocalAddr().(*net.UDPAddr).Port); p != port {
+			t.Fatalf("socket on port %d, want %d", p, port)
+		}
+	}
+	// another server, reuseport or not, must not share the port
+	for _, n := range []int{1, 4} {
+		if others, err := listen(port, n, 8, false); err == nil {
+			for _, c := range others {
+				c.conn.Close()
+			}
+			t.Fatalf("%d socket(s) joined port %d", n, port)
+		}
+	}
+}
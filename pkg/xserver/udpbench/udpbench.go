@@ -0,0 +1,184 @@
+// Package udpbench measures the udp package: clients on the loopback send
+// datagrams to a udp.Server whose workers echo them back, once per
+// combination of sockets and batch sizes, so that the runs can be compared.
+package udpbench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/counts"
+	"github.com/spinlock/xserver/pkg/xserver/udp"
+)
+
+type Options struct {
+	Sockets []int
+	Batches []int
+	Clients int
+	Workers int
+	Packets int
+	Size    int
+	Window  int
+	Output  io.Writer
+}
+
+type result struct {
+	elapsed  time.Duration
+	echoed   int64
+	lost     int64
+	mallocs  uint64
+	bytes    uint64
+	gcs      uint32
+	recvs    uint64
+	sends    uint64
+	received uint64
+	sent     uint64
+}
+
+// Run prints a line per run: echoed datagrams per second, heap allocations
+// and bytes per datagram over the whole process, and how many datagrams
+// the server read and wrote per system call.
+func Run(opts *Options) error {
+	if opts.Clients < 1 || opts.Workers < 1 || opts.Packets < 1 || opts.Window < 1 {
+		return errors.New("udpbench.bad options")
+	}
+	if opts.Size < 16 || opts.Size > udp.MaxPacketSize {
+		return errors.New("udpbench.bad size")
+	}
+	w := opts.Output
+	fmt.Fprintf(w, "%8s %6s %12s %10s %10s %6s %10s %10s %8s\n", "sockets", "batch", "datagram/s", "allocs/dg", "bytes/dg", "gcs", "recv/call", "send/call", "lost")
+	for _, sockets := range opts.Sockets {
+		for _, batch := range opts.Batches {
+			r, err := run(opts, sockets, batch)
+			if err != nil {
+				return err
+			}
+			n := float64(r.echoed)
+			if n == 0 {
+				n = 1
+			}
+			fmt.Fprintf(w, "%8d %6d %12.0f %10.2f %10.0f %6d %10.2f %10.2f %8d\n", sockets, batch,
+				float64(r.echoed)/r.elapsed.Seconds(), float64(r.mallocs)/n, float64(r.bytes)/n, r.gcs,
+				perCall(r.received, r.recvs), perCall(r.sent, r.sends), r.lost)
+		}
+	}
+	return nil
+}
+
+func perCall(n, calls uint64) float64 {
+	if calls == 0 {
+		return 0
+	}
+	return float64(n) / float64(calls)
+}
+
+// batches returns how many calls the histogram name of c has seen and the
+// sum of their sizes.
+func batches(c *counts.Counts, name string) (uint64, uint64) {
+	for _, h := range c.Histograms() {
+		if h.Name() == name {
+			_, _, count, sum := h.Snapshot()
+			return count, uint64(sum)
+		}
+	}
+	return 0, 0
+}
+
+func run(opts *Options, sockets, batch int) (*result, error) {
+	cnts := counts.New(nil)
+	srv, err := udp.NewServers(cnts, nil).Listen(0, sockets, batch)
+	if err != nil {
+		return nil, err
+	}
+	var workers sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				dgs := srv.Recv()
+				if dgs == nil {
+					return
+				}
+				for _, dg := range dgs {
+					srv.Send(dg.Addr, append([]byte(nil), dg.Data...))
+					dg.Free()
+				}
+			}
+		}()
+	}
+	defer func() {
+		srv.Close()
+		workers.Wait()
+	}()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(srv.Port())}
+	conns := make([]*net.UDPConn, opts.Clients)
+	for i := range conns {
+		if conns[i], err = net.DialUDP("udp4", nil, addr); err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return nil, err
+		}
+		defer conns[i].Close()
+	}
+
+	r := &result{}
+	runtime.GC()
+	var m0, m1 runtime.MemStats
+	runtime.ReadMemStats(&m0)
+	recvs0, received0 := batches(cnts, "udp.recv.batch")
+	sends0, sent0 := batches(cnts, "udp.send.batch")
+	beg := time.Now()
+	var clients sync.WaitGroup
+	for _, c := range conns {
+		clients.Add(1)
+		go func(c *net.UDPConn) {
+			defer clients.Done()
+			echoed, lost := client(c, opts)
+			atomic.AddInt64(&r.echoed, echoed)
+			atomic.AddInt64(&r.lost, lost)
+		}(c)
+	}
+	clients.Wait()
+	r.elapsed = time.Since(beg)
+	runtime.ReadMemStats(&m1)
+	recvs1, received1 := batches(cnts, "udp.recv.batch")
+	sends1, sent1 := batches(cnts, "udp.send.batch")
+	r.mallocs, r.bytes, r.gcs = m1.Mallocs-m0.Mallocs, m1.TotalAlloc-m0.TotalAlloc, m1.NumGC-m0.NumGC
+	r.recvs, r.received = recvs1-recvs0, received1-received0
+	r.sends, r.sent = sends1-sends0, sent1-sent0
+	return r, nil
+}
+
+// client keeps up to a window of datagrams in flight until it has sent its
+// share; a datagram whose echo does not come back within a second is lost.
+func client(c *net.UDPConn, opts *Options) (int64, int64) {
+	out := make([]byte, opts.Size)
+	in := make([]byte, udp.MaxPacketSize)
+	echoed, lost, sent, inflight := int64(0), int64(0), 0, 0
+	for sent < opts.Packets || inflight != 0 {
+		for sent < opts.Packets && inflight < opts.Window {
+			if _, err := c.Write(out); err != nil {
+				return echoed, lost + int64(opts.Packets-sent)
+			}
+			sent, inflight = sent+1, inflight+1
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(in); err != nil {
+			lost, inflight = lost+int64(inflight), 0
+			continue
+		}
+		echoed, inflight = echoed+1, inflight-1
+	}
+	return echoed, lost
+}
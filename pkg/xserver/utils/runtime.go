@@ -12,17 +12,6 @@ var (
 	Starttime = time.Now().Unix()
 )
 
-func init() {
-	go func() {
-		for {
-			time.Sleep(time.Minute * 5)
-			runtime.GC()
-		}
-	}()
-	log.Printf("[compile]: %s\n", Compile)
-	log.Printf("[version]: %s\n", Version)
-}
-
 func Trace() string {
 	b := make([]byte, 4096)
 	m := string(b[:runtime.Stack(b, false)])
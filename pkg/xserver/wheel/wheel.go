@@ -0,0 +1,176 @@
+// Package wheel runs timers on a hierarchical timing wheel: a timer costs
+// nothing until it is due, however many of them wait, and scheduling or
+// moving one is a list operation. Timers fire a tick late at most, in the
+// goroutine of their wheel.
+package wheel
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/spinlock/xserver/pkg/xserver/counts"
+)
+
+const (
+	slotBits = 6
+	slots    = 1 << slotBits
+	levels   = 4
+)
+
+// Timer calls its function once it is due. It belongs to one wheel and may
+// be scheduled again, earlier or later, from any goroutine.
+type Timer struct {
+	f    func()
+	at   int64
+	tick int64
+	slot *list.List
+	e    *list.Element
+}
+
+func NewTimer(f func()) *Timer {
+	return &Timer{f: f}
+}
+
+// Wheel keeps timers in levels of slots: a slot of the first level spans a
+// tick, and a slot of the next level spans a whole turn of the previous
+// one. As the wheel turns, the timers of the next slot up are spread over
+// the level below, down to the first where they fire.
+type Wheel struct {
+	tick   int64
+	cur    int64
+	levels [levels][slots]list.List
+	count  int
+	lag    *counts.Histogram
+	fired  *counts.Histogram
+	quit   chan struct{}
+	done   sync.WaitGroup
+	sync.Mutex
+}
+
+// Start returns a running wheel turning every tick, which observes how many
+// timers fire per tick and how late in the histograms of c.
+func Start(tick time.Duration, c *counts.Counts) *Wheel {
+	w := &Wheel{}
+	w.tick = int64(tick)
+	w.lag = c.NewHistogram("wheel.lag.seconds", 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1)
+	w.fired = c.NewHistogram("wheel.fired", 0, 1, 4, 16, 64, 256, 1024, 4096)
+	w.cur = time.Now().UnixNano() / w.tick
+	for l := 0; l < levels; l++ {
+		for i := 0; i < slots; i++ {
+			w.levels[l][i].Init()
+		}
+	}
+	w.quit = make(chan struct{})
+	w.done.Add(1)
+	go w.run()
+	return w
+}
+
+// Stop stops the wheel; the timers left never fire.
+func (w *Wheel) Stop() {
+	close(w.quit)
+	w.done.Wait()
+}
+
+// Len returns how many timers wait.
+func (w *Wheel) Len() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.count
+}
+
+// Schedule sets t to fire at, in unix nanoseconds, moving it when it waits
+// already. A time past fires on the next tick.
+func (w *Wheel) Schedule(t *Timer, at int64) {
+	w.Lock()
+	defer w.Unlock()
+	w.remove(t)
+	t.at = at
+	if t.tick = (at + w.tick - 1) / w.tick; t.tick <= w.cur {
+		t.tick = w.cur + 1
+	}
+	w.add(t)
+}
+
+// Cancel keeps t from firing.
+func (w *Wheel) Cancel(t *Timer) {
+	w.Lock()
+	defer w.Unlock()
+	w.remove(t)
+}
+
+func (w *Wheel) remove(t *Timer) {
+	if t.slot != nil {
+		t.slot.Remove(t.e)
+		t.slot, t.e = nil, nil
+		w.count--
+	}
+}
+
+func (w *Wheel) add(t *Timer) {
+	delta, l := t.tick-w.cur, 0
+	for l < levels-1 && delta >= int64(1)<<(slotBits*uint(l+1)) {
+		l++
+	}
+	if max := int64(1) << (slotBits * levels); delta >= max {
+		t.tick = w.cur + max - 1
+	}
+	slot := &w.levels[l][(t.tick>>(slotBits*uint(l)))&(slots-1)]
+	t.slot, t.e = slot, slot.PushBack(t)
+	w.count++
+}
+
+func (w *Wheel) run() {
+	defer w.done.Done()
+	ticker := time.NewTicker(time.Duration(w.tick))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now().UnixNano()
+		fired := w.advance(now / w.tick)
+		w.fired.Observe(float64(len(fired)))
+		for _, t := range fired {
+			w.lag.Observe(float64(now-t.at) / float64(time.Second))
+			t.f()
+		}
+	}
+}
+
+// advance turns the wheel up to tick and returns the timers due. A level
+// spreads its slot over the lower ones when they wrap, from the top down,
+// so that each timer lands where the turn is still to come.
+func (w *Wheel) advance(tick int64) []*Timer {
+	w.Lock()
+	defer w.Unlock()
+	var fired []*Timer
+	for w.cur < tick {
+		w.cur++
+		for l := levels - 1; l > 0; l-- {
+			if w.cur&(int64(1)<<(slotBits*uint(l))-1) != 0 {
+				continue
+			}
+			slot := &w.levels[l][(w.cur>>(slotBits*uint(l)))&(slots-1)]
+			for e := slot.Front(); e != nil; e = slot.Front() {
+				t := slot.Remove(e).(*Timer)
+				t.slot, t.e = nil, nil
+				w.count--
+				w.add(t)
+			}
+		}
+		slot := &w.levels[0][w.cur&(slots-1)]
+		for e := slot.Front(); e != nil; e = slot.Front() {
+			t := slot.Remove(e).(*Timer)
+			t.slot, t.e = nil, nil
+			w.count--
+			fired = append(fired, t)
+		}
+	}
+	return fired
+}
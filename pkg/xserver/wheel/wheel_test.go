@@ -0,0 +1,91 @@
+package wheel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWheelFiresOnTime(t *testing.T) {
+	w := Start(time.Millisecond, nil)
+	defer w.Stop()
+	fired := make(chan int64, 1)
+	at := time.Now().Add(time.Millisecond * 50).UnixNano()
+	w.Schedule(NewTimer(func() {
+		fired <- time.Now().UnixNano()
+	}), at)
+	select {
+	case now := <-fired:
+		if now < at {
+			t.Fatalf("fired %v early", time.Duration(at-now))
+		}
+		if lag := time.Duration(now - at); lag > time.Millisecond*250 {
+			t.Fatalf("fired %v late", lag)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timer never fired")
+	}
+	if n := w.Len(); n != 0 {
+		t.Fatalf("%d timer(s) left", n)
+	}
+}
+
+func TestWheelRescheduleEarlier(t *testing.T) {
+	w := Start(time.Millisecond, nil)
+	defer w.Stop()
+	fired := make(chan struct{}, 2)
+	timer := NewTimer(func() {
+		fired <- struct{}{}
+	})
+	w.Schedule(timer, time.Now().Add(time.Hour).UnixNano())
+	w.Schedule(timer, time.Now().Add(time.Millisecond*20).UnixNano())
+	select {
+	case <-fired:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timer rescheduled earlier never fired")
+	}
+	if n := w.Len(); n != 0 {
+		t.Fatalf("%d timer(s) left", n)
+	}
+}
+
+// TestWheelAdvance turns a wheel by hand over timers of every level, which
+// have to come down the levels and fire on their very tick.
+func TestWheelAdvance(t *testing.T) {
+	w := &Wheel{tick: 1, cur: 1000}
+	firedAt := make(map[int64]int64)
+	ticks := []int64{1, 63, 64, 65, 4095, 4096, 4097, 262143, 262144, 300000}
+	for _, d := range ticks {
+		at := w.cur + d
+		w.Schedule(NewTimer(func() {
+			firedAt[at] = w.cur
+		}), at)
+	}
+	moved := NewTimer(func() {
+		firedAt[-1] = w.cur
+	})
+	w.Schedule(moved, w.cur+200000)
+	w.Schedule(moved, w.cur+70)
+	want := map[int64]int64{-1: w.cur + 70}
+	for _, d := range ticks {
+		want[w.cur+d] = w.cur + d
+	}
+	end := w.cur + 300000
+	for w.cur < end {
+		for _, timer := range w.advance(w.cur + 1) {
+			timer.f()
+		}
+	}
+	for at, tick := range want {
+		if got, ok := firedAt[at]; !ok {
+			t.Fatalf("timer at %d never fired", at)
+		} else if got != tick {
+			t.Fatalf("timer at %d fired on %d", at, got)
+		}
+	}
+	if len(firedAt) != len(want) {
+		t.Fatalf("%d timer(s) fired, want %d", len(firedAt), len(want))
+	}
+	if n := w.Len(); n != 0 {
+		t.Fatalf("%d timer(s) left", n)
+	}
+}
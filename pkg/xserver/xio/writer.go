@@ -203,13 +203,15 @@ func (w *RawWriter) WriteAddress(addr *net.UDPAddr, public bool) error {
 	} else {
 		flag = 0x01
 	}
-	if len(addr.IP) != 4 {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
 		flag |= 0x80
 	}
 	if err := w.Write8(flag); err != nil {
 		return err
 	}
-	if err := w.WriteBytes(addr.IP); err != nil {
+	if err := w.WriteBytes(ip); err != nil {
 		return err
 	}
 	if err := w.Write16(uint16(addr.Port)); err != nil {
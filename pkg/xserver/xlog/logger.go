@@ -5,43 +5,83 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 )
 
 import (
-	"github.com/spinlock/xserver/pkg/xserver/args"
 	"github.com/spinlock/xserver/pkg/xserver/utils"
 )
 
-var (
+// Logs are the loggers of a server. They write to the files of log/ while
+// those exist, or to the sink of the server when it has one.
+type Logs struct {
 	OutLog, ErrLog, SssLog, TcpLog *Logger
-)
 
+	loggers map[string]*Logger
+	debug   bool
+	sink    Sink
+	quit    chan struct{}
+	done    sync.WaitGroup
+}
+
+// Logger prints nothing until its Logs start, nor once they stop; a nil
+// *Logger never does.
 type Logger struct {
+	name     string
 	filename string
 	file     *os.File
-	Printf   func(format string, v ...interface{})
+	printf   func(format string, v ...interface{})
 }
 
-func init() {
-	loggers := make(map[string]*Logger)
+type Sink func(name string, format string, v ...interface{})
 
-	OutLog = newLogger(loggers, "outlog")
-	ErrLog = newLogger(loggers, "errlog")
-	SssLog = newLogger(loggers, "ssslog")
-	TcpLog = newLogger(loggers, "tcplog")
+func New(debug bool, sink Sink) *Logs {
+	l := &Logs{}
+	l.loggers = make(map[string]*Logger)
+	l.debug, l.sink = debug, sink
+
+	l.OutLog = newLogger(l.loggers, "outlog")
+	l.ErrLog = newLogger(l.loggers, "errlog")
+	l.SssLog = newLogger(l.loggers, "ssslog")
+	l.TcpLog = newLogger(l.loggers, "tcplog")
+	return l
+}
 
-	go func() {
-		debug := args.IsDebug()
+func (l *Logger) Printf(format string, v ...interface{}) {
+	if l != nil {
+		l.printf(format, v...)
+	}
+}
+
+func (l *Logs) Start() {
+	l.quit = make(chan struct{})
+	if sink := l.sink; sink != nil {
+		for _, x := range l.loggers {
+			name := x.name
+			x.printf = func(format string, v ...interface{}) {
+				sink(name, format, v...)
+			}
+		}
+		return
+	}
+	debug := l.debug
+	l.done.Add(1)
+	go func(quit <-chan struct{}) {
+		defer l.done.Done()
 		for {
-			time.Sleep(time.Second)
-			for _, l := range loggers {
-				if l.file == nil {
-					if file, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND, 0666); err == nil {
-						log.Printf("[logger]: open '%s'\n", l.filename)
-						l.file = file
+			select {
+			case <-quit:
+				return
+			case <-time.After(time.Second):
+			}
+			for _, x := range l.loggers {
+				if x.file == nil {
+					if file, err := os.OpenFile(x.filename, os.O_WRONLY|os.O_APPEND, 0666); err == nil {
+						log.Printf("[logger]: open '%s'\n", x.filename)
+						x.file = file
 						logger := log.New(file, "", log.LstdFlags)
-						l.Printf = func(format string, v ...interface{}) {
+						x.printf = func(format string, v ...interface{}) {
 							logger.Printf(format, v...)
 							if debug {
 								log.Printf(format, v...)
@@ -49,16 +89,31 @@ func init() {
 						}
 					}
 				} else {
-					if _, err := os.Stat(l.filename); err != nil {
-						log.Printf("[logger]: close '%s'\n", l.filename)
-						l.Printf = func(format string, v ...interface{}) {}
-						l.file.Close()
-						l.file = nil
+					if _, err := os.Stat(x.filename); err != nil {
+						log.Printf("[logger]: close '%s'\n", x.filename)
+						x.printf = func(format string, v ...interface{}) {}
+						x.file.Close()
+						x.file = nil
 					}
 				}
 			}
 		}
-	}()
+	}(l.quit)
+}
+
+func (l *Logs) Stop() {
+	if l.quit != nil {
+		close(l.quit)
+		l.done.Wait()
+		l.quit = nil
+	}
+	for _, x := range l.loggers {
+		x.printf = func(format string, v ...interface{}) {}
+		if x.file != nil {
+			x.file.Close()
+			x.file = nil
+		}
+	}
 }
 
 func newLogger(loggers map[string]*Logger, name string) *Logger {
@@ -69,9 +124,10 @@ func newLogger(loggers map[string]*Logger, name string) *Logger {
 			utils.Panic("invalid logger name")
 		}
 		l = &Logger{}
+		l.name = name
 		l.filename = fmt.Sprintf("log/%s", name)
 		l.file = nil
-		l.Printf = func(format string, v ...interface{}) {}
+		l.printf = func(format string, v ...interface{}) {}
 		loggers[name] = l
 		log.Printf("[logger]: add logger '%s'\n", l.filename)
 		return l